@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// apiSample は API で返す項目の値と、その計測時刻です。
+type apiSample struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// latestReadings は項目毎の直近の取得値です。/api/v1/reading で返します。
+// 1回の取得で全ての項目が得られるとは限らないため、項目毎に最後に得られた値とその時刻を保持します。
+type latestReadings struct {
+	mu     sync.Mutex
+	values map[string]apiSample
+}
+
+// latest は /api/v1/reading で返す直近の取得値です。
+var latest = &latestReadings{values: make(map[string]apiSample)}
+
+// update は取得値で項目毎の直近の値を更新します。
+func (l *latestReadings) update(r *reading) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, item := range r.items() {
+		l.values[item.Name] = apiSample{Value: item.Value, Time: item.Time}
+	}
+	if r.Phases == 1 {
+		// 単相2線式では T相の電流は計測していない
+		delete(l.values, "current_t_amperes")
+	}
+}
+
+// snapshot は項目毎の直近の値の複製を返します。
+func (l *latestReadings) snapshot() map[string]apiSample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	values := make(map[string]apiSample, len(l.values))
+	for k, v := range l.values {
+		values[k] = v
+	}
+	return values
+}
+
+// writeJSON は v を JSON で書き出します。
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// apiError は API のエラーの応答です。
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// allowGet は GET と HEAD 以外の要求を拒否します。拒否した場合は false を返します。
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{"only GET or HEAD requests allowed"})
+	return false
+}
+
+// readingHandler は項目毎の直近の取得値とその計測時刻を JSON で返す /api/v1/reading のハンドラーです。
+// 項目の名前は read の出力と同じで、定時積算電力量は fixed_time_<direction>_kwh です。
+// まだ取得していない場合は 503 を返します。
+func readingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		values := latest.snapshot()
+		if len(values) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, apiError{"no reading yet"})
+			return
+		}
+		writeJSON(w, http.StatusOK, values)
+	})
+}
+
+// apiHistoryDefaultRange は /api/v1/history で from を省略した場合の期間です。
+const apiHistoryDefaultRange = time.Hour
+
+// readingHistory は /api/v1/history のために、項目毎の取得値を retention の期間だけメモリに保持します。
+type readingHistory struct {
+	mu        sync.Mutex
+	retention time.Duration
+	series    map[string][]apiSample
+}
+
+// history は /api/v1/history で返す取得値の履歴です。retention は serve で設定します。
+var history = &readingHistory{series: make(map[string][]apiSample)}
+
+// add は取得値を履歴に追加し、retention より古い値を削除します。
+// 定時積算電力量は同じ計測日時の値を重複して追加しません。
+func (h *readingHistory) add(r *reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.retention <= 0 {
+		return
+	}
+	oldest := time.Now().Add(-h.retention)
+	for _, item := range r.items() {
+		s := h.series[item.Name]
+		if n := len(s); n > 0 && !item.Time.After(s[n-1].Time) {
+			continue
+		}
+		s = append(s, apiSample{Value: item.Value, Time: item.Time})
+		i, _ := slices.BinarySearchFunc(s, oldest, func(v apiSample, t time.Time) int {
+			return v.Time.Compare(t)
+		})
+		h.series[item.Name] = slices.Delete(s, 0, i)
+	}
+}
+
+// insert は履歴から復元した過去の取得値を、時刻の順になる位置に追加します。
+// 同じ時刻の値がある場合と、retention より古い値は追加しません。
+func (h *readingHistory) insert(r *reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.retention <= 0 {
+		return
+	}
+	oldest := time.Now().Add(-h.retention)
+	for _, item := range r.items() {
+		if item.Time.Before(oldest) {
+			continue
+		}
+		s := h.series[item.Name]
+		i, found := slices.BinarySearchFunc(s, item.Time, func(v apiSample, t time.Time) int {
+			return v.Time.Compare(t)
+		})
+		if !found {
+			h.series[item.Name] = slices.Insert(s, i, apiSample{Value: item.Value, Time: item.Time})
+		}
+	}
+}
+
+// query は from から to までの項目毎の値を返します。step が正の場合は、step 毎の区間の最後の値のみを返します。
+func (h *readingHistory) query(from, to time.Time, step time.Duration) map[string][]apiSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make(map[string][]apiSample, len(h.series))
+	for name, s := range h.series {
+		points := []apiSample{}
+		for _, v := range s {
+			if v.Time.Before(from) || v.Time.After(to) {
+				continue
+			}
+			n := len(points)
+			if step > 0 && n > 0 && v.Time.Truncate(step).Equal(points[n-1].Time.Truncate(step)) {
+				points[n-1] = v
+				continue
+			}
+			points = append(points, v)
+		}
+		if len(points) > 0 {
+			result[name] = points
+		}
+	}
+	return result
+}
+
+// apiHistory は /api/v1/history の応答です。
+type apiHistory struct {
+	From   time.Time              `json:"from"`
+	To     time.Time              `json:"to"`
+	Step   string                 `json:"step,omitempty"`
+	Series map[string][]apiSample `json:"series"`
+}
+
+// historyHandler は from から to までの項目毎の取得値を JSON で返す /api/v1/history のハンドラーです。
+// from と to は RFC 3339 または Unix 時間 (秒) で、省略した場合は直近1時間です。
+// step (例: 5m、300) を指定すると、step 毎の区間の最後の値のみを返します。
+func historyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		history.mu.Lock()
+		enabled := history.retention > 0
+		history.mu.Unlock()
+		if !enabled {
+			writeJSON(w, http.StatusNotFound, apiError{"history is disabled (-api.history-retention=0)"})
+			return
+		}
+		from, to, step, err := parseHistoryQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		resp := apiHistory{From: from, To: to, Series: history.query(from, to, step)}
+		if step > 0 {
+			resp.Step = step.String()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+// parseHistoryQuery は /api/v1/history の from、to、step をパースします。
+func parseHistoryQuery(
+	q url.Values,
+	now time.Time,
+) (from, to time.Time, step time.Duration, err error) {
+	to = now
+	if v := q.Get("to"); v != "" {
+		if to, err = parseAPITime(v); err != nil {
+			return from, to, 0, fmt.Errorf("invalid to %q: %w", v, err)
+		}
+	}
+	from = to.Add(-apiHistoryDefaultRange)
+	if v := q.Get("from"); v != "" {
+		if from, err = parseAPITime(v); err != nil {
+			return from, to, 0, fmt.Errorf("invalid from %q: %w", v, err)
+		}
+	}
+	if from.After(to) {
+		return from, to, 0, errors.New("from must not be after to")
+	}
+	if v := q.Get("step"); v != "" {
+		if step, err = parseDuration(v); err != nil {
+			return from, to, 0, fmt.Errorf("invalid step %q: %w", v, err)
+		}
+		if step < 0 {
+			return from, to, 0, fmt.Errorf("step must not be negative: %s", step)
+		}
+	}
+	return from, to, step, nil
+}
+
+// parseAPITime は RFC 3339 または Unix 時間 (秒、小数可) の時刻をパースします。
+func parseAPITime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// AWS のドキュメントにある署名の例 (IAM の ListUsers) と同じ要求
+	const (
+		contentType = "application/x-www-form-urlencoded; charset=utf-8"
+		url         = "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08"
+		secret      = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+		scope       = "AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request"
+	)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		creds     awsCredentials
+		want      string
+		wantToken string
+	}{
+		{
+			"static",
+			awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: secret},
+			"AWS4-HMAC-SHA256 Credential=" + scope +
+				", SignedHeaders=content-type;host;x-amz-date" +
+				", Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+			"",
+		},
+		{
+			"session token",
+			awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: secret, SessionToken: "token"},
+			"AWS4-HMAC-SHA256 Credential=" + scope +
+				", SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, Signature=",
+			"token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			signAWSRequest(req, nil, tt.creds, "us-east-1", "iam", now)
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q, want 20150830T123600Z", got)
+			}
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tt.wantToken {
+				t.Errorf("X-Amz-Security-Token = %q, want %q", got, tt.wantToken)
+			}
+			// セッショントークンを含む場合は署名が変わるため、署名より前の部分のみ比較する
+			if got := req.Header.Get("Authorization"); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAWSCredentials(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials")
+	content := "[default]\naws_access_key_id = FILEDEFAULT\naws_secret_access_key = s1\n\n" +
+		"[work]\naws_access_key_id=FILEWORK\naws_secret_access_key=s2\naws_session_token=tok\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		static  awsCredentials
+		env     map[string]string
+		want    awsCredentials
+		wantErr bool
+	}{
+		{
+			"static",
+			awsCredentials{AccessKeyID: "STATIC", SecretAccessKey: "s"},
+			map[string]string{"AWS_ACCESS_KEY_ID": "ENV"},
+			awsCredentials{AccessKeyID: "STATIC", SecretAccessKey: "s"},
+			false,
+		},
+		{
+			"environment",
+			awsCredentials{},
+			map[string]string{"AWS_ACCESS_KEY_ID": "ENV", "AWS_SECRET_ACCESS_KEY": "s"},
+			awsCredentials{AccessKeyID: "ENV", SecretAccessKey: "s"},
+			false,
+		},
+		{
+			"default profile",
+			awsCredentials{},
+			nil,
+			awsCredentials{AccessKeyID: "FILEDEFAULT", SecretAccessKey: "s1"},
+			false,
+		},
+		{
+			"named profile",
+			awsCredentials{},
+			map[string]string{"AWS_PROFILE": "work"},
+			awsCredentials{AccessKeyID: "FILEWORK", SecretAccessKey: "s2", SessionToken: "tok"},
+			false,
+		},
+		{
+			"unknown profile",
+			awsCredentials{},
+			map[string]string{"AWS_PROFILE": "home"},
+			awsCredentials{},
+			true,
+		},
+		{
+			"missing file",
+			awsCredentials{},
+			map[string]string{"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing")},
+			awsCredentials{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+				"AWS_PROFILE"} {
+				t.Setenv(k, tt.env[k])
+			}
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", cmp.Or(tt.env["AWS_SHARED_CREDENTIALS_FILE"], path))
+			got, err := resolveAWSCredentials(tt.static)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveAWSCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveAWSCredentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
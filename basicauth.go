@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthRealm は WWW-Authenticate で返す realm です。
+const basicAuthRealm = "smartmeter-exporter"
+
+// basicAuthCacheSize は検証に成功した認証情報を覚えておく最大数です。
+const basicAuthCacheSize = 100
+
+// basicAuthDummyHash は存在しないユーザー名の場合に比較する bcrypt のハッシュです。
+// ユーザー名が存在するかどうかを応答時間から推測されないよう、存在する場合と同じだけ時間をかけます。
+const basicAuthDummyHash = "$2a$10$.zhOGnvcGI/p36G6d0hYuuXRXUy9Utaa.S29A0UW7Tjezd8DP9Q0."
+
+// basicAuthExemptPaths は認証なしで応答するパスです。
+// コンテナのヘルスチェックなどは認証情報を送れないことが多く、取得値も返さないため除外します。
+var basicAuthExemptPaths = []string{"/-/healthy", "/healthz", "/readyz"}
+
+// basicAuthenticator は -web.config.file の basic_auth_users による Basic 認証です。
+type basicAuthenticator struct {
+	// users はユーザー名と bcrypt のハッシュです。
+	users map[string][]byte
+	mu    sync.Mutex
+	// verified は検証に成功した認証情報のハッシュです。
+	// bcrypt の比較は意図的に遅いため、Prometheus が取得する度に比較しないよう覚えておきます。
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// newBasicAuthenticator はユーザー名と bcrypt のハッシュから basicAuthenticator を作成します。
+func newBasicAuthenticator(users map[string]string) (*basicAuthenticator, error) {
+	a := &basicAuthenticator{
+		users:    make(map[string][]byte, len(users)),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	for user, hash := range users {
+		if user == "" {
+			return nil, errors.New("basic_auth_users contains an empty user name")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %q in basic_auth_users: %w", user, err)
+		}
+		a.users[user] = []byte(hash)
+	}
+	return a, nil
+}
+
+// authenticate は要求の Authorization ヘッダーの認証情報が正しいかを返します。
+func (a *basicAuthenticator) authenticate(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.users[user]
+	if !known {
+		_ = bcrypt.CompareHashAndPassword([]byte(basicAuthDummyHash), []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+	a.mu.Lock()
+	_, cached := a.verified[key]
+	a.mu.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.verified) >= basicAuthCacheSize {
+		clear(a.verified)
+	}
+	a.verified[key] = struct{}{}
+	return true
+}
+
+// handler は Basic 認証を行い、認証に成功した要求を next に渡すハンドラーを返します。
+func (a *basicAuthenticator) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(basicAuthExemptPaths, r.URL.Path) && !a.authenticate(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+basicAuthRealm+`", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcHandler は Basic 認証を行い、認証に成功した gRPC の要求を next に渡すハンドラーを返します。
+// 認証に失敗した場合は UNAUTHENTICATED を返します。
+func (a *basicAuthenticator) grpcHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authenticate(r) {
+			g := newGRPCResponse(w)
+			g.finish(grpcStatus{grpcUnauthenticated, "invalid or missing basic auth credentials"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
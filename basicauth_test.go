@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testBasicAuthenticator はユーザー alice (パスワード secret) の basicAuthenticator を作成します。
+func testBasicAuthenticator(t *testing.T) *basicAuthenticator {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newBasicAuthenticator(map[string]string{"alice": string(hash)})
+	if err != nil {
+		t.Fatalf("newBasicAuthenticator() error = %v", err)
+	}
+	return a
+}
+
+func TestNewBasicAuthenticatorRejectsInvalidUsers(t *testing.T) {
+	for name, users := range map[string]map[string]string{
+		"plain password": {"alice": "secret"},
+		"empty user":     {"": basicAuthDummyHash},
+	} {
+		if _, err := newBasicAuthenticator(users); err == nil {
+			t.Errorf("newBasicAuthenticator() with %s error = nil, want error", name)
+		}
+	}
+}
+
+func TestBasicAuthenticatorHandler(t *testing.T) {
+	a := testBasicAuthenticator(t)
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		want     int
+	}{
+		{"valid", "/metrics", "alice", "secret", http.StatusNoContent},
+		{"cached", "/metrics", "alice", "secret", http.StatusNoContent},
+		{"wrong password", "/metrics", "alice", "wrong", http.StatusUnauthorized},
+		{"unknown user", "/metrics", "bob", "secret", http.StatusUnauthorized},
+		{"no credentials", "/metrics", "", "", http.StatusUnauthorized},
+		{"exempt path", "/healthz", "", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header is missing")
+			}
+		})
+	}
+	if len(a.verified) != 1 {
+		t.Errorf("verified credentials = %d, want 1", len(a.verified))
+	}
+}
+
+func TestConfigWebBasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeWebConfig(t, dir, "basic_auth_users:\n  alice: "+string(hash)+"\n")
+	c := &config{WebConfigFile: path}
+	a, err := c.webBasicAuth()
+	if err != nil || a == nil {
+		t.Fatalf("webBasicAuth() = %v, %v", a, err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("alice", "secret")
+	if !a.authenticate(req) {
+		t.Error("authenticate() = false, want true")
+	}
+
+	writeWebConfig(t, dir, "basic_auth_users:\n  alice: secret\n")
+	if _, err = c.webBasicAuth(); err == nil {
+		t.Error("webBasicAuth() with plain password error = nil, want error")
+	}
+	writeWebConfig(t, dir, "{}\n")
+	if a, err = c.webBasicAuth(); a != nil || err != nil {
+		t.Errorf("webBasicAuth() without users = %v, %v, want nil, nil", a, err)
+	}
+}
+
+func TestValidateMetricsOptionsGRPCBasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := "basic_auth_users:\n  alice: " + string(hash) + "\n"
+	tlsServer := "tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n"
+	tests := []struct {
+		name    string
+		grpc    string
+		web     string
+		wantErr bool
+	}{
+		{"gRPC with TLS", "9103", users + tlsServer, false},
+		{"gRPC without TLS", "9103", users, true},
+		{"HTTP only without TLS", "", users, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{
+				MetricsPath:   "/metrics",
+				ListenPort:    "9102",
+				GRPCPort:      tt.grpc,
+				WebConfigFile: writeWebConfig(t, dir, tt.web),
+			}
+			if err := c.validateMetricsOptions(); (err != nil) != tt.wantErr {
+				t.Errorf("validateMetricsOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkReporter は -check の各段階の結果を書き出します。
+type checkReporter struct {
+	w io.Writer
+}
+
+func (r checkReporter) ok(step string, start time.Time, details ...string) {
+	fmt.Fprintf(r.w, "[ OK ] %s", step)
+	if !start.IsZero() {
+		fmt.Fprintf(r.w, " (%s)", time.Since(start).Round(time.Millisecond))
+	}
+	if len(details) > 0 {
+		fmt.Fprintf(r.w, ": %s", strings.Join(details, ", "))
+	}
+	fmt.Fprintln(r.w)
+}
+
+func (r checkReporter) fail(step string, err error, hints ...string) {
+	fmt.Fprintf(r.w, "[FAIL] %s: %v\n", step, err)
+	for _, h := range hints {
+		fmt.Fprintf(r.w, "       hint: %s\n", h)
+	}
+}
+
+// runCheck は -check の動作です。シリアルデバイスを開き、スマートメーターに接続 (スキャンと PANA 認証) して
+// 1回だけ取得し、各段階の結果を標準出力に書き出して終了します。HTTP サーバーは起動しません。
+// 終了コードは read と同じです。
+func runCheck(cfg *config, logger *slog.Logger) {
+	r := checkReporter{os.Stdout}
+	r.ok("configuration", time.Time{})
+
+	if cfg.BRouteID == "" || cfg.BRoutePass == "" {
+		r.fail("credentials", errors.New("B-route ID or password is not set"),
+			"set "+envName("SMARTMETER_ID")+" and "+envName("SMARTMETER_PASSWORD")+
+				" (or -id-file, -id-command, -keyring)")
+		os.Exit(exitError)
+	}
+	r.ok("credentials", time.Time{})
+
+	if err := checkDevice(cfg.DevicePath); err != nil {
+		r.fail("serial device "+cfg.DevicePath, err,
+			"check that the Wi-SUN module is plugged in and -device points to it")
+		os.Exit(exitDevice)
+	}
+	r.ok("serial device "+cfg.DevicePath, time.Time{})
+
+	libLogger := slog.NewLogLogger(logger.Handler(), slog.LevelInfo)
+	monitor := newSKStackMonitor(libLogger.Writer(), logger)
+	start := time.Now()
+	dev, err := openDeviceWithState(cfg, monitor, logger)
+	if err != nil {
+		hints := []string{
+			"check the B-route ID and password (PANA authentication fails with wrong ones)",
+			"move the Wi-SUN module closer to the meter, e.g. with a USB extension cable",
+		}
+		if cfg.Channel != "" || cfg.IPAddr != "" {
+			hints = append(hints, "-channel and -ipaddr may be stale; unset them to scan again")
+		}
+		if cfg.Verbosity < scanVerbosity {
+			hints = append(hints, "run with -verbosity=3 to log the serial communication")
+		}
+		r.fail("connect (scan and authentication)", err, hints...)
+		os.Exit(exitDevice)
+	}
+	recordAuthentication(authKindInitial, nil)
+	var details []string
+	if pan := monitor.scan.selected(); pan != nil {
+		details = append(details, "channel "+pan.Channel, "PAN ID "+pan.PANID)
+	} else if cfg.Channel != "" {
+		details = append(details, "channel "+cfg.Channel)
+	}
+	if dev.IPAddr != "" {
+		details = append(details, "IPv6 "+dev.IPAddr)
+	}
+	r.ok("connect (scan and authentication)", start, details...)
+
+	scrapeEPCs = cfg.EPCs
+	start = time.Now()
+	got := readMeter(dev, cfg.EPCs, logger)
+	if got == nil {
+		r.fail("query", errors.New("no response to the ECHONET Lite request"),
+			"the meter accepted the connection but did not answer; see the log above",
+			"try more -query.attempts or a longer -query.timeout")
+		os.Exit(exitRead)
+	}
+	details = nil
+	if got.PowerWatts != nil {
+		details = append(details, fmt.Sprintf("power %g W", *got.PowerWatts))
+	}
+	if got.EnergyConsumedKWh != nil {
+		details = append(details, fmt.Sprintf("energy %g kWh", *got.EnergyConsumedKWh))
+	}
+	r.ok("query", start, details...)
+	fmt.Fprintln(r.w, "All checks passed")
+}
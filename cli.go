@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/common/version"
+)
+
+// 終了コード
+const (
+	exitError  = 1 // 設定の誤りなど
+	exitUsage  = 2 // コマンドライン引数または設定ファイルの誤り
+	exitDevice = 3 // デバイスまたはスマートメーターとの接続の失敗
+	exitRead   = 4 // スマートメーターから取得できない
+)
+
+// scanVerbosity は scan でライブラリに指定する詳細度です。
+// チャネルと PAN ID はライブラリが出力するシリアル通信のログから検出します。
+const scanVerbosity = 3
+
+// command はサブコマンドです。
+type command struct {
+	name    string
+	summary string
+	run     func()
+}
+
+// commands はサブコマンドの一覧です。先頭がサブコマンドを省略した場合の動作です。
+// completion が一覧を参照するため、init で設定します。
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Run the exporter (default)", serve},
+		{"read", "Read the meter once, print the values and exit", runRead},
+		{"scan", "Scan for the meter and print its channel, PAN ID and IPv6 address", runScan},
+		{"config validate", "Validate the configuration and exit", runConfigValidate},
+		{"systemd", "Print a hardened systemd unit file for the current flags", runSystemd},
+		{"completion", "Print a shell completion script (bash, zsh or fish)", runCompletion},
+		{"version", "Print version information and exit", printVersion},
+	}
+	flag.Usage = usage
+}
+
+// parseCommand はコマンドライン引数の先頭からサブコマンドを取り出し、残りの引数を返します。
+// 先頭がフラグの場合は serve です。
+func parseCommand(args []string) (*command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &commands[0], args, nil
+	}
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown command %q", strings.Join(args[:min(2, len(args))], " "))
+}
+
+// usage はサブコマンドとフラグの一覧を出力します。
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// setup は設定を読み込んで検証し、ロガーを初期化します。設定に誤りがある場合は終了します。
+func setup() (*config, *slog.Logger) {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(exitUsage)
+	}
+	if cfg.ShowVersion {
+		printVersion()
+		os.Exit(0)
+	}
+	if cfg.HelpEnv {
+		printEnvHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if cfg.PrintConfig {
+		if err := writeEffectiveConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to print configuration:", err)
+			os.Exit(exitError)
+		}
+		os.Exit(0)
+	}
+	if cfg.LogFile != "" {
+		f, err := cfg.openLogFile()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open log file:", err)
+			os.Exit(exitError)
+		}
+		logOutput = f
+	}
+
+	logger := newLogger(cfg)
+	slog.SetDefault(logger)
+	if err := cfg.validate(logger); err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		os.Exit(exitError)
+	}
+	logSecrets = cfg.secrets()
+	queryAttempts, queryRetryInterval, queryTimeout =
+		cfg.QueryAttempts, cfg.QueryRetryInterval, cfg.QueryTimeout
+	reAuthCooldown, postAuthCooldown = cfg.ReAuthCooldown, cfg.PostAuthCooldown
+	return cfg, logger
+}
+
+func printVersion() {
+	fmt.Println(version.Print(programName))
+}
+
+// runConfigValidate は設定を検証し、シリアルデバイスを開けることを確認します。
+// Wi-SUN モジュールにはコマンドを送信しません。誤りがなければ終了コード 0 で終了します。
+func runConfigValidate() {
+	cfg, logger := setup()
+	var devices []string
+	if !cfg.probeOnly() {
+		devices = append(devices, cfg.DevicePath)
+	}
+	for _, m := range cfg.File.Meters {
+		if !slices.Contains(devices, m.Device) {
+			devices = append(devices, m.Device)
+		}
+	}
+	failed := false
+	for _, d := range devices {
+		if err := checkDevice(d); err != nil {
+			logger.Error("Cannot open serial device", "device", d, "error", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(exitDevice)
+	}
+	fmt.Println("Configuration is valid")
+}
+
+// openMeter はスマートメーターに接続します。B ルート ID とパスワードがない場合や、接続できない場合は終了します。
+func openMeter(
+	cfg *config,
+	logger *slog.Logger,
+	open func() (*smartmeter.Device, error),
+) *smartmeter.Device {
+	if cfg.BRouteID == "" || cfg.BRoutePass == "" {
+		logger.Error("ID and Password are required via flags or env vars")
+		os.Exit(exitError)
+	}
+	dev, err := open()
+	if err != nil {
+		logger.Error("Failed to open device", "error", err, "device", cfg.DevicePath)
+		os.Exit(exitDevice)
+	}
+	return dev
+}
+
+// runRead はスマートメーターから1回だけ取得し、取得値を JSON で標準出力に書き出して終了します。
+// 終了コードは、取得できた場合は 0、接続できなかった場合は exitDevice、取得できなかった場合は exitRead です。
+func runRead() {
+	logOutput = os.Stderr
+	cfg, logger := setup()
+	libLogger := slog.NewLogLogger(logger.Handler(), slog.LevelInfo)
+	monitor := newSKStackMonitor(libLogger.Writer(), logger)
+	dev := openMeter(cfg, logger, func() (*smartmeter.Device, error) {
+		return openDeviceWithState(cfg, monitor, logger)
+	})
+	scrapeEPCs = cfg.EPCs
+
+	r := readMeter(dev, cfg.EPCs, logger)
+	if r == nil {
+		os.Exit(exitRead)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		logger.Error("Failed to write reading", "error", err)
+		os.Exit(exitError)
+	}
+}
+
+// runScan は指定されたチャネルと IPv6 アドレスを使わずにアクティブスキャンを行い、
+// 見つかったスマートメーターのチャネル、PAN ID、MAC アドレス、IPv6 アドレスを標準出力に書き出して終了します。
+// 状態ファイルが指定されている場合は、状態ファイルにも保存します。
+func runScan() {
+	logOutput = os.Stderr
+	cfg, logger := setup()
+	if !slices.Contains([]string{"text", "env", "json"}, cfg.ScanFormat) {
+		logger.Error("Invalid scan output format", "format", cfg.ScanFormat)
+		os.Exit(exitUsage)
+	}
+	var out io.Writer = io.Discard
+	if cfg.Verbosity >= scanVerbosity {
+		out = slog.NewLogLogger(logger.Handler(), slog.LevelInfo).Writer()
+	}
+	monitor := newSKStackMonitor(out, logger)
+	m := cfg.meter()
+	m.Channel, m.IPAddr = "", ""
+	dev := openMeter(cfg, logger, func() (*smartmeter.Device, error) {
+		return openDevice(m, scanVerbosity, log.New(monitor, "", 0))
+	})
+
+	result := panState{UpdatedAt: time.Now()}
+	if pan := monitor.scan.selected(); pan != nil {
+		result.panDescriptor = *pan
+	}
+	result.IPAddr = dev.IPAddr
+	if result.IPAddr == "" {
+		var err error
+		if result.IPAddr, err = dev.GetNeibourIP(); err != nil {
+			logger.Error("Failed to resolve the meter IPv6 address", "error", err)
+			os.Exit(exitRead)
+		}
+	}
+	if result.MAC != "" {
+		if addr, err := linkLocalAddr(result.MAC); err == nil && addr != result.IPAddr {
+			logger.Warn("IPv6 address differs from the one derived from the MAC address",
+				"ipaddr", result.IPAddr, "derived", addr)
+		}
+	}
+
+	if cfg.StateFile != "" {
+		if err := writePANState(cfg.StateFile, &result); err != nil {
+			logger.Error("Failed to save the scanned PAN", "error", err)
+			os.Exit(exitError)
+		}
+		logger.Info("Saved the scanned PAN", "state_file", cfg.StateFile)
+	}
+
+	switch cfg.ScanFormat {
+	case "env":
+		fmt.Printf("%s=%s\n%s=%s\n", envName("SMARTMETER_CHANNEL"), result.Channel,
+			envName("SMARTMETER_IPADDR"), result.IPAddr)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	default:
+		fmt.Printf("Channel: %s\nPAN ID:  %s\nMAC:     %s\nIPv6:    %s\n",
+			result.Channel, result.PANID, result.MAC, result.IPAddr)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// epcCurrentTime は現在時刻設定 (EPC 0x97) です。
+	epcCurrentTime = 0x97
+	// epcCurrentDate は現在年月日設定 (EPC 0x98) です。
+	epcCurrentDate = 0x98
+
+	// clockCheckInterval はスマートメーターの時計のずれを確認する間隔です。
+	clockCheckInterval = time.Hour
+)
+
+// スマートメーターの時計のずれ (秒)。メーターの時刻 - エクスポーターのホストの時刻
+var clockSkewGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "smartmeter_meter_clock_skew_seconds",
+	Help: "Meter clock minus exporter host clock in seconds (1 minute resolution)",
+})
+
+func init() {
+	prometheus.MustRegister(clockSkewGauge)
+}
+
+// lastClockCheck は最後に時計のずれを確認した時刻です。
+var lastClockCheck time.Time
+
+// needsClockCheck は時計のずれを確認すべきかどうかを返します。
+// プロパティマップで未対応と分かっている場合は確認しません。
+func needsClockCheck(now time.Time) bool {
+	if supportedEPCs != nil && (!supportedEPCs[epcCurrentTime] || !supportedEPCs[epcCurrentDate]) {
+		return false
+	}
+	return now.Sub(lastClockCheck) >= clockCheckInterval
+}
+
+// decodeMeterClock は現在時刻設定 (時(1) 分(1)) と現在年月日設定 (年(2) 月(1) 日(1)) を
+// スマートメーターの時刻にデコードします。
+func decodeMeterClock(timeEDT, dateEDT []byte) (time.Time, error) {
+	if len(timeEDT) != 2 {
+		return time.Time{}, fmt.Errorf("unexpected current time EDT length: %d", len(timeEDT))
+	}
+	if len(dateEDT) != 4 {
+		return time.Time{}, fmt.Errorf("unexpected current date EDT length: %d", len(dateEDT))
+	}
+	year := int(binary.BigEndian.Uint16(dateEDT[:2]))
+	month, day := int(dateEDT[2]), int(dateEDT[3])
+	hour, minute := int(timeEDT[0]), int(timeEDT[1])
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 {
+		return time.Time{}, fmt.Errorf("invalid meter clock: % X % X", dateEDT, timeEDT)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, meterLocation), nil
+}
+
+// updateClockSkew はスマートメーターの現在時刻を取得し、smartmeter_meter_clock_skew_seconds を更新します。
+// メーターの時刻は分単位のため、ホストの時刻も分未満を切り捨てて比較します。
+func updateClockSkew(dev *smartmeter.Device, logger *slog.Logger) error {
+	now := time.Now()
+	lastClockCheck = now
+	response, err := getProperties(dev, epcCurrentTime, epcCurrentDate)
+	if err != nil {
+		return err
+	}
+	var timeEDT, dateEDT []byte
+	for _, p := range response.Properties {
+		switch p.EPC {
+		case epcCurrentTime:
+			timeEDT = p.EDT
+		case epcCurrentDate:
+			dateEDT = p.EDT
+		}
+	}
+	meterTime, err := decodeMeterClock(timeEDT, dateEDT)
+	if err != nil {
+		return err
+	}
+	skew := meterTime.Sub(now.Truncate(time.Minute))
+	clockSkewGauge.Set(skew.Seconds())
+	logger.Debug("Meter clock checked", "meter_time", meterTime, "skew", skew)
+	return nil
+}
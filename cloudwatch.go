@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudWatchMaxDatums は PutMetricData の1回の要求に含めるデータの上限です。
+const cloudWatchMaxDatums = 1000
+
+// cloudWatchConfig は Amazon CloudWatch への送信の設定です。
+type cloudWatchConfig struct {
+	Region         string
+	Namespace      string
+	DimensionPairs []string
+	Endpoint       string
+	MaxBuffered    int
+	// 指定しない場合は環境変数、共有認証情報ファイルの順に探す
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// validate で設定される
+	Dimensions map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *cloudWatchConfig) bind() {
+	c.Region = getEnv("SMARTMETER_CLOUDWATCH_REGION",
+		getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", "")))
+	c.Namespace = getEnv("SMARTMETER_CLOUDWATCH_NAMESPACE", "")
+	c.Endpoint = getEnv("SMARTMETER_CLOUDWATCH_ENDPOINT", "")
+	c.MaxBuffered = getEnvInt("SMARTMETER_CLOUDWATCH_MAX_BUFFERED", 1440)
+	c.AccessKeyID = getEnv("SMARTMETER_CLOUDWATCH_ACCESS_KEY_ID", "")
+	c.SecretAccessKey = getEnv("SMARTMETER_CLOUDWATCH_SECRET_ACCESS_KEY", "")
+	if v := getEnv("SMARTMETER_CLOUDWATCH_DIMENSIONS", ""); v != "" {
+		c.DimensionPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.Namespace, "cloudwatch.namespace", c.Namespace,
+		"Amazon CloudWatch namespace to put readings into as custom metrics (e.g. SmartMeter)")
+	flag.StringVar(&c.Region, "cloudwatch.region", c.Region, "AWS region of CloudWatch")
+	flag.Var(&labelFlag{values: &c.DimensionPairs}, "cloudwatch.dimension",
+		"CloudWatch dimension name=value added to every metric (repeatable)")
+	flag.StringVar(&c.Endpoint, "cloudwatch.endpoint", c.Endpoint,
+		"CloudWatch endpoint URL (default: https://monitoring.<region>.amazonaws.com)")
+	flag.IntVar(&c.MaxBuffered, "cloudwatch.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while CloudWatch is unreachable")
+	flag.StringVar(&c.AccessKeyID, "cloudwatch.access-key-id", c.AccessKeyID,
+		"AWS access key ID (default: AWS_ACCESS_KEY_ID or the shared credentials file)")
+	flag.StringVar(&c.SecretAccessKey, "cloudwatch.secret-access-key", c.SecretAccessKey,
+		"AWS secret access key")
+}
+
+func (c *cloudWatchConfig) enabled() bool {
+	return c.Namespace != ""
+}
+
+// validate は CloudWatch の設定値を検証します。
+func (c *cloudWatchConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Region == "" {
+		return errors.New("AWS region is required for CloudWatch")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://monitoring." + c.Region + ".amazonaws.com/"
+	}
+	if _, err := url.ParseRequestURI(c.Endpoint); err != nil {
+		return errors.New("invalid CloudWatch endpoint: " + c.Endpoint)
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("CloudWatch max buffered readings must be positive")
+	}
+	dims, err := parseLabels(c.DimensionPairs)
+	if err != nil {
+		return err
+	}
+	c.Dimensions = dims
+	return nil
+}
+
+// cloudWatchSink は取得値を CloudWatch の PutMetricData でカスタムメトリクスとして送信します。
+// メトリクス名は /metrics と同じで、ラベル (phase, direction) はディメンションになります。
+// 送信に失敗した取得値は保持しておき、次回の送信時にまとめて再送します。
+type cloudWatchSink struct {
+	cfg    *cloudWatchConfig
+	client *http.Client
+	buffer *retryBuffer
+}
+
+func newCloudWatchSink(cfg *cloudWatchConfig) (*cloudWatchSink, error) {
+	client, err := newHTTPClient("", false)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudWatchSink{
+		cfg:    cfg,
+		client: client,
+		buffer: newRetryBuffer("cloudwatch", cfg.MaxBuffered),
+	}, nil
+}
+
+func (s *cloudWatchSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var samples []readingSample
+		for _, rd := range rs {
+			samples = append(samples, rd.samples()...)
+		}
+		for len(samples) > 0 {
+			n := min(len(samples), cloudWatchMaxDatums)
+			if err := s.put(ctx, samples[:n]); err != nil {
+				return err
+			}
+			samples = samples[n:]
+		}
+		return nil
+	})
+}
+
+// put は1回の PutMetricData の要求を送信します。
+func (s *cloudWatchSink) put(ctx context.Context, samples []readingSample) error {
+	creds, err := resolveAWSCredentials(awsCredentials{
+		AccessKeyID:     s.cfg.AccessKeyID,
+		SecretAccessKey: s.cfg.SecretAccessKey,
+	})
+	if err != nil {
+		return err
+	}
+	body := []byte(s.putMetricDataForm(samples).Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.Endpoint,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, creds, s.cfg.Region, "monitoring", time.Now())
+	return sendHTTP(s.client, req)
+}
+
+// putMetricDataForm は PutMetricData (Query API) の要求のパラメーターを生成します。
+func (s *cloudWatchSink) putMetricDataForm(samples []readingSample) url.Values {
+	names := make([]string, 0, len(s.cfg.Dimensions))
+	for k := range s.cfg.Dimensions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	form := url.Values{}
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("Namespace", s.cfg.Namespace)
+	for i, sample := range samples {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"MetricName", sample.Name)
+		form.Set(prefix+"Value", strconv.FormatFloat(sample.Value, 'f', -1, 64))
+		form.Set(prefix+"Timestamp", sample.Time.UTC().Format(time.RFC3339))
+		dims := make([][2]string, 0, len(names)+1)
+		for _, k := range names {
+			dims = append(dims, [2]string{k, s.cfg.Dimensions[k]})
+		}
+		if sample.LabelName != "" {
+			dims = append(dims, [2]string{sample.LabelName, sample.LabelValue})
+		}
+		for j, d := range dims {
+			dp := prefix + "Dimensions.member." + strconv.Itoa(j+1) + "."
+			form.Set(dp+"Name", d[0])
+			form.Set(dp+"Value", d[1])
+		}
+	}
+	return form
+}
+
+func (s *cloudWatchSink) close() error {
+	return nil
+}
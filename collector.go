@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// refreshWaitTimeout は /metrics の要求時に取得し直す場合に、取得の完了を待つ最大時間です。
+const refreshWaitTimeout = 30 * time.Second
+
+// sampleTimestamps が true の場合、取得値をスマートメーターから取得した時刻付きで出力します。
+var sampleTimestamps bool
+
+// newSample は取得時刻 t の値 v のメトリクスを生成します。
+// sampleTimestamps が true の場合は取得時刻をサンプルのタイムスタンプとして付加します。
+func newSample(
+	desc *prometheus.Desc,
+	vt prometheus.ValueType,
+	v float64,
+	t time.Time,
+	labels ...string,
+) prometheus.Metric {
+	m := prometheus.MustNewConstMetric(desc, vt, v, labels...)
+	if sampleTimestamps {
+		return prometheus.NewMetricWithTimestamp(t, m)
+	}
+	return m
+}
+
+// sample は取得時刻付きの取得値です。
+type sample struct {
+	value float64
+	time  time.Time
+}
+
+var (
+	// 動作状態 (ON: 1, OFF: 0)
+	operationalDesc = prometheus.NewDesc(
+		"smartmeter_meter_operational",
+		"Whether the meter reports its operation status as ON (1) or OFF (0)",
+		nil, nil,
+	)
+	// 異常発生状態 (異常あり: 1, 異常なし: 0)
+	faultDesc = prometheus.NewDesc(
+		"smartmeter_meter_fault",
+		"Whether the meter reports a fault (1) or not (0)",
+		nil, nil,
+	)
+	// 電力 (W)
+	powerDesc = prometheus.NewDesc(
+		"smartmeter_power_watts",
+		"Instantaneous electric power consumption in Watts (negative when exporting)",
+		nil, nil,
+	)
+	// 電流 (A) - R相とT相をラベルで分ける
+	currentDesc = prometheus.NewDesc(
+		"smartmeter_current_amperes",
+		"Instantaneous electric current in Amperes",
+		[]string{"phase"}, nil, // phase="r" or "t"
+	)
+	// 電流を計測している相の数 (単相2線式: 1, 単相3線式: 2)
+	phasesDesc = prometheus.NewDesc(
+		"smartmeter_phases",
+		"Number of phases with current measurement (1: single-phase 2-wire, 2: 3-wire)",
+		nil, nil,
+	)
+	// 直近の取得値の経過時間 (秒)
+	readingAgeDesc = prometheus.NewDesc(
+		"smartmeter_reading_age_seconds",
+		"Seconds since the cached instantaneous readings were obtained from the meter",
+		nil, nil,
+	)
+)
+
+// readingCollector はスマートメーターから取得した瞬時値のキャッシュを保持し、
+// /metrics の要求時にキャッシュの値とその経過時間を出力する Collector です。
+// maxAge が正の場合、キャッシュが maxAge より古ければ取得ループに取得し直しを要求します。
+type readingCollector struct {
+	maxAge  time.Duration
+	refresh chan chan struct{}
+
+	mu          sync.Mutex
+	updated     time.Time // 最後に値を更新した取得の時刻 (ゼロ値は未取得)
+	operational *sample
+	fault       *sample
+	power       *sample
+	currentR    *sample
+	currentT    *sample
+	phases      *sample
+}
+
+// readings は瞬時値のキャッシュです。
+var readings = &readingCollector{refresh: make(chan chan struct{})}
+
+// update は取得値でキャッシュを更新します。取得できなかった値は直前の値を保持します。
+func (c *readingCollector) update(r *reading) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set := func(dst **sample, v *float64) {
+		if v != nil {
+			*dst = &sample{value: *v, time: r.Time}
+			c.updated = r.Time
+		}
+	}
+	if r.Operational != nil {
+		set(&c.operational, ptr(boolToFloat(*r.Operational)))
+	}
+	if r.Fault != nil {
+		set(&c.fault, ptr(boolToFloat(*r.Fault)))
+	}
+	set(&c.power, r.PowerWatts)
+	set(&c.currentR, r.CurrentRAmperes)
+	set(&c.currentT, r.CurrentTAmperes)
+	if r.Phases != 0 {
+		set(&c.phases, ptr(float64(r.Phases)))
+	}
+	if r.Phases == 1 {
+		// 単相2線式では T相の系列自体を出力しない
+		c.currentT = nil
+	}
+}
+
+// age はキャッシュの経過時間を返します。未取得の場合は false を返します。
+func (c *readingCollector) age(now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated.IsZero() {
+		return 0, false
+	}
+	return now.Sub(c.updated), true
+}
+
+// stale はキャッシュが maxAge より古い (または未取得) かどうかを返します。
+func (c *readingCollector) stale(now time.Time) bool {
+	age, ok := c.age(now)
+	return !ok || age >= c.maxAge
+}
+
+// requestRefresh は取得ループに取得し直しを要求し、完了するか refreshWaitTimeout が経過するまで待ちます。
+func (c *readingCollector) requestRefresh() {
+	timer := time.NewTimer(refreshWaitTimeout)
+	defer timer.Stop()
+	done := make(chan struct{})
+	select {
+	case c.refresh <- done:
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// Describe は prometheus.Collector を実装します。
+func (c *readingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- operationalDesc
+	ch <- faultDesc
+	ch <- powerDesc
+	ch <- currentDesc
+	ch <- phasesDesc
+	ch <- readingAgeDesc
+}
+
+// Collect は prometheus.Collector を実装します。未取得の値は出力しません。
+func (c *readingCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.maxAge > 0 && c.stale(time.Now()) {
+		c.requestRefresh()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gauge := func(desc *prometheus.Desc, s *sample, labels ...string) {
+		if s != nil {
+			ch <- newSample(desc, prometheus.GaugeValue, s.value, s.time, labels...)
+		}
+	}
+	gauge(operationalDesc, c.operational)
+	gauge(faultDesc, c.fault)
+	gauge(powerDesc, c.power)
+	gauge(currentDesc, c.currentR, "r")
+	gauge(currentDesc, c.currentT, "t")
+	gauge(phasesDesc, c.phases)
+	if !c.updated.IsZero() {
+		// 経過時間は /metrics の要求時点の値のため、タイムスタンプを付けない
+		ch <- prometheus.MustNewConstMetric(
+			readingAgeDesc,
+			prometheus.GaugeValue,
+			time.Since(c.updated).Seconds(),
+		)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// completionShells は completion で補完スクリプトを出力できるシェルです。
+var completionShells = map[string]func(w io.Writer, name string){
+	"bash": writeBashCompletion,
+	"zsh":  writeZshCompletion,
+	"fish": writeFishCompletion,
+}
+
+// runCompletion は引数で指定されたシェルの補完スクリプトを標準出力に書き出します。
+// 補完の候補はサブコマンドとフラグの一覧から生成します。
+func runCompletion() {
+	var write func(io.Writer, string)
+	if len(os.Args) == 2 {
+		write = completionShells[os.Args[1]]
+	}
+	if write == nil {
+		fmt.Fprintln(os.Stderr, "usage: completion bash|zsh|fish")
+		os.Exit(exitUsage)
+	}
+	newConfig()
+	write(os.Stdout, filepath.Base(os.Args[0]))
+}
+
+// completionFlag は補完の候補とするフラグです。
+type completionFlag struct {
+	name    string
+	usage   string
+	hasArgs bool
+}
+
+// completionFlags は登録されているフラグを名前順に返します。
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		usage, _, _ := strings.Cut(f.Usage, "\n")
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{f.Name, usage, !ok || !b.IsBoolFlag()})
+	})
+	return flags
+}
+
+// completionCommands はサブコマンドの最初の語と、2語のサブコマンドの場合は2番目の語の一覧を返します。
+func completionCommands() (first []command, second map[string][]command) {
+	second = make(map[string][]command)
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if !slices.ContainsFunc(first, func(f command) bool { return f.name == words[0] }) {
+			first = append(first, command{name: words[0], summary: c.summary})
+		}
+		if len(words) > 1 {
+			second[words[0]] = append(second[words[0]], command{name: words[1], summary: c.summary})
+		}
+	}
+	second["completion"] = []command{{name: "bash"}, {name: "zsh"}, {name: "fish"}}
+	return first, second
+}
+
+// commandNames はサブコマンドの名前を空白区切りで返します。
+func commandNames(commands []command) string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return strings.Join(names, " ")
+}
+
+// shellQuote は文字列をシェルの単一引用符で囲みます。
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// completionFunc は補完スクリプトの関数名です。
+func completionFunc(name string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func writeBashCompletion(w io.Writer, name string) {
+	first, second := completionCommands()
+	var flags []string
+	for _, f := range completionFlags() {
+		flags = append(flags, "-"+f.name)
+	}
+	fn := completionFunc(name)
+	fmt.Fprintf(w, "# bash completion for %s\n%s() {\n", name, fn)
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]}\n")
+	fmt.Fprintf(w, "\tif [[ $cur == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n",
+		shellQuote(strings.Join(flags, " ")))
+	fmt.Fprintf(w, "\telif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(commandNames(first)))
+	for _, c := range first {
+		if sub := second[c.name]; len(sub) > 0 {
+			fmt.Fprintf(w, "\telif [[ $COMP_CWORD -eq 2 && ${COMP_WORDS[1]} == %s ]]; then\n", c.name)
+			fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n",
+				shellQuote(commandNames(sub)))
+		}
+	}
+	fmt.Fprintf(w, "\telse\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\tfi\n}\n")
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, name)
+}
+
+func writeZshCompletion(w io.Writer, name string) {
+	first, second := completionCommands()
+	fn := completionFunc(name)
+	fmt.Fprintf(w, "#compdef %s\n\n%s() {\n\tlocal -a commands flags\n\tcommands=(\n", name, fn)
+	for _, c := range first {
+		fmt.Fprintf(w, "\t\t%s\n", shellQuote(c.name+":"+c.summary))
+	}
+	fmt.Fprintf(w, "\t)\n\tflags=(\n")
+	for _, f := range completionFlags() {
+		fmt.Fprintf(w, "\t\t%s\n", shellQuote("-"+f.name+":"+f.usage))
+	}
+	fmt.Fprintf(w, "\t)\n")
+	fmt.Fprintf(w, "\tif [[ $PREFIX == -*=* ]]; then\n\t\tcompset -P '*='\n\t\t_files\n")
+	fmt.Fprintf(w, "\telif [[ $PREFIX == -* ]]; then\n\t\t_describe -t flags flag flags\n")
+	fmt.Fprintf(w, "\telif (( CURRENT == 2 )); then\n\t\t_describe -t commands command commands\n")
+	for _, c := range first {
+		if sub := second[c.name]; len(sub) > 0 {
+			fmt.Fprintf(w, "\telif (( CURRENT == 3 )) && [[ $words[2] == %s ]]; then\n", c.name)
+			fmt.Fprintf(w, "\t\tcompadd %s\n", commandNames(sub))
+		}
+	}
+	fmt.Fprintf(w, "\telse\n\t\t_files\n\tfi\n}\n\n")
+	fmt.Fprintf(w, "if [[ $zsh_eval_context[-1] == loadautofunc ]]; then\n\t%s \"$@\"\n", fn)
+	fmt.Fprintf(w, "else\n\tcompdef %s %s\nfi\n", fn, name)
+}
+
+func writeFishCompletion(w io.Writer, name string) {
+	first, second := completionCommands()
+	fmt.Fprintf(w, "# fish completion for %s\n", name)
+	for _, c := range first {
+		fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -a %s -d %s\n",
+			name, c.name, shellQuote(c.summary))
+	}
+	for _, c := range first {
+		for _, sub := range second[c.name] {
+			fmt.Fprintf(w, "complete -c %s -f -n %s -a %s", name,
+				shellQuote("__fish_seen_subcommand_from "+c.name), sub.name)
+			if sub.summary != "" {
+				fmt.Fprintf(w, " -d %s", shellQuote(sub.summary))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	for _, f := range completionFlags() {
+		fmt.Fprintf(w, "complete -c %s -o %s -d %s", name, f.name, shellQuote(f.usage))
+		if f.hasArgs {
+			fmt.Fprint(w, " -r")
+		}
+		fmt.Fprintln(w)
+	}
+}
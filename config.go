@@ -0,0 +1,974 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config はエクスポーターの設定です。設定ファイル、環境変数、コマンドラインフラグから読み込みます。
+type config struct {
+	BRouteID    string
+	BRoutePass  string
+	DevicePath  string
+	ListenPort  string
+	MetricsPath string
+	Channel     string
+	IPAddr      string
+	UseDSE      bool
+	Backfill    bool
+	HistoryDays int
+	EPCsStr     string
+	BucketsStr  string
+	ConfigFile  string
+	Timezone    string
+	Verbosity   int
+
+	// IDFile と PasswordFile は B ルート ID とパスワードを読み込むファイルです (Docker の secrets など)。
+	IDFile       string
+	PasswordFile string
+	// IDCommand と PasswordCommand は B ルート ID とパスワードを標準出力に書き出すコマンドです。
+	IDCommand       string
+	PasswordCommand string
+	// Keyring は B ルート ID とパスワードを OS のキーリングから読み込むかどうかです。
+	Keyring        bool
+	KeyringService string
+	// StateFile はアクティブスキャンで見つかったスマートメーターの接続情報を保存するファイルです。
+	StateFile string
+	// LogFile はログの出力先のファイルです。LogMaxSize (MB) を超えるとローテーションします。
+	LogFile       string
+	LogMaxSize    int
+	LogMaxAge     time.Duration
+	LogMaxBackups int
+	// LogLevel はログのレベル (debug、info、warn、error) です。空の場合は Verbosity から決めます。
+	LogLevel string
+	// LogTimestamps はログに時刻を含めるかどうか (auto、always、never) です。
+	LogTimestamps string
+	// LogSource はログにソースコードの位置を含めるかどうかです。
+	LogSource bool
+	// LogRedact は値を伏せ字にするログの属性名のカンマ区切りリストです。
+	LogRedact string
+
+	Interval       time.Duration
+	FixedTimeDelay time.Duration
+	Staleness      time.Duration
+	MaxCacheAge    time.Duration
+	PANALifetime   time.Duration
+	// INFPollInterval はスマートメーターからの通知を読み出すために Wi-SUN モジュールに問い合わせる間隔です。
+	// 0 の場合は取得の際にのみ通知を処理します。
+	INFPollInterval time.Duration
+
+	// QueryAttempts、QueryRetryInterval、QueryTimeout は ECHONET Lite の要求の再試行の設定です。
+	QueryAttempts      int
+	QueryRetryInterval time.Duration
+	QueryTimeout       time.Duration
+	// ReAuthCooldown と PostAuthCooldown は再認証の前と後の待ち時間です。
+	ReAuthCooldown   time.Duration
+	PostAuthCooldown time.Duration
+	// ReadinessIntervals は /readyz が準備完了とする、最後の取得成功からの経過時間 (取得間隔の倍数) です。
+	ReadinessIntervals int
+	// APIHistoryRetention は /api/v1/history のためにメモリに保持する取得値の期間です。
+	APIHistoryRetention time.Duration
+	// GRPCPort は gRPC API を待ち受けるポートです。空の場合は gRPC API を無効にします。
+	GRPCPort string
+
+	// ShowVersion はバージョン情報を表示して終了するかどうかです。
+	ShowVersion bool
+	// Check はスマートメーターへの接続と取得を1回だけ試して終了するかどうかです。
+	Check bool
+	// PrintConfig は有効な設定を表示して終了するかどうかです。
+	PrintConfig bool
+	// Settings は読み込んだ時点の各フラグの値と設定元です。
+	Settings []setting
+	// HelpEnv は環境変数の一覧を表示して終了するかどうかです。
+	HelpEnv bool
+	// EnvPrefix は環境変数の名前の接頭辞です。
+	EnvPrefix string
+	// ScanFormat は scan の出力形式です。
+	ScanFormat string
+	// EnableLifecycle は /-/reload による設定の再読み込みを許可するかどうかです。
+	EnableLifecycle bool
+	// EnablePprof は /debug/pprof でプロファイルを公開するかどうかです。
+	EnablePprof bool
+	// WebConfigFile は TLS や Basic 認証などの HTTP サーバーの設定ファイル (exporter-toolkit の形式) です。
+	WebConfigFile string
+	// SampleTimestamps は取得値を取得時刻付きで出力するかどうかです。
+	SampleTimestamps bool
+	// NativeHistogram は取得時間をネイティブヒストグラムでも出力するかどうかです。
+	NativeHistogram bool
+	// Exemplars は取得時間にトレース ID の exemplar を付加するかどうかです。
+	Exemplars bool
+	// LabelPairs は "key=value" 形式の定数ラベルの列です。
+	LabelPairs []string
+
+	// 以下は Prometheus 以外の出力先の設定
+	MQTT            mqttConfig
+	InfluxDB        influxDBConfig
+	LineProtocol    lineProtocolConfig
+	VictoriaMetrics victoriaMetricsConfig
+	RemoteWrite     remoteWriteConfig
+	Pushgateway     pushgatewayConfig
+	Graphite        graphiteConfig
+	StatsD          statsdConfig
+	CSV             csvConfig
+	JSONL           jsonlConfig
+	SQLite          sqliteConfig
+	Postgres        postgresConfig
+	CloudWatch      cloudWatchConfig
+	GCM             gcmConfig
+	NATS            natsConfig
+	Webhook         webhookConfig
+	Zabbix          zabbixConfig
+	Modbus          modbusConfig
+	Datadog         datadogConfig
+
+	// EchonetServer は LAN 側で ECHONET Lite の要求に応答する設定です。
+	EchonetServer echonetServerConfig
+
+	// 以下は validate で設定される
+	EPCs     []smartmeter.PropertyCode
+	Buckets  []float64
+	Location *time.Location
+	File     fileConfig
+	Labels   map[string]string
+}
+
+// loadConfig は設定ファイル、環境変数、コマンドラインフラグから設定を読み込みます。
+// フラグ、環境変数、設定ファイルの順に優先されます。
+func loadConfig() (*config, error) {
+	if err := setEnvPrefix(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	var cf *configFile
+	if path := configFilePath(os.Args[1:]); path != "" {
+		var err error
+		if cf, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	defaults := flagDefaults()
+
+	envErrors = nil
+	cfg := newConfig()
+	if err := errors.Join(envErrors...); err != nil {
+		return nil, err
+	}
+	if cf != nil {
+		if err := cf.apply(defaults); err != nil {
+			return nil, err
+		}
+		cfg.File = cf.file
+	}
+	flag.Parse()
+	cfg.Settings = settingSources(defaults, cf)
+	return cfg, nil
+}
+
+// newConfig は環境変数から初期値を読み込んだ設定を作成し、コマンドラインフラグを登録します。
+func newConfig() *config {
+	cfg := &config{
+		BRouteID:    getEnv("SMARTMETER_ID", ""),
+		BRoutePass:  getEnv("SMARTMETER_PASSWORD", ""),
+		DevicePath:  getEnv("SMARTMETER_DEVICE", "/dev/ttyACM0"),
+		ListenPort:  getEnv("SMARTMETER_PORT", "9102"),
+		MetricsPath: getEnv("SMARTMETER_TELEMETRY_PATH", "/metrics"),
+		Channel:     getEnv("SMARTMETER_CHANNEL", ""),
+		IPAddr:      getEnv("SMARTMETER_IPADDR", ""),
+		EPCsStr:     getEnv("SMARTMETER_EPCS", formatEPCList(scrapeEPCs)),
+		BucketsStr:  getEnv("SMARTMETER_SCRAPE_DURATION_BUCKETS", ""),
+		ConfigFile:  getEnv("SMARTMETER_CONFIG_FILE", ""),
+		Timezone:    getEnv("SMARTMETER_TIMEZONE", "Asia/Tokyo"),
+		Verbosity:   getEnvInt("SMARTMETER_VERBOSITY", 1),
+
+		Backfill:         getEnvBool("SMARTMETER_BACKFILL"),
+		SampleTimestamps: getEnvBool("SMARTMETER_SAMPLE_TIMESTAMPS"),
+		NativeHistogram:  getEnvBool("SMARTMETER_NATIVE_HISTOGRAM"),
+		Exemplars:        getEnvBool("SMARTMETER_EXEMPLARS"),
+		EnableLifecycle:  getEnvBool("SMARTMETER_WEB_ENABLE_LIFECYCLE"),
+		EnablePprof:      getEnvBool("SMARTMETER_WEB_ENABLE_PPROF"),
+		WebConfigFile:    getEnv("SMARTMETER_WEB_CONFIG_FILE", ""),
+		Interval:         getEnvDuration("SMARTMETER_INTERVAL", defaultInterval),
+		FixedTimeDelay:   getEnvDuration("SMARTMETER_FIXED_TIME_DELAY", time.Minute),
+		Staleness:        getEnvDuration("SMARTMETER_STALENESS", 0),
+		MaxCacheAge:      getEnvDuration("SMARTMETER_MAX_CACHE_AGE", 0),
+		PANALifetime:     getEnvDuration("SMARTMETER_PANA_LIFETIME", 2*time.Hour),
+		INFPollInterval:  getEnvDuration("SMARTMETER_INF_POLL_INTERVAL", 0),
+		IDFile:           getEnv("SMARTMETER_ID_FILE", ""),
+		PasswordFile:     getEnv("SMARTMETER_PASSWORD_FILE", ""),
+		IDCommand:        getEnv("SMARTMETER_ID_COMMAND", ""),
+		PasswordCommand:  getEnv("SMARTMETER_PASSWORD_COMMAND", ""),
+		Keyring:          getEnvBool("SMARTMETER_KEYRING"),
+		KeyringService:   getEnv("SMARTMETER_KEYRING_SERVICE", "smartmeter-exporter"),
+		StateFile:        getEnv("SMARTMETER_STATE_FILE", ""),
+
+		QueryAttempts:      getEnvInt("SMARTMETER_QUERY_ATTEMPTS", 3),
+		ReadinessIntervals: getEnvInt("SMARTMETER_READINESS_INTERVALS", 3),
+		QueryRetryInterval: getEnvDuration("SMARTMETER_QUERY_RETRY_INTERVAL", 5*time.Second),
+		QueryTimeout:       getEnvDuration("SMARTMETER_QUERY_TIMEOUT", 0),
+		ReAuthCooldown:     getEnvDuration("SMARTMETER_REAUTH_COOLDOWN", 5*time.Second),
+		PostAuthCooldown:   getEnvDuration("SMARTMETER_POST_AUTH_COOLDOWN", 2*time.Second),
+
+		APIHistoryRetention: getEnvDuration("SMARTMETER_API_HISTORY_RETENTION", 24*time.Hour),
+		GRPCPort:            getEnv("SMARTMETER_GRPC_PORT", ""),
+
+		LogFile:       getEnv("SMARTMETER_LOG_FILE", ""),
+		LogMaxSize:    getEnvInt("SMARTMETER_LOG_MAX_SIZE", 10),
+		LogMaxAge:     getEnvDuration("SMARTMETER_LOG_MAX_AGE", 7*24*time.Hour),
+		LogMaxBackups: getEnvInt("SMARTMETER_LOG_MAX_BACKUPS", 5),
+		LogTimestamps: getEnv("SMARTMETER_LOG_TIMESTAMPS", "auto"),
+		LogSource:     getEnvBool("SMARTMETER_LOG_SOURCE"),
+		LogRedact:     getEnv("SMARTMETER_LOG_REDACT", "password"),
+	}
+
+	if v := getEnv("SMARTMETER_DSE", ""); v != "false" && v != "0" {
+		cfg.UseDSE = true
+	}
+	if v := getEnv("SMARTMETER_LABELS", ""); v != "" {
+		cfg.LabelPairs = strings.Split(v, ",")
+	}
+	if v := getEnv("SMARTMETER_LOG_LEVEL", ""); v != "" {
+		if err := (&logLevelValue{&cfg.LogLevel}).Set(v); err != nil {
+			envErrors = append(envErrors,
+				fmt.Errorf("invalid %s %q: %w", envName("SMARTMETER_LOG_LEVEL"), v, err))
+		}
+	}
+
+	flag.StringVar(&cfg.BRouteID, "id", cfg.BRouteID, "B-route ID")
+	flag.StringVar(&cfg.BRoutePass, "password", cfg.BRoutePass, "B-route password")
+	flag.StringVar(&cfg.IDFile, "id-file", cfg.IDFile, "Path to a file containing the B-route ID")
+	flag.StringVar(
+		&cfg.PasswordFile,
+		"password-file",
+		cfg.PasswordFile,
+		"Path to a file containing the B-route password",
+	)
+	flag.StringVar(
+		&cfg.IDCommand,
+		"id-command",
+		cfg.IDCommand,
+		"Shell command that prints the B-route ID",
+	)
+	flag.StringVar(
+		&cfg.PasswordCommand,
+		"password-command",
+		cfg.PasswordCommand,
+		"Shell command that prints the B-route password (e.g. \"pass show smartmeter\")",
+	)
+	flag.BoolVar(
+		&cfg.Keyring,
+		"keyring",
+		cfg.Keyring,
+		"Read the B-route ID and password not given otherwise from the OS keyring",
+	)
+	flag.StringVar(
+		&cfg.KeyringService,
+		"keyring.service",
+		cfg.KeyringService,
+		"Service name of the B-route credentials in the OS keyring",
+	)
+	flag.StringVar(&cfg.DevicePath, "device", cfg.DevicePath, "Serial port device path")
+	durationVar(
+		&cfg.Interval,
+		"interval",
+		cfg.Interval,
+		"Scrape interval (e.g. 90s or 5m; a bare number is seconds, minimum 10s)",
+	)
+	flag.StringVar(&cfg.ListenPort, "port", cfg.ListenPort, "Exporter listen port (default: 9102)")
+	flag.StringVar(
+		&cfg.MetricsPath,
+		"web.telemetry-path",
+		cfg.MetricsPath,
+		"Path under which to expose metrics",
+	)
+	flag.BoolVar(
+		&cfg.EnableLifecycle,
+		"web.enable-lifecycle",
+		cfg.EnableLifecycle,
+		"Enable reloading the configuration via HTTP POST to /-/reload",
+	)
+	flag.BoolVar(
+		&cfg.EnablePprof,
+		"web.enable-pprof",
+		cfg.EnablePprof,
+		"Expose Go runtime profiles under /debug/pprof/",
+	)
+	flag.StringVar(
+		&cfg.WebConfigFile,
+		"web.config.file",
+		cfg.WebConfigFile,
+		"Path to a web configuration file enabling TLS and basic auth (exporter-toolkit format)",
+	)
+	flag.StringVar(&cfg.Channel, "channel", cfg.Channel, "Fixed Wi-SUN Channel (skip scan)")
+	flag.StringVar(&cfg.IPAddr, "ipaddr", cfg.IPAddr, "Fixed Smart Meter IPv6 Address (skip scan)")
+	flag.StringVar(
+		&cfg.StateFile,
+		"state.file",
+		cfg.StateFile,
+		"Path to a file caching the scanned channel and IPv6 address for fast restarts",
+	)
+	flag.BoolVar(&cfg.UseDSE, "dse", cfg.UseDSE, "Enable Dual Stack Edition (DSE)")
+	flag.BoolVar(
+		&cfg.Backfill,
+		"backfill",
+		cfg.Backfill,
+		"Recover half-hourly history at startup and after outages",
+	)
+	flag.BoolVar(
+		&cfg.SampleTimestamps,
+		"sample-timestamps",
+		cfg.SampleTimestamps,
+		"Expose readings with the timestamp at which they were obtained from the meter",
+	)
+	flag.StringVar(
+		&cfg.BucketsStr,
+		"scrape-duration-buckets",
+		cfg.BucketsStr,
+		"Comma-separated bucket upper bounds in seconds for the scrape duration histogram",
+	)
+	flag.BoolVar(
+		&cfg.NativeHistogram,
+		"native-histogram",
+		cfg.NativeHistogram,
+		"Also expose the scrape duration as a Prometheus native histogram",
+	)
+	flag.BoolVar(
+		&cfg.Exemplars,
+		"exemplars",
+		cfg.Exemplars,
+		"Tag each scrape with a trace ID in logs and as a scrape duration exemplar",
+	)
+	flag.IntVar(
+		&cfg.HistoryDays,
+		"history-days",
+		cfg.HistoryDays,
+		"Print half-hourly history of the last N days as CSV and exit",
+	)
+	flag.StringVar(
+		&cfg.ScanFormat,
+		"scan.format",
+		"text",
+		"Output format of the scan command (text, env or json)",
+	)
+	flag.StringVar(
+		&cfg.EPCsStr,
+		"epcs",
+		cfg.EPCsStr,
+		"Comma-separated EPCs to request each scrape (e.g. E7,E8,E0,EA)",
+	)
+	durationVar(
+		&cfg.FixedTimeDelay,
+		"fixed-time-delay",
+		cfg.FixedTimeDelay,
+		"Delay after each half-hour boundary before reading fixed-time cumulative energy",
+	)
+	durationVar(
+		&cfg.Staleness,
+		"staleness",
+		cfg.Staleness,
+		"Stop exporting instantaneous metrics after no successful scrape for this long (0: never)",
+	)
+	durationVar(
+		&cfg.MaxCacheAge,
+		"max-cache-age",
+		cfg.MaxCacheAge,
+		"Read the meter on demand when cached readings are older than this on /metrics (0: never)",
+	)
+	durationVar(
+		&cfg.PANALifetime,
+		"pana-lifetime",
+		cfg.PANALifetime,
+		"PANA session lifetime configured in the Wi-SUN module (SKSTACK register S16)",
+	)
+	flag.IntVar(
+		&cfg.QueryAttempts,
+		"query.attempts",
+		cfg.QueryAttempts,
+		"Maximum number of attempts for each ECHONET Lite query, including retries",
+	)
+	durationVar(
+		&cfg.QueryRetryInterval,
+		"query.retry-interval",
+		cfg.QueryRetryInterval,
+		"Wait between attempts of a failed ECHONET Lite query",
+	)
+	durationVar(
+		&cfg.QueryTimeout,
+		"query.timeout",
+		cfg.QueryTimeout,
+		"Stop retrying an ECHONET Lite query once this much time has passed (0: no limit)",
+	)
+	durationVar(
+		&cfg.ReAuthCooldown,
+		"reauth-cooldown",
+		cfg.ReAuthCooldown,
+		"Wait after a failed query before re-authenticating",
+	)
+	durationVar(
+		&cfg.PostAuthCooldown,
+		"post-auth-cooldown",
+		cfg.PostAuthCooldown,
+		"Wait after re-authenticating before retrying the query",
+	)
+	durationVar(
+		&cfg.INFPollInterval,
+		"inf.poll-interval",
+		cfg.INFPollInterval,
+		"Interval to poll for unsolicited notifications between scrapes (0: disabled)",
+	)
+	flag.IntVar(
+		&cfg.ReadinessIntervals,
+		"readiness.intervals",
+		cfg.ReadinessIntervals,
+		"/readyz fails when the last successful scrape is older than this many intervals",
+	)
+	durationVar(
+		&cfg.APIHistoryRetention,
+		"api.history-retention",
+		cfg.APIHistoryRetention,
+		"How long readings are kept in memory for /api/v1/history (0: disable)",
+	)
+	flag.StringVar(
+		&cfg.GRPCPort,
+		"grpc.port",
+		cfg.GRPCPort,
+		"Port to serve the gRPC API on (empty: disable)",
+	)
+	flag.StringVar(
+		&cfg.Timezone,
+		"timezone",
+		cfg.Timezone,
+		"Timezone for daily energy, CSV file dates and history timestamps",
+	)
+	flag.Var(
+		&labelFlag{values: &cfg.LabelPairs},
+		"label",
+		"Constant label key=value added to every metric (repeatable)",
+	)
+	flag.StringVar(
+		&cfg.ConfigFile,
+		"config.file",
+		cfg.ConfigFile,
+		"Path to YAML or TOML configuration file",
+	)
+	flag.IntVar(&cfg.Verbosity, "verbosity", cfg.Verbosity, "Log verbosity (0:quiet, 3:debug)")
+	flag.Var(
+		&logLevelValue{&cfg.LogLevel},
+		"log.level",
+		"Log level: debug, info, warn or error (overrides -verbosity for log filtering)",
+	)
+	flag.StringVar(
+		&cfg.LogFile,
+		"log.file",
+		cfg.LogFile,
+		"Write logs to this file instead of stdout, rotating it by size",
+	)
+	flag.IntVar(
+		&cfg.LogMaxSize,
+		"log.max-size",
+		cfg.LogMaxSize,
+		"Rotate the log file when it exceeds this size in megabytes (0: never)",
+	)
+	durationVar(
+		&cfg.LogMaxAge,
+		"log.max-age",
+		cfg.LogMaxAge,
+		"Remove rotated log files older than this (0: keep)",
+	)
+	flag.IntVar(
+		&cfg.LogMaxBackups,
+		"log.max-backups",
+		cfg.LogMaxBackups,
+		"Number of rotated log files to keep (0: all)",
+	)
+	flag.StringVar(
+		&cfg.LogTimestamps,
+		"log.timestamps",
+		cfg.LogTimestamps,
+		"Include timestamps in logs: auto (only with -log.file), always or never",
+	)
+	flag.BoolVar(&cfg.LogSource, "log.source", cfg.LogSource, "Include the source location in logs")
+	flag.StringVar(
+		&cfg.LogRedact,
+		"log.redact",
+		cfg.LogRedact,
+		"Comma-separated log attribute keys whose values are redacted",
+	)
+	flag.BoolVar(&cfg.ShowVersion, "version", false, "Print version information and exit")
+	flag.BoolVar(
+		&cfg.PrintConfig,
+		"print-config",
+		false,
+		"Print the effective configuration with secrets redacted, then exit",
+	)
+	flag.BoolVar(
+		&cfg.Check,
+		"check",
+		false,
+		"Connect to the meter, read it once, report each step and exit without serving",
+	)
+	flag.BoolVar(
+		&cfg.HelpEnv,
+		"help-env",
+		false,
+		"Print the environment variables with their flags and defaults, then exit",
+	)
+	flag.StringVar(
+		&cfg.EnvPrefix,
+		"env.prefix",
+		envPrefix,
+		"Prefix of the environment variable names (also set by SMARTMETER_ENV_PREFIX)",
+	)
+	cfg.MQTT.bind()
+	cfg.InfluxDB.bind()
+	cfg.LineProtocol.bind()
+	cfg.VictoriaMetrics.bind()
+	cfg.RemoteWrite.bind()
+	cfg.Pushgateway.bind()
+	cfg.Graphite.bind()
+	cfg.StatsD.bind()
+	cfg.CSV.bind()
+	cfg.JSONL.bind()
+	cfg.SQLite.bind()
+	cfg.Postgres.bind()
+	cfg.CloudWatch.bind()
+	cfg.GCM.bind()
+	cfg.NATS.bind()
+	cfg.Webhook.bind()
+	cfg.Zabbix.bind()
+	cfg.Modbus.bind()
+	cfg.Datadog.bind()
+	cfg.EchonetServer.bind()
+	return cfg
+}
+
+// validate は設定値を検証し、派生する値を設定します。
+// 致命的でない不正値は警告を出力してデフォルト値を使用します。
+func (c *config) validate(logger *slog.Logger) error {
+	c.checkInterval(logger)
+	if err := c.validateDurations(); err != nil {
+		return err
+	}
+	// ライブラリのデバッグログも出力されるよう、詳細度を合わせる
+	if c.LogLevel == "debug" && c.Verbosity < 2 {
+		c.Verbosity = 2
+	}
+	switch c.LogTimestamps {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("log timestamps must be auto, always or never: %q", c.LogTimestamps)
+	}
+
+	epcs, err := parseEPCList(c.EPCsStr)
+	if err != nil {
+		return fmt.Errorf("invalid EPC list %q: %w", c.EPCsStr, err)
+	}
+	c.EPCs = epcs
+
+	if err = c.validateMetricsOptions(); err != nil {
+		return err
+	}
+	if err = c.validateOutputs(); err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", c.Timezone, err)
+	}
+	c.Location = loc
+
+	if err := validateMeters(c.File.Meters); err != nil {
+		return err
+	}
+
+	if err := c.loadCredentials(); err != nil {
+		return err
+	}
+	// 設定ファイルで meters を宣言した場合は、/probe のみで動作できる
+	if !c.probeOnly() && (c.BRouteID == "" || c.BRoutePass == "") {
+		return errors.New("ID and Password are required via flags or env vars")
+	}
+	return nil
+}
+
+// probeOnly は、B ルートの ID とパスワードが指定されておらず、設定ファイルで宣言された
+// スマートメーターを /probe で取得するだけの動作かどうかを返します。
+func (c *config) probeOnly() bool {
+	return c.BRouteID == "" && c.BRoutePass == "" && len(c.File.Meters) > 0
+}
+
+// meter はフラグと環境変数で指定されたスマートメーターへの接続設定を返します。
+func (c *config) meter() meterConfig {
+	return meterConfig{
+		Device:   c.DevicePath,
+		ID:       c.BRouteID,
+		Password: c.BRoutePass,
+		Channel:  c.Channel,
+		IPAddr:   c.IPAddr,
+		DSE:      c.UseDSE,
+	}
+}
+
+// validateMeters は設定ファイルで宣言されたスマートメーターの設定を検証します。
+func validateMeters(meters []meterConfig) error {
+	seen := make(map[string]bool, len(meters))
+	for i, m := range meters {
+		switch {
+		case m.Name == "":
+			return fmt.Errorf("meters[%d]: name is required", i)
+		case seen[m.Name]:
+			return fmt.Errorf("meters[%d]: duplicate name %q", i, m.Name)
+		case m.Device == "" || m.ID == "" || m.Password == "":
+			return fmt.Errorf("meters[%d]: device, id and password are required", i)
+		}
+		seen[m.Name] = true
+	}
+	return nil
+}
+
+// parseEPCList は "E7,E8,0xE0" のようなカンマ区切りの EPC の列をパースします。
+func parseEPCList(s string) ([]smartmeter.PropertyCode, error) {
+	var epcs []smartmeter.PropertyCode
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		epc, err := parseEPC(f)
+		if err != nil {
+			return nil, err
+		}
+		epcs = append(epcs, epc)
+	}
+	if len(epcs) == 0 {
+		return nil, errors.New("no EPC specified")
+	}
+	return epcs, nil
+}
+
+// reservedPaths はメトリクス以外に使う HTTP のパスです。/-/、/api/ と /debug/ で始まるパスも使います。
+var reservedPaths = []string{"/probe", "/healthz", "/readyz"}
+
+// validateMetricsOptions はメトリクスの公開に関する設定値を検証します。
+func (c *config) validateMetricsOptions() error {
+	if !strings.HasPrefix(c.MetricsPath, "/") || slices.Contains(reservedPaths, c.MetricsPath) ||
+		strings.HasPrefix(c.MetricsPath, "/-/") || strings.HasPrefix(c.MetricsPath, "/api/") ||
+		strings.HasPrefix(c.MetricsPath, "/debug/") {
+		return fmt.Errorf("invalid telemetry path %q", c.MetricsPath)
+	}
+	if c.GRPCPort != "" && c.GRPCPort == c.ListenPort {
+		return fmt.Errorf("gRPC port must differ from the exporter port: %s", c.GRPCPort)
+	}
+	if err := c.validateWebConfig(); err != nil {
+		return err
+	}
+
+	c.Buckets = prometheus.DefBuckets
+	if c.BucketsStr != "" {
+		buckets, err := parseBuckets(c.BucketsStr)
+		if err != nil {
+			return fmt.Errorf("invalid scrape duration buckets %q: %w", c.BucketsStr, err)
+		}
+		c.Buckets = buckets
+	}
+
+	labels, err := parseLabels(c.LabelPairs)
+	if err != nil {
+		return err
+	}
+	c.Labels = labels
+	return nil
+}
+
+// validateWebConfig は -web.config.file の設定を検証します。
+func (c *config) validateWebConfig() error {
+	tlsConfig, err := c.webTLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid web config: %w", err)
+	}
+	auth, err := c.webBasicAuth()
+	if err != nil {
+		return fmt.Errorf("invalid web config: %w", err)
+	}
+	// gRPC API の Basic 認証の資格情報を平文で送らせない
+	if c.GRPCPort != "" && auth != nil && tlsConfig == nil {
+		return errors.New("basic_auth_users requires tls_server_config when the gRPC API is enabled")
+	}
+	return nil
+}
+
+// outputConfig は出力先の設定です。
+type outputConfig interface {
+	validate() error
+}
+
+// sinkConfigs は sink として動作する出力先の設定です。
+func (c *config) sinkConfigs() []outputConfig {
+	return []outputConfig{
+		&c.MQTT, &c.InfluxDB, &c.LineProtocol, &c.VictoriaMetrics, &c.RemoteWrite,
+		&c.Pushgateway, &c.Graphite, &c.StatsD, &c.CSV, &c.JSONL, &c.SQLite, &c.Postgres,
+		&c.CloudWatch, &c.GCM, &c.NATS, &c.Webhook, &c.Zabbix, &c.Modbus, &c.Datadog,
+	}
+}
+
+// validateOutputs は Prometheus 以外の出力先の設定値を検証します。
+func (c *config) validateOutputs() error {
+	for _, o := range append(c.sinkConfigs(), &c.EchonetServer) {
+		if err := o.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultInterval と minInterval は取得間隔の既定値と最小値です。
+const (
+	defaultInterval = time.Minute
+	minInterval     = 10 * time.Second
+)
+
+// checkInterval は取得間隔が短すぎる場合に警告を出力し、既定値を使用します。
+func (c *config) checkInterval(logger *slog.Logger) {
+	if c.Interval >= minInterval {
+		return
+	}
+	logger.Warn("Interval is too short, using default",
+		"interval", c.Interval.String(), "minimum", minInterval.String(),
+		"default", defaultInterval.String())
+	c.Interval = defaultInterval
+}
+
+// validateDurations は時間の設定値の範囲を検証します。
+func (c *config) validateDurations() error {
+	if c.FixedTimeDelay < 0 || c.FixedTimeDelay >= 30*time.Minute {
+		return fmt.Errorf("fixed-time delay must be between 0 and 30m: %s", c.FixedTimeDelay)
+	}
+	if c.Staleness < 0 {
+		return fmt.Errorf("staleness must not be negative: %s", c.Staleness)
+	}
+	if c.MaxCacheAge < 0 {
+		return fmt.Errorf("max cache age must not be negative: %s", c.MaxCacheAge)
+	}
+	if c.PANALifetime <= 0 {
+		return fmt.Errorf("PANA lifetime must be positive: %s", c.PANALifetime)
+	}
+	if c.QueryAttempts < 1 {
+		return fmt.Errorf("query attempts must be at least 1: %d", c.QueryAttempts)
+	}
+	if c.QueryRetryInterval < 0 || c.QueryTimeout < 0 {
+		return errors.New("query retry interval and timeout must not be negative")
+	}
+	if c.ReAuthCooldown < 0 || c.PostAuthCooldown < 0 {
+		return errors.New("re-auth cooldowns must not be negative")
+	}
+	if c.INFPollInterval < 0 {
+		return fmt.Errorf("INF poll interval must not be negative: %s", c.INFPollInterval)
+	}
+	if c.APIHistoryRetention < 0 {
+		return fmt.Errorf("API history retention must not be negative: %s", c.APIHistoryRetention)
+	}
+	if c.ReadinessIntervals < 1 {
+		return fmt.Errorf("readiness intervals must be at least 1: %d", c.ReadinessIntervals)
+	}
+	return nil
+}
+
+// parseBuckets は "5,10,30" のようなカンマ区切りのヒストグラムのバケット上限をパースします。
+// 上限は昇順である必要があります。
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", f)
+		}
+		if len(buckets) > 0 && v <= buckets[len(buckets)-1] {
+			return nil, errors.New("buckets must be in increasing order")
+		}
+		buckets = append(buckets, v)
+	}
+	if len(buckets) == 0 {
+		return nil, errors.New("no bucket specified")
+	}
+	return buckets, nil
+}
+
+// parseEPC は "E7" または "0xE7" 形式の EPC をパースします。
+func parseEPC(s string) (smartmeter.PropertyCode, error) {
+	h := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	v, err := strconv.ParseUint(h, 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EPC %q", s)
+	}
+	return smartmeter.PropertyCode(v), nil
+}
+
+// formatEPCList は EPC の列を "E7,E8,E0" のようなカンマ区切りの文字列に変換します。
+func formatEPCList(epcs []smartmeter.PropertyCode) string {
+	s := make([]string, len(epcs))
+	for i, epc := range epcs {
+		s[i] = fmt.Sprintf("%02X", epc)
+	}
+	return strings.Join(s, ",")
+}
+
+// defaultEnvPrefix は環境変数の名前の既定の接頭辞です。
+const defaultEnvPrefix = "SMARTMETER_"
+
+// envPrefix は環境変数の名前の接頭辞です。
+// 1つのプロセス管理の下で設定の異なる複数のエクスポーターを動かす場合に変更します。
+var envPrefix = defaultEnvPrefix
+
+// envPrefixPattern は環境変数の名前の接頭辞に使える文字列です。
+var envPrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// setEnvPrefix はコマンドライン引数の -env.prefix (なければ環境変数 SMARTMETER_ENV_PREFIX) から
+// 環境変数の名前の接頭辞を設定します。環境変数の読み込みより前に決める必要があるため、フラグのパースより前に取り出します。
+// 末尾に "_" がない場合は補います。
+func setEnvPrefix(args []string) error {
+	prefix, ok := flagArg(args, "env.prefix")
+	if !ok {
+		prefix, _ = lookupEnv(defaultEnvPrefix + "ENV_PREFIX")
+	}
+	if prefix == "" {
+		envPrefix = defaultEnvPrefix
+		return nil
+	}
+	if !envPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid environment variable prefix %q", prefix)
+	}
+	if !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+	envPrefix = prefix
+	return nil
+}
+
+// envName は SMARTMETER_ で始まる環境変数の名前の接頭辞を envPrefix に置き換えます。
+func envName(key string) string {
+	if rest, ok := strings.CutPrefix(key, defaultEnvPrefix); ok {
+		return envPrefix + rest
+	}
+	return key
+}
+
+// lookupEnv は環境変数を参照します。
+// 設定ファイルの適用時に、環境変数を参照しない既定値を求めるために置き換えます。
+var lookupEnv = os.LookupEnv
+
+func getEnv(key, defaultVal string) string {
+	if val, _ := lookupEnv(envName(key)); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+// getEnvBool は環境変数が "true" または "1" の場合に true を返します。
+func getEnvBool(key string) bool {
+	v := getEnv(key, "")
+	return v == "true" || v == "1"
+}
+
+// envErrors は newConfig で見つかった環境変数の誤りです。loadConfig で報告します。
+var envErrors []error
+
+// getEnvDuration は環境変数を parseDuration でパースします。
+// 未設定の場合は defaultVal を返します。パースできない場合は envErrors に追加します。
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultVal
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("invalid %s %q: %w", envName(key), v, err))
+		return defaultVal
+	}
+	return d
+}
+
+// getEnvInt は環境変数を整数としてパースします。
+// 未設定の場合は defaultVal を返します。パースできない場合は envErrors に追加します。
+func getEnvInt(key string, defaultVal int) int {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("invalid %s %q: %w", envName(key), v, err))
+		return defaultVal
+	}
+	return i
+}
+
+// parseDuration は "90s" や "5m" のような Go の duration 形式、または単位のない秒数をパースします。
+// 単位のない秒数は以前の -interval との互換性のために受け付けます。
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if sec, err := strconv.Atoi(s); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New(
+			"use a duration with a unit such as 90s, 5m or 1h30m, or a number of seconds")
+	}
+	return d, nil
+}
+
+// durationValue は parseDuration でパースするフラグの値です。
+type durationValue time.Duration
+
+func (d *durationValue) Set(s string) error {
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// logLevelValue は -log.level のフラグの値です。parseLogLevel で解釈できる値のみ受け付けます。
+type logLevelValue struct {
+	level *string
+}
+
+func (v *logLevelValue) Set(s string) error {
+	if _, err := parseLogLevel(s); err != nil {
+		return err
+	}
+	*v.level = strings.ToLower(s)
+	return nil
+}
+
+func (v *logLevelValue) String() string {
+	if v.level == nil {
+		return ""
+	}
+	return *v.level
+}
+
+// durationVar は flag.DurationVar と同様に duration のフラグを登録します。単位のない秒数も受け付けます。
+func durationVar(p *time.Duration, name string, value time.Duration, usage string) {
+	*p = value
+	flag.Var((*durationValue)(p), name, usage)
+}
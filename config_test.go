@@ -0,0 +1,284 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+func TestParseEPCList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []smartmeter.PropertyCode
+		wantErr bool
+	}{
+		{"E7", []smartmeter.PropertyCode{0xE7}, false},
+		{"E7,E8,0xE0", []smartmeter.PropertyCode{0xE7, 0xE8, 0xE0}, false},
+		{" e7 , 0Xea ,", []smartmeter.PropertyCode{0xE7, 0xEA}, false},
+		{"", nil, true},
+		{",", nil, true},
+		{"E7,ZZ", nil, true},
+		{"100", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseEPCList(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEPCList(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseEPCList(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatEPCList(t *testing.T) {
+	epcs := []smartmeter.PropertyCode{0xE7, 0x08, 0xEA}
+	if got, want := formatEPCList(epcs), "E7,08,EA"; got != want {
+		t.Errorf("formatEPCList() = %q, want %q", got, want)
+	}
+	// 書式化した結果はパースし直せる
+	back, err := parseEPCList(formatEPCList(epcs))
+	if err != nil || !slices.Equal(back, epcs) {
+		t.Errorf("parseEPCList(formatEPCList()) = %v, %v, want %v", back, err, epcs)
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{"5,10,30", []float64{5, 10, 30}, false},
+		{" 0.5, 1 ,", []float64{0.5, 1}, false},
+		{"10,5", nil, true},
+		{"5,5", nil, true},
+		{"5,x", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseBuckets(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBuckets(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseBuckets(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"90s", 90 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"60", time.Minute, false},
+		{" 5m ", 5 * time.Minute, false},
+		{"0", 0, false},
+		{"5 minutes", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseDuration(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDuration(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDurations(t *testing.T) {
+	valid := func() *config {
+		return &config{
+			Interval:           time.Minute,
+			FixedTimeDelay:     time.Minute,
+			PANALifetime:       2 * time.Hour,
+			QueryAttempts:      3,
+			ReadinessIntervals: 3,
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(c *config)
+		wantErr bool
+	}{
+		{"defaults", func(*config) {}, false},
+		{"fixed-time delay too long", func(c *config) { c.FixedTimeDelay = 30 * time.Minute }, true},
+		{"negative staleness", func(c *config) { c.Staleness = -time.Second }, true},
+		{"no query attempts", func(c *config) { c.QueryAttempts = 0 }, true},
+		{"negative INF poll interval", func(c *config) { c.INFPollInterval = -time.Second }, true},
+		{"no readiness intervals", func(c *config) { c.ReadinessIntervals = 0 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			if err := c.validateDurations(); (err != nil) != tt.wantErr {
+				t.Errorf("validateDurations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{90 * time.Second, 90 * time.Second},
+		{minInterval, minInterval},
+		// 短すぎる間隔は起動を止めずに既定値にする
+		{5 * time.Second, defaultInterval},
+		{0, defaultInterval},
+	}
+	for _, tt := range tests {
+		c := &config{Interval: tt.interval}
+		c.checkInterval(testLogger)
+		if c.Interval != tt.want {
+			t.Errorf("checkInterval() with %s = %s, want %s", tt.interval, c.Interval, tt.want)
+		}
+	}
+}
+
+// stubEnv はテストの間だけ環境変数の参照先を env に置き換え、環境変数の誤りと接頭辞を初期化します。
+func stubEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	savedLookup, savedErrors, savedPrefix := lookupEnv, envErrors, envPrefix
+	lookupEnv = func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	envErrors, envPrefix = nil, defaultEnvPrefix
+	t.Cleanup(func() {
+		lookupEnv, envErrors, envPrefix = savedLookup, savedErrors, savedPrefix
+	})
+}
+
+func TestGetEnvBool(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"true", true},
+		{"1", true},
+		{"false", false},
+		{"0", false},
+		{"yes", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		stubEnv(t, map[string]string{"SMARTMETER_BACKFILL": tt.value})
+		if got := getEnvBool("SMARTMETER_BACKFILL"); got != tt.want {
+			t.Errorf("getEnvBool() with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"unset", nil, 3, false},
+		{"empty", map[string]string{"SMARTMETER_QUERY_ATTEMPTS": ""}, 3, false},
+		{"set", map[string]string{"SMARTMETER_QUERY_ATTEMPTS": "5"}, 5, false},
+		{"invalid", map[string]string{"SMARTMETER_QUERY_ATTEMPTS": "five"}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubEnv(t, tt.env)
+			if got := getEnvInt("SMARTMETER_QUERY_ATTEMPTS", 3); got != tt.want {
+				t.Errorf("getEnvInt() = %d, want %d", got, tt.want)
+			}
+			if (len(envErrors) > 0) != tt.wantErr {
+				t.Errorf("envErrors = %v, wantErr %v", envErrors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"unset", "", time.Minute, false},
+		{"duration", "90s", 90 * time.Second, false},
+		{"seconds", "30", 30 * time.Second, false},
+		{"invalid", "soon", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubEnv(t, map[string]string{"SMARTMETER_INTERVAL": tt.value})
+			if got := getEnvDuration("SMARTMETER_INTERVAL", time.Minute); got != tt.want {
+				t.Errorf("getEnvDuration() = %v, want %v", got, tt.want)
+			}
+			if (len(envErrors) > 0) != tt.wantErr {
+				t.Errorf("envErrors = %v, wantErr %v", envErrors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetEnvPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"default", nil, nil, "SMARTMETER_", false},
+		{"flag", []string{"-env.prefix", "METER2"}, nil, "METER2_", false},
+		{"flag with value", []string{"--env.prefix=METER2_"}, nil, "METER2_", false},
+		{"environment", nil, map[string]string{"SMARTMETER_ENV_PREFIX": "HOUSE"}, "HOUSE_", false},
+		{
+			"flag overrides environment",
+			[]string{"-env.prefix=METER2"},
+			map[string]string{"SMARTMETER_ENV_PREFIX": "HOUSE"},
+			"METER2_",
+			false,
+		},
+		{"invalid", []string{"-env.prefix=METER-2"}, nil, "SMARTMETER_", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubEnv(t, tt.env)
+			err := setEnvPrefix(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setEnvPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if envPrefix != tt.want {
+				t.Errorf("envPrefix = %q, want %q", envPrefix, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvNameWithPrefix(t *testing.T) {
+	stubEnv(t, map[string]string{"METER2_INTERVAL": "2m", "SMARTMETER_INTERVAL": "1m"})
+	envPrefix = "METER2_"
+	if got := envName("SMARTMETER_INTERVAL"); got != "METER2_INTERVAL" {
+		t.Errorf("envName() = %q, want METER2_INTERVAL", got)
+	}
+	if got := getEnvDuration("SMARTMETER_INTERVAL", time.Minute); got != 2*time.Minute {
+		t.Errorf("getEnvDuration() = %v, want 2m", got)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// fileConfig は設定ファイルのうち、フラグに対応しない構造化された設定です。
+type fileConfig struct {
+	CustomMetrics []customMetricConfig `yaml:"custom_metrics"`
+	Meters        []meterConfig        `yaml:"meters"`
+}
+
+// fileConfigKeys は設定ファイルで fileConfig に読み込むキーです。その他のキーはフラグ名です。
+var fileConfigKeys = []string{"custom_metrics", "meters"}
+
+// configFile は設定ファイル (YAML または TOML) の内容です。
+type configFile struct {
+	// settings はフラグ名と値 (リストの場合は各要素) の対応です。
+	settings map[string][]string
+	file     fileConfig
+}
+
+// configFilePath はコマンドライン引数の -config.file (なければ環境変数) から設定ファイルのパスを返します。
+// 設定ファイルの値はフラグの既定値になるため、フラグのパースより前に取り出します。
+func configFilePath(args []string) string {
+	if path, ok := flagArg(args, "config.file"); ok {
+		return path
+	}
+	return getEnv("SMARTMETER_CONFIG_FILE", "")
+}
+
+// flagArg はフラグのパースより前に、コマンドライン引数から -name の値を取り出します。
+// 複数指定された場合は最後の値を返します。
+func flagArg(args []string, name string) (string, bool) {
+	var value string
+	found := false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		n, v, hasValue := strings.Cut(strings.TrimPrefix(a[1:], "-"), "=")
+		if n != name {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			v = args[i]
+		}
+		value, found = v, true
+	}
+	return value, found
+}
+
+// readConfigFile は設定ファイルを読み込みます。拡張子が .toml の場合は TOML、それ以外は YAML です。
+func readConfigFile(path string) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	var doc map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		doc, err = parseTOML(string(b))
+	} else {
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	cf := &configFile{settings: make(map[string][]string)}
+	structured := make(map[string]interface{})
+	for k, v := range doc {
+		if slices.Contains(fileConfigKeys, k) {
+			structured[k] = v
+			continue
+		}
+		if err = cf.flatten(k, v); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	if len(structured) > 0 {
+		// 構造化された設定は YAML に戻して未知のキーを検出する
+		b, err = yaml.Marshal(structured)
+		if err == nil {
+			err = yaml.UnmarshalStrict(b, &cf.file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+	return cf, nil
+}
+
+// flatten は入れ子の値を "mqtt.url" のような "." 区切りのフラグ名に展開します。
+func (cf *configFile) flatten(key string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			if err := cf.flatten(key+"."+k, vv); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, vv := range v {
+			if err := cf.flatten(key+"."+fmt.Sprint(k), vv); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := configScalar(key, e)
+			if err != nil {
+				return err
+			}
+			values = append(values, s)
+		}
+		cf.settings[key] = values
+	default:
+		s, err := configScalar(key, v)
+		if err != nil {
+			return err
+		}
+		cf.settings[key] = []string{s}
+	}
+	return nil
+}
+
+// configScalar は設定ファイルのスカラー値をフラグの値の文字列に変換します。
+func configScalar(key string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value for %s", key)
+	}
+}
+
+// apply は設定ファイルの値をフラグに設定します。
+// defaults はフラグの本来の既定値で、既定値が環境変数で変更されているフラグには設定しません。
+// コマンドラインフラグは apply の後にパースするため、設定ファイルより優先されます。
+func (cf *configFile) apply(defaults map[string]string) error {
+	names := make([]string, 0, len(cf.settings))
+	for name := range cf.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config.file" || name == "env.prefix" {
+			return fmt.Errorf("unknown setting %q in config file", name)
+		}
+		if f.DefValue != defaults[name] {
+			continue
+		}
+		values := cf.settings[name]
+		if lf, ok := f.Value.(*labelFlag); ok {
+			for _, v := range values {
+				if err := lf.Set(v); err != nil {
+					return fmt.Errorf("invalid value %q for %s in config file: %w", v, name, err)
+				}
+			}
+			// コマンドラインで指定された場合は設定ファイルの値を置き換える
+			lf.set = false
+			continue
+		}
+		// リストはカンマ区切りの値として設定する
+		v := strings.Join(values, ",")
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("invalid value %q for %s in config file: %w", v, name, err)
+		}
+	}
+	return nil
+}
+
+// flagDefaults は環境変数を参照しない場合のフラグの既定値を返します。
+func flagDefaults() map[string]string {
+	defaults := make(map[string]string)
+	newFlagSet(func(string) (string, bool) { return "", false }).VisitAll(func(f *flag.Flag) {
+		defaults[f.Name] = f.DefValue
+	})
+	return defaults
+}
+
+// newFlagSet は環境変数を lookup で参照して newConfig を呼び、登録されたフラグを返します。
+// flag.CommandLine と環境変数の参照は元に戻します。
+func newFlagSet(lookup func(string) (string, bool)) *flag.FlagSet {
+	commandLine, env := flag.CommandLine, lookupEnv
+	defer func() { flag.CommandLine, lookupEnv = commandLine, env }()
+	flag.CommandLine = flag.NewFlagSet(commandLine.Name(), flag.ContinueOnError)
+	lookupEnv = lookup
+
+	newConfig()
+	return flag.CommandLine
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// credentialCommandTimeout は B ルート ID とパスワードを取得するコマンドのタイムアウトです。
+const credentialCommandTimeout = 30 * time.Second
+
+// loadCredentials は B ルート ID とパスワードを、ファイル、コマンド、OS のキーリングのうち
+// 指定されたものから読み込みます。前後の空白と改行は取り除きます。
+// キーリングは、値、ファイル、コマンドのいずれも指定されていない場合にのみ使います。
+func (c *config) loadCredentials() error {
+	for _, cred := range []struct {
+		name, account string
+		value         *string
+		file, command string
+	}{
+		{"ID", "id", &c.BRouteID, c.IDFile, c.IDCommand},
+		{"password", "password", &c.BRoutePass, c.PasswordFile, c.PasswordCommand},
+	} {
+		sources := 0
+		for _, v := range []string{*cred.value, cred.file, cred.command} {
+			if v != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return fmt.Errorf("B-route %s must be given by only one of value, file and command",
+				cred.name)
+		}
+		var err error
+		switch {
+		case cred.file != "":
+			var b []byte
+			if b, err = os.ReadFile(cred.file); err != nil {
+				return fmt.Errorf("read B-route %s file: %w", cred.name, err)
+			}
+			*cred.value = strings.TrimSpace(string(b))
+		case cred.command != "":
+			if *cred.value, err = runShellCommand(cred.command); err != nil {
+				return fmt.Errorf("B-route %s command: %w", cred.name, err)
+			}
+		case *cred.value == "" && c.Keyring:
+			if *cred.value, err = readKeyring(c.KeyringService, cred.account); err != nil {
+				return fmt.Errorf("read B-route %s from keyring: %w", cred.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runShellCommand はシェルでコマンドを実行し、標準出力を返します。
+func runShellCommand(command string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return runCommand("cmd", "/C", command)
+	}
+	return runCommand("sh", "-c", command)
+}
+
+// readKeyring は OS のキーリングから service と account に対応するパスワードを読み込みます。
+// macOS はキーチェーン (security コマンド)、その他は Secret Service (libsecret の secret-tool コマンド) を使います。
+func readKeyring(service, account string) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return runCommand("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "windows":
+		return "", errors.New("OS keyring is not supported on Windows")
+	default:
+		return runCommand("secret-tool", "lookup", "service", service, "account", account)
+	}
+}
+
+// runCommand はコマンドを実行し、前後の空白を取り除いた標準出力を返します。
+// 失敗した場合は標準エラー出力をエラーに含めます。
+func runCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "" {
+		return "", errors.New("no output")
+	}
+	return v, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// csvHeader は CSV ファイルの列です。
+var csvHeader = []string{
+	"timestamp", "power_watts", "current_r_amperes", "current_t_amperes",
+	"energy_consumed_kwh", "energy_exported_kwh",
+}
+
+// csvConfig は CSV ファイルへの記録の設定です。
+type csvConfig struct {
+	Dir string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *csvConfig) bind() {
+	c.Dir = getEnv("SMARTMETER_CSV_DIR", "")
+
+	flag.StringVar(&c.Dir, "csv.dir", c.Dir,
+		"Directory to append readings to as daily CSV files (smartmeter-YYYY-MM-DD.csv)")
+}
+
+func (c *csvConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+// validate は CSV ファイルへの記録の設定値を検証します。
+func (c *csvConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	fi, err := os.Stat(c.Dir)
+	if err != nil {
+		return fmt.Errorf("invalid CSV directory: %w", err)
+	}
+	if !fi.IsDir() {
+		return errors.New("CSV directory is not a directory: " + c.Dir)
+	}
+	return nil
+}
+
+// csvSink は取得値を日毎の CSV ファイルに追記します。
+// 日付は -timezone のタイムゾーンで判定し、ファイルの作成時にヘッダー行を書き込みます。
+// 外部からのファイルの移動や削除に対応するため、書き込み毎にファイルを開き直します。
+type csvSink struct {
+	dir string
+	loc *time.Location
+}
+
+func newCSVSink(cfg *csvConfig, loc *time.Location) (*csvSink, error) {
+	return &csvSink{dir: cfg.Dir, loc: loc}, nil
+}
+
+func (s *csvSink) publish(_ context.Context, r *reading) error {
+	record := csvRecord(r, s.loc)
+	if record == nil {
+		return nil // 定時積算電力量のみの取得値は記録しない
+	}
+	name := filepath.Join(s.dir, "smartmeter-"+r.Time.In(s.loc).Format(time.DateOnly)+".csv")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w := csv.NewWriter(f)
+	if fi.Size() == 0 {
+		_ = w.Write(csvHeader)
+	}
+	_ = w.Write(record)
+	w.Flush()
+	if err = w.Error(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *csvSink) close() error {
+	return nil
+}
+
+// csvRecord は取得値を CSV の1行に変換します。記録する値が1つもない場合は nil を返します。
+func csvRecord(r *reading, loc *time.Location) []string {
+	values := []*float64{
+		r.PowerWatts, r.CurrentRAmperes, r.CurrentTAmperes,
+		r.EnergyConsumedKWh, r.EnergyExportedKWh,
+	}
+	record := []string{r.Time.In(loc).Format(time.RFC3339)}
+	var found bool
+	for _, v := range values {
+		if v == nil {
+			record = append(record, "")
+			continue
+		}
+		found = true
+		record = append(record, strconv.FormatFloat(*v, 'f', -1, 64))
+	}
+	if !found {
+		return nil
+	}
+	return record
+}
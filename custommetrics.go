@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// customMetricConfig は設定ファイルで宣言する任意の EPC とメトリクスの対応です。
+// EDT の Offset バイト目から Width バイトを整数としてデコードし、Scale 倍した値を設定します。
+type customMetricConfig struct {
+	EPC    string            `yaml:"epc"`
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Labels map[string]string `yaml:"labels"`
+	Offset int               `yaml:"offset"`
+	Width  int               `yaml:"width"`
+	Signed bool              `yaml:"signed"`
+	Scale  float64           `yaml:"scale"`
+}
+
+// customMetric はデコード方法と出力先のメトリクスを解決済みのカスタムメトリクスです。
+type customMetric struct {
+	epc         smartmeter.PropertyCode
+	offset      int
+	width       int
+	signed      bool
+	scale       float64
+	gauge       *prometheus.GaugeVec
+	labelValues []string
+}
+
+// customMetrics は設定ファイルで宣言されたカスタムメトリクスです。
+var customMetrics []*customMetric
+
+// setupCustomMetrics は設定からカスタムメトリクスを生成し、メトリクスを登録します。
+// 同じ名前のメトリクスは、同じラベル名の組を持つ必要があります。
+func setupCustomMetrics(configs []customMetricConfig) ([]*customMetric, error) {
+	gauges := map[string]*prometheus.GaugeVec{}
+	labelNames := map[string][]string{}
+
+	metrics := make([]*customMetric, 0, len(configs))
+	for i, c := range configs {
+		m, err := newCustomMetric(c)
+		if err != nil {
+			return nil, fmt.Errorf("custom_metrics[%d]: %w", i, err)
+		}
+
+		names := make([]string, 0, len(c.Labels))
+		for k := range c.Labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			m.labelValues = append(m.labelValues, c.Labels[k])
+		}
+
+		if g, ok := gauges[c.Name]; ok {
+			if !slices.Equal(labelNames[c.Name], names) {
+				return nil, fmt.Errorf("custom_metrics[%d]: inconsistent labels for %s", i, c.Name)
+			}
+			m.gauge = g
+		} else {
+			help := c.Help
+			if help == "" {
+				help = fmt.Sprintf("ECHONET Lite property 0x%02X", m.epc)
+			}
+			g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: c.Name, Help: help}, names)
+			if err := prometheus.Register(g); err != nil {
+				return nil, fmt.Errorf("custom_metrics[%d]: %w", i, err)
+			}
+			gauges[c.Name] = g
+			labelNames[c.Name] = names
+			m.gauge = g
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func newCustomMetric(c customMetricConfig) (*customMetric, error) {
+	epc, err := parseEPC(c.EPC)
+	if err != nil {
+		return nil, err
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	width := c.Width
+	if width == 0 {
+		width = 4
+	}
+	if width != 1 && width != 2 && width != 4 {
+		return nil, fmt.Errorf("unsupported width: %d", width)
+	}
+	if c.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset: %d", c.Offset)
+	}
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return &customMetric{
+		epc:    epc,
+		offset: c.Offset,
+		width:  width,
+		signed: c.Signed,
+		scale:  scale,
+	}, nil
+}
+
+// customMetricEPCs はカスタムメトリクスが必要とする EPC を重複なく返します。
+func customMetricEPCs(metrics []*customMetric) []smartmeter.PropertyCode {
+	var epcs []smartmeter.PropertyCode
+	for _, m := range metrics {
+		if !slices.Contains(epcs, m.epc) {
+			epcs = append(epcs, m.epc)
+		}
+	}
+	return epcs
+}
+
+// setCustomMetrics はレスポンスのプロパティからカスタムメトリクスを更新し、更新した数を返します。
+func setCustomMetrics(props []*smartmeter.Property, logger *slog.Logger) int {
+	updated := 0
+	for _, p := range props {
+		for _, m := range customMetrics {
+			if m.epc != p.EPC {
+				continue
+			}
+			v, ok, err := m.decode(p.EDT)
+			if err != nil {
+				logger.Warn("Failed to decode custom metric", "epc", epcLabel(m.epc), "error", err)
+				continue
+			}
+			if !ok {
+				invalidValues.WithLabelValues(epcLabel(m.epc)).Inc()
+				continue
+			}
+			m.gauge.WithLabelValues(m.labelValues...).Set(v)
+			updated++
+		}
+	}
+	return updated
+}
+
+// decode は EDT から値をデコードします。ECHONET Lite の特殊値 (オーバーフロー、データなし等)
+// の場合は ok に false を返します。
+func (m *customMetric) decode(edt []byte) (float64, bool, error) {
+	if len(edt) < m.offset+m.width {
+		return 0, false, fmt.Errorf("EDT too short: %d bytes", len(edt))
+	}
+	b := edt[m.offset : m.offset+m.width]
+
+	var u uint64
+	switch m.width {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		u = uint64(binary.BigEndian.Uint32(b))
+	}
+
+	bits := uint(m.width * 8)
+	if !m.signed {
+		// 符号なし: 最大値 (オーバーフロー) と最大値-1 (データなし)
+		if u >= 1<<bits-2 {
+			return 0, false, nil
+		}
+		return float64(u) * m.scale, true, nil
+	}
+	// 符号付き: 最大値 (オーバーフロー)、最大値-1 (データなし)、最小値 (アンダーフロー)
+	v := int64(u<<(64-bits)) >> (64 - bits)
+	maxVal := int64(1)<<(bits-1) - 1
+	if v == maxVal || v == maxVal-1 || v == -maxVal-1 {
+		return 0, false, nil
+	}
+	return float64(v) * m.scale, true, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 当日0時からの積算電力量 (kWh)
+var energyTodayGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "smartmeter_energy_today_kwh",
+	Help: "Electric energy consumed since local midnight in kWh",
+})
+
+func init() {
+	prometheus.MustRegister(energyTodayGauge)
+}
+
+// dailyEnergyTracker は当日0時 (loc のタイムゾーン) の積算電力量を基準として、
+// 当日の使用電力量を計算します。
+type dailyEnergyTracker struct {
+	loc      *time.Location
+	day      time.Time // 基準とする日の0時
+	baseline float64   // 基準日0時時点の積算電力量 (kWh)
+	valid    bool
+}
+
+// dailyEnergy は当日の使用電力量の計算状態です。
+var dailyEnergy = &dailyEnergyTracker{loc: meterLocation}
+
+// update は取得した積算電力量 (正方向) から当日の使用電力量を更新します。
+// 日付が変わった場合や起動直後は、スマートメーターの履歴 (EPC 0xE2) から
+// 0時時点の値を取得して基準とします。履歴が取得できない場合は現在値を基準とします。
+func (d *dailyEnergyTracker) update(dev *smartmeter.Device, r *reading, logger *slog.Logger) {
+	if r.EnergyConsumedKWh == nil {
+		return
+	}
+	current := *r.EnergyConsumedKWh
+
+	y, m, day := r.Time.In(d.loc).Date()
+	midnight := time.Date(y, m, day, 0, 0, 0, 0, d.loc)
+	if !d.valid || !d.day.Equal(midnight) {
+		d.day = midnight
+		d.baseline = current
+		if kwh, ok := midnightEnergy(dev, midnight, r.Time, logger); ok {
+			d.baseline = kwh
+		} else {
+			logger.Info("Using current cumulative energy as today's baseline", "day", midnight)
+		}
+		d.valid = true
+	}
+
+	today := current - d.baseline
+	if today < 0 {
+		// 積算電力量が減った場合 (メーターの異常など) は、現在値を基準にし直す
+		logger.Warn("Cumulative energy is below today's baseline, resetting the baseline",
+			"baseline", d.baseline, "current", current)
+		d.baseline, today = current, 0
+	}
+	energyTodayGauge.Set(today)
+}
+
+// midnightEnergy はスマートメーターの積算電力量計測値履歴から midnight 時点の積算電力量 (kWh) を取得します。
+func midnightEnergy(
+	dev *smartmeter.Device,
+	midnight, now time.Time,
+	logger *slog.Logger,
+) (float64, bool) {
+	if energyUnitKWh == 0 {
+		return 0, false
+	}
+	points, err := queryEnergyHistory(dev, daysBetween(midnight, now), now)
+	if err != nil {
+		logger.Warn("Failed to read history for today's baseline", "error", err)
+		return 0, false
+	}
+	return historyEnergyAt(points, midnight)
+}
+
+// historyEnergyAt は積算電力量計測値履歴から時刻 t の積算電力量 (kWh) を返します。
+// 取得値 (reading) と比較できるよう、履歴の値も桁あふれを補正します。
+func historyEnergyAt(points []historyPoint, t time.Time) (float64, bool) {
+	for _, p := range points {
+		if p.Time.Equal(t) {
+			counter := energyCounters[epcCumulativeEnergyNormal]
+			return float64(counter.unwrap(p.Value, energyModulus())) * energyUnitKWh, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue はゲージの現在値を返します。
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestDailyEnergyTrackerUpdate(t *testing.T) {
+	midnight := time.Date(2025, 10, 16, 0, 0, 0, 0, meterLocation)
+	noon := midnight.Add(12 * time.Hour)
+	tests := []struct {
+		name         string
+		baseline     float64
+		current      float64
+		at           time.Time
+		want         float64
+		wantBaseline float64
+	}{
+		{"same day", 1000, 1012.5, noon, 12.5, 1000},
+		{"after rollover", 99990, 100010.5, noon, 20.5, 99990},
+		{"decreased", 1000, 900, noon, 0, 900},
+		// 履歴を取得できない (単位が未取得) 場合は現在値を基準にする
+		{"next day", 1000, 1030, noon.Add(24 * time.Hour), 0, 1030},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnergyScale(t, 0, 0)
+			d := &dailyEnergyTracker{loc: meterLocation, day: midnight, baseline: tt.baseline, valid: true}
+			d.update(nil, &reading{Time: tt.at, EnergyConsumedKWh: ptr(tt.current)}, testLogger)
+			if got := gaugeValue(t, energyTodayGauge); !almostEqual(got, tt.want) {
+				t.Errorf("smartmeter_energy_today_kwh = %v, want %v", got, tt.want)
+			}
+			if !almostEqual(d.baseline, tt.wantBaseline) {
+				t.Errorf("baseline = %v, want %v", d.baseline, tt.wantBaseline)
+			}
+		})
+	}
+}
+
+func TestDailyEnergyTrackerIgnoresMissingEnergy(t *testing.T) {
+	energyTodayGauge.Set(42)
+	d := &dailyEnergyTracker{loc: meterLocation}
+	d.update(nil, &reading{Time: time.Now()}, testLogger)
+	if d.valid {
+		t.Error("valid = true after a reading without cumulative energy")
+	}
+	if got := gaugeValue(t, energyTodayGauge); got != 42 {
+		t.Errorf("smartmeter_energy_today_kwh = %v, want unchanged 42", got)
+	}
+}
+
+func TestHistoryEnergyAt(t *testing.T) {
+	midnight := time.Date(2025, 10, 16, 0, 0, 0, 0, meterLocation)
+	points := []historyPoint{
+		{Time: midnight.Add(-30 * time.Minute), Value: 999980},
+		{Time: midnight, Value: 999990},
+		{Time: midnight.Add(30 * time.Minute), Value: 5},
+	}
+	tests := []struct {
+		name    string
+		updates []uint32
+		at      time.Time
+		want    float64
+		wantOK  bool
+	}{
+		{"before rollover", []uint32{999995}, midnight, 99999.0, true},
+		// 0時以降に桁あふれした場合も、補正済みの現在値と同じ基準で比較できる
+		{"after rollover", []uint32{999995, 20}, midnight, 99999.0, true},
+		{"measured after rollover", []uint32{999995, 20}, midnight.Add(30 * time.Minute), 100000.5, true},
+		{"missing", []uint32{999995}, midnight.Add(time.Hour), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnergyScale(t, 0.1, 6)
+			for _, v := range tt.updates {
+				energyCounters[epcCumulativeEnergyNormal].update(v, energyModulus(), testLogger)
+			}
+			got, ok := historyEnergyAt(points, tt.at)
+			if ok != tt.wantOK || !almostEqual(got, tt.want) {
+				t.Errorf("historyEnergyAt() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
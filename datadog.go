@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// datadogGauge は Datadog の metrics API (v2) のメトリクスの種類のゲージです。
+const datadogGauge = 3
+
+// datadogConfig は Datadog への送信の設定です。
+type datadogConfig struct {
+	APIKey      string
+	Site        string
+	Prefix      string
+	Host        string
+	TagPairs    []string
+	BatchSize   int
+	MaxBuffered int
+
+	// validate で設定される
+	Tags []string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *datadogConfig) bind() {
+	c.APIKey = getEnv("SMARTMETER_DATADOG_API_KEY", "")
+	c.Site = getEnv("SMARTMETER_DATADOG_SITE", "datadoghq.com")
+	c.Prefix = getEnv("SMARTMETER_DATADOG_PREFIX", "smartmeter.")
+	c.Host = getEnv("SMARTMETER_DATADOG_HOST", "")
+	c.BatchSize = getEnvInt("SMARTMETER_DATADOG_BATCH_SIZE", 1)
+	c.MaxBuffered = getEnvInt("SMARTMETER_DATADOG_MAX_BUFFERED", 60)
+	if v := getEnv("SMARTMETER_DATADOG_TAGS", ""); v != "" {
+		c.TagPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.APIKey, "datadog.api-key", c.APIKey,
+		"Datadog API key to submit readings to the Datadog metrics API")
+	flag.StringVar(&c.Site, "datadog.site", c.Site,
+		"Datadog site (e.g. datadoghq.com, datadoghq.eu, ap1.datadoghq.com)")
+	flag.StringVar(&c.Prefix, "datadog.prefix", c.Prefix, "Prefix of Datadog metric names")
+	flag.StringVar(&c.Host, "datadog.host", c.Host, "Host name reported with the metrics")
+	flag.Var(&labelFlag{values: &c.TagPairs}, "datadog.tag",
+		"Tag key=value added to every metric (repeatable)")
+	flag.IntVar(&c.BatchSize, "datadog.batch-size", c.BatchSize,
+		"Number of readings to submit together in one request")
+	flag.IntVar(&c.MaxBuffered, "datadog.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while Datadog is unreachable")
+}
+
+func (c *datadogConfig) enabled() bool {
+	return c.APIKey != ""
+}
+
+// validate は Datadog の設定値を検証します。
+func (c *datadogConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Site == "" || strings.ContainsAny(c.Site, "/:") {
+		return errors.New("invalid Datadog site: " + c.Site)
+	}
+	if c.BatchSize < 1 {
+		return errors.New("datadog batch size must be positive")
+	}
+	if c.MaxBuffered < c.BatchSize {
+		return errors.New("datadog max buffered readings must not be less than the batch size")
+	}
+	tags, err := parseLabels(c.TagPairs)
+	if err != nil {
+		return err
+	}
+	c.Tags = make([]string, 0, len(tags))
+	for k, v := range tags {
+		c.Tags = append(c.Tags, k+":"+v)
+	}
+	sort.Strings(c.Tags)
+	return nil
+}
+
+// datadogSink は取得値を Datadog の metrics API (v2) にゲージとして送信します。
+// メトリクス名は StatsD と同じ <prefix><項目名> で、値には取得時刻 (定時積算電力量は計測日時) が付きます。
+// batch-size 個の取得値が揃うまで送信を待ち、送信に失敗した取得値は次回の送信時にまとめて再送します。
+type datadogSink struct {
+	cfg    *datadogConfig
+	client *http.Client
+	url    string
+	buffer *retryBuffer
+}
+
+func newDatadogSink(cfg *datadogConfig) (*datadogSink, error) {
+	client, err := newHTTPClient("", false)
+	if err != nil {
+		return nil, err
+	}
+	return &datadogSink{
+		cfg:    cfg,
+		client: client,
+		url:    "https://api." + cfg.Site + "/api/v2/series",
+		buffer: newRetryBuffer("datadog", cfg.MaxBuffered),
+	}, nil
+}
+
+// datadogSeries は metrics API の1つの時系列です。
+type datadogSeries struct {
+	Metric    string            `json:"metric"`
+	Type      int               `json:"type"`
+	Points    []datadogPoint    `json:"points"`
+	Tags      []string          `json:"tags,omitempty"`
+	Resources []datadogResource `json:"resources,omitempty"`
+}
+
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (s *datadogSink) publish(ctx context.Context, r *reading) error {
+	if len(s.buffer.readings)+1 < s.cfg.BatchSize {
+		s.buffer.add(r)
+		return nil
+	}
+	return s.buffer.flush(r, func(rs []*reading) error {
+		return s.send(ctx, rs)
+	})
+}
+
+// send は取得値をメトリクス毎の時系列にまとめて送信します。
+func (s *datadogSink) send(ctx context.Context, rs []*reading) error {
+	bySeries := make(map[string]*datadogSeries)
+	var names []string
+	for _, rd := range rs {
+		for _, item := range rd.items() {
+			series, ok := bySeries[item.Name]
+			if !ok {
+				series = &datadogSeries{
+					Metric: s.cfg.Prefix + item.Name,
+					Type:   datadogGauge,
+					Tags:   s.cfg.Tags,
+				}
+				if s.cfg.Host != "" {
+					series.Resources = []datadogResource{{Name: s.cfg.Host, Type: "host"}}
+				}
+				bySeries[item.Name] = series
+				names = append(names, item.Name)
+			}
+			series.Points = append(series.Points,
+				datadogPoint{Timestamp: item.Time.Unix(), Value: item.Value})
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	series := make([]*datadogSeries, 0, len(names))
+	for _, name := range names {
+		series = append(series, bySeries[name])
+	}
+	body, err := json.Marshal(map[string]any{"series": series})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("DD-API-KEY", s.cfg.APIKey)
+	return postHTTP(ctx, s.client, s.url, "application/json", body, header)
+}
+
+func (s *datadogSink) close() error {
+	if len(s.buffer.readings) == 0 {
+		return nil
+	}
+	// 終了時は、batch-size に満たずに送信を待っていた取得値を送信する
+	ctx, cancel := context.WithTimeout(context.Background(), sinkPublishTimeout)
+	defer cancel()
+	return s.send(ctx, s.buffer.readings)
+}
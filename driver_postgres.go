@@ -0,0 +1,7 @@
+//go:build postgres
+
+package main
+
+// PostgreSQL への記録 (-postgres.dsn) に使うドライバー。
+// 依存を増やさないよう、-tags postgres を指定した場合のみ組み込む。
+import _ "github.com/jackc/pgx/v5/stdlib"
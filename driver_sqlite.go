@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// SQLite への記録 (-sqlite.path) に使うドライバー。ビルドには cgo が必要。
+// 依存を増やさないよう、-tags sqlite を指定した場合のみ組み込む。
+import _ "github.com/mattn/go-sqlite3"
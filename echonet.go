@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+// ECHONET Lite 低圧スマート電力量メータクラスのプロパティ (EPC)
+const (
+	epcOperationStatus         = 0x80 // 動作状態
+	epcFaultStatus             = 0x88 // 異常発生状態
+	epcCoefficient             = 0xD3 // 係数
+	epcEnergyDigits            = 0xD7 // 積算電力量有効桁数
+	epcCumulativeEnergyNormal  = 0xE0 // 積算電力量計測値 (正方向計測値)
+	epcCumulativeEnergyUnit    = 0xE1 // 積算電力量単位 (正方向、逆方向計測値)
+	epcCumulativeEnergyReverse = 0xE3 // 積算電力量計測値 (逆方向計測値)
+	epcFixedTimeEnergyNormal   = 0xEA // 定時積算電力量計測値 (正方向計測値)
+	epcFixedTimeEnergyReverse  = 0xEB // 定時積算電力量計測値 (逆方向計測値)
+)
+
+// scrapeEPCs はスクレイプ毎に要求するプロパティです
+// (動作状態、異常発生状態、電力、電流、積算電力量 正方向/逆方向、定時積算電力量)。
+var scrapeEPCs = []smartmeter.PropertyCode{
+	epcOperationStatus,
+	epcFaultStatus,
+	smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower,
+	smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent,
+	epcCumulativeEnergyNormal,
+	epcCumulativeEnergyReverse,
+	epcFixedTimeEnergyNormal,
+	epcFixedTimeEnergyReverse,
+}
+
+// splitFixedTimeEPCs は epcs を定期取得するプロパティと、定時積算電力量 (0xEA/0xEB) に分けます。
+func splitFixedTimeEPCs(
+	epcs []smartmeter.PropertyCode,
+) (regular, fixedTime []smartmeter.PropertyCode) {
+	for _, epc := range epcs {
+		if epc == epcFixedTimeEnergyNormal || epc == epcFixedTimeEnergyReverse {
+			fixedTime = append(fixedTime, epc)
+		} else {
+			regular = append(regular, epc)
+		}
+	}
+	return regular, fixedTime
+}
+
+// nextFixedTimeRead は now 以降で、定時積算電力量を取得すべき次の時刻
+// (毎時0分・30分から delay 経過後) を返します。
+func nextFixedTimeRead(now time.Time, delay time.Duration) time.Time {
+	next := now.Truncate(30 * time.Minute).Add(delay)
+	for !next.After(now) {
+		next = next.Add(30 * time.Minute)
+	}
+	return next
+}
+
+// 動作状態 (EPC 0x80) の値
+const (
+	operationStatusOn  = 0x30
+	operationStatusOff = 0x31
+)
+
+// 異常発生状態 (EPC 0x88) の値
+const (
+	faultStatusFault   = 0x41
+	faultStatusNoFault = 0x42
+)
+
+// meterLocation はスマートメーターが日時を表現するタイムゾーン (日本標準時) です。
+var meterLocation = time.FixedZone("JST", 9*60*60)
+
+// energyUnitTable は積算電力量単位 (EPC 0xE1) の値と kWh 換算係数の対応表です。
+var energyUnitTable = map[byte]float64{
+	0x00: 1,
+	0x01: 0.1,
+	0x02: 0.01,
+	0x03: 0.001,
+	0x04: 0.0001,
+	0x0A: 10,
+	0x0B: 100,
+	0x0C: 1000,
+	0x0D: 10000,
+}
+
+// maxCumulativeEnergy は積算電力量計測値 (8桁) の最大値です。
+const maxCumulativeEnergy = 99999999
+
+// isSentinelInt32 は符号付き32ビット値が ECHONET Lite の特殊値
+// (オーバーフロー 0x7FFFFFFF、データなし 0x7FFFFFFE、アンダーフロー 0x80000000) かどうかを返します。
+func isSentinelInt32(v int32) bool {
+	return v == math.MaxInt32 || v == math.MaxInt32-1 || v == math.MinInt32
+}
+
+// currentNoData は瞬時電流計測値の「データなし」を示す値です (単相2線式の T相など)。
+const currentNoData = math.MaxInt16 - 1
+
+// isSentinelInt16 は符号付き16ビット値が ECHONET Lite の特殊値
+// (オーバーフロー 0x7FFF、データなし 0x7FFE、アンダーフロー 0x8000) かどうかを返します。
+func isSentinelInt16(v int16) bool {
+	return v == math.MaxInt16 || v == currentNoData || v == math.MinInt16
+}
+
+// isValidCumulativeEnergy は積算電力量計測値が有効範囲 (0〜99999999) 内かどうかを返します。
+// データなし (0xFFFFFFFE など) やオーバーフローを示す値は範囲外になります。
+func isValidCumulativeEnergy(v uint32) bool {
+	return v <= maxCumulativeEnergy
+}
+
+// fixedTimeEnergy は定時積算電力量計測値 (EPC 0xEA/0xEB) のデコード結果です。
+type fixedTimeEnergy struct {
+	Time  time.Time
+	Value uint32
+}
+
+// decodeFixedTimeEnergy は定時積算電力量計測値をデコードします。
+// EDT は 年(2) 月(1) 日(1) 時(1) 分(1) 秒(1) 積算電力量(4) の11バイトです。
+func decodeFixedTimeEnergy(edt []byte) (fixedTimeEnergy, error) {
+	if len(edt) != 11 {
+		return fixedTimeEnergy{}, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	t, err := decodeDateTime(edt[:7])
+	if err != nil {
+		return fixedTimeEnergy{}, err
+	}
+	return fixedTimeEnergy{
+		Time:  t,
+		Value: binary.BigEndian.Uint32(edt[7:]),
+	}, nil
+}
+
+// decodeDateTime は 年(2) 月(1) 日(1) 時(1) 分(1) 秒(1) 形式の日時をデコードします。
+func decodeDateTime(b []byte) (time.Time, error) {
+	year := int(binary.BigEndian.Uint16(b[:2]))
+	month, day, hour, minute, sec := int(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6])
+	if year == 0xFFFF || month < 1 || month > 12 || day < 1 || day > 31 ||
+		hour > 23 || minute > 59 || sec > 59 {
+		return time.Time{}, fmt.Errorf("invalid date time: % X", b)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, sec, 0, meterLocation), nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+// ECHONET Lite の LAN 側の定数
+const (
+	echonetPort      = 3610
+	echonetEHD1      = 0x10
+	echonetEHD2      = 0x81 // 電文形式1 (規定電文形式)
+	echonetHeaderLen = 12
+)
+
+// echonetMulticastGroup は ECHONET Lite のマルチキャストアドレス (IPv4) です。
+var echonetMulticastGroup = net.IPv4(224, 0, 23, 0)
+
+// ECHONET Lite サービス (ESV)
+const (
+	esvSetISNA = 0x50
+	esvSetCSNA = 0x51
+	esvGetSNA  = 0x52
+	esvINFSNA  = 0x53
+	esvSetI    = 0x60
+	esvSetC    = 0x61
+	esvGet     = 0x62
+	esvINFReq  = 0x63
+	esvGetRes  = 0x72
+	esvINF     = 0x73
+	esvINFC    = 0x74
+)
+
+// サーバーが応答するプロパティ (EPC)
+const (
+	epcNotifMap                 = 0x9D // 状変アナウンスプロパティマップ
+	epcSetMap                   = 0x9E // Setプロパティマップ
+	epcInstanceListNotification = 0xD5 // インスタンスリスト通知
+	epcSelfNodeInstances        = 0xD3 // 自ノードインスタンス数
+	epcSelfNodeClasses          = 0xD4 // 自ノードクラス数
+	epcSelfNodeClassList        = 0xD7 // 自ノードクラスリストS
+)
+
+// ECHONET オブジェクト (EOJ)
+var (
+	nodeProfileEOJ  = [3]byte{0x0E, 0xF0, 0x01}
+	lvSmartMeterEOJ = [3]byte{lvSmartMeterClass >> 8, lvSmartMeterClass & 0xFF, 0x01}
+)
+
+// echonetServerConfig は ECHONET Lite の LAN 側のサーバーの設定です。
+type echonetServerConfig struct {
+	Enabled   bool
+	Interface string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *echonetServerConfig) bind() {
+	c.Enabled = getEnvBool("SMARTMETER_ECHONET_LITE_SERVER")
+	c.Interface = getEnv("SMARTMETER_ECHONET_LITE_INTERFACE", "")
+
+	flag.BoolVar(&c.Enabled, "echonet-lite.server", c.Enabled,
+		"Act as a virtual low-voltage smart meter on the LAN (ECHONET Lite, UDP 3610)")
+	flag.StringVar(&c.Interface, "echonet-lite.interface", c.Interface,
+		"Network interface to join the ECHONET Lite multicast group on (default: system default)")
+}
+
+func (c *echonetServerConfig) enabled() bool {
+	return c.Enabled
+}
+
+// validate は ECHONET Lite のサーバーの設定値を検証します。
+func (c *echonetServerConfig) validate() error {
+	if !c.enabled() || c.Interface == "" {
+		return nil
+	}
+	if _, err := net.InterfaceByName(c.Interface); err != nil {
+		return fmt.Errorf("invalid ECHONET Lite interface %q: %w", c.Interface, err)
+	}
+	return nil
+}
+
+// echonetPropertyCache はスマートメーターから取得したプロパティの EDT を EPC 毎に保持します。
+// LAN 側のサーバーは Get にこの値で応答します。
+type echonetPropertyCache struct {
+	mu  sync.Mutex
+	edt map[byte][]byte
+}
+
+// meterProperties はスマートメーターから取得した低圧スマート電力量メータクラスのプロパティです。
+var meterProperties = &echonetPropertyCache{edt: map[byte][]byte{}}
+
+// store は応答に含まれていたプロパティを保持します。
+// 現在時刻・年月日は応答する時点の値にならないため、プロパティマップはサーバーが応答できるものを
+// 返すため、保持しません。
+func (c *echonetPropertyCache) store(props []*smartmeter.Property) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range props {
+		switch p.EPC {
+		case epcCurrentTime, epcCurrentDate, epcNotifMap, epcSetMap, epcGetPropertyMap:
+			continue
+		}
+		if len(p.EDT) > 0 {
+			// LAN 側のフレームは EPC をバイトのまま扱う
+			c.edt[byte(p.EPC)] = slices.Clone(p.EDT)
+		}
+	}
+}
+
+// get は EPC の EDT を返します。
+func (c *echonetPropertyCache) get(epc byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	edt, ok := c.edt[epc]
+	return edt, ok
+}
+
+// epcs は保持しているプロパティの EPC を返します。
+func (c *echonetPropertyCache) epcs() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Sorted(maps.Keys(c.edt))
+}
+
+// echonetProperty はフレームのプロパティ (EPC と EDT) です。
+type echonetProperty struct {
+	EPC byte
+	EDT []byte
+}
+
+// echonetFrame は ECHONET Lite の規定電文形式のフレームです。
+type echonetFrame struct {
+	TID   uint16
+	SEOJ  [3]byte
+	DEOJ  [3]byte
+	ESV   byte
+	Props []echonetProperty
+}
+
+// decodeEchonetFrame はフレームをデコードします。
+func decodeEchonetFrame(b []byte) (*echonetFrame, error) {
+	if len(b) < echonetHeaderLen || b[0] != echonetEHD1 || b[1] != echonetEHD2 {
+		return nil, errors.New("not an ECHONET Lite frame")
+	}
+	f := &echonetFrame{TID: binary.BigEndian.Uint16(b[2:4]), ESV: b[10]}
+	copy(f.SEOJ[:], b[4:7])
+	copy(f.DEOJ[:], b[7:10])
+	opc := int(b[11])
+	rest := b[echonetHeaderLen:]
+	for range opc {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errors.New("truncated ECHONET Lite frame")
+		}
+		n := int(rest[1])
+		f.Props = append(f.Props, echonetProperty{EPC: rest[0], EDT: rest[2 : 2+n]})
+		rest = rest[2+n:]
+	}
+	return f, nil
+}
+
+// encode はフレームをエンコードします。
+func (f *echonetFrame) encode() []byte {
+	b := []byte{echonetEHD1, echonetEHD2}
+	b = binary.BigEndian.AppendUint16(b, f.TID)
+	b = append(b, f.SEOJ[:]...)
+	b = append(b, f.DEOJ[:]...)
+	b = append(b, f.ESV, byte(len(f.Props)))
+	for _, p := range f.Props {
+		b = append(b, p.EPC, byte(len(p.EDT)))
+		b = append(b, p.EDT...)
+	}
+	return b
+}
+
+// encodePropertyMap はプロパティの集合をプロパティマップの EDT にエンコードします。
+// decodePropertyMap の逆変換です。
+func encodePropertyMap(epcs []byte) []byte {
+	if len(epcs) < 16 {
+		return append([]byte{byte(len(epcs))}, epcs...)
+	}
+	b := make([]byte, 17)
+	b[0] = byte(len(epcs))
+	for _, epc := range epcs {
+		if epc >= 0x80 {
+			b[1+int(epc&0x0F)] |= 1 << ((epc >> 4) - 8)
+		}
+	}
+	return b
+}
+
+// echonetServer は LAN 上で仮想の低圧スマート電力量メータとして動作し、
+// スマートメーターから取得したプロパティの値で Get に応答します。
+// HEMS コントローラーなどが Wi-SUN モジュールなしで B ルートの値を取得できます。
+type echonetServer struct {
+	conn   *net.UDPConn
+	logger *slog.Logger
+	// identification はノードプロファイルの識別番号 (EPC 0x83) です。
+	identification []byte
+}
+
+// startEchonetServer は設定で有効にした場合に ECHONET Lite のサーバーをバックグラウンドで起動します。
+func startEchonetServer(ctx context.Context, cfg *echonetServerConfig, logger *slog.Logger) {
+	if !cfg.enabled() {
+		return
+	}
+	go func() {
+		if err := runEchonetServer(ctx, cfg, logger); err != nil {
+			logger.Error("ECHONET Lite server error", "error", err)
+		}
+	}()
+}
+
+// runEchonetServer は ECHONET Lite のサーバーを起動し、ctx が終了するまで要求に応答します。
+func runEchonetServer(ctx context.Context, cfg *echonetServerConfig, logger *slog.Logger) error {
+	var ifi *net.Interface
+	if cfg.Interface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return err
+		}
+	}
+	group := &net.UDPAddr{IP: echonetMulticastGroup, Port: echonetPort}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return err
+	}
+	s := &echonetServer{conn: conn, logger: logger, identification: nodeIdentification()}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	// 起動時にインスタンスリスト通知を送信して、コントローラーにノードの存在を知らせる
+	s.announce()
+	logger.Info("ECHONET Lite server started", "port", echonetPort)
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		f, err := decodeEchonetFrame(buf[:n])
+		if err != nil {
+			logger.Debug("Ignoring invalid ECHONET Lite frame", "from", addr, "error", err)
+			continue
+		}
+		s.handle(f, addr)
+	}
+}
+
+// nodeIdentification はノードプロファイルの識別番号を生成します。
+// メーカコードは未登録 (0xFFFFFF) とし、残りはホスト名から生成します。
+func nodeIdentification() []byte {
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(programName + "/" + hostname))
+	return append([]byte{0xFE, 0xFF, 0xFF, 0xFF}, sum[:13]...)
+}
+
+// handle は要求に応答します。自ノードのオブジェクト宛てでない要求と、要求でないフレームは無視します。
+func (s *echonetServer) handle(req *echonetFrame, addr *net.UDPAddr) {
+	var eoj [3]byte
+	switch {
+	case matchEOJ(req.DEOJ, nodeProfileEOJ):
+		eoj = nodeProfileEOJ
+	case matchEOJ(req.DEOJ, lvSmartMeterEOJ):
+		eoj = lvSmartMeterEOJ
+	default:
+		return
+	}
+	resp := &echonetFrame{TID: req.TID, SEOJ: eoj, DEOJ: req.SEOJ}
+	switch req.ESV {
+	case esvGet, esvINFReq:
+		ok := true
+		for _, p := range req.Props {
+			edt, found := s.property(eoj, p.EPC)
+			ok = ok && found
+			resp.Props = append(resp.Props, echonetProperty{EPC: p.EPC, EDT: edt})
+		}
+		switch {
+		case req.ESV == esvGet && ok:
+			resp.ESV = esvGetRes
+		case req.ESV == esvGet:
+			resp.ESV = esvGetSNA
+		case ok:
+			resp.ESV = esvINF
+		default:
+			resp.ESV = esvINFSNA
+		}
+	case esvSetI, esvSetC:
+		// 値の書き込みには対応しない (要求をそのまま返して不可応答とする)
+		resp.ESV = esvSetCSNA
+		if req.ESV == esvSetI {
+			resp.ESV = esvSetISNA
+		}
+		resp.Props = req.Props
+	default:
+		return
+	}
+	// 要求への INF 応答はマルチキャストで送信する
+	if resp.ESV == esvINF {
+		addr = &net.UDPAddr{IP: echonetMulticastGroup, Port: echonetPort}
+	}
+	if _, err := s.conn.WriteToUDP(resp.encode(), addr); err != nil {
+		s.logger.Debug("Failed to send ECHONET Lite response", "to", addr, "error", err)
+	}
+}
+
+// matchEOJ は宛先の EOJ が obj を指しているかどうかを返します (インスタンスコード 0 は全インスタンス)。
+func matchEOJ(deoj, obj [3]byte) bool {
+	return deoj[0] == obj[0] && deoj[1] == obj[1] && (deoj[2] == 0 || deoj[2] == obj[2])
+}
+
+// property はオブジェクトのプロパティの EDT を返します。
+func (s *echonetServer) property(eoj [3]byte, epc byte) ([]byte, bool) {
+	if eoj == nodeProfileEOJ {
+		edt, ok := s.nodeProfileProperties()[epc]
+		return edt, ok
+	}
+	switch epc {
+	case epcGetPropertyMap:
+		epcs := meterProperties.epcs()
+		for _, m := range []byte{epcNotifMap, epcSetMap, epcGetPropertyMap} {
+			if !slices.Contains(epcs, m) {
+				epcs = append(epcs, m)
+			}
+		}
+		return encodePropertyMap(epcs), true
+	case epcSetMap:
+		return encodePropertyMap(nil), true
+	case epcNotifMap:
+		return encodePropertyMap([]byte{epcOperationStatus}), true
+	}
+	return meterProperties.get(epc)
+}
+
+// nodeProfileProperties はノードプロファイルのプロパティです。
+func (s *echonetServer) nodeProfileProperties() map[byte][]byte {
+	instances := []byte{1, lvSmartMeterEOJ[0], lvSmartMeterEOJ[1], lvSmartMeterEOJ[2]}
+	props := map[byte][]byte{
+		epcOperationStatus:          {operationStatusOn},
+		epcVersion:                  {0x01, 0x0D, 0x01, 0x00}, // Ver.1.13、規定電文形式
+		epcIdentificationNumber:     s.identification,
+		epcManufacturerCode:         {0xFF, 0xFF, 0xFF},
+		epcSelfNodeInstances:        {0, 0, 1},
+		epcSelfNodeClasses:          {0, 2},
+		epcInstanceListNotification: instances,
+		epcSelfNodeInstanceList:     instances,
+		epcSelfNodeClassList:        {1, lvSmartMeterEOJ[0], lvSmartMeterEOJ[1]},
+		epcNotifMap:                 encodePropertyMap([]byte{epcOperationStatus}),
+		epcSetMap:                   encodePropertyMap(nil),
+	}
+	epcs := slices.Sorted(maps.Keys(props))
+	props[epcGetPropertyMap] = encodePropertyMap(append(epcs, epcGetPropertyMap))
+	return props
+}
+
+// announce はインスタンスリスト通知をマルチキャストで送信します。
+func (s *echonetServer) announce() {
+	f := &echonetFrame{
+		SEOJ: nodeProfileEOJ,
+		DEOJ: nodeProfileEOJ,
+		ESV:  esvINF,
+		Props: []echonetProperty{{
+			EPC: epcInstanceListNotification,
+			EDT: s.nodeProfileProperties()[epcInstanceListNotification],
+		}},
+	}
+	addr := &net.UDPAddr{IP: echonetMulticastGroup, Port: echonetPort}
+	if _, err := s.conn.WriteToUDP(f.encode(), addr); err != nil {
+		s.logger.Warn("Failed to send ECHONET Lite instance list notification", "error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+func TestEchonetFrameRoundTrip(t *testing.T) {
+	f := &echonetFrame{
+		TID:  0x1234,
+		SEOJ: [3]byte{0x05, 0xFF, 0x01},
+		DEOJ: lvSmartMeterEOJ,
+		ESV:  esvGet,
+		Props: []echonetProperty{
+			{EPC: epcCumulativeEnergyNormal, EDT: []byte{}},
+			{EPC: epcOperationStatus, EDT: []byte{operationStatusOn}},
+		},
+	}
+	got, err := decodeEchonetFrame(f.encode())
+	if err != nil {
+		t.Fatalf("decodeEchonetFrame() error = %v", err)
+	}
+	if !bytes.Equal(got.encode(), f.encode()) {
+		t.Errorf("decodeEchonetFrame() = %+v, want %+v", got, f)
+	}
+
+	for _, b := range [][]byte{
+		{0x10, 0x81, 0x00},
+		{0x10, 0x82, 0, 0, 0x0E, 0xF0, 0x01, 0x0E, 0xF0, 0x01, esvGet, 0},
+		{0x10, 0x81, 0, 0, 0x0E, 0xF0, 0x01, 0x0E, 0xF0, 0x01, esvGet, 1, 0x80, 2, 0x30},
+	} {
+		if _, err := decodeEchonetFrame(b); err == nil {
+			t.Errorf("decodeEchonetFrame(% X) error = nil, want error", b)
+		}
+	}
+}
+
+// testEchonetExchange は要求をサーバーに処理させ、送信された応答を返します。
+func testEchonetExchange(t *testing.T, req *echonetFrame) *echonetFrame {
+	t.Helper()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	s := &echonetServer{conn: server, logger: testLogger, identification: nodeIdentification()}
+	s.handle(req, client.LocalAddr().(*net.UDPAddr))
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	resp, err := decodeEchonetFrame(buf[:n])
+	if err != nil {
+		t.Fatalf("decodeEchonetFrame() error = %v", err)
+	}
+	return resp
+}
+
+func TestEchonetServerGet(t *testing.T) {
+	saved := meterProperties.edt
+	meterProperties.edt = map[byte][]byte{}
+	t.Cleanup(func() { meterProperties.edt = saved })
+	meterProperties.store([]*smartmeter.Property{
+		smartmeter.NewProperty(epcCumulativeEnergyNormal, []byte{0x00, 0x01, 0xE2, 0x40}),
+		smartmeter.NewProperty(epcOperationStatus, []byte{operationStatusOn}),
+	})
+
+	controller := [3]byte{0x05, 0xFF, 0x01}
+	tests := []struct {
+		name      string
+		deoj      [3]byte
+		esv       byte
+		props     []echonetProperty
+		wantESV   byte
+		wantProps []echonetProperty
+	}{
+		{
+			"get",
+			lvSmartMeterEOJ,
+			esvGet,
+			[]echonetProperty{{EPC: epcCumulativeEnergyNormal}},
+			esvGetRes,
+			[]echonetProperty{{EPC: epcCumulativeEnergyNormal, EDT: []byte{0x00, 0x01, 0xE2, 0x40}}},
+		},
+		{
+			"get with unknown property",
+			lvSmartMeterEOJ,
+			esvGet,
+			[]echonetProperty{{EPC: epcOperationStatus}, {EPC: epcFixedTimeEnergyNormal}},
+			esvGetSNA,
+			[]echonetProperty{
+				{EPC: epcOperationStatus, EDT: []byte{operationStatusOn}},
+				{EPC: epcFixedTimeEnergyNormal},
+			},
+		},
+		{
+			"all instances",
+			[3]byte{lvSmartMeterEOJ[0], lvSmartMeterEOJ[1], 0},
+			esvGet,
+			[]echonetProperty{{EPC: epcOperationStatus}},
+			esvGetRes,
+			[]echonetProperty{{EPC: epcOperationStatus, EDT: []byte{operationStatusOn}}},
+		},
+		{
+			"node profile",
+			nodeProfileEOJ,
+			esvGet,
+			[]echonetProperty{{EPC: epcSelfNodeInstanceList}},
+			esvGetRes,
+			[]echonetProperty{{
+				EPC: epcSelfNodeInstanceList,
+				EDT: []byte{1, lvSmartMeterEOJ[0], lvSmartMeterEOJ[1], lvSmartMeterEOJ[2]},
+			}},
+		},
+		{
+			"set is rejected",
+			lvSmartMeterEOJ,
+			esvSetC,
+			[]echonetProperty{{EPC: epcOperationStatus, EDT: []byte{0x31}}},
+			esvSetCSNA,
+			[]echonetProperty{{EPC: epcOperationStatus, EDT: []byte{0x31}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &echonetFrame{TID: 7, SEOJ: controller, DEOJ: tt.deoj, ESV: tt.esv, Props: tt.props}
+			resp := testEchonetExchange(t, req)
+			if resp.TID != req.TID || resp.DEOJ != controller {
+				t.Errorf("response TID = %d, DEOJ = % X, want %d, % X",
+					resp.TID, resp.DEOJ, req.TID, controller)
+			}
+			if resp.ESV != tt.wantESV {
+				t.Errorf("ESV = 0x%02X, want 0x%02X", resp.ESV, tt.wantESV)
+			}
+			want := &echonetFrame{Props: tt.wantProps}
+			if got := (&echonetFrame{Props: resp.Props}); !bytes.Equal(got.encode(), want.encode()) {
+				t.Errorf("properties = %+v, want %+v", resp.Props, tt.wantProps)
+			}
+		})
+	}
+}
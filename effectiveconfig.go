@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// setting は1つのフラグの有効な値と、その値をどこから設定したか (flag、env、file、default) です。
+// List は繰り返し指定するフラグかどうかです。
+type setting struct {
+	Name   string
+	Values []string
+	List   bool
+	Source string
+}
+
+// settingSources は各フラグの値の設定元を、優先度の高い順 (コマンドライン、環境変数、設定ファイル) に判定して返します。
+// defaults は環境変数を参照しない場合の既定値です。loadConfig のフラグのパース後に呼びます。
+func settingSources(defaults map[string]string, cf *configFile) []setting {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var settings []setting
+	flag.VisitAll(func(f *flag.Flag) {
+		s := setting{Name: f.Name, Values: []string{f.Value.String()}, Source: "default"}
+		if lf, ok := f.Value.(*labelFlag); ok {
+			s.Values, s.List = slices.Clone(*lf.values), true
+		}
+		switch {
+		case set[f.Name]:
+			s.Source = "flag"
+		case f.DefValue != defaults[f.Name]:
+			s.Source = "env"
+		case cf != nil && cf.settings[f.Name] != nil:
+			s.Source = "file"
+		}
+		settings = append(settings, s)
+	})
+	return settings
+}
+
+// secretSettings は値を伏せ字にするフラグ名の末尾 (最後の "." 以降) です。
+var secretSettings = []string{
+	"id", "password", "token", "bearer-token", "api-key", "secret-access-key", "header",
+}
+
+// dsnPasswordPattern は PostgreSQL などのキーと値の形式の接続文字列に含まれるパスワードです。
+var dsnPasswordPattern = regexp.MustCompile(`(\bpassword=)('[^']*'|\S+)`)
+
+// redactSetting はフラグの値に含まれる秘密の情報を伏せ字にします。
+// 空の値は指定されていないことが分かるよう、そのまま返します。
+func redactSetting(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if slices.Contains(secretSettings, name[strings.LastIndex(name, ".")+1:]) {
+		return redactedValue
+	}
+	// URL に含まれるパスワード
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return dsnPasswordPattern.ReplaceAllString(value, "${1}"+redactedValue)
+}
+
+// effectiveConfigHeader は writeEffectiveConfig の出力の先頭に付けるコメントです。
+const effectiveConfigHeader = `# Effective configuration.
+# The comment on each setting shows where it comes from:
+# flag (command line), env (environment variable), file (config file) or default.
+`
+
+// commandLineSettings は設定ファイルには書けない、コマンドラインと環境変数でのみ指定するフラグです。
+var commandLineSettings = []string{
+	"config.file", "env.prefix", "version", "help-env", "print-config", "check",
+}
+
+// writeEffectiveConfig は環境変数、設定ファイル、コマンドラインフラグを反映した設定を、
+// 設定ファイルと同じ YAML 形式で書き出します。各値の設定元をコメントとして付け、秘密の情報は伏せ字にします。
+func writeEffectiveConfig(w io.Writer, cfg *config) error {
+	fmt.Fprint(w, effectiveConfigHeader)
+	for _, s := range cfg.Settings {
+		values := make([]string, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = redactSetting(s.Name, v)
+		}
+		var value any = values
+		if !s.List {
+			value = values[0]
+		}
+		b, err := yaml.Marshal(map[string]any{s.Name: value})
+		if err != nil {
+			return err
+		}
+		first, rest, _ := strings.Cut(string(b), "\n")
+		if slices.Contains(commandLineSettings, s.Name) {
+			// 設定ファイルに書けないため、コメントにする
+			first = "# " + first
+		}
+		fmt.Fprintf(w, "%s  # %s\n%s", first, s.Source, rest)
+	}
+
+	file := cfg.File
+	file.Meters = slices.Clone(file.Meters)
+	for i := range file.Meters {
+		file.Meters[i].ID = redactSetting("id", file.Meters[i].ID)
+		file.Meters[i].Password = redactSetting("password", file.Meters[i].Password)
+	}
+	if len(file.Meters) == 0 && len(file.CustomMetrics) == 0 {
+		return nil
+	}
+	b, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "# Structured settings from the config file.")
+	_, err = w.Write(b)
+	return err
+}
+
+var (
+	// effectiveMu は effective を保護します。
+	effectiveMu sync.Mutex
+	// effective は /-/config で返す、直近に読み込んだ設定です。
+	effective *config
+)
+
+// setEffectiveConfig は /-/config で返す設定を置き換えます。
+func setEffectiveConfig(cfg *config) {
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	effective = cfg
+}
+
+// configHandler は直近に読み込んだ設定を返す /-/config のハンドラーです。
+// enabled が false の場合は要求を拒否します。
+func configHandler(enabled bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			http.Error(w, "Lifecycle API is not enabled.", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		effectiveMu.Lock()
+		cfg := effective
+		effectiveMu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = writeEffectiveConfig(w, cfg)
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// energyUnitKWh は積算電力量の1カウントあたりの kWh です (単位 × 係数、0 は未取得)。
+	energyUnitKWh float64
+	// energyDigits は積算電力量計測値の有効桁数 (EPC 0xD7) です (0 は未取得)。
+	energyDigits int
+)
+
+// energyCounters は積算電力量 (正方向、逆方向) の桁あふれ補正の状態です。
+var energyCounters = map[smartmeter.PropertyCode]*rolloverCounter{
+	epcCumulativeEnergyNormal:  {},
+	epcCumulativeEnergyReverse: {},
+}
+
+// rolloverCounter は有効桁数で桁あふれする積算値を単調増加する値に補正します。
+type rolloverCounter struct {
+	last  uint32
+	valid bool
+	wraps uint64
+}
+
+// update は計測値 v を取り込み、桁あふれを補正した値を返します。
+// modulus は桁あふれする値 (10^有効桁数) で、0 の場合は補正しません。
+// 値の減少は、直前の値が上限付近かつ新しい値が下限付近の場合のみ桁あふれとみなし、
+// それ以外 (メーター交換など) は補正しません。
+func (c *rolloverCounter) update(v uint32, modulus uint64, logger *slog.Logger) uint64 {
+	if c.valid && v < c.last && modulus != 0 {
+		if uint64(c.last) >= modulus*9/10 && uint64(v) < modulus/10 {
+			c.wraps++
+			logger.Info("Cumulative energy counter rolled over", "last", c.last, "current", v)
+		} else {
+			logger.Warn("Cumulative energy counter decreased", "last", c.last, "current", v)
+		}
+	}
+	c.last, c.valid = v, true
+	return c.wraps*modulus + uint64(v)
+}
+
+// unwrap は直前に update で取り込んだ値より前に計測された値 v を、update と同じ桁あふれ補正済みの値にします。
+// v が直前の値より大きい場合は、v の計測後に桁あふれしたとみなします。
+func (c *rolloverCounter) unwrap(v uint32, modulus uint64) uint64 {
+	wraps := c.wraps
+	if c.valid && v > c.last && wraps > 0 {
+		wraps--
+	}
+	return wraps*modulus + uint64(v)
+}
+
+// energyModulus は有効桁数から桁あふれする値を返します (有効桁数が不明な場合は 0)。
+func energyModulus() uint64 {
+	if energyDigits < 1 || energyDigits > 8 {
+		return 0
+	}
+	m := uint64(1)
+	for range energyDigits {
+		m *= 10
+	}
+	return m
+}
+
+// resolveEnergyScale は積算電力量の単位・係数・有効桁数を取得し、
+// 積算電力量を kWh に換算するための energyUnitKWh と energyDigits を設定します。
+func resolveEnergyScale(dev *smartmeter.Device, logger *slog.Logger) error {
+	unitKWh, digits, err := mainMeter.readEnergyScale(dev, logger)
+	if err != nil {
+		return err
+	}
+	energyUnitKWh = unitKWh
+	energyDigits = digits
+	return nil
+}
+
+// readEnergyScale は積算電力量単位 (EPC 0xE1)、係数 (EPC 0xD3)、有効桁数 (EPC 0xD7) を取得し、
+// 積算電力量の1カウントあたりの kWh (単位 × 係数) と有効桁数を返します。
+// 係数は実装されていないメーターもあるため、取得できない場合は 1 とみなします。
+func (c *meterClient) readEnergyScale(
+	dev *smartmeter.Device,
+	logger *slog.Logger,
+) (float64, int, error) {
+	response, err := c.getProperties(dev, epcCumulativeEnergyUnit, epcEnergyDigits)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get cumulative energy unit: %w", err)
+	}
+	var unit float64
+	var digits int
+	for _, p := range response.Properties {
+		switch {
+		case p.EPC == epcCumulativeEnergyUnit && len(p.EDT) == 1:
+			u, ok := energyUnitTable[p.EDT[0]]
+			if !ok {
+				return 0, 0, fmt.Errorf("unknown cumulative energy unit: 0x%02X", p.EDT[0])
+			}
+			unit = u
+		case p.EPC == epcEnergyDigits && len(p.EDT) == 1 && p.EDT[0] >= 1 && p.EDT[0] <= 8:
+			digits = int(p.EDT[0])
+		}
+	}
+	if unit == 0 {
+		return 0, 0, fmt.Errorf("response contained no cumulative energy unit")
+	}
+
+	coefficient := c.readCoefficient(dev, logger)
+	logger.Info(
+		"Cumulative energy scale resolved",
+		"unit_kwh",
+		unit,
+		"coefficient",
+		coefficient,
+		"digits",
+		digits,
+	)
+	return unit * float64(coefficient), digits, nil
+}
+
+// readCoefficient は係数 (EPC 0xD3) を取得します。取得できない場合は 1 を返します。
+func (c *meterClient) readCoefficient(dev *smartmeter.Device, logger *slog.Logger) uint32 {
+	response, err := c.getProperties(dev, epcCoefficient)
+	if err != nil {
+		logger.Debug("Coefficient is not available, assuming 1", "error", err)
+		return 1
+	}
+	for _, p := range response.Properties {
+		if p.EPC != epcCoefficient || len(p.EDT) != 4 {
+			continue
+		}
+		if v := binary.BigEndian.Uint32(p.EDT); v != 0 {
+			return v
+		}
+	}
+	return 1
+}
+
+// getProperties は定期取得するスマートメーターから低圧スマート電力量メータクラスの指定プロパティを
+// Get で取得します。
+func getProperties(
+	dev *smartmeter.Device,
+	epcs ...smartmeter.PropertyCode,
+) (*smartmeter.Frame, error) {
+	return mainMeter.getProperties(dev, epcs...)
+}
+
+// getProperties は低圧スマート電力量メータクラスの指定プロパティを Get で取得します。
+func (c *meterClient) getProperties(
+	dev *smartmeter.Device,
+	epcs ...smartmeter.PropertyCode,
+) (*smartmeter.Frame, error) {
+	request := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		smartmeter.Get,
+		newProperties(epcs),
+	)
+	response, err := c.query(dev, request)
+	if err != nil {
+		return nil, err
+	}
+	c.properties.store(response.Properties)
+	return response, nil
+}
+
+// newProperties は EDT が空のプロパティ (Get 要求用) の列を生成します。
+func newProperties(epcs []smartmeter.PropertyCode) []*smartmeter.Property {
+	props := make([]*smartmeter.Property, 0, len(epcs))
+	for _, epc := range epcs {
+		props = append(props, smartmeter.NewProperty(epc, nil))
+	}
+	return props
+}
+
+// energyCounter は積算電力量を Prometheus の Counter として公開する Collector です。
+// 計測値の増加分だけを内部の累計に加算するため、桁あふれの補正漏れやメーター交換で
+// 計測値が減少しても公開する値は単調増加し、rate() や increase() が正しく計算できます。
+type energyCounter struct {
+	desc *prometheus.Desc
+
+	mu    sync.Mutex
+	total float64   // 公開する累計値 (kWh)
+	last  float64   // 直前の計測値 (kWh)
+	time  time.Time // 直前の計測値の取得時刻
+	valid bool
+}
+
+func newEnergyCounter(name, help string) *energyCounter {
+	return &energyCounter{desc: prometheus.NewDesc(name, help, nil, nil)}
+}
+
+// observe は時刻 t に取得した桁あふれ補正済みの積算電力量 (kWh) を取り込みます。
+// 初回は計測値をそのまま累計とし、以降は増加分のみを加算します。
+// 計測値が減少した場合 (メーター交換など) は加算せず、新しい値を次の基準とします。
+func (c *energyCounter) observe(kwh float64, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case !c.valid:
+		c.total = kwh
+	case kwh > c.last:
+		c.total += kwh - c.last
+	}
+	c.last, c.time, c.valid = kwh, t, true
+}
+
+// Describe は prometheus.Collector を実装します。
+func (c *energyCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect は prometheus.Collector を実装します。計測値を取得するまでは何も出力しません。
+func (c *energyCounter) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.valid {
+		return
+	}
+	ch <- newSample(c.desc, prometheus.CounterValue, c.total, c.time)
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestRolloverCounterUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modulus uint64
+		values  []uint32
+		want    []uint64
+	}{
+		{
+			name:    "increasing",
+			modulus: 1000000,
+			values:  []uint32{100, 200, 300},
+			want:    []uint64{100, 200, 300},
+		},
+		{
+			name:    "rollover",
+			modulus: 1000000,
+			values:  []uint32{999990, 999999, 5, 20},
+			want:    []uint64{999990, 999999, 1000005, 1000020},
+		},
+		{
+			name:    "two rollovers",
+			modulus: 1000,
+			values:  []uint32{950, 10, 990, 3},
+			want:    []uint64{950, 1010, 1990, 2003},
+		},
+		{
+			name:    "decrease is not a rollover",
+			modulus: 1000000,
+			values:  []uint32{500000, 400000, 400100},
+			want:    []uint64{500000, 400000, 400100},
+		},
+		{
+			name:    "unknown digits",
+			modulus: 0,
+			values:  []uint32{999999, 5},
+			want:    []uint64{999999, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c rolloverCounter
+			for i, v := range tt.values {
+				if got := c.update(v, tt.modulus, testLogger); got != tt.want[i] {
+					t.Errorf("update(%d) = %d, want %d", v, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRolloverCounterUnwrap(t *testing.T) {
+	const modulus = 1000000
+	tests := []struct {
+		name    string
+		updates []uint32
+		v       uint32
+		want    uint64
+	}{
+		{"no rollover", []uint32{1000, 2000}, 1500, 1500},
+		{"measured after rollover", []uint32{999990, 10}, 5, 1000005},
+		{"measured before rollover", []uint32{999990, 10}, 999995, 999995},
+		{"measured before first update", []uint32{2000}, 3000, 3000},
+		{"no updates", nil, 3000, 3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c rolloverCounter
+			for _, v := range tt.updates {
+				c.update(v, modulus, testLogger)
+			}
+			if got := c.unwrap(tt.v, modulus); got != tt.want {
+				t.Errorf("unwrap(%d) = %d, want %d", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnergyModulus(t *testing.T) {
+	tests := []struct {
+		digits int
+		want   uint64
+	}{
+		{0, 0},
+		{1, 10},
+		{6, 1000000},
+		{8, 100000000},
+		{9, 0},
+	}
+	for _, tt := range tests {
+		setEnergyScale(t, 1, tt.digits)
+		if got := energyModulus(); got != tt.want {
+			t.Errorf("energyModulus() with %d digits = %d, want %d", tt.digits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// envVar は環境変数と、それに対応するフラグです。
+type envVar struct {
+	name  string
+	flag  string
+	def   string
+	usage string
+}
+
+// envProbeValues は環境変数に対応するフラグを調べるために設定する値です。
+// 真偽値、整数、時間、ログのレベルのいずれかとして解釈でき、既定値と異なるものが1つはあるように選んでいます。
+var envProbeValues = []string{"1", "2", "0", "debug"}
+
+// envVars は newConfig が参照する環境変数と、それぞれに対応するフラグを返します。
+// 環境変数を1つずつ設定して newConfig を呼び、既定値が変わったフラグを対応するフラグとします。
+func envVars() []envVar {
+	var names []string
+	seen := make(map[string]bool)
+	base := newFlagSet(func(name string) (string, bool) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return "", false
+	})
+	// 値を設定した環境変数の誤りは報告しない
+	defer func() { envErrors = nil }()
+
+	vars := make([]envVar, 0, len(names)+2)
+	for _, name := range names {
+		v := envVar{name: name}
+		for _, value := range envProbeValues {
+			fs := newFlagSet(func(n string) (string, bool) {
+				if n != name {
+					return "", false
+				}
+				return value, true
+			})
+			fs.VisitAll(func(f *flag.Flag) {
+				if v.flag == "" && f.DefValue != base.Lookup(f.Name).DefValue {
+					v.flag = f.Name
+				}
+			})
+			if v.flag != "" {
+				f := base.Lookup(v.flag)
+				v.def = f.DefValue
+				v.usage, _, _ = strings.Cut(f.Usage, "\n")
+				break
+			}
+		}
+		vars = append(vars, v)
+	}
+	// newConfig より前に参照する環境変数
+	return append(vars,
+		envVar{
+			name:  defaultEnvPrefix + "ENV_PREFIX",
+			flag:  "env.prefix",
+			def:   defaultEnvPrefix,
+			usage: "Prefix of the environment variable names",
+		},
+		envVar{
+			name:  envName("SMARTMETER_LOG_FORMAT"),
+			def:   "text",
+			usage: "Log format (text, json, syslog or journal)",
+		},
+	)
+}
+
+// printEnvHelp は環境変数と対応するフラグ、既定値、説明の一覧を書き出します。
+func printEnvHelp(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENVIRONMENT VARIABLE\tFLAG\tDEFAULT\tDESCRIPTION")
+	for _, v := range envVars() {
+		f := "-"
+		if v.flag != "" {
+			f = "-" + v.flag
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%q\t%s\n", v.name, f, v.def, v.usage)
+	}
+	_ = tw.Flush()
+}
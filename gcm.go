@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// gcmConfig は Google Cloud Monitoring への送信の設定です。
+type gcmConfig struct {
+	ProjectID          string
+	CredentialsFile    string
+	MetricPrefix       string
+	ResourceType       string
+	ResourceLabelPairs []string
+	LabelPairs         []string
+	MaxBuffered        int
+
+	// validate で設定される
+	ResourceLabels map[string]string
+	Labels         map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *gcmConfig) bind() {
+	c.ProjectID = getEnv("SMARTMETER_GCM_PROJECT_ID", "")
+	c.CredentialsFile = getEnv("SMARTMETER_GCM_CREDENTIALS_FILE", "")
+	c.MetricPrefix = getEnv("SMARTMETER_GCM_METRIC_PREFIX", "custom.googleapis.com/smartmeter/")
+	c.ResourceType = getEnv("SMARTMETER_GCM_RESOURCE_TYPE", "global")
+	c.MaxBuffered = getEnvInt("SMARTMETER_GCM_MAX_BUFFERED", 60)
+	if v := getEnv("SMARTMETER_GCM_RESOURCE_LABELS", ""); v != "" {
+		c.ResourceLabelPairs = strings.Split(v, ",")
+	}
+	if v := getEnv("SMARTMETER_GCM_LABELS", ""); v != "" {
+		c.LabelPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.ProjectID, "gcm.project-id", c.ProjectID,
+		"Google Cloud project to write readings to as Cloud Monitoring custom metrics")
+	flag.StringVar(&c.CredentialsFile, "gcm.credentials-file", c.CredentialsFile,
+		"Service account key file (default: GOOGLE_APPLICATION_CREDENTIALS or the metadata server)")
+	flag.StringVar(&c.MetricPrefix, "gcm.metric-prefix", c.MetricPrefix,
+		"Prefix of Cloud Monitoring metric types")
+	flag.StringVar(&c.ResourceType, "gcm.resource-type", c.ResourceType,
+		"Monitored resource type (e.g. global, generic_node)")
+	flag.Var(&labelFlag{values: &c.ResourceLabelPairs}, "gcm.resource-label",
+		"Monitored resource label key=value (repeatable)")
+	flag.Var(&labelFlag{values: &c.LabelPairs}, "gcm.label",
+		"Metric label key=value added to every time series (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "gcm.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while Cloud Monitoring is unreachable")
+}
+
+func (c *gcmConfig) enabled() bool {
+	return c.ProjectID != ""
+}
+
+// validate は Cloud Monitoring の設定値を検証します。
+func (c *gcmConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.ResourceType == "" {
+		return errors.New("cloud Monitoring resource type must not be empty")
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("cloud Monitoring max buffered readings must be positive")
+	}
+	resourceLabels, err := parseLabels(c.ResourceLabelPairs)
+	if err != nil {
+		return err
+	}
+	labels, err := parseLabels(c.LabelPairs)
+	if err != nil {
+		return err
+	}
+	// global リソースはプロジェクト ID のラベルを必要とする
+	if _, ok := resourceLabels["project_id"]; !ok && c.ResourceType == "global" {
+		resourceLabels["project_id"] = c.ProjectID
+	}
+	c.ResourceLabels, c.Labels = resourceLabels, labels
+	return nil
+}
+
+// gcmSink は取得値を Cloud Monitoring のカスタムメトリクス (ゲージ) として書き込みます。
+// メトリクスの種類は <prefix><名前> (名前は /metrics の名前から smartmeter_ を除いたもの) で、ラベル (phase, direction) は
+// メトリクスのラベルになります。Cloud Monitoring は時系列毎に1回の要求で1点しか受け付けないため、
+// 送信に失敗した取得値は次回の送信時に古いものから1つずつ再送します。
+type gcmSink struct {
+	cfg    *gcmConfig
+	client *http.Client
+	tokens *gcpTokenSource
+	buffer *retryBuffer
+}
+
+func newGCMSink(cfg *gcmConfig) (*gcmSink, error) {
+	client, err := newHTTPClient("", false)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newGCPTokenSource(client, cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSink{
+		cfg:    cfg,
+		client: client,
+		tokens: tokens,
+		buffer: newRetryBuffer("gcm", cfg.MaxBuffered),
+	}, nil
+}
+
+// gcmTimeSeries は timeSeries.create の要求の1つの時系列です。
+type gcmTimeSeries struct {
+	Metric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"metric"`
+	Resource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	MetricKind string     `json:"metricKind"`
+	ValueType  string     `json:"valueType"`
+	Points     []gcmPoint `json:"points"`
+}
+
+type gcmPoint struct {
+	Interval struct {
+		EndTime string `json:"endTime"`
+	} `json:"interval"`
+	Value struct {
+		DoubleValue float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+func (s *gcmSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flushEach(r, func(rd *reading) error {
+		token, err := s.tokens.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(map[string]any{"timeSeries": s.timeSeries(rd)})
+		if err != nil {
+			return err
+		}
+		header := authHeader(token, "", "")
+		u := "https://monitoring.googleapis.com/v3/projects/" + s.cfg.ProjectID + "/timeSeries"
+		return postHTTP(ctx, s.client, u, "application/json", body, header)
+	})
+}
+
+// timeSeries は取得値を時系列の列に変換します。
+func (s *gcmSink) timeSeries(r *reading) []gcmTimeSeries {
+	var series []gcmTimeSeries
+	for _, sample := range r.samples() {
+		var ts gcmTimeSeries
+		ts.Metric.Type = s.cfg.MetricPrefix + strings.TrimPrefix(sample.Name, "smartmeter_")
+		ts.Metric.Labels = make(map[string]string, len(s.cfg.Labels)+1)
+		for k, v := range s.cfg.Labels {
+			ts.Metric.Labels[k] = v
+		}
+		if sample.LabelName != "" {
+			ts.Metric.Labels[sample.LabelName] = sample.LabelValue
+		}
+		ts.Resource.Type = s.cfg.ResourceType
+		ts.Resource.Labels = s.cfg.ResourceLabels
+		ts.MetricKind = "GAUGE"
+		ts.ValueType = "DOUBLE"
+		var p gcmPoint
+		p.Interval.EndTime = sample.Time.UTC().Format(time.RFC3339Nano)
+		p.Value.DoubleValue = sample.Value
+		ts.Points = []gcmPoint{p}
+		series = append(series, ts)
+	}
+	return series
+}
+
+func (s *gcmSink) close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/" +
+		"instance/service-accounts/default/token"
+	gcpMonitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+)
+
+// gcpServiceAccount はサービスアカウントのキーファイル (JSON) の内容です。
+type gcpServiceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcpTokenSource は Google Cloud の API のアクセストークンを取得し、有効期限まで保持します。
+// サービスアカウントのキーファイルを指定した場合は JWT で、指定しない場合は
+// メタデータサーバー (GCE、Cloud Run など) から取得します。
+type gcpTokenSource struct {
+	client  *http.Client
+	account *gcpServiceAccount
+	key     *rsa.PrivateKey
+
+	token  string
+	expiry time.Time
+}
+
+// newGCPTokenSource は credentialsFile (空の場合は GOOGLE_APPLICATION_CREDENTIALS) の
+// サービスアカウントのキーを使うトークンの取得元を生成します。
+func newGCPTokenSource(client *http.Client, credentialsFile string) (*gcpTokenSource, error) {
+	ts := &gcpTokenSource{client: client}
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		return ts, nil
+	}
+	b, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var account gcpServiceAccount
+	if err = json.Unmarshal(b, &account); err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %w", err)
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("unsupported credentials type %q", account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("no private key found in credentials file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key in credentials file is not an RSA key")
+	}
+	ts.account, ts.key = &account, key
+	return ts, nil
+}
+
+// accessToken は有効なアクセストークンを返します。
+func (ts *gcpTokenSource) accessToken(ctx context.Context) (string, error) {
+	// 期限切れの直前に使わないよう、1分の余裕を持たせる
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+	var req *http.Request
+	var err error
+	if ts.account != nil {
+		req, err = ts.jwtTokenRequest(ctx)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+		if req != nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get access token: %s: %s", resp.Status, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// jwtTokenRequest はサービスアカウントの署名付き JWT でアクセストークンを要求します。
+func (ts *gcpTokenSource) jwtTokenRequest(ctx context.Context) (*http.Request, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   ts.account.ClientEmail,
+		"scope": gcpMonitoringWriteScope,
+		"aud":   ts.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", unsigned+"."+base64.RawURLEncoding.EncodeToString(sig))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.account.TokenURI,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// roundTripFunc は関数を http.RoundTripper として使うための型です。
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// pemPrivateKey は秘密鍵を PKCS #8 の PEM 形式に変換します。
+func pemPrivateKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// writeServiceAccount はサービスアカウントのキーファイルを書き出し、そのパスを返します。
+func writeServiceAccount(t *testing.T, account gcpServiceAccount) string {
+	t.Helper()
+	b, err := json.Marshal(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err = os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewGCPTokenSource(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := gcpServiceAccount{
+		Type:        "service_account",
+		ClientEmail: "meter@example.iam.gserviceaccount.com",
+		PrivateKey:  pemPrivateKey(t, rsaKey),
+		TokenURI:    "https://oauth2.googleapis.com/token",
+	}
+	withType, withKey := valid, valid
+	withType.Type = "authorized_user"
+	withKey.PrivateKey = pemPrivateKey(t, ecKey)
+	withoutKey := valid
+	withoutKey.PrivateKey = "not a key"
+
+	tests := []struct {
+		name        string
+		file        string
+		wantAccount bool
+		wantErr     bool
+	}{
+		{"metadata server", "", false, false},
+		{"service account", writeServiceAccount(t, valid), true, false},
+		{"authorized user", writeServiceAccount(t, withType), false, true},
+		{"ECDSA key", writeServiceAccount(t, withKey), false, true},
+		{"no private key", writeServiceAccount(t, withoutKey), false, true},
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+			ts, err := newGCPTokenSource(http.DefaultClient, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newGCPTokenSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ts != nil && (ts.account != nil) != tt.wantAccount {
+				t.Errorf("account = %+v, want account %v", ts.account, tt.wantAccount)
+			}
+		})
+	}
+}
+
+// verifyJWTAssertion は RS256 で署名された JWT を検証し、クレームを返します。
+func verifyJWTAssertion(t *testing.T, assertion string, key *rsa.PublicKey) map[string]any {
+	t.Helper()
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion has %d parts, want 3", len(parts))
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if string(header) != `{"alg":"RS256","typ":"JWT"}` {
+		t.Errorf("JWT header = %s", header)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("VerifyPKCS1v15() error = %v", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err = json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestGCPTokenSourceAccessToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &gcpServiceAccount{
+		ClientEmail: "meter@example.iam.gserviceaccount.com",
+		TokenURI:    "https://oauth2.googleapis.com/token",
+	}
+	tests := []struct {
+		name         string
+		account      *gcpServiceAccount
+		status       int
+		want         string
+		wantErr      bool
+		wantRequests int
+	}{
+		// 有効期限内のトークンは再利用する
+		{"service account", account, http.StatusOK, "ya29.jwt", false, 1},
+		{"metadata server", nil, http.StatusOK, "ya29.metadata", false, 1},
+		{"denied", account, http.StatusBadRequest, "", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				requests++
+				token := "ya29.metadata"
+				if tt.account == nil {
+					if req.URL.String() != gcpMetadataTokenURL || req.Header.Get("Metadata-Flavor") != "Google" {
+						t.Errorf("metadata request = %s %v", req.URL, req.Header)
+					}
+				} else {
+					token = "ya29.jwt"
+					if err := req.ParseForm(); err != nil {
+						t.Fatal(err)
+					}
+					claims := verifyJWTAssertion(t, req.PostForm.Get("assertion"), &key.PublicKey)
+					if claims["iss"] != account.ClientEmail || claims["aud"] != account.TokenURI ||
+						claims["scope"] != gcpMonitoringWriteScope {
+						t.Errorf("JWT claims = %v", claims)
+					}
+					if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp-iat != 3600 {
+						t.Errorf("JWT lifetime = %vs, want 3600s", exp-iat)
+					}
+				}
+				body := `{"access_token":"` + token + `","expires_in":3599}`
+				return &http.Response{
+					StatusCode: tt.status,
+					Status:     http.StatusText(tt.status),
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			})}
+			ts := &gcpTokenSource{client: client, account: tt.account, key: key}
+			for range 2 {
+				got, err := ts.accessToken(context.Background())
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("accessToken() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Errorf("accessToken() = %q, want %q", got, tt.want)
+				}
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("token requests = %d, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphiteConfig は Graphite (Carbon の plaintext プロトコル) への出力の設定です。
+type graphiteConfig struct {
+	Address     string
+	Prefix      string
+	TagPairs    []string
+	MaxBuffered int
+
+	// validate で設定される
+	Tags map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *graphiteConfig) bind() {
+	c.Address = getEnv("SMARTMETER_GRAPHITE_ADDRESS", "")
+	c.Prefix = getEnv("SMARTMETER_GRAPHITE_PREFIX", "smartmeter")
+	c.MaxBuffered = getEnvInt("SMARTMETER_GRAPHITE_MAX_BUFFERED", 1440)
+	if v := getEnv("SMARTMETER_GRAPHITE_TAGS", ""); v != "" {
+		c.TagPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.Address, "graphite.address", c.Address,
+		"Carbon plaintext receiver host:port to send readings to (e.g. localhost:2003)")
+	flag.StringVar(&c.Prefix, "graphite.prefix", c.Prefix, "Prefix of Graphite metric paths")
+	flag.Var(&labelFlag{values: &c.TagPairs}, "graphite.tag",
+		"Graphite tag key=value added to every metric (repeatable, requires Graphite 1.1+)")
+	flag.IntVar(&c.MaxBuffered, "graphite.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while Graphite is unreachable")
+}
+
+func (c *graphiteConfig) enabled() bool {
+	return c.Address != ""
+}
+
+// validate は Graphite の設定値を検証します。
+func (c *graphiteConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid Graphite address %q: %w", c.Address, err)
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("graphite max buffered readings must be positive")
+	}
+	tags, err := parseLabels(c.TagPairs)
+	if err != nil {
+		return err
+	}
+	c.Tags = tags
+	return nil
+}
+
+// graphiteSink は取得値を Carbon の plaintext プロトコルで TCP で送信します。
+// 接続を保ったまま送信し、書き込みに失敗した場合は接続し直して、次回の送信時にまとめて再送します。
+type graphiteSink struct {
+	cfg    *graphiteConfig
+	buffer *retryBuffer
+	// tags は各パスに付加する ";key=value" の列です。
+	tags string
+	conn net.Conn
+}
+
+func newGraphiteSink(cfg *graphiteConfig) (*graphiteSink, error) {
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&tags, ";%s=%s", k, cfg.Tags[k])
+	}
+	return &graphiteSink{
+		cfg:    cfg,
+		buffer: newRetryBuffer("graphite", cfg.MaxBuffered),
+		tags:   tags.String(),
+	}, nil
+}
+
+func (s *graphiteSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var b []byte
+		for _, rd := range rs {
+			b = s.appendReading(b, rd)
+		}
+		return s.write(ctx, b)
+	})
+}
+
+// appendReading は取得値を "<prefix>.<name>[;tag=value...] <value> <timestamp>" の行で追加します。
+// 定時積算電力量は <prefix>.fixed_time.<direction>.energy_kwh として計測日時で出力します。
+func (s *graphiteSink) appendReading(b []byte, r *reading) []byte {
+	for _, f := range r.fields() {
+		b = s.appendLine(b, f.Name, f.Value, r.Time)
+	}
+	for _, ft := range r.fixedTimeFields() {
+		b = s.appendLine(b, "fixed_time."+ft.Direction+".energy_kwh", ft.KWh, ft.Time)
+	}
+	return b
+}
+
+func (s *graphiteSink) appendLine(b []byte, name string, v float64, t time.Time) []byte {
+	b = append(b, s.cfg.Prefix...)
+	b = append(b, '.')
+	b = append(b, name...)
+	b = append(b, s.tags...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, v, 'f', -1, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t.Unix(), 10)
+	return append(b, '\n')
+}
+
+func (s *graphiteSink) write(ctx context.Context, b []byte) error {
+	if s.conn == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.cfg.Address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *graphiteSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcServicePrefix は gRPC API のメソッドのパスの接頭辞です。
+// サービスの定義は proto/smartmeter/v1/smartmeter.proto にあります。
+const grpcServicePrefix = "/smartmeter.v1.SmartMeter/"
+
+// grpcMaxRequestSize は受け付ける要求のメッセージの最大長です。要求のメッセージはいずれも空です。
+const grpcMaxRequestSize = 4096
+
+// gRPC のステータスコード
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcStatus は gRPC の応答のステータスです。
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+// grpcResponse は1つの RPC の応答です。メッセージを送信し、最後にトレーラーでステータスを送ります。
+type grpcResponse struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// newGRPCResponse は応答のヘッダーを送信します。
+func newGRPCResponse(w http.ResponseWriter) *grpcResponse {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	return &grpcResponse{w: w, rc: http.NewResponseController(w)}
+}
+
+// send は長さを前置したメッセージを送信します。メッセージは圧縮しません。
+func (g *grpcResponse) send(msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	if _, err := g.w.Write(append(b, msg...)); err != nil {
+		return err
+	}
+	return g.rc.Flush()
+}
+
+// finish はステータスをトレーラーで送ります。
+func (g *grpcResponse) finish(st grpcStatus) {
+	g.w.Header().Set("Grpc-Status", strconv.Itoa(st.code))
+	if st.message != "" {
+		g.w.Header().Set("Grpc-Message", url.PathEscape(st.message))
+	}
+}
+
+// readGRPCRequest は要求のメッセージを1つ読み込みます。
+func readGRPCRequest(r io.Reader) ([]byte, *grpcStatus) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcStatus{grpcInvalidArgument, "missing request message"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > grpcMaxRequestSize {
+		return nil, &grpcStatus{grpcResourceExhausted, "request message too large"}
+	}
+	if n > 0 && prefix[0] != 0 {
+		return nil, &grpcStatus{grpcUnimplemented, "compressed requests are not supported"}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcStatus{grpcInvalidArgument, "truncated request message"}
+	}
+	return msg, nil
+}
+
+// grpcHandler は gRPC API (smartmeter.v1.SmartMeter) のハンドラーです。
+// grpc-go などに依存しないよう、gRPC の HTTP/2 上のプロトコルと protobuf のエンコードを直接扱います。
+func grpcHandler(devicePath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+			!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "Only gRPC requests allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		g := newGRPCResponse(w)
+		// 要求のメッセージはいずれも空のため、内容は使わない
+		if _, st := readGRPCRequest(r.Body); st != nil {
+			g.finish(*st)
+			return
+		}
+		switch method := strings.TrimPrefix(r.URL.Path, grpcServicePrefix); method {
+		case "GetLatest":
+			values := latest.snapshot()
+			if len(values) == 0 {
+				g.finish(grpcStatus{grpcUnavailable, "no reading yet"})
+				return
+			}
+			_ = g.send(encodeGRPCReading(values))
+		case "StreamReadings":
+			if st := streamGRPCReadings(r, g); st != nil {
+				g.finish(*st)
+				return
+			}
+		case "GetDeviceInfo":
+			_ = g.send(encodeGRPCDeviceInfo(devicePath, meterInfo.Load(), sessionStart.Load()))
+		default:
+			g.finish(grpcStatus{grpcUnimplemented, "unknown method " + r.URL.Path})
+			return
+		}
+		g.finish(grpcStatus{code: grpcOK})
+	})
+}
+
+// streamGRPCReadings は直近の取得値を送り、以降は取得する度にその取得値を送ります。
+// クライアントが切断するまで続けます。サーバーの終了時は UNAVAILABLE を返します。
+func streamGRPCReadings(r *http.Request, g *grpcResponse) *grpcStatus {
+	ch := stream.subscribe()
+	defer stream.unsubscribe(ch)
+	if values := latest.snapshot(); len(values) > 0 {
+		if err := g.send(encodeGRPCReading(values)); err != nil {
+			return nil
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case ev, ok := <-ch:
+			if !ok {
+				return &grpcStatus{grpcUnavailable, "server is shutting down"}
+			}
+			values, isReading := ev.Data.(map[string]apiSample)
+			if ev.Type != "reading" || !isReading {
+				continue
+			}
+			if err := g.send(encodeGRPCReading(values)); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// appendGRPCTimestamp は google.protobuf.Timestamp のフィールドを追加します。
+func appendGRPCTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+	ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Nanosecond()))
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
+
+// appendGRPCString は空でない文字列のフィールドを追加します。proto3 では空文字列は省略します。
+func appendGRPCString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// encodeGRPCReading は項目毎の取得値を Reading メッセージにエンコードします。
+func encodeGRPCReading(values map[string]apiSample) []byte {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b []byte
+	for _, name := range names {
+		v := values[name]
+		var sb []byte
+		sb = appendGRPCString(sb, 1, name)
+		sb = protowire.AppendTag(sb, 2, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(v.Value))
+		sb = appendGRPCTimestamp(sb, 3, v.Time)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// encodeGRPCDeviceInfo はデバイスとスマートメーターの情報を DeviceInfo メッセージにエンコードします。
+// id はスマートメーターの識別情報 (nil は未取得)、start は PANA セッションの開始時刻 (Unix ナノ秒、0 はなし) です。
+func encodeGRPCDeviceInfo(devicePath string, id *meterIdentity, start int64) []byte {
+	b := appendGRPCString(nil, 1, devicePath)
+	if id != nil {
+		b = appendGRPCString(b, 2, id.Manufacturer)
+		b = appendGRPCString(b, 3, id.ProductCode)
+		b = appendGRPCString(b, 4, id.ProductionNumber)
+		b = appendGRPCString(b, 5, id.IdentificationNumber)
+		b = appendGRPCString(b, 6, id.Version)
+	}
+	if start != 0 {
+		b = appendGRPCTimestamp(b, 7, time.Unix(0, start))
+	}
+	return b
+}
+
+// startGRPCServer は -grpc.port が指定されている場合に、gRPC API を待ち受けます。
+// -web.config.file に TLS の設定がある場合は TLS で、ない場合は TLS なしの HTTP/2 (h2c) で待ち受けます。
+// auth が nil でない場合は Basic 認証を行います。指定されていない場合は nil を返します。
+func startGRPCServer(cfg *config, auth *basicAuthenticator, logger *slog.Logger) *http.Server {
+	if cfg.GRPCPort == "" {
+		return nil
+	}
+	tlsConfig, err := cfg.webTLSConfig()
+	if err != nil {
+		logger.Error("Invalid web config", "error", err)
+		os.Exit(1)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(grpcServicePrefix, grpcHandler(cfg.DevicePath))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := newGRPCResponse(w)
+		g.finish(grpcStatus{grpcUnimplemented, "unknown service " + r.URL.Path})
+	}))
+	handler := http.Handler(mux)
+	if auth != nil {
+		handler = auth.grpcHandler(mux)
+	}
+	var protocols http.Protocols
+	if tlsConfig != nil {
+		protocols.SetHTTP2(true)
+		tlsConfig = grpcTLSConfig(tlsConfig)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	server := &http.Server{
+		Addr:              ":" + cfg.GRPCPort,
+		Handler:           handler,
+		Protocols:         &protocols,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// 接続したままの StreamReadings は Shutdown で終わらないため、イベントの配信を終了する
+	server.RegisterOnShutdown(stream.close)
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			// 証明書は tlsConfig で読み込む
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("gRPC server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+	logger.Info("Serving gRPC API", "port", cfg.GRPCPort, "tls", tlsConfig != nil)
+	return server
+}
+
+// grpcTLSConfig は HTTPS の tls.Config を gRPC で使えるようにします。
+// HTTPS は WebSocket のために HTTP/1.1 で通信しますが、gRPC は HTTP/2 を必要とします。
+func grpcTLSConfig(base *tls.Config) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := base.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			cfg.NextProtos = []string{"h2"}
+			return cfg, nil
+		},
+	}
+}
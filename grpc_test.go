@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcFrame は長さを前置した gRPC のメッセージを作成します。
+func grpcFrame(compressed byte, msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	b[0] = compressed
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func TestReadGRPCRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		want     []byte
+		wantCode int
+	}{
+		{"empty message", grpcFrame(0, nil), []byte{}, grpcOK},
+		{"message", grpcFrame(0, []byte{0x08, 0x01}), []byte{0x08, 0x01}, grpcOK},
+		// 空のメッセージは圧縮フラグに関わらず受け付ける
+		{"compressed empty message", grpcFrame(1, nil), []byte{}, grpcOK},
+		{"compressed", grpcFrame(1, []byte{0x08, 0x01}), nil, grpcUnimplemented},
+		{"missing", nil, nil, grpcInvalidArgument},
+		{"short prefix", []byte{0, 0, 0}, nil, grpcInvalidArgument},
+		{"truncated", grpcFrame(0, []byte{0x08, 0x01})[:6], nil, grpcInvalidArgument},
+		{"too large", []byte{0, 0, 0, 0x10, 0x01}, nil, grpcResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, st := readGRPCRequest(bytes.NewReader(tt.in))
+			code := grpcOK
+			if st != nil {
+				code = st.code
+			}
+			if code != tt.wantCode {
+				t.Fatalf("readGRPCRequest() status = %+v, want code %d", st, tt.wantCode)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("readGRPCRequest() = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	g := newGRPCResponse(rec)
+	if err := g.send([]byte{0x0A, 0x00}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	g.finish(grpcStatus{grpcUnavailable, "no reading yet"})
+
+	if got := rec.Header().Get("Content-Type"); got != "application/grpc" {
+		t.Errorf("Content-Type = %q, want application/grpc", got)
+	}
+	if want := grpcFrame(0, []byte{0x0A, 0x00}); !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Errorf("body = % X, want % X", rec.Body.Bytes(), want)
+	}
+	if got := rec.Header().Get("Grpc-Status"); got != "14" {
+		t.Errorf("Grpc-Status = %q, want 14", got)
+	}
+	if got := rec.Header().Get("Grpc-Message"); got != "no%20reading%20yet" {
+		t.Errorf("Grpc-Message = %q, want percent-encoded message", got)
+	}
+}
+
+func TestEncodeGRPCReading(t *testing.T) {
+	at := time.Date(2025, 10, 16, 12, 0, 0, 500, time.UTC)
+	values := map[string]apiSample{
+		"power_watts":         {Value: 512, Time: at},
+		"energy_consumed_kwh": {Value: 1234.5, Time: at},
+	}
+	b := encodeGRPCReading(values)
+
+	// Reading.samples (1) を順に取り出し、名前の昇順に並んでいることを確かめる
+	var names []string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field %d (type %d)", num, typ)
+		}
+		b = b[n:]
+		sample, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("ConsumeBytes() error = %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		name, value, ts := decodeGRPCSample(t, sample)
+		names = append(names, name)
+		if want := values[name]; value != want.Value || !ts.Equal(want.Time) {
+			t.Errorf("sample %s = %v at %v, want %v at %v", name, value, ts, want.Value, want.Time)
+		}
+	}
+	if len(names) != 2 || names[0] != "energy_consumed_kwh" || names[1] != "power_watts" {
+		t.Errorf("sample names = %v, want sorted names", names)
+	}
+}
+
+// decodeGRPCSample は Sample メッセージ (name = 1, value = 2, time = 3) をデコードします。
+func decodeGRPCSample(t *testing.T, b []byte) (string, float64, time.Time) {
+	t.Helper()
+	var (
+		name  string
+		value float64
+		ts    time.Time
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s, m := protowire.ConsumeString(b)
+			name, n = s, m
+		case num == 2 && typ == protowire.Fixed64Type:
+			v, m := protowire.ConsumeFixed64(b)
+			value, n = math.Float64frombits(v), m
+		case num == 3 && typ == protowire.BytesType:
+			tb, m := protowire.ConsumeBytes(b)
+			ts, n = decodeGRPCTimestamp(t, tb), m
+		default:
+			t.Fatalf("unexpected field %d (type %d)", num, typ)
+		}
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return name, value, ts
+}
+
+// decodeGRPCTimestamp は google.protobuf.Timestamp をデコードします。
+func decodeGRPCTimestamp(t *testing.T, b []byte) time.Time {
+	t.Helper()
+	var sec, nsec uint64
+	for len(b) > 0 {
+		num, _, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		v, m := protowire.ConsumeVarint(b)
+		if m < 0 {
+			t.Fatalf("timestamp field %d: %v", num, protowire.ParseError(m))
+		}
+		b = b[m:]
+		switch num {
+		case 1:
+			sec = v
+		case 2:
+			nsec = v
+		}
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func TestEncodeGRPCDeviceInfo(t *testing.T) {
+	start := time.Date(2025, 10, 16, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		id     *meterIdentity
+		start  int64
+		fields []protowire.Number
+	}{
+		{"device only", nil, 0, []protowire.Number{1}},
+		{
+			"identity",
+			&meterIdentity{Manufacturer: "000016", ProductionNumber: "123", Version: "J"},
+			0,
+			[]protowire.Number{1, 2, 4, 6},
+		},
+		{"session", nil, start.UnixNano(), []protowire.Number{1, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := encodeGRPCDeviceInfo("/dev/ttyUSB0", tt.id, tt.start)
+			var got []protowire.Number
+			for len(b) > 0 {
+				num, typ, n := protowire.ConsumeTag(b)
+				b = b[n:]
+				n = protowire.ConsumeFieldValue(num, typ, b)
+				if n < 0 {
+					t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+				}
+				b = b[n:]
+				got = append(got, num)
+			}
+			if !slices.Equal(got, tt.fields) {
+				t.Errorf("fields = %v, want %v", got, tt.fields)
+			}
+		})
+	}
+}
+
+func TestGRPCHandler(t *testing.T) {
+	const grpcType = "application/grpc"
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		protoMajor  int
+		body        []byte
+		wantHTTP    int
+		wantStatus  string
+	}{
+		{"not gRPC", "GetLatest", "application/json", 2, nil, 415, ""},
+		{"HTTP/1.1", "GetLatest", grpcType, 1, nil, 415, ""},
+		{"no reading", "GetLatest", grpcType, 2, grpcFrame(0, nil), 200, "14"},
+		{"unknown method", "Reboot", grpcType, 2, grpcFrame(0, nil), 200, "12"},
+		{"missing message", "GetDeviceInfo", grpcType, 2, nil, 200, "3"},
+		{"device info", "GetDeviceInfo", grpcType, 2, grpcFrame(0, nil), 200, "0"},
+	}
+	h := grpcHandler("/dev/ttyUSB0")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				http.MethodPost, grpcServicePrefix+tt.method, bytes.NewReader(tt.body))
+			req.ProtoMajor = tt.protoMajor
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantHTTP {
+				t.Fatalf("HTTP status = %d, want %d", rec.Code, tt.wantHTTP)
+			}
+			if got := rec.Header().Get("Grpc-Status"); got != tt.wantStatus {
+				t.Errorf("Grpc-Status = %q, want %q", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGRPCTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	path := writeWebConfig(t, dir, "tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n")
+	base, err := (&config{WebConfigFile: path}).webTLSConfig()
+	if err != nil || base == nil {
+		t.Fatalf("webTLSConfig() = %v, %v", base, err)
+	}
+	// gRPC は HTTP/2 で、HTTPS は HTTP/1.1 で通信する
+	got, err := grpcTLSConfig(base).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient() error = %v", err)
+	}
+	if !slices.Equal(got.NextProtos, []string{"h2"}) || len(got.Certificates) != 1 {
+		t.Errorf("gRPC NextProtos = %v, certificates = %d", got.NextProtos, len(got.Certificates))
+	}
+	https, err := base.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient() error = %v", err)
+	}
+	if !slices.Equal(https.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("HTTPS NextProtos = %v", https.NextProtos)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// minLivenessTimeout は /healthz が取得ループの停止と判断するまでの最短の時間です。
+// 再認証や要求の再試行で1回の取得に数分かかることがあるため、取得間隔が短くてもこれより短くしません。
+const minLivenessTimeout = 10 * time.Minute
+
+var (
+	// scrapeLoopBeat は取得ループが最後に動作した時刻 (Unix ナノ秒、0 は開始前) です。
+	// /healthz の要求と取得ループの双方から参照するため atomic で保持します。
+	scrapeLoopBeat atomic.Int64
+	// livenessTimeout は取得ループが動作しないまま経過すると停止と判断する時間です。
+	livenessTimeout atomic.Int64
+	// scrapeSuccess は定期取得に最後に成功した時刻 (Unix ナノ秒、0 は未成功) です。
+	scrapeSuccess atomic.Int64
+	// readinessMaxAge は /readyz が準備完了とする、最後の取得成功からの経過時間の上限です。
+	readinessMaxAge atomic.Int64
+)
+
+// beatScrapeLoop は取得ループが動作していることを記録します。
+func beatScrapeLoop() {
+	scrapeLoopBeat.Store(time.Now().UnixNano())
+}
+
+// setLivenessTimeout は取得間隔から livenessTimeout を設定します。取得間隔の3倍で、minLivenessTimeout 以上です。
+func setLivenessTimeout(interval time.Duration) {
+	livenessTimeout.Store(int64(max(3*interval, minLivenessTimeout)))
+}
+
+// livenessHandler はプロセスと取得ループが動作している間は 200 を返す /healthz のハンドラーです。
+// 取得ループの開始前 (デバイスの接続中) と、定期取得を行わない場合は、プロセスが動作していれば 200 を返します。
+func livenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if beat := scrapeLoopBeat.Load(); beat != 0 {
+			age := time.Since(time.Unix(0, beat))
+			if timeout := time.Duration(livenessTimeout.Load()); age > timeout {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "Scrape loop has not run for %s (timeout %s).\n",
+					age.Round(time.Second), timeout)
+				return
+			}
+		}
+		_, _ = io.WriteString(w, "OK.\n")
+	})
+}
+
+// readinessHandler は定期取得に成功していて、最後の成功から取得間隔の -readiness.intervals 倍が
+// 経過していない間は 200 を、それ以外は 503 を返す /readyz のハンドラーです。
+// scraping が false (定期取得を行わない) の場合は常に 200 を返します。
+func readinessHandler(scraping bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if scraping {
+			last := scrapeSuccess.Load()
+			if last == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = io.WriteString(w, "No successful scrape yet.\n")
+				return
+			}
+			age := time.Since(time.Unix(0, last))
+			if maxAge := time.Duration(readinessMaxAge.Load()); age > maxAge {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "Last successful scrape was %s ago (max %s).\n",
+					age.Round(time.Second), maxAge)
+				return
+			}
+		}
+		_, _ = io.WriteString(w, "Ready.\n")
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 積算電力量計測値履歴 (EPC 0xE2, 0xEC) 関連のプロパティ
+const (
+	epcHistoryEnergyNormal = 0xE2 // 積算電力量計測値履歴1 (正方向計測値)
+	epcHistoryDay          = 0xE5 // 積算履歴収集日1
+	epcHistory2Energy      = 0xEC // 積算電力量計測値履歴2 (正方向、逆方向計測値)
+	epcHistory2Time        = 0xED // 積算履歴収集日2
+)
+
+// setC はプロパティ値書き込み要求 (応答要) の ESV です。go-smartmeter は Get と GetRes のみを定義しています。
+const setC smartmeter.ServiceCode = 0x61
+
+const (
+	// historySlots は1日分の履歴に含まれる30分毎のコマ数です。
+	historySlots = 48
+	// historySlotInterval は履歴1コマの間隔です。
+	historySlotInterval = 30 * time.Minute
+	// historyMaxDays は遡って取得する最大日数です (スマートメーターは当日を含め最大100日分を保持)。
+	historyMaxDays = 99
+	// backfillGap はこれ以上スクレイプが途絶えた場合に履歴を取得し直す間隔です。
+	backfillGap = 30 * time.Minute
+	// history2MaxSlots は積算電力量計測値履歴2で1回に取得できる最大コマ数です。
+	history2MaxSlots = 12
+)
+
+var (
+	// 履歴から取得したデータ点の数
+	backfillPoints = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_backfill_points_total",
+		Help: "Total number of half-hourly cumulative energy points recovered from meter history",
+	})
+	// 最後に履歴取得に成功した時刻 (Unix Timestamp)
+	lastBackfillGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_last_backfill_timestamp_seconds",
+		Help: "Unix timestamp of the last successful history backfill",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(backfillPoints)
+	prometheus.MustRegister(lastBackfillGauge)
+}
+
+// historyPoint は履歴1コマ分の積算電力量です。
+type historyPoint struct {
+	Time  time.Time
+	Value uint32
+}
+
+// decodeEnergyHistory は積算電力量計測値履歴 (EPC 0xE2) をデコードします。
+// EDT は 収集日(2) と 48コマ分の積算電力量(4バイト×48) の194バイトです。
+// 収集日は today を基準とした日数 (0: 当日, 1: 前日, ...) として解釈します。
+func decodeEnergyHistory(edt []byte, today time.Time) (int, []historyPoint, error) {
+	if len(edt) != 2+historySlots*4 {
+		return 0, nil, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	day := int(binary.BigEndian.Uint16(edt[:2]))
+	y, m, d := today.In(meterLocation).Date()
+	base := time.Date(y, m, d-day, 0, 0, 0, 0, meterLocation)
+
+	points := make([]historyPoint, 0, historySlots)
+	for i := range historySlots {
+		v := binary.BigEndian.Uint32(edt[2+i*4:])
+		if !isValidCumulativeEnergy(v) {
+			continue
+		}
+		points = append(points, historyPoint{
+			Time:  base.Add(time.Duration(i) * historySlotInterval),
+			Value: v,
+		})
+	}
+	return day, points, nil
+}
+
+// historyLocation は履歴から復元した時刻を出力するタイムゾーン (-timezone) です。
+// 履歴の収集日や30分毎のコマはスマートメーターの時計 (meterLocation) に従います。
+var historyLocation = meterLocation
+
+// backfillHistory は since から until までの30分毎の積算電力量をスマートメーターの履歴から取得します。
+func backfillHistory(dev *smartmeter.Device, since, until time.Time, logger *slog.Logger) {
+	if energyUnitKWh == 0 {
+		logger.Debug("Skipping backfill: cumulative energy unit is unknown")
+		return
+	}
+
+	days := daysBetween(since, until)
+	if days > historyMaxDays {
+		days = historyMaxDays
+	}
+	logger.Info("Backfilling history", "since", since, "until", until, "days", days+1)
+
+	recovered := 0
+	for day := days; day >= 0; day-- {
+		points, err := queryEnergyHistory(dev, day, until)
+		if err != nil {
+			logger.Warn("Failed to read history", "day", day, "error", err)
+			recordError(errorTypeBackfill, err)
+			return
+		}
+		for _, p := range points {
+			if !p.Time.After(since) || p.Time.After(until) {
+				continue
+			}
+			recordHistoryPoint(p, logger)
+			recovered++
+		}
+	}
+
+	backfillPoints.Add(float64(recovered))
+	lastBackfillGauge.Set(float64(time.Now().Unix()))
+	logger.Info("History backfill finished", "points", recovered)
+}
+
+// queryEnergyHistory は収集日を設定した上で1日分の積算電力量計測値履歴を取得します。
+func queryEnergyHistory(dev *smartmeter.Device, day int, now time.Time) ([]historyPoint, error) {
+	set := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		setC,
+		[]*smartmeter.Property{
+			smartmeter.NewProperty(epcHistoryDay, []byte{byte(day)}),
+		},
+	)
+	if _, err := query(dev, set); err != nil {
+		return nil, fmt.Errorf("set history day: %w", err)
+	}
+
+	get := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		smartmeter.Get,
+		[]*smartmeter.Property{
+			smartmeter.NewProperty(epcHistoryEnergyNormal, nil),
+		},
+	)
+	response, err := query(dev, get)
+	if err != nil {
+		return nil, fmt.Errorf("get history: %w", err)
+	}
+	for _, p := range response.Properties {
+		if p.EPC != epcHistoryEnergyNormal {
+			continue
+		}
+		gotDay, points, err := decodeEnergyHistory(p.EDT, now)
+		if err != nil {
+			return nil, err
+		}
+		if gotDay != day {
+			return nil, fmt.Errorf("history day mismatch: requested %d, got %d", day, gotDay)
+		}
+		return points, nil
+	}
+	return nil, fmt.Errorf("response contained no history property")
+}
+
+// recordHistoryPoint は履歴から復元したデータ点を、/api/v1/history と過去の時刻の値を受け付ける出力先に送ります。
+// 積算電力量は定期取得の値と同じく、桁あふれを補正した値にします。
+func recordHistoryPoint(p historyPoint, logger *slog.Logger) {
+	counter := energyCounters[epcCumulativeEnergyNormal]
+	kwh := float64(counter.unwrap(p.Value, energyModulus())) * energyUnitKWh
+	r := &reading{Time: p.Time, EnergyConsumedKWh: &kwh}
+	history.insert(r)
+	publishHistoricalReading(r)
+	logger.Debug("Recovered history", "time", p.Time.In(historyLocation), "energy_consumed_kwh", kwh)
+}
+
+// needsBackfill は前回成功時刻から履歴の再取得が必要かどうかを判定します。
+func needsBackfill(lastSuccess, now time.Time) bool {
+	return lastSuccess.IsZero() || now.Sub(lastSuccess) >= backfillGap
+}
+
+// daysBetween は since の日付から until の日付までの日数を返します。
+func daysBetween(since, until time.Time) int {
+	sy, sm, sd := since.In(meterLocation).Date()
+	uy, um, ud := until.In(meterLocation).Date()
+	s := time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)
+	u := time.Date(uy, um, ud, 0, 0, 0, 0, time.UTC)
+	return int(u.Sub(s).Hours() / 24)
+}
+
+// history2Point は積算電力量計測値履歴2の1コマ分 (正方向、逆方向) です。
+// 値が記録されていない方向は有効範囲外の値 (0xFFFFFFFE) になります。
+type history2Point struct {
+	Time    time.Time
+	Normal  uint32
+	Reverse uint32
+}
+
+// encodeHistory2Time は積算履歴収集日2 (EPC 0xED) の EDT を生成します。
+// EDT は 年(2) 月(1) 日(1) 時(1) 分(1) 収集コマ数(1) の7バイトです。
+func encodeHistory2Time(t time.Time, slots int) []byte {
+	t = t.In(meterLocation)
+	edt := make([]byte, 7)
+	binary.BigEndian.PutUint16(edt[:2], uint16(t.Year()))
+	edt[2] = byte(t.Month())
+	edt[3] = byte(t.Day())
+	edt[4] = byte(t.Hour())
+	edt[5] = byte(t.Minute())
+	edt[6] = byte(slots)
+	return edt
+}
+
+// decodeEnergyHistory2 は積算電力量計測値履歴2 (EPC 0xEC) をデコードします。
+// EDT は 年(2) 月(1) 日(1) 時(1) 分(1) 収集コマ数(1) と、
+// 指定日時から遡る順に並んだ 正方向(4) 逆方向(4) の組です。
+func decodeEnergyHistory2(edt []byte) ([]history2Point, error) {
+	if len(edt) < 7 {
+		return nil, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	end, err := decodeDateTime(append(edt[:6:6], 0))
+	if err != nil {
+		return nil, err
+	}
+	slots := int(edt[6])
+	if len(edt) != 7+slots*8 {
+		return nil, fmt.Errorf("unexpected EDT length: %d for %d slots", len(edt), slots)
+	}
+
+	points := make([]history2Point, slots)
+	for i := range slots {
+		off := 7 + i*8
+		// 古い順に並べ替える
+		points[slots-1-i] = history2Point{
+			Time:    end.Add(-time.Duration(i) * historySlotInterval),
+			Normal:  binary.BigEndian.Uint32(edt[off:]),
+			Reverse: binary.BigEndian.Uint32(edt[off+4:]),
+		}
+	}
+	return points, nil
+}
+
+// queryEnergyHistory2 は end から遡って slots コマ分の積算電力量計測値履歴2を取得します。
+func queryEnergyHistory2(
+	dev *smartmeter.Device,
+	end time.Time,
+	slots int,
+) ([]history2Point, error) {
+	set := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		setC,
+		[]*smartmeter.Property{
+			smartmeter.NewProperty(epcHistory2Time, encodeHistory2Time(end, slots)),
+		},
+	)
+	if _, err := query(dev, set); err != nil {
+		return nil, fmt.Errorf("set history time: %w", err)
+	}
+
+	get := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		smartmeter.Get,
+		[]*smartmeter.Property{
+			smartmeter.NewProperty(epcHistory2Energy, nil),
+		},
+	)
+	response, err := query(dev, get)
+	if err != nil {
+		return nil, fmt.Errorf("get history: %w", err)
+	}
+	for _, p := range response.Properties {
+		if p.EPC == epcHistory2Energy {
+			return decodeEnergyHistory2(p.EDT)
+		}
+	}
+	return nil, fmt.Errorf("response contained no history property")
+}
+
+// dumpHistory2 は直近 days 日分の30分毎の積算電力量 (正方向、逆方向) を CSV で w に書き出します。
+func dumpHistory2(dev *smartmeter.Device, days int, w io.Writer, logger *slog.Logger) error {
+	if err := resolveEnergyScale(dev, logger); err != nil {
+		return err
+	}
+
+	until := time.Now().Truncate(historySlotInterval)
+	since := until.Add(-time.Duration(days) * 24 * time.Hour)
+	span := history2MaxSlots * historySlotInterval
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"time", "energy_consumed_kwh", "energy_exported_kwh"}); err != nil {
+		return err
+	}
+	for start := since.Add(historySlotInterval); !start.After(until); start = start.Add(span) {
+		end := start.Add(span - historySlotInterval)
+		if end.After(until) {
+			end = until
+		}
+		slots := int(end.Sub(start)/historySlotInterval) + 1
+		logger.Debug("Reading history", "end", end, "slots", slots)
+
+		points, err := queryEnergyHistory2(dev, end, slots)
+		if err != nil {
+			return err
+		}
+		for _, p := range points {
+			record := []string{
+				p.Time.In(historyLocation).Format(time.RFC3339),
+				formatHistoryValue(p.Normal),
+				formatHistoryValue(p.Reverse),
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatHistoryValue は履歴の値を kWh の文字列に変換します。値がない場合は空文字列を返します。
+func formatHistoryValue(v uint32) string {
+	if !isValidCumulativeEnergy(v) {
+		return ""
+	}
+	return strconv.FormatFloat(float64(v)*energyUnitKWh, 'f', -1, 64)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 機器オブジェクトスーパークラスの識別情報に関するプロパティ (EPC)
+const (
+	epcVersion              = 0x82 // 規格Version情報
+	epcIdentificationNumber = 0x83 // 識別番号
+	epcManufacturerCode     = 0x8A // メーカコード
+	epcProductCode          = 0x8C // 商品コード
+	epcProductionNumber     = 0x8D // 製造番号
+)
+
+// メーターの識別情報 (値は常に 1)
+var meterInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "smartmeter_meter_info",
+	Help: "Identification of the smart meter the exporter is talking to",
+}, []string{
+	"manufacturer",
+	"product_code",
+	"production_number",
+	"identification_number",
+	"version",
+})
+
+// メーター交換 (識別情報の変化) の検出回数
+var meterChanges = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "smartmeter_meter_changes_total",
+	Help: "Total number of times the meter identification changed (e.g. meter replacement)",
+})
+
+func init() {
+	prometheus.MustRegister(meterInfoGauge)
+	prometheus.MustRegister(meterChanges)
+}
+
+// identityCheckInterval はメーター交換を検出するために識別情報を再取得する間隔です。
+const identityCheckInterval = time.Hour
+
+// meterIdentity はスマートメーターの識別情報です。取得できなかった項目は空文字列になります。
+type meterIdentity struct {
+	Manufacturer         string // メーカコード (16進数6桁)
+	ProductCode          string // 商品コード
+	ProductionNumber     string // 製造番号
+	IdentificationNumber string // 識別番号 (16進数)
+	Version              string // 規格Version情報 (リリース番号とリビジョン)
+}
+
+var (
+	// currentMeter は最後に取得したスマートメーターの識別情報です (nil は未取得)。
+	currentMeter *meterIdentity
+	// lastIdentityCheck は最後に識別情報を取得した時刻です。
+	lastIdentityCheck time.Time
+	// meterInfo は取得ループ以外の goroutine (gRPC API の要求など) から参照するための currentMeter です。
+	meterInfo atomic.Pointer[meterIdentity]
+)
+
+// sameMeter は2つの識別情報が同一のメーターを指しているかどうかを返します。
+// 規格Version情報はファームウェア更新で変わり得るため比較しません。
+func (id *meterIdentity) sameMeter(other *meterIdentity) bool {
+	return id.Manufacturer == other.Manufacturer &&
+		id.IdentificationNumber == other.IdentificationNumber &&
+		id.ProductionNumber == other.ProductionNumber
+}
+
+// needsIdentityCheck は識別情報を (再) 取得すべきかどうかを返します。
+func needsIdentityCheck(now time.Time) bool {
+	return currentMeter == nil || now.Sub(lastIdentityCheck) >= identityCheckInterval
+}
+
+// readMeterIdentity はスマートメーターの識別情報を取得します。
+func readMeterIdentity(dev *smartmeter.Device) (*meterIdentity, error) {
+	response, err := getProperties(
+		dev,
+		epcManufacturerCode,
+		epcIdentificationNumber,
+		epcProductCode,
+		epcProductionNumber,
+		epcVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &meterIdentity{}
+	for _, p := range response.Properties {
+		// 未実装のプロパティは EDT が空で返る
+		if len(p.EDT) == 0 {
+			continue
+		}
+		switch p.EPC {
+		case epcManufacturerCode:
+			id.Manufacturer = hex.EncodeToString(p.EDT)
+		case epcIdentificationNumber:
+			id.IdentificationNumber = hex.EncodeToString(p.EDT)
+		case epcProductCode:
+			id.ProductCode = asciiString(p.EDT)
+		case epcProductionNumber:
+			id.ProductionNumber = asciiString(p.EDT)
+		case epcVersion:
+			id.Version = decodeVersion(p.EDT)
+		}
+	}
+	if id.Manufacturer == "" && id.IdentificationNumber == "" {
+		return nil, fmt.Errorf("response contained no identification properties")
+	}
+	return id, nil
+}
+
+// resolveMeterIdentity はスマートメーターの識別情報を取得し、smartmeter_meter_info に反映します。
+// 前回と異なるメーターを検出した場合は、メーター固有の情報を破棄して取得し直させます。
+func resolveMeterIdentity(dev *smartmeter.Device, logger *slog.Logger) error {
+	id, err := readMeterIdentity(dev)
+	if err != nil {
+		return err
+	}
+	lastIdentityCheck = time.Now()
+	if currentMeter != nil {
+		if currentMeter.sameMeter(id) {
+			currentMeter = id
+			meterInfo.Store(id)
+			return nil
+		}
+		meterChanges.Inc()
+		logger.Warn(
+			"Meter replacement detected",
+			"old_identification_number",
+			currentMeter.IdentificationNumber,
+			"new_identification_number",
+			id.IdentificationNumber,
+			"old_production_number",
+			currentMeter.ProductionNumber,
+			"new_production_number",
+			id.ProductionNumber,
+		)
+		resetMeterState()
+	}
+
+	meterInfoGauge.Reset()
+	meterInfoGauge.WithLabelValues(
+		id.Manufacturer,
+		id.ProductCode,
+		id.ProductionNumber,
+		id.IdentificationNumber,
+		id.Version,
+	).Set(1)
+	currentMeter = id
+	meterInfo.Store(id)
+	logger.Info(
+		"Meter identified",
+		"manufacturer",
+		id.Manufacturer,
+		"product_code",
+		id.ProductCode,
+		"production_number",
+		id.ProductionNumber,
+		"identification_number",
+		id.IdentificationNumber,
+		"version",
+		id.Version,
+	)
+	return nil
+}
+
+// decodeVersion は規格Version情報 (EPC 0x82) を "J.0" のような文字列にデコードします。
+// EDT は 0x00 0x00 リリース番号(ASCII) リビジョン番号 の4バイトです。
+func decodeVersion(edt []byte) string {
+	if len(edt) != 4 {
+		return hex.EncodeToString(edt)
+	}
+	return fmt.Sprintf("%c.%d", edt[2], edt[3])
+}
+
+// asciiString は ASCII 文字列の EDT から末尾の空白と NUL を取り除いた文字列を返します。
+func asciiString(edt []byte) string {
+	return strings.TrimRight(string(edt), " \x00")
+}
+
+// resetMeterState はメーター固有の情報と積算値の補正状態を破棄します。
+func resetMeterState() {
+	nodeObjects = nil
+	supportedEPCs = nil
+	lastClockCheck = time.Time{}
+	energyUnitKWh = 0
+	energyDigits = 0
+	for _, c := range energyCounters {
+		*c = rolloverCounter{}
+	}
+	dailyEnergy.valid = false
+	lastFault = nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// echonetPortHex は SKSENDTO と ERXUDP で使う ECHONET Lite の UDP ポート番号 (3610) です。
+const echonetPortHex = "0E1A"
+
+// fixedTimeSlot は定時積算電力量の計測間隔です。
+const fixedTimeSlot = 30 * time.Minute
+
+var (
+	// スマートメーターが自発的に送信した通知 (INF / INFC) に含まれていたプロパティの数
+	infNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_inf_notifications_total",
+		Help: "Properties received in unsolicited ECHONET Lite notifications (INF/INFC) by EPC",
+	}, []string{"epc"})
+	// 取得ループの処理が追いつかずに捨てた通知の数
+	infDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_inf_notifications_dropped_total",
+		Help: "Total number of unsolicited notifications dropped because the scrape loop was busy",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(infNotifications)
+	prometheus.MustRegister(infDropped)
+}
+
+// infFrames は要求の処理中に受信した通知を取得ループに渡します。
+// 通知の受信は要求の処理中に行われるため、メトリクスへの反映は要求の完了後に取得ループで行います。
+var infFrames = make(chan *smartmeter.Frame, 8)
+
+// queryEchonetLite は ECHONET Lite の要求を送信し、対応する応答を返します。
+// go-smartmeter の QueryEchonetLite と同じく SKSENDTO を送信しますが、応答を待つ間に受信した
+// スマートメーターからの通知 (INF / INFC) を読み捨てずに notify に渡します。
+func queryEchonetLite(
+	dev *smartmeter.Device,
+	req *smartmeter.Frame,
+	notify func(*smartmeter.Frame),
+	opts ...smartmeter.Option,
+) (*smartmeter.Frame, error) {
+	if dev.IPAddr == "" {
+		return nil, errors.New("ip address for smart electric energy meter is not specified")
+	}
+	raw := req.Build()
+	// SKSENDTO <HANDLE> <IPADDR> <PORT> <SEC> [<SIDE>] <DATALEN> <DATA>
+	// Dual Stack 版では送信先 (0: B ルート) を指定する
+	side := ""
+	if dev.DualStackSK {
+		side = " 0"
+	}
+	cmd := fmt.Sprintf(
+		"SKSENDTO 1 %s %s 1%s %04X %s",
+		dev.IPAddr,
+		echonetPortHex,
+		side,
+		len(raw),
+		raw,
+	)
+
+	var res *smartmeter.Frame
+	reader := func(line string) (bool, error) {
+		if strings.HasPrefix(line, "EVENT 21 ") {
+			// EVENT 21 は UDP 送信完了 (01: 送信失敗、02: アドレス要請)
+			switch {
+			case strings.HasSuffix(line, " 01"):
+				return false, fmt.Errorf(
+					"failed to send UDP packet (EVENT 21/01). %w",
+					smartmeter.ErrRetryable,
+				)
+			case strings.HasSuffix(line, " 02"):
+				return false, errors.New("pana unconnected (EVENT 21/02)")
+			}
+			return false, nil
+		}
+		f, ok := parseERXUDPFrame(line)
+		switch {
+		case !ok:
+		case f.CorrespondTo(req):
+			res = f
+			return true, nil
+		case notify != nil && isMeterNotification(f):
+			notify(f)
+		}
+		return false, nil
+	}
+	opts = append([]smartmeter.Option{smartmeter.Reader(reader)}, opts...)
+	if _, err := dev.QuerySKCommand(cmd, opts...); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseERXUDPFrame は Wi-SUN モジュールの ERXUDP イベントから ECHONET Lite のフレームを取り出します。
+// ERXUDP は "ERXUDP <SENDER> <DEST> <RPORT> <LPORT> <SENDERLLA> ... <DATALEN> <DATA>" の形式で、
+// Dual Stack 版では RSSI と SIDE が加わります。DATA が16進数 (WOPT 1) の場合のみ扱います。
+func parseERXUDPFrame(line string) (*smartmeter.Frame, bool) {
+	if !strings.HasPrefix(line, "ERXUDP ") {
+		return nil, false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 9 ||
+		!strings.EqualFold(fields[3], echonetPortHex) ||
+		!strings.EqualFold(fields[4], echonetPortHex) {
+		return nil, false
+	}
+	n, err := strconv.ParseUint(fields[len(fields)-2], 16, 16)
+	if err != nil {
+		return nil, false
+	}
+	data, err := hex.DecodeString(fields[len(fields)-1])
+	if err != nil || len(data) != int(n) {
+		return nil, false
+	}
+	f, err := smartmeter.ParseFrame(data)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// isMeterNotification はフレームがスマートメーターからの通知 (INF / INFC) かどうかを返します。
+func isMeterNotification(f *smartmeter.Frame) bool {
+	return (f.ESV == esvINF || f.ESV == esvINFC) && f.SEOJ == smartmeter.LvSmartElectricEnergyMeter
+}
+
+// queueNotification は通知を取得ループに渡します。取得ループの処理が追いつかない場合は捨てます。
+func queueNotification(f *smartmeter.Frame) {
+	select {
+	case infFrames <- f:
+	default:
+		infDropped.Inc()
+	}
+}
+
+// notificationTracker はスマートメーターからの通知で受信した定時積算電力量の計測時刻を覚えておきます。
+// 直近の計測分を通知で受信済みの EPC は、定時の取得で要求しないようにします。
+type notificationTracker struct {
+	fixedTime map[smartmeter.PropertyCode]time.Time
+}
+
+func newNotificationTracker() *notificationTracker {
+	return &notificationTracker{fixedTime: make(map[smartmeter.PropertyCode]time.Time)}
+}
+
+// apply は通知の内容をメトリクスに反映します。
+func (t *notificationTracker) apply(
+	dev *smartmeter.Device,
+	f *smartmeter.Frame,
+	logger *slog.Logger,
+) {
+	for _, p := range f.Properties {
+		infNotifications.WithLabelValues(epcLabel(p.EPC)).Inc()
+	}
+	r := decodeReading(f.Properties, logger)
+	custom := setCustomMetrics(f.Properties, logger)
+	if r.empty() && custom == 0 {
+		logger.Debug("Notification contained no recognized properties", "esv", f.ESV)
+		return
+	}
+	if r.FixedTimeConsumed != nil {
+		t.fixedTime[epcFixedTimeEnergyNormal] = r.FixedTimeConsumed.Time
+	}
+	if r.FixedTimeExported != nil {
+		t.fixedTime[epcFixedTimeEnergyReverse] = r.FixedTimeExported.Time
+	}
+	meterProperties.store(f.Properties)
+	setMetrics(r, logger)
+	dailyEnergy.update(dev, r, logger)
+	publishReading(r)
+	logger.Debug("Applied unsolicited notification", "properties", len(f.Properties))
+}
+
+// scrapeFixedTime は定時積算電力量を取得します。直近の計測分を通知で受信済みの EPC は要求しません。
+func (t *notificationTracker) scrapeFixedTime(
+	dev *smartmeter.Device,
+	epcs []smartmeter.PropertyCode,
+	logger *slog.Logger,
+) {
+	epcs = t.pending(epcs, time.Now())
+	if len(epcs) == 0 {
+		logger.Debug("Fixed-time energy already received by notification")
+		return
+	}
+	scrape(dev, epcs, logger)
+}
+
+// pending は epcs のうち、時刻 now の直前の計測分をまだ通知で受信していないものを返します。
+func (t *notificationTracker) pending(
+	epcs []smartmeter.PropertyCode,
+	now time.Time,
+) []smartmeter.PropertyCode {
+	slot := now.Truncate(fixedTimeSlot)
+	var out []smartmeter.PropertyCode
+	for _, epc := range epcs {
+		if at, ok := t.fixedTime[epc]; !ok || at.Before(slot) {
+			out = append(out, epc)
+		}
+	}
+	return out
+}
+
+// newNotificationPoller は通知を読み出すために Wi-SUN モジュールに問い合わせる間隔の ticker を作成します。
+// interval が 0 の場合は受信しないチャネルを返します。
+func newNotificationPoller(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
+
+// pollNotifications は Wi-SUN モジュールに SKINFO を送信し、その応答までに受信した通知を読み出します。
+// go-smartmeter は要求の処理中にしかシリアルポートの受信内容を読まないため、取得の合間に通知を処理するために使います。
+// SKINFO はモジュール内で完結するコマンドで、電波は送信しません。
+func pollNotifications(dev *smartmeter.Device, logger *slog.Logger) {
+	reader := func(line string) (bool, error) {
+		if f, ok := parseERXUDPFrame(line); ok && isMeterNotification(f) {
+			queueNotification(f)
+		}
+		return line == "OK", nil
+	}
+	if _, err := dev.QuerySKCommand("SKINFO", smartmeter.Reader(reader)); err != nil {
+		logger.Debug("Failed to poll Wi-SUN module for notifications", "error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	testERXUDPSender = "FE80:0000:0000:0000:021C:6400:0000:0001"
+	testERXUDPDest   = "FE80:0000:0000:0000:021D:1290:0000:0002"
+	testERXUDPLLA    = "001C640000000001"
+	// 定時積算電力量 (EA) の INF: 2025/10/16 12:00:00 に 12345
+	testINFFixedTime = "1081000102880105FF017301EA0B07E90A100C000000003039"
+	// 瞬時電力 (E7) の INF: 500W
+	testINFPower = "1081000102880105FF017301E704000001F4"
+	// 瞬時電力 (E7) の Get_Res
+	testGetResPower = "1081000202880105FF017201E704000001F4"
+)
+
+// testERXUDP は ECHONET Lite のポート間の ERXUDP イベントの行を組み立てます。
+func testERXUDP(length, data string) string {
+	return "ERXUDP " + testERXUDPSender + " " + testERXUDPDest + " 0E1A 0E1A " + testERXUDPLLA +
+		" 1 " + length + " " + data
+}
+
+func TestParseERXUDPFrame(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		wantOK     bool
+		wantESV    smartmeter.ServiceCode
+		wantNotify bool
+	}{
+		{"INF", testERXUDP("0019", testINFFixedTime), true, esvINF, true},
+		{
+			"dual stack",
+			"ERXUDP " + testERXUDPSender + " " + testERXUDPDest + " 0E1A 0E1A " + testERXUDPLLA +
+				" E1 1 0 0019 " + testINFFixedTime,
+			true, esvINF, true,
+		},
+		{"Get_Res", testERXUDP("0012", testGetResPower), true, smartmeter.GetRes, false},
+		{
+			"other port",
+			"ERXUDP " + testERXUDPSender + " " + testERXUDPDest + " 02CC 02CC " + testERXUDPLLA +
+				" 1 0019 " + testINFFixedTime,
+			false, 0, false,
+		},
+		{"length mismatch", testERXUDP("0018", testINFFixedTime), false, 0, false},
+		{"not hex", testERXUDP("0002", "ZZZZ"), false, 0, false},
+		{"not ECHONET Lite", testERXUDP("0002", "0102"), false, 0, false},
+		{
+			"too few fields",
+			"ERXUDP " + testERXUDPSender + " " + testERXUDPDest + " 0E1A 0E1A",
+			false, 0, false,
+		},
+		{"other event", "EVENT 21 " + testERXUDPSender + " 00", false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, ok := parseERXUDPFrame(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("parseERXUDPFrame() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if f.ESV != tt.wantESV {
+				t.Errorf("ESV = 0x%02X, want 0x%02X", f.ESV, tt.wantESV)
+			}
+			if got := isMeterNotification(f); got != tt.wantNotify {
+				t.Errorf("isMeterNotification() = %v, want %v", got, tt.wantNotify)
+			}
+		})
+	}
+}
+
+func TestNotificationTrackerApply(t *testing.T) {
+	raw, err := hex.DecodeString(testINFPower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := smartmeter.ParseFrame(raw)
+	if err != nil {
+		t.Fatalf("ParseFrame() error = %v", err)
+	}
+	counter := infNotifications.WithLabelValues(
+		epcLabel(smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower),
+	)
+	before := &dto.Metric{}
+	if err := counter.Write(before); err != nil {
+		t.Fatal(err)
+	}
+
+	newNotificationTracker().apply(nil, f, testLogger)
+
+	readings.mu.Lock()
+	power := readings.power
+	readings.mu.Unlock()
+	if power == nil || power.value != 500 {
+		t.Errorf("cached power = %+v, want 500", power)
+	}
+	m := &dto.Metric{}
+	if err := counter.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue() - before.GetCounter().GetValue(); got != 1 {
+		t.Errorf("smartmeter_inf_notifications_total increased by %v, want 1", got)
+	}
+}
+
+func TestNotificationTrackerApplyFixedTime(t *testing.T) {
+	setEnergyScale(t, 0.1, 6)
+	raw, err := hex.DecodeString(testINFFixedTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := smartmeter.ParseFrame(raw)
+	if err != nil {
+		t.Fatalf("ParseFrame() error = %v", err)
+	}
+	n := newNotificationTracker()
+	n.apply(nil, f, testLogger)
+	// 通知で受信した計測分は、その直後の定時の取得で要求しない
+	at := time.Date(2025, 10, 16, 12, 0, 0, 0, meterLocation)
+	epcs := []smartmeter.PropertyCode{epcFixedTimeEnergyNormal, epcFixedTimeEnergyReverse}
+	want := []smartmeter.PropertyCode{epcFixedTimeEnergyReverse}
+	if got := n.pending(epcs, at.Add(time.Minute)); !slices.Equal(got, want) {
+		t.Errorf("pending() = %v, want %v", got, want)
+	}
+}
+
+func TestNotificationTrackerPending(t *testing.T) {
+	slot := time.Date(2025, 10, 16, 12, 0, 0, 0, meterLocation)
+	epcs := []smartmeter.PropertyCode{epcFixedTimeEnergyNormal, epcFixedTimeEnergyReverse}
+	tests := []struct {
+		name     string
+		received map[smartmeter.PropertyCode]time.Time
+		now      time.Time
+		want     []smartmeter.PropertyCode
+	}{
+		{"nothing received", nil, slot.Add(time.Minute), epcs},
+		{
+			"normal received",
+			map[smartmeter.PropertyCode]time.Time{epcFixedTimeEnergyNormal: slot},
+			slot.Add(time.Minute),
+			[]smartmeter.PropertyCode{epcFixedTimeEnergyReverse},
+		},
+		{
+			"both received",
+			map[smartmeter.PropertyCode]time.Time{
+				epcFixedTimeEnergyNormal:  slot,
+				epcFixedTimeEnergyReverse: slot,
+			},
+			slot.Add(29 * time.Minute),
+			nil,
+		},
+		{
+			"previous slot",
+			map[smartmeter.PropertyCode]time.Time{
+				epcFixedTimeEnergyNormal:  slot.Add(-fixedTimeSlot),
+				epcFixedTimeEnergyReverse: slot,
+			},
+			slot.Add(time.Minute),
+			[]smartmeter.PropertyCode{epcFixedTimeEnergyNormal},
+		},
+		{
+			"next slot",
+			map[smartmeter.PropertyCode]time.Time{
+				epcFixedTimeEnergyNormal:  slot,
+				epcFixedTimeEnergyReverse: slot,
+			},
+			slot.Add(fixedTimeSlot + time.Minute),
+			epcs,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newNotificationTracker()
+			for epc, at := range tt.received {
+				n.fixedTime[epc] = at
+			}
+			if got := n.pending(epcs, tt.now); !slices.Equal(got, tt.want) {
+				t.Errorf("pending() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueNotificationDropsWhenFull(t *testing.T) {
+	// 取得ループが受け取らない間に溜まった通知は、容量を超えた分を捨てる
+	t.Cleanup(func() {
+		for len(infFrames) > 0 {
+			<-infFrames
+		}
+	})
+	dropped := func() float64 {
+		m := &dto.Metric{}
+		if err := infDropped.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := dropped()
+	f := &smartmeter.Frame{ESV: esvINF, SEOJ: smartmeter.LvSmartElectricEnergyMeter}
+	for range cap(infFrames) + 2 {
+		queueNotification(f)
+	}
+	if got := len(infFrames); got != cap(infFrames) {
+		t.Errorf("queued = %d, want %d", got, cap(infFrames))
+	}
+	if got := dropped() - before; got != 2 {
+		t.Errorf("smartmeter_inf_notifications_dropped_total increased by %v, want 2", got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// influxDBConfig は InfluxDB 2.x への出力の設定です。
+type influxDBConfig struct {
+	URL                string
+	Org                string
+	Bucket             string
+	Token              string
+	Measurement        string
+	TagPairs           []string
+	MaxBuffered        int
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Tags map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *influxDBConfig) bind() {
+	c.URL = getEnv("SMARTMETER_INFLUXDB_URL", "")
+	c.Org = getEnv("SMARTMETER_INFLUXDB_ORG", "")
+	c.Bucket = getEnv("SMARTMETER_INFLUXDB_BUCKET", "")
+	c.Token = getEnv("SMARTMETER_INFLUXDB_TOKEN", "")
+	c.Measurement = getEnv("SMARTMETER_INFLUXDB_MEASUREMENT", "smartmeter")
+	c.MaxBuffered = getEnvInt("SMARTMETER_INFLUXDB_MAX_BUFFERED", 1440)
+	c.CAFile = getEnv("SMARTMETER_INFLUXDB_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_INFLUXDB_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_INFLUXDB_TAGS", ""); v != "" {
+		c.TagPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "influxdb.url", c.URL,
+		"InfluxDB 2.x URL to write readings to (e.g. http://localhost:8086)")
+	flag.StringVar(&c.Org, "influxdb.org", c.Org, "InfluxDB organization")
+	flag.StringVar(&c.Bucket, "influxdb.bucket", c.Bucket, "InfluxDB bucket")
+	flag.StringVar(&c.Token, "influxdb.token", c.Token, "InfluxDB API token")
+	flag.StringVar(&c.Measurement, "influxdb.measurement", c.Measurement,
+		"InfluxDB measurement name")
+	flag.Var(&labelFlag{values: &c.TagPairs}, "influxdb.tag",
+		"Tag key=value added to every InfluxDB point (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "influxdb.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while InfluxDB is unreachable")
+	flag.StringVar(&c.CAFile, "influxdb.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the InfluxDB server")
+	flag.BoolVar(&c.InsecureSkipVerify, "influxdb.tls.insecure-skip-verify", c.InsecureSkipVerify,
+		"Skip verification of the InfluxDB server certificate")
+}
+
+func (c *influxDBConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は InfluxDB の設定値を検証します。
+func (c *influxDBConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return errors.New("invalid InfluxDB URL: " + c.URL)
+	}
+	if c.Org == "" || c.Bucket == "" {
+		return errors.New("InfluxDB organization and bucket are required")
+	}
+	if c.Measurement == "" {
+		return errors.New("InfluxDB measurement must not be empty")
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("InfluxDB max buffered readings must be positive")
+	}
+	tags, err := parseLabels(c.TagPairs)
+	if err != nil {
+		return err
+	}
+	c.Tags = tags
+	return nil
+}
+
+// influxDBSink は取得値を InfluxDB 2.x の書き込み API (/api/v2/write) に送信します。
+// 送信に失敗した取得値は保持しておき、次回の送信時にまとめて再送します。
+type influxDBSink struct {
+	cfg      *influxDBConfig
+	client   *http.Client
+	writeURL string
+	buffer   *retryBuffer
+}
+
+func newInfluxDBSink(cfg *influxDBConfig) (*influxDBSink, error) {
+	client, err := newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("org", cfg.Org)
+	q.Set("bucket", cfg.Bucket)
+	q.Set("precision", "ns")
+	return &influxDBSink{
+		cfg:      cfg,
+		client:   client,
+		writeURL: strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + q.Encode(),
+		buffer:   newRetryBuffer("influxdb", cfg.MaxBuffered),
+	}, nil
+}
+
+func (s *influxDBSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var body []byte
+		for _, rd := range rs {
+			body = appendLineProtocol(body, s.cfg.Measurement, s.cfg.Tags, rd)
+		}
+		header := http.Header{}
+		if s.cfg.Token != "" {
+			header.Set("Authorization", "Token "+s.cfg.Token)
+		}
+		return postHTTP(ctx, s.client, s.writeURL, "text/plain; charset=utf-8", body, header)
+	})
+}
+
+func (s *influxDBSink) close() error {
+	return nil
+}
+
+// appendLineProtocol は取得値を InfluxDB の line protocol で b に追加します。
+// 計測値は measurement のフィールドとして、定時積算電力量は計測日時を時刻とする
+// <measurement>_fixed_time の energy_kwh フィールドとして出力します。
+func appendLineProtocol(b []byte, measurement string, tags map[string]string, r *reading) []byte {
+	series := appendSeriesKey(nil, measurement, tags)
+	if fields := r.fields(); len(fields) > 0 {
+		b = append(b, series...)
+		for i, f := range fields {
+			if i == 0 {
+				b = append(b, ' ')
+			} else {
+				b = append(b, ',')
+			}
+			b = append(b, f.Name...)
+			b = append(b, '=')
+			b = strconv.AppendFloat(b, f.Value, 'f', -1, 64)
+		}
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, r.Time.UnixNano(), 10)
+		b = append(b, '\n')
+	}
+	for _, ft := range r.fixedTimeFields() {
+		b = appendSeriesKey(b, measurement+"_fixed_time", tags)
+		b = append(b, ",direction="...)
+		b = append(b, ft.Direction...)
+		b = append(b, " energy_kwh="...)
+		b = strconv.AppendFloat(b, ft.KWh, 'f', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, ft.Time.UnixNano(), 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// appendSeriesKey は measurement と (キーでソートした) タグを line protocol の形式で追加します。
+func appendSeriesKey(b []byte, measurement string, tags map[string]string) []byte {
+	b = append(b, measurementEscaper.Replace(measurement)...)
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// line protocol では空のタグ値を指定できない
+		if tags[k] == "" {
+			continue
+		}
+		b = append(b, ',')
+		b = append(b, tagEscaper.Replace(k)...)
+		b = append(b, '=')
+		b = append(b, tagEscaper.Replace(tags[k])...)
+	}
+	return b
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
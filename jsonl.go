@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+)
+
+// jsonlConfig は JSON Lines での出力の設定です。
+type jsonlConfig struct {
+	Output string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *jsonlConfig) bind() {
+	c.Output = getEnv("SMARTMETER_JSONL_OUTPUT", "")
+
+	flag.StringVar(&c.Output, "jsonl.output", c.Output,
+		"File to append readings to as JSON Lines (\"-\" for stdout)")
+}
+
+func (c *jsonlConfig) enabled() bool {
+	return c.Output != ""
+}
+
+// validate は JSON Lines での出力の設定値を検証します。
+func (c *jsonlConfig) validate() error {
+	return nil
+}
+
+// jsonlSink は取得値を1行に1つの JSON オブジェクトとして標準出力またはファイルに書き出します。
+type jsonlSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func newJSONLSink(cfg *jsonlConfig) (*jsonlSink, error) {
+	if cfg.Output == "-" {
+		return &jsonlSink{enc: json.NewEncoder(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{w: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *jsonlSink) publish(_ context.Context, r *reading) error {
+	// json.Encoder は値毎に改行を付加する
+	return s.enc.Encode(r)
+}
+
+func (s *jsonlSink) close() error {
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelNamePattern は Prometheus のラベル名として有効な文字列です。
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelFlag は繰り返し指定できる -label フラグです。
+// 最初にフラグで指定されたときに、環境変数で指定された値を置き換えます。
+type labelFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *labelFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f *labelFlag) Set(s string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, s)
+	return nil
+}
+
+// parseLabels は "key=value" 形式の定数ラベルの列をパースします。
+func parseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok {
+			return nil, fmt.Errorf("label must be key=value: %q", p)
+		}
+		if !labelNamePattern.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("duplicate label %q", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// withConstLabels は g が返すすべてのメトリクスに定数ラベルを付加する Gatherer を返します。
+// メトリクスが同じ名前のラベルを既に持っている場合は、元のラベルを優先します。
+func withConstLabels(g prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	if len(labels) == 0 {
+		return g
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.Label = addLabels(m.Label, names, labels)
+			}
+		}
+		return mfs, err
+	})
+}
+
+// addLabels はラベルの組に定数ラベルを追加し、ラベル名の順に並べ替えて返します。
+func addLabels(pairs []*dto.LabelPair, names []string, labels map[string]string) []*dto.LabelPair {
+	existing := make(map[string]bool, len(pairs))
+	for _, p := range pairs {
+		existing[p.GetName()] = true
+	}
+	for _, k := range names {
+		if existing[k] {
+			continue
+		}
+		name, value := k, labels[k]
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return pairs
+}
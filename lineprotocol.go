@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// lineProtocolConfig は InfluxDB 1.x 互換の line protocol での出力の設定です。
+type lineProtocolConfig struct {
+	URL                string
+	Username           string
+	Password           string
+	Measurement        string
+	TagPairs           []string
+	MaxBuffered        int
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Tags map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *lineProtocolConfig) bind() {
+	c.URL = getEnv("SMARTMETER_LINE_PROTOCOL_URL", "")
+	c.Username = getEnv("SMARTMETER_LINE_PROTOCOL_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_LINE_PROTOCOL_PASSWORD", "")
+	c.Measurement = getEnv("SMARTMETER_LINE_PROTOCOL_MEASUREMENT", "smartmeter")
+	c.MaxBuffered = getEnvInt("SMARTMETER_LINE_PROTOCOL_MAX_BUFFERED", 1440)
+	c.CAFile = getEnv("SMARTMETER_LINE_PROTOCOL_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_LINE_PROTOCOL_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_LINE_PROTOCOL_TAGS", ""); v != "" {
+		c.TagPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "line-protocol.url", c.URL,
+		"URL to send readings to in line protocol "+
+			"(e.g. http://localhost:8086/write?db=smartmeter or udp://localhost:8089)")
+	flag.StringVar(&c.Username, "line-protocol.username", c.Username,
+		"Username for HTTP basic authentication")
+	flag.StringVar(&c.Password, "line-protocol.password", c.Password,
+		"Password for HTTP basic authentication")
+	flag.StringVar(&c.Measurement, "line-protocol.measurement", c.Measurement,
+		"Line protocol measurement name")
+	flag.Var(&labelFlag{values: &c.TagPairs}, "line-protocol.tag",
+		"Tag key=value added to every line protocol point (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "line-protocol.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while the HTTP receiver is unreachable")
+	flag.StringVar(&c.CAFile, "line-protocol.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the HTTP receiver")
+	flag.BoolVar(&c.InsecureSkipVerify, "line-protocol.tls.insecure-skip-verify",
+		c.InsecureSkipVerify, "Skip verification of the HTTP receiver certificate")
+}
+
+func (c *lineProtocolConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は line protocol での出力の設定値を検証します。
+func (c *lineProtocolConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid line protocol URL %q: %w", c.URL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp":
+	default:
+		return fmt.Errorf("unsupported line protocol URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("line protocol URL %q has no host", c.URL)
+	}
+	if c.Measurement == "" {
+		return errors.New("line protocol measurement must not be empty")
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("line protocol max buffered readings must be positive")
+	}
+	tags, err := parseLabels(c.TagPairs)
+	if err != nil {
+		return err
+	}
+	c.Tags = tags
+	return nil
+}
+
+// lineProtocolSink は取得値を line protocol で HTTP (InfluxDB 1.x の /write など) または
+// UDP で送信します。HTTP の場合は、送信に失敗した取得値を次回の送信時にまとめて再送します。
+type lineProtocolSink struct {
+	cfg    *lineProtocolConfig
+	client *http.Client
+	buffer *retryBuffer
+	// UDP の場合のみ
+	addr string
+	conn net.Conn
+}
+
+func newLineProtocolSink(cfg *lineProtocolConfig) (*lineProtocolSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	s := &lineProtocolSink{cfg: cfg}
+	if u.Scheme == "udp" {
+		s.addr = u.Host
+		return s, nil
+	}
+	if s.client, err = newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify); err != nil {
+		return nil, err
+	}
+	s.buffer = newRetryBuffer("line_protocol", cfg.MaxBuffered)
+	return s, nil
+}
+
+func (s *lineProtocolSink) publish(ctx context.Context, r *reading) error {
+	if s.client == nil {
+		return s.sendUDP(ctx, appendLineProtocol(nil, s.cfg.Measurement, s.cfg.Tags, r))
+	}
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var body []byte
+		for _, rd := range rs {
+			body = appendLineProtocol(body, s.cfg.Measurement, s.cfg.Tags, rd)
+		}
+		header := http.Header{}
+		if s.cfg.Username != "" {
+			header.Set("Authorization", basicAuth(s.cfg.Username, s.cfg.Password))
+		}
+		return postHTTP(ctx, s.client, s.cfg.URL, "text/plain; charset=utf-8", body, header)
+	})
+}
+
+// sendUDP は1回分の取得値を1つのデータグラムで送信します。
+// UDP では受信の確認ができないため、再送はしません。
+func (s *lineProtocolSink) sendUDP(ctx context.Context, b []byte) error {
+	if s.conn == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "udp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *lineProtocolSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logBackupTimeFormat はローテーションしたログファイルの名前に付加する時刻 (UTC) の形式です。
+const logBackupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile はサイズが上限を超えるとローテーションするログファイルです。
+// ローテーションしたファイルは "<名前>-<時刻><拡張子>" とし、古いものから削除します。
+type rotatingFile struct {
+	path string
+	// maxSize はローテーションするサイズ (バイト) です。0 の場合はローテーションしません。
+	maxSize int64
+	// maxAge と maxBackups はローテーションしたファイルを残す期間と数です。0 の場合は無制限です。
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openLogFile は -log.file のログファイルを開きます。
+func (c *config) openLogFile() (*rotatingFile, error) {
+	if c.LogMaxSize < 0 || c.LogMaxAge < 0 || c.LogMaxBackups < 0 {
+		return nil, errors.New("log file size, age and backups must not be negative")
+	}
+	return openRotatingFile(c.LogFile, int64(c.LogMaxSize)<<20, c.LogMaxAge, c.LogMaxBackups)
+}
+
+// openRotatingFile はログファイルを追記で開きます。ディレクトリがない場合は作成します。
+func openRotatingFile(
+	path string,
+	maxSize int64,
+	maxAge time.Duration,
+	maxBackups int,
+) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.file, r.size = f, fi.Size()
+	return nil
+}
+
+// Write は io.Writer を実装します。書き込むとサイズの上限を超える場合は、先にローテーションします。
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(time.Now()); err != nil {
+			// ログに書き込めないため標準エラー出力に書き出し、元のファイルへの書き込みを続ける
+			fmt.Fprintln(os.Stderr, "Failed to rotate log file:", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate は現在のファイルの名前に時刻を付加して新しいファイルを開き、古いファイルを削除します。
+func (r *rotatingFile) rotate(now time.Time) error {
+	ext := filepath.Ext(r.path)
+	backup := strings.TrimSuffix(r.path, ext) + "-" + now.UTC().Format(logBackupTimeFormat) + ext
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		// 新しいファイルを開けない場合は、名前を変えたファイルへの書き込みを続ける
+		return err
+	}
+	_ = old.Close()
+	r.prune(now)
+	return nil
+}
+
+// prune は maxBackups と maxAge を超えたローテーション済みのファイルを削除します。
+func (r *rotatingFile) prune(now time.Time) {
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(r.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+	// 時刻の形式により、名前の降順は新しい順になる
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	kept := 0
+	for _, m := range matches {
+		t, err := time.Parse(logBackupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext))
+		if err != nil {
+			continue
+		}
+		if (r.maxBackups > 0 && kept >= r.maxBackups) || (r.maxAge > 0 && now.Sub(t) > r.maxAge) {
+			_ = os.Remove(m)
+			continue
+		}
+		kept++
+	}
+}
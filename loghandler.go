@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logIdentifier は syslog と journald に送るログの識別子です。
+const logIdentifier = "smartmeter-exporter"
+
+// journalSocket は journald がネイティブプロトコルでログを受け付けるソケットです。
+const journalSocket = "/run/systemd/journal/socket"
+
+// lineHandler はレコードを時刻とレベルを除いた logfmt 形式の1行に整形し、レベルとともに send に渡します。
+// syslog と journald は時刻を付け、レベルは優先度として扱うため、どちらもメッセージには含めません。
+type lineHandler struct {
+	h     slog.Handler
+	state *lineState
+}
+
+// lineState は WithAttrs などで派生したハンドラが共有するバッファと送信先です。
+type lineState struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	send func(level slog.Level, line string) error
+}
+
+func newLineHandler(opts *slog.HandlerOptions, send func(slog.Level, string) error) *lineHandler {
+	st := &lineState{send: send}
+	h := slog.NewTextHandler(&st.buf, &slog.HandlerOptions{
+		Level:     opts.Level,
+		AddSource: opts.AddSource,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			if opts.ReplaceAttr != nil {
+				return opts.ReplaceAttr(groups, attr)
+			}
+			return attr
+		},
+	})
+	return &lineHandler{h: h, state: st}
+}
+
+func (h *lineHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *lineHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	h.state.buf.Reset()
+	if err := h.h.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.state.send(r.Level, strings.TrimSuffix(h.state.buf.String(), "\n"))
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lineHandler{h: h.h.WithAttrs(attrs), state: h.state}
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	return &lineHandler{h: h.h.WithGroup(name), state: h.state}
+}
+
+// newJournalHandler は journald のネイティブプロトコルでログを送るハンドラを返します。
+func newJournalHandler(opts *slog.HandlerOptions) (slog.Handler, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return newLineHandler(opts, func(l slog.Level, line string) error {
+		var b bytes.Buffer
+		writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriority(l)))
+		writeJournalField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+		writeJournalField(&b, "MESSAGE", line)
+		_, err := conn.Write(b.Bytes())
+		return err
+	}), nil
+}
+
+// writeJournalField は journald のネイティブプロトコルのフィールドを書き込みます。
+// 値が改行を含む場合は、長さを前置する形式にします。
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalPriority は slog のレベルを syslog の優先度 (3:err, 4:warning, 6:info, 7:debug) に変換します。
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// redactedValue は伏せ字にした属性の値です。
+const redactedValue = "[REDACTED]"
+
+// logSecrets はログに含まれていれば伏せ字にする値 (B ルートのパスワード) です。
+// 設定の検証後、ログを出力する goroutine を開始する前に設定します。
+var logSecrets []string
+
+// secrets は伏せ字にする B ルートのパスワードを返します。
+func (c *config) secrets() []string {
+	var secrets []string
+	if c.BRoutePass != "" {
+		secrets = append(secrets, c.BRoutePass)
+	}
+	for _, m := range c.File.Meters {
+		if m.Password != "" {
+			secrets = append(secrets, m.Password)
+		}
+	}
+	return secrets
+}
+
+// logReplaceAttr は -log.timestamps、-log.redact と logSecrets に従って属性を置き換える関数を返します。
+func (c *config) logReplaceAttr() func([]string, slog.Attr) slog.Attr {
+	// 時刻は journald などが付けるため、auto ではログファイルに書き出す場合にだけ出力する
+	_, toFile := logOutput.(*rotatingFile)
+	dropTime := c.LogTimestamps == "never" || (c.LogTimestamps != "always" && !toFile)
+	redact := make(map[string]bool)
+	for _, k := range strings.Split(c.LogRedact, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			redact[strings.ToLower(k)] = true
+		}
+	}
+	return func(groups []string, attr slog.Attr) slog.Attr {
+		if len(groups) == 0 && attr.Key == slog.TimeKey {
+			if dropTime {
+				return slog.Attr{}
+			}
+			return attr
+		}
+		if redact[strings.ToLower(attr.Key)] {
+			return slog.String(attr.Key, redactedValue)
+		}
+		return redactSecrets(attr)
+	}
+}
+
+// redactSecrets は文字列 (エラーなどを含む) の値に含まれる logSecrets を伏せ字にします。
+// ライブラリが出力するシリアル通信のログ (SKSETPWD など) もメッセージとして渡されます。
+func redactSecrets(attr slog.Attr) slog.Attr {
+	if len(logSecrets) == 0 {
+		return attr
+	}
+	var s string
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		s = attr.Value.String()
+	case slog.KindAny:
+		s = fmt.Sprint(attr.Value.Any())
+	default:
+		return attr
+	}
+	redacted := s
+	for _, secret := range logSecrets {
+		redacted = strings.ReplaceAll(redacted, secret, redactedValue)
+	}
+	if redacted == s {
+		return attr
+	}
+	return slog.String(attr.Key, redacted)
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// newSyslogHandler は syslog に対応していない OS ではエラーを返します。
+func newSyslogHandler(*slog.HandlerOptions) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// newSyslogHandler はローカルの syslog デーモンにログを送るハンドラを返します。ファシリティは daemon です。
+func newSyslogHandler(opts *slog.HandlerOptions) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return newLineHandler(opts, func(l slog.Level, line string) error {
+		switch journalPriority(l) {
+		case 3:
+			return w.Err(line)
+		case 4:
+			return w.Warning(line)
+		case 6:
+			return w.Info(line)
+		default:
+			return w.Debug(line)
+		}
+	}), nil
+}
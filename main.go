@@ -2,54 +2,102 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log"
 	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
+	_ "time/tzdata" // タイムゾーン情報を埋め込む
 
 	"github.com/hnw/go-smartmeter"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
 )
 
 // --- 1. メトリクスの定義 ---
 var (
-	// 電力 (W)
-	powerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "smartmeter_power_watts",
-		Help: "Instantaneous electric power consumption in Watts",
+	// 異常発生状態の変化回数
+	faultTransitions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_meter_fault_transitions_total",
+		Help: "Total number of changes in the meter fault status",
+	})
+	// 積算電力量 正方向 (kWh)
+	energyConsumedCounter = newEnergyCounter(
+		"smartmeter_energy_consumed_kwh_total",
+		"Cumulative electric energy consumed (normal direction) in kWh",
+	)
+	// 積算電力量 逆方向 (kWh) - 太陽光発電などの売電量
+	energyExportedCounter = newEnergyCounter(
+		"smartmeter_energy_exported_kwh_total",
+		"Cumulative electric energy exported to the grid (reverse direction) in kWh",
+	)
+	// 定時積算電力量 (kWh) - 30分毎の確定値。direction="consumed" or "exported"
+	fixedTimeEnergyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_fixed_time_energy_kwh",
+		Help: "Cumulative electric energy measured at the latest fixed time (every 30 minutes) in kWh",
+	}, []string{"direction"})
+	// 定時積算電力量の計測日時 (Unix Timestamp)
+	fixedTimeEnergyTimestampGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_fixed_time_energy_timestamp_seconds",
+		Help: "Unix timestamp at which the fixed-time cumulative energy was measured",
+	}, []string{"direction"})
+
+	// 直近の取得が成功したか (成功: 1, 失敗: 0)
+	upGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_up",
+		Help: "Whether the last scrape of the smart meter was successful (1) or not (0)",
+	})
+	// 連続して失敗した定期取得の回数 (成功すると 0 に戻る)
+	consecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_consecutive_failures",
+		Help: "Number of consecutive failed scrapes, reset to 0 on success",
 	})
-	// 電流 (A) - R相とT相をラベルで分ける
-	currentGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "smartmeter_current_amperes",
-		Help: "Instantaneous electric current in Amperes",
-	}, []string{"phase"}) // phase="r" or "t"
-
 	// 成功時刻 (Unix Timestamp) - データの鮮度確認用
 	lastSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "smartmeter_last_scrape_timestamp_seconds",
 		Help: "Unix timestamp of the last successful scrape",
 	})
 
-	// 通信時間 (秒)
-	scrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "smartmeter_scrape_duration_seconds",
-		Help:    "Scrape duration in seconds",
-		Buckets: prometheus.DefBuckets,
-	})
+	// 通信時間 (秒) - 設定に応じて main で生成する
+	scrapeDuration prometheus.Histogram
+
+	// 無効値 (データなし、オーバーフロー等) の検出回数
+	invalidValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_invalid_values_total",
+		Help: "Total number of samples skipped because the meter reported a sentinel value",
+	}, []string{"epc"})
 
 	// エラー回数カウンター（種類別）
 	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "smartmeter_scrape_errors_total",
 		Help: "Total number of failed scrapes, labeled by error type",
 	}, []string{"type"})
+	// 有効な設定 (値は常に 1)。パスワードなどの秘密情報は含めない
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_exporter_config_info",
+		Help: "Effective configuration of the exporter (secrets excluded)",
+	}, []string{"interval_seconds", "device", "channel", "dse", "epcs", "backfill", "timezone"})
+	// 直近のエラーの種類とメッセージ (値は常に 1)
+	lastErrorInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_last_error_info",
+		Help: "Type and message of the most recent scrape error",
+	}, []string{"type", "message"})
+	// 直近のエラーの発生時刻 (Unix Timestamp)
+	lastErrorTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_last_error_timestamp_seconds",
+		Help: "Unix timestamp of the most recent scrape error",
+	})
 )
 
 const (
@@ -57,286 +105,642 @@ const (
 	errorTypeAuth      = "auth"
 	errorTypeQuery     = "query"
 	errorTypeParse     = "parse"
+	errorTypeBackfill  = "backfill"
 )
 
-const (
-	reAuthCooldown   = 5 * time.Second
+// setConfigInfo は有効な設定を smartmeter_exporter_config_info に設定します。
+func setConfigInfo(cfg *config) {
+	configInfo.Reset()
+	configInfo.WithLabelValues(
+		strconv.FormatFloat(cfg.Interval.Seconds(), 'f', -1, 64),
+		cfg.DevicePath,
+		cfg.Channel,
+		strconv.FormatBool(cfg.UseDSE),
+		formatEPCList(scrapeEPCs),
+		strconv.FormatBool(cfg.Backfill),
+		cfg.Location.String(),
+	).Set(1)
+}
+
+// recordError はエラーを種類別に計上し、直近のエラーとして記録します。
+func recordError(errType string, err error) {
+	scrapeErrors.WithLabelValues(errType).Inc()
+	lastErrorInfo.Reset()
+	lastErrorInfo.WithLabelValues(errType, err.Error()).Set(1)
+	lastErrorTimestamp.SetToCurrentTime()
+	connStatus.addError(errType, err, time.Now())
+	stream.publish(streamEvent{Type: "error", Data: apiErrorEvent{
+		Type: errType, Error: err.Error(), Time: time.Now(),
+	}})
+}
+
+// 再認証の前後の待ち時間です。setup で設定から設定します。
+var (
+	// reAuthCooldown は要求が失敗してから再認証するまでの待ち時間です。
+	reAuthCooldown = 5 * time.Second
+	// postAuthCooldown は再認証してから要求を再試行するまでの待ち時間です。
 	postAuthCooldown = 2 * time.Second
 )
 
 func init() {
 	// メトリクスを登録
-	prometheus.MustRegister(powerGauge)
-	prometheus.MustRegister(currentGauge)
+	prometheus.MustRegister(readings)
+	prometheus.MustRegister(faultTransitions)
+	prometheus.MustRegister(energyConsumedCounter)
+	prometheus.MustRegister(energyExportedCounter)
+	prometheus.MustRegister(fixedTimeEnergyGauge)
+	prometheus.MustRegister(fixedTimeEnergyTimestampGauge)
+	prometheus.MustRegister(upGauge)
+	prometheus.MustRegister(consecutiveFailures)
 	prometheus.MustRegister(lastSuccessGauge)
-	prometheus.MustRegister(scrapeDuration)
 	prometheus.MustRegister(scrapeErrors)
+	prometheus.MustRegister(configInfo)
+	prometheus.MustRegister(lastErrorInfo)
+	prometheus.MustRegister(lastErrorTimestamp)
+	prometheus.MustRegister(invalidValues)
 }
 
 func main() {
-	// --- 2. 設定の読み込み ---
-	var (
-		bRouteID    = getEnv("SMARTMETER_ID", "")
-		bRoutePass  = getEnv("SMARTMETER_PASSWORD", "")
-		devicePath  = getEnv("SMARTMETER_DEVICE", "/dev/ttyACM0")
-		intervalStr = getEnv("SMARTMETER_INTERVAL", "60")
-		listenPort  = getEnv("SMARTMETER_PORT", "9102")
-		channel     = getEnv("SMARTMETER_CHANNEL", "")
-		ipAddr      = getEnv("SMARTMETER_IPADDR", "")
-		useDSE      = false
-		verbosity   = 1
-	)
-
-	if v := os.Getenv("SMARTMETER_DSE"); v != "false" && v != "0" {
-		useDSE = true
-	}
-	if v := os.Getenv("SMARTMETER_VERBOSITY"); v != "" {
-		if i, err := strconv.Atoi(v); err == nil {
-			verbosity = i
-		}
+	cmd, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
+	// 以降のフラグのパース (設定の再読み込みを含む) ではサブコマンドを除いた引数を使う
+	os.Args = append([]string{os.Args[0]}, args...)
+	cmd.run()
+}
 
-	flag.StringVar(&bRouteID, "id", bRouteID, "B-route ID")
-	flag.StringVar(&bRoutePass, "password", bRoutePass, "B-route password")
-	flag.StringVar(&devicePath, "device", devicePath, "Serial port device path")
-	flag.StringVar(
-		&intervalStr,
-		"interval",
-		intervalStr,
-		"Scrape interval in seconds (default: 60)",
-	)
-	flag.StringVar(&listenPort, "port", listenPort, "Exporter listen port (default: 9102)")
-	flag.StringVar(&channel, "channel", channel, "Fixed Wi-SUN Channel (skip scan)")
-	flag.StringVar(&ipAddr, "ipaddr", ipAddr, "Fixed Smart Meter IPv6 Address (skip scan)")
-	flag.BoolVar(&useDSE, "dse", useDSE, "Enable Dual Stack Edition (DSE)")
-	flag.IntVar(&verbosity, "verbosity", verbosity, "Log verbosity (0:quiet, 3:debug)")
-
-	flag.Parse()
-
-	logger := newLogger(verbosity)
-	slog.SetDefault(logger)
-	smLogger := slog.NewLogLogger(logger.Handler(), slog.LevelInfo)
+// serve はエクスポーターとして動作します。サブコマンドを省略した場合の動作です。
+func serve() {
+	// --- 2. 設定の読み込み ---
+	cfg, logger := setup()
+	if cfg.Check {
+		runCheck(cfg, logger)
+		return
+	}
+	libLogger := slog.NewLogLogger(logger.Handler(), slog.LevelInfo)
+	// 定期取得するスマートメーターのライブラリのログからは SKSTACK のイベントを検出する
+	monitor := newSKStackMonitor(libLogger.Writer(), logger)
+
+	scrapeEPCs = cfg.EPCs
+	dailyEnergy.loc = cfg.Location
+	historyLocation = cfg.Location
+	readings.maxAge = cfg.MaxCacheAge
+	panaLifetime = cfg.PANALifetime
+	sampleTimestamps = cfg.SampleTimestamps
+	history.retention = cfg.APIHistoryRetention
+	scrapeExemplars = cfg.Exemplars
+	scrapeDuration = newScrapeDuration(cfg.Buckets, cfg.NativeHistogram)
+	prometheus.MustRegister(scrapeDuration)
 
-	if bRouteID == "" || bRoutePass == "" {
-		logger.Error("ID and Password are required via flags or env vars")
+	if err := applyCustomMetrics(cfg.File.CustomMetrics); err != nil {
+		logger.Error("Invalid custom metrics", "error", err)
 		os.Exit(1)
 	}
 
-	intervalSec, err := strconv.Atoi(intervalStr)
-	if err != nil || intervalSec < 10 {
-		logger.Warn(
-			"Invalid interval, using default",
-			"interval",
-			intervalStr,
-			"default_seconds",
-			60,
-		)
-		intervalSec = 60
-	}
+	setConfigInfo(cfg)
+	setEffectiveConfig(cfg)
 
 	// --- 3. デバイスの初期化 ---
-	// smartmeter.Open に渡すオプションを動的に構築
-	smOpts := []smartmeter.Option{
-		smartmeter.ID(bRouteID),
-		smartmeter.Password(bRoutePass),
-		smartmeter.DualStackSK(useDSE),
-		smartmeter.Verbosity(verbosity),
-		smartmeter.Logger(smLogger),
-		smartmeter.RetryInterval(5 * time.Second),
-	}
-
-	// Channel指定がある場合のみ追加
-	if channel != "" {
-		smOpts = append(smOpts, smartmeter.Channel(channel))
-	}
-	// IP指定がある場合のみ追加
-	if ipAddr != "" {
-		smOpts = append(smOpts, smartmeter.IPAddr(ipAddr))
-	}
-
-	dev, err := smartmeter.Open(devicePath, smOpts...)
-	if err != nil {
-		logger.Error("Failed to open device", "error", err, "device", devicePath)
-		os.Exit(1)
-	}
-
-	// --- 4. バックグラウンド取得ループの開始 ---
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	if err := startSinks(ctx, cfg, logger); err != nil {
+		logger.Error("Invalid output configuration", "error", err)
+		os.Exit(1)
+	}
+	if !cfg.probeOnly() {
+		dev, err := openDeviceWithState(cfg, monitor, logger)
+		if err != nil {
+			logger.Error("Failed to open device", "error", err, "device", cfg.DevicePath)
+			os.Exit(1)
+		}
+		// smartmeter.Open は PANA 認証まで行う
+		recordAuthentication(authKindInitial, nil)
+		connStatus.setConnection("", "", dev.IPAddr)
+
+		// 履歴の出力が指定された場合は、出力して終了する
+		if cfg.HistoryDays > 0 {
+			if err := runHistoryDump(dev, cfg.HistoryDays, logger); err != nil {
+				logger.Error("Failed to read history", "error", err)
+				os.Exit(1)
+			}
+			return
+		}
 
-	go runScrapeLoop(ctx, dev, time.Duration(intervalSec)*time.Second, logger)
+		// --- 4. バックグラウンド取得ループの開始 ---
+		go runScrapeLoop(ctx, dev, cfg, logger)
+		startEchonetServer(ctx, &cfg.EchonetServer, logger)
+	}
 
 	// --- 5. HTTPサーバー起動 ---
-	http.Handle("/metrics", promhttp.Handler())
+	mux := newServeMux(cfg, libLogger, logger)
+	if cfg.probeOnly() {
+		// 定期取得を行わないため、定期取得の結果を表すメトリクスは出力しない
+		prometheus.Unregister(upGauge)
+		prometheus.Unregister(consecutiveFailures)
+		prometheus.Unregister(sessionAge)
+		prometheus.Unregister(sessionRemaining)
+	}
 
-	logger.Info("Starting Prometheus exporter", "port", listenPort)
+	logger.Info(
+		"Starting Prometheus exporter",
+		"port",
+		cfg.ListenPort,
+		"path",
+		cfg.MetricsPath,
+		"version",
+		version.Info(),
+		"build_context",
+		version.BuildContext(),
+	)
 	logger.Info(
 		"Device configured",
 		"device",
-		devicePath,
-		"interval_seconds",
-		intervalSec,
+		cfg.DevicePath,
+		"interval",
+		cfg.Interval.String(),
 		"dse",
-		useDSE,
+		cfg.UseDSE,
+		"backfill",
+		cfg.Backfill,
+		"fixed_time_delay",
+		cfg.FixedTimeDelay,
+		"staleness",
+		cfg.Staleness,
+		"max_cache_age",
+		cfg.MaxCacheAge,
+		"sample_timestamps",
+		cfg.SampleTimestamps,
+		"scrape_duration_buckets",
+		cfg.Buckets,
+		"native_histogram",
+		cfg.NativeHistogram,
+		"exemplars",
+		cfg.Exemplars,
+		"pana_lifetime",
+		cfg.PANALifetime,
+		"labels",
+		cfg.Labels,
+		"timezone",
+		cfg.Location,
+		"epcs",
+		formatEPCList(cfg.EPCs),
 	)
 
-	server := &http.Server{
-		Addr:              ":" + listenPort,
-		ReadHeaderTimeout: 10 * time.Second,
+	auth, err := cfg.webBasicAuth()
+	if err != nil {
+		logger.Error("Invalid web config", "error", err)
+		os.Exit(1)
 	}
+	server := startHTTPServer(cfg, mux, auth, logger)
+	grpcServer := startGRPCServer(cfg, auth, logger)
 
 	// Graceful Shutdown用
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	waitSignals(ctx, cfg, logger)
+	logger.Info("Shutting down")
+	cancel() // ループを停止
+	waitSinks()
+	ctxShut, cancelShut := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShut()
+	if err := server.Shutdown(ctxShut); err != nil {
+		logger.Warn("HTTP server shutdown error", "error", err)
+	}
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(ctxShut); err != nil {
+			logger.Warn("gRPC server shutdown error", "error", err)
+		}
+	}
+}
+
+// startHTTPServer はメトリクスと API の HTTP サーバーを開始します。
+// -web.config.file に TLS の設定がある場合は HTTPS で待ち受けます。auth が nil でない場合は Basic 認証を行います。
+func startHTTPServer(
+	cfg *config, mux *http.ServeMux, auth *basicAuthenticator, logger *slog.Logger,
+) *http.Server {
+	tlsConfig, err := cfg.webTLSConfig()
+	if err != nil {
+		logger.Error("Invalid web config", "error", err)
+		os.Exit(1)
+	}
+	handler := http.Handler(mux)
+	if auth != nil {
+		handler = auth.handler(mux)
+		logger.Info("Basic authentication enabled", "users", len(auth.users))
+	}
+	server := &http.Server{
+		Addr:              ":" + cfg.ListenPort,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// 接続したままの /api/v1/stream と /api/v1/ws の要求は Shutdown で終わらないため、イベントの配信を終了する
+	server.RegisterOnShutdown(stream.close)
 
+	if tlsConfig != nil {
+		logger.Info("Serving HTTPS", "web_config_file", cfg.WebConfigFile)
+	}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// 証明書は tlsConfig で読み込む
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("HTTP server error", "error", err)
 			os.Exit(1)
 		}
 	}()
+	return server
+}
 
-	<-stopChan
-	logger.Info("Shutting down")
-	cancel() // ループを停止
-	ctxShut, cancelShut := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelShut()
-	if err := server.Shutdown(ctxShut); err != nil {
-		logger.Warn("HTTP server shutdown error", "error", err)
+// newServeMux はエクスポーターの HTTP のハンドラーを登録した ServeMux を返します。
+// net/http/pprof が http.DefaultServeMux に登録するハンドラーを公開しないよう、専用の ServeMux を使います。
+func newServeMux(cfg *config, libLogger *log.Logger, logger *slog.Logger) *http.ServeMux {
+	gatherer := withConstLabels(prometheus.DefaultGatherer, cfg.Labels)
+	mux := http.NewServeMux()
+	mux.Handle(cfg.MetricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))
+	mux.Handle("/-/healthy", healthyHandler())
+	mux.Handle("/healthz", livenessHandler())
+	mux.Handle("/readyz", readinessHandler(!cfg.probeOnly()))
+	mux.Handle("/api/v1/reading", readingHandler())
+	mux.Handle("/api/v1/history", historyHandler())
+	mux.Handle("/api/v1/stream", streamHandler())
+	mux.Handle("/api/v1/ws", webSocketHandler())
+	mux.Handle("/-/reload", reloadHandler(cfg.EnableLifecycle))
+	mux.Handle("/-/config", configHandler(cfg.EnableLifecycle))
+	mux.Handle("/debug/status", statusHandler(cfg))
+	if len(cfg.File.Meters) > 0 {
+		targets := newProbeTargets(cfg.File.Meters, cfg.Verbosity, libLogger)
+		mux.Handle("/probe", probeHandler(targets, cfg.Labels, logger))
+	}
+	if cfg.EnablePprof {
+		// コマンドラインには B ルートのパスワードを含むことがあるため、cmdline は公開しない
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// applyCustomMetrics はカスタムメトリクスを登録し、その EPC を定期取得の対象に加えます。
+func applyCustomMetrics(cfgs []customMetricConfig) error {
+	metrics, err := setupCustomMetrics(cfgs)
+	if err != nil {
+		return err
+	}
+	customMetrics = metrics
+	scrapeEPCs = withCustomMetricEPCs(scrapeEPCs)
+	return nil
+}
+
+// withCustomMetricEPCs は epcs にカスタムメトリクスの EPC を加えた列を返します。
+func withCustomMetricEPCs(epcs []smartmeter.PropertyCode) []smartmeter.PropertyCode {
+	epcs = slices.Clone(epcs)
+	for _, epc := range customMetricEPCs(customMetrics) {
+		if !slices.Contains(epcs, epc) {
+			epcs = append(epcs, epc)
+		}
+	}
+	return epcs
+}
+
+// runHistoryDump は積算電力量計測値履歴2を標準出力に書き出します。
+func runHistoryDump(dev *smartmeter.Device, days int, logger *slog.Logger) error {
+	if dev.IPAddr == "" {
+		ipAddr, err := dev.GetNeibourIP()
+		if err != nil {
+			return err
+		}
+		dev.IPAddr = ipAddr
 	}
+	return dumpHistory2(dev, days, os.Stdout, logger)
+}
+
+// newScrapeDuration はバケット上限 buckets の取得時間のヒストグラムを生成します。
+// native が true の場合は、従来のバケットに加えてネイティブヒストグラムも出力します。
+// ネイティブヒストグラムは Prometheus が Protobuf 形式で取得した場合のみ利用されます。
+func newScrapeDuration(buckets []float64, native bool) prometheus.Histogram {
+	opts := prometheus.HistogramOpts{
+		Name:    "smartmeter_scrape_duration_seconds",
+		Help:    "Scrape duration in seconds",
+		Buckets: buckets,
+	}
+	if native {
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 100
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return prometheus.NewHistogram(opts)
 }
 
 // runScrapeLoop は定期的にデータを取得します。
 // スマートメーターの応答遅延（約30秒）によるタイムアウトを回避するため、
 // バックグラウンドで非同期に取得し、HTTP要求には直近のキャッシュを返します。
+// 取得の合間には、要求の処理中に受信したスマートメーターからの通知をメトリクスに反映します。
 func runScrapeLoop(
 	ctx context.Context,
 	dev *smartmeter.Device,
-	interval time.Duration,
+	cfg *config,
 	logger *slog.Logger,
 ) {
-	ticker := time.NewTicker(interval)
+	ticker := time.NewTicker(cfg.Interval)
 	defer ticker.Stop()
+	fixedTimer := time.NewTimer(0)
+	defer fixedTimer.Stop()
+	stale := &stalenessGuard{}
+	notifications := newNotificationTracker()
+	pollC, stopPoll := newNotificationPoller(cfg.INFPollInterval)
+	defer stopPoll()
+	var (
+		schedule                   *scheduleTracker
+		regularEPCs, fixedTimeEPCs []smartmeter.PropertyCode
+	)
+	// configure は取得間隔などを設定します。設定の再読み込み時にも呼ばれます。
+	configure := func(c *config) {
+		cfg = c
+		interval := c.Interval
+		ticker.Reset(interval)
+		setLivenessTimeout(interval)
+		readinessMaxAge.Store(int64(time.Duration(c.ReadinessIntervals) * interval))
+		schedule = newScheduleTracker(interval, time.Now())
+		stale.window = c.Staleness
+
+		// 定時積算電力量は30分毎にしか更新されないため、定期取得とは分けて
+		// 毎時0分・30分の直後 (fixedTimeDelay 経過後) に取得する
+		regularEPCs, fixedTimeEPCs = splitFixedTimeEPCs(scrapeEPCs)
+		if len(fixedTimeEPCs) == 0 {
+			fixedTimer.Stop()
+			nextScrapeGauge.DeleteLabelValues(scheduleFixedTime)
+			return
+		}
+		fixedTimer.Reset(scheduleFixedTimeRead(time.Now(), c.FixedTimeDelay))
+	}
+	configure(cfg)
+
+	// 起動直後および長時間の取得失敗からの復帰時には履歴を取得し、欠損期間を補完する
+	// 取得の失敗が続いた場合は瞬時値などの出力を止める
+	var lastSuccess time.Time
+	started := time.Now()
+	run := func() {
+		ok := scrape(dev, regularEPCs, logger)
+		upGauge.Set(boolToFloat(ok))
+		now := time.Now()
+		if !ok {
+			consecutiveFailures.Inc()
+			stale.check(cmp.Or(lastSuccess, started), now, logger)
+			return
+		}
+		consecutiveFailures.Set(0)
+		stale.restore(logger)
+		if cfg.Backfill && needsBackfill(lastSuccess, now) {
+			since := cmp.Or(lastSuccess, now.Add(-historySlots*historySlotInterval))
+			backfillHistory(dev, since, now, logger)
+		}
+		lastSuccess = now
+		scrapeSuccess.Store(now.UnixNano())
+	}
 
 	// 起動時にまず1回実行
 	logger.Info("First scrape starting")
-	scrape(dev, logger)
+	beatScrapeLoop()
+	run()
+	if len(fixedTimeEPCs) > 0 {
+		scrape(dev, fixedTimeEPCs, logger)
+	}
 
 	for {
+		beatScrapeLoop()
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			scrape(dev, logger)
+		case t := <-ticker.C:
+			schedule.tick(t, time.Now())
+			run()
+		case done := <-readings.refresh:
+			// /metrics の要求が重なった場合に重複して取得しないよう、古い場合のみ取得する
+			if readings.stale(time.Now()) {
+				run()
+			}
+			close(done)
+		case <-fixedTimer.C:
+			notifications.scrapeFixedTime(dev, fixedTimeEPCs, logger)
+			fixedTimer.Reset(scheduleFixedTimeRead(time.Now(), cfg.FixedTimeDelay))
+		case f := <-infFrames:
+			notifications.apply(dev, f, logger)
+		case <-pollC:
+			pollNotifications(dev, logger)
+		case next := <-scrapeConfigs:
+			scrapeEPCs = withCustomMetricEPCs(next.EPCs)
+			setConfigInfo(next)
+			configure(next)
+			logger.Info("Scrape configuration reloaded",
+				"interval", next.Interval.String(), "epcs", formatEPCList(scrapeEPCs))
 		}
 	}
 }
 
 // 実際のデータ取得ロジック
-func scrape(dev *smartmeter.Device, logger *slog.Logger) {
+func scrape(dev *smartmeter.Device, epcs []smartmeter.PropertyCode, logger *slog.Logger) bool {
+	logger, exemplar := startScrapeTrace(logger)
 	start := time.Now()
 	defer func(start time.Time) {
-		scrapeDuration.Observe(time.Since(start).Seconds())
+		observeScrapeDuration(time.Since(start).Seconds(), exemplar)
 	}(start)
 
+	r := readMeter(dev, epcs, logger)
+	if r == nil {
+		return false
+	}
+	dailyEnergy.update(dev, r, logger)
+	publishReading(r)
+	return true
+}
+
+// readMeter はスマートメーターから epcs のプロパティを取得し、メトリクスを更新します。
+// 取得に失敗した場合は再認証して再試行します。取得できなかった場合は nil を返します。
+func readMeter(
+	dev *smartmeter.Device,
+	epcs []smartmeter.PropertyCode,
+	logger *slog.Logger,
+) *reading {
 	// IPアドレス解決 (初回のみ、またはロスト時)
 	if dev.IPAddr == "" {
 		ipAddr, err := dev.GetNeibourIP()
 		if err != nil {
 			logger.Warn("Failed to scan neighbor IP", "error", err)
-			scrapeErrors.WithLabelValues(errorTypeIPResolve).Inc()
-			return
+			recordError(errorTypeIPResolve, err)
+			return nil
 		}
 		dev.IPAddr = ipAddr
 	}
 
-	// プロパティ要求 (電力と電流)
+	// メーター固有の情報は、未取得の場合のみ取得する
+	resolveMeterProperties(dev, logger)
+
+	epcs = filterSupportedEPCs(epcs)
+	if len(epcs) == 0 {
+		logger.Debug("No properties to request")
+		return nil
+	}
 	request := smartmeter.NewFrame(
 		smartmeter.LvSmartElectricEnergyMeter,
 		smartmeter.Get,
-		[]*smartmeter.Property{
-			smartmeter.NewProperty(
-				smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower,
-				nil,
-			),
-			smartmeter.NewProperty(smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent, nil),
-		},
+		newProperties(epcs),
 	)
 
 	// クエリ実行
-	response, err := dev.QueryEchonetLite(request, smartmeter.Retry(3))
+	response, err := query(dev, request)
 	if err != nil {
 		logger.Info("Query failed, attempting re-auth", "error", err)
 		logger.Debug("Waiting before re-auth", "cooldown", reAuthCooldown.String())
 		time.Sleep(reAuthCooldown)
 		// 失敗時は再認証を試みる
-		if authErr := dev.Authenticate(); authErr != nil {
+		authErr := dev.Authenticate()
+		recordAuthentication(authKindReauth, authErr)
+		if authErr != nil {
 			logger.Warn("Authentication failed", "error", authErr)
-			scrapeErrors.WithLabelValues(errorTypeAuth).Inc()
-			return
+			recordError(errorTypeAuth, authErr)
+			recordPropertyReads(epcs, nil)
+			return nil
 		}
 		logger.Info("Re-authentication successful")
+		// 再認証が必要になった場合はメーター交換の可能性もあるため、識別情報を確認し直す
+		lastIdentityCheck = time.Time{}
 		logger.Debug("Waiting before retrying query", "cooldown", postAuthCooldown.String())
 		time.Sleep(postAuthCooldown)
 		// 再試行
-		response, err = dev.QueryEchonetLite(request, smartmeter.Retry(3))
+		response, err = query(dev, request)
 		if err != nil {
 			logger.Warn("Query failed after re-auth", "error", err)
-			scrapeErrors.WithLabelValues(errorTypeQuery).Inc()
-			return
+			recordError(errorTypeQuery, err)
+			recordPropertyReads(epcs, nil)
+			return nil
 		}
 	}
+	recordPropertyReads(epcs, response)
+	meterProperties.store(response.Properties)
 
 	// 値のパースとメトリクス更新
-	parseAndSetMetrics(response, logger)
+	return parseAndSetMetrics(response, logger)
 }
 
-func parseAndSetMetrics(response *smartmeter.Frame, logger *slog.Logger) {
-	foundData := false
-	for _, p := range response.Properties {
-		switch p.EPC {
-		case smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower:
-			val := float64(binary.BigEndian.Uint32(p.EDT))
-			powerGauge.Set(val)
-			foundData = true
-		case smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent:
-			r := float64(binary.BigEndian.Uint16(p.EDT[:2])) / 10.0
-			t := float64(binary.BigEndian.Uint16(p.EDT[2:])) / 10.0
-			currentGauge.WithLabelValues("r").Set(r)
-			currentGauge.WithLabelValues("t").Set(t)
-			foundData = true
+// resolveMeterProperties は識別情報、ノードのインスタンスリスト、プロパティマップ、
+// 積算電力量の単位・係数・有効桁数のうち未取得のものを取得します。識別情報はメーター交換の検出のため定期的に取得し直します。
+// 取得できなくても瞬時値の取得は続行します。
+func resolveMeterProperties(dev *smartmeter.Device, logger *slog.Logger) {
+	// メーター交換を検出した場合は他の情報も取得し直すため、識別情報を最初に取得する
+	if needsIdentityCheck(time.Now()) {
+		if err := resolveMeterIdentity(dev, logger); err != nil {
+			logger.Warn("Failed to read meter identification", "error", err)
 		}
 	}
-
-	if foundData {
-		lastSuccessGauge.Set(float64(time.Now().Unix()))
-		logger.Debug("Scrape successful")
-	} else {
-		logger.Warn("Response contained no recognized properties")
-		scrapeErrors.WithLabelValues(errorTypeParse).Inc()
+	if nodeObjects == nil {
+		if err := resolveNodeObjects(dev, logger); err != nil {
+			logger.Warn("Failed to read node instance list", "error", err)
+			// 調査用の情報のため、取得できなくても毎回は取得し直さない
+			nodeObjects = []uint32{}
+		}
+	}
+	if supportedEPCs == nil {
+		if err := resolvePropertyMap(dev, logger); err != nil {
+			logger.Warn("Failed to read property map", "error", err)
+		}
+	}
+	if energyUnitKWh == 0 {
+		if err := resolveEnergyScale(dev, logger); err != nil {
+			logger.Warn("Failed to read cumulative energy unit", "error", err)
+		}
+	}
+	if needsClockCheck(time.Now()) {
+		if err := updateClockSkew(dev, logger); err != nil {
+			logger.Warn("Failed to read meter clock", "error", err)
+		}
 	}
 }
 
-func getEnv(key, defaultVal string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
+// parseAndSetMetrics はレスポンスをデコードしてメトリクスを更新します。
+// 認識できるプロパティが含まれていない場合は nil を返します。
+func parseAndSetMetrics(response *smartmeter.Frame, logger *slog.Logger) *reading {
+	r := decodeReading(response.Properties, logger)
+	custom := setCustomMetrics(response.Properties, logger)
+	if r.empty() && custom == 0 {
+		logger.Warn("Response contained no recognized properties")
+		recordError(errorTypeParse, errors.New("response contained no recognized properties"))
+		return nil
 	}
-	return defaultVal
+
+	setMetrics(r, logger)
+	lastSuccessGauge.Set(float64(r.Time.Unix()))
+	logger.Debug("Scrape successful")
+	return r
 }
 
-func newLogger(verbosity int) *slog.Logger {
-	level := levelFromVerbosity(verbosity)
+// logOutput はログの出力先です。取得値を標準出力に書き出すサブコマンドでは標準エラー出力、
+// -log.file が指定された場合はそのファイルにします。
+var logOutput io.Writer = os.Stdout
+
+func newLogger(cfg *config) *slog.Logger {
+	level := cfg.logLevel()
 	opts := &slog.HandlerOptions{
 		Level:       level,
-		ReplaceAttr: dropTimeAttr,
+		AddSource:   cfg.LogSource,
+		ReplaceAttr: cfg.logReplaceAttr(),
 	}
 
+	var newHandler func(*slog.HandlerOptions) (slog.Handler, error)
 	switch logFormat() {
 	case "json":
-		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+		return slog.New(slog.NewJSONHandler(logOutput, opts))
+	case "syslog":
+		newHandler = newSyslogHandler
+	case "journal":
+		newHandler = newJournalHandler
 	default:
-		return slog.New(slog.NewTextHandler(os.Stdout, opts))
+		return slog.New(slog.NewTextHandler(logOutput, opts))
+	}
+	h, err := newHandler(opts)
+	if err == nil {
+		return slog.New(h)
+	}
+	// syslog や journald に接続できない場合は、通常の出力先に書き出す
+	logger := slog.New(slog.NewTextHandler(logOutput, opts))
+	logger.Warn("Failed to connect to the system logger, falling back to text",
+		"format", logFormat(), "error", err)
+	return logger
+}
+
+// logLevel はログのレベルを返します。-log.level が指定されていればそれを優先し、
+// 指定されていなければ -verbosity から決めます。
+func (c *config) logLevel() slog.Level {
+	if c.LogLevel != "" {
+		if level, err := parseLogLevel(c.LogLevel); err == nil {
+			return level
+		}
 	}
+	return levelFromVerbosity(c.Verbosity)
+}
+
+// parseLogLevel は debug、info、warn (warning)、error のいずれかのレベルをパースします。大文字小文字は区別しません。
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
 }
 
 func levelFromVerbosity(verbosity int) slog.Level {
@@ -351,17 +755,10 @@ func levelFromVerbosity(verbosity int) slog.Level {
 }
 
 func logFormat() string {
-	if v := strings.ToLower(os.Getenv("SMARTMETER_LOG_FORMAT")); v != "" {
-		if v == "json" || v == "text" {
+	if v := strings.ToLower(getEnv("SMARTMETER_LOG_FORMAT", "")); v != "" {
+		if v == "json" || v == "text" || v == "syslog" || v == "journal" {
 			return v
 		}
 	}
 	return "text"
 }
-
-func dropTimeAttr(_ []string, attr slog.Attr) slog.Attr {
-	if attr.Key == slog.TimeKey {
-		return slog.Attr{}
-	}
-	return attr
-}
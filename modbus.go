@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus の機能コードと例外コード
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+	modbusIllegalFunction      = 0x01
+	modbusIllegalDataAddress   = 0x02
+	modbusIllegalDataValue     = 0x03
+	// modbusMaxReadRegisters は1回の要求で読み出せるレジスタ数の上限です。
+	modbusMaxReadRegisters = 125
+	// modbusIdleTimeout は要求のない接続を閉じるまでの時間です。
+	modbusIdleTimeout = 5 * time.Minute
+)
+
+// レジスタマップの先頭アドレス。各値は2レジスタ (32ビット、上位ワードが先) です。
+const (
+	// modbusIntBase からは整数 (int32) で、未取得の値は 0x80000000 です。
+	modbusIntBase = 0
+	// modbusFloatBase からは単精度浮動小数点数 (float32) で、未取得の値は NaN です。
+	modbusFloatBase = 100
+)
+
+// modbusIntNoData は整数のレジスタの未取得を示す値です。
+const modbusIntNoData uint32 = 0x80000000
+
+// modbusInt は値を scale 倍した整数のレジスタの値を返します。
+// 32 ビットの符号付き整数で表せない場合は modbusIntNoData を返します。
+func modbusInt(v, scale float64) uint32 {
+	x := math.Round(v * scale)
+	if math.IsNaN(x) || x <= math.MinInt32 || x > math.MaxInt32 {
+		return modbusIntNoData
+	}
+	return uint32(int32(x))
+}
+
+// modbusRegister はレジスタマップの1項目です。
+type modbusRegister struct {
+	// item は readingItemNames の項目名です (空の場合は取得時刻)。
+	item string
+	// scale は整数のレジスタに格納する際の倍率です。
+	scale float64
+}
+
+// modbusRegisters はレジスタマップの項目の並びです。i 番目の項目は base+2*i のアドレスに格納します。
+var modbusRegisters = []modbusRegister{
+	{"power_watts", 1},
+	{"current_r_amperes", 10},
+	{"current_t_amperes", 10},
+	{"energy_consumed_kwh", 100},
+	{"energy_exported_kwh", 100},
+	{"fixed_time_consumed_kwh", 100},
+	{"fixed_time_exported_kwh", 100},
+	{"operational", 1},
+	{"fault", 1},
+	{"phases", 1},
+	// 取得時刻 (Unix 時間) は整数のレジスタのみ
+	{"", 1},
+}
+
+// modbusConfig は Modbus TCP のサーバーの設定です。
+type modbusConfig struct {
+	Listen string
+	UnitID int
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *modbusConfig) bind() {
+	c.Listen = getEnv("SMARTMETER_MODBUS_LISTEN", "")
+	c.UnitID = getEnvInt("SMARTMETER_MODBUS_UNIT_ID", 1)
+
+	flag.StringVar(&c.Listen, "modbus.listen", c.Listen,
+		"Address to serve the latest readings on as Modbus TCP registers (e.g. :502)")
+	flag.IntVar(&c.UnitID, "modbus.unit-id", c.UnitID,
+		"Modbus unit identifier to answer (0 answers any unit)")
+}
+
+func (c *modbusConfig) enabled() bool {
+	return c.Listen != ""
+}
+
+// validate は Modbus TCP の設定値を検証します。
+func (c *modbusConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid Modbus listen address %q: %w", c.Listen, err)
+	}
+	if c.UnitID < 0 || c.UnitID > 255 {
+		return fmt.Errorf("invalid Modbus unit identifier %d", c.UnitID)
+	}
+	return nil
+}
+
+// modbusSink は直近の取得値を Modbus TCP のレジスタ (保持レジスタ、入力レジスタ共通) として提供します。
+// 取得値に含まれていない項目は直前の値を保ちます (定時積算電力量は30分毎に更新されるため)。
+type modbusSink struct {
+	cfg      *modbusConfig
+	listener net.Listener
+
+	mu     sync.Mutex
+	values map[string]float64
+	time   time.Time
+	conns  map[net.Conn]struct{}
+}
+
+func newModbusSink(cfg *modbusConfig) (*modbusSink, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &modbusSink{
+		cfg:      cfg,
+		listener: listener,
+		values:   make(map[string]float64),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *modbusSink) publish(_ context.Context, r *reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range r.items() {
+		s.values[item.Name] = item.Value
+	}
+	s.time = r.Time
+	return nil
+}
+
+func (s *modbusSink) close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return err
+}
+
+func (s *modbusSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// close で閉じられた
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle は接続を閉じるまで要求 (MBAP ヘッダー + PDU) に応答します。
+func (s *modbusSink) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	header := make([]byte, 7)
+	for {
+		_ = conn.SetDeadline(time.Now().Add(modbusIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		// プロトコル識別子は 0、長さはユニット識別子と PDU のバイト数
+		n := int(binary.BigEndian.Uint16(header[4:6]))
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || n < 2 || n > 254 {
+			return
+		}
+		pdu := make([]byte, n-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		unit := header[6]
+		if s.cfg.UnitID != 0 && int(unit) != s.cfg.UnitID {
+			// 他のユニット宛ての要求には応答しない
+			continue
+		}
+		resp := s.respond(pdu)
+		b := append([]byte{}, header[:4]...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(resp)+1))
+		b = append(b, unit)
+		if _, err := conn.Write(append(b, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// respond は要求の PDU に対する応答の PDU を返します。
+func (s *modbusSink) respond(pdu []byte) []byte {
+	fc := pdu[0]
+	if fc != modbusReadHoldingRegisters && fc != modbusReadInputRegisters {
+		return []byte{fc | 0x80, modbusIllegalFunction}
+	}
+	if len(pdu) != 5 {
+		return []byte{fc | 0x80, modbusIllegalDataValue}
+	}
+	addr := int(binary.BigEndian.Uint16(pdu[1:3]))
+	count := int(binary.BigEndian.Uint16(pdu[3:5]))
+	if count < 1 || count > modbusMaxReadRegisters {
+		return []byte{fc | 0x80, modbusIllegalDataValue}
+	}
+	registers, ok := s.registers(addr, count)
+	if !ok {
+		return []byte{fc | 0x80, modbusIllegalDataAddress}
+	}
+	b := []byte{fc, byte(2 * count)}
+	for _, r := range registers {
+		b = binary.BigEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+// registers はアドレス addr から count 個のレジスタの値を返します。
+// 範囲にレジスタマップ外のアドレスが含まれる場合は false を返します。
+func (s *modbusSink) registers(addr, count int) ([]uint16, bool) {
+	intBlock, floatBlock := s.blocks()
+	var regs []uint16
+	for a := addr; a < addr+count; a++ {
+		switch {
+		case a >= modbusIntBase && a < modbusIntBase+len(intBlock):
+			regs = append(regs, intBlock[a-modbusIntBase])
+		case a >= modbusFloatBase && a < modbusFloatBase+len(floatBlock):
+			regs = append(regs, floatBlock[a-modbusFloatBase])
+		default:
+			return nil, false
+		}
+	}
+	return regs, true
+}
+
+// blocks は整数と浮動小数点数のレジスタの値を生成します。
+func (s *modbusSink) blocks() (intBlock, floatBlock []uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reg := range modbusRegisters {
+		if reg.item == "" {
+			var ts uint32
+			if !s.time.IsZero() {
+				ts = uint32(s.time.Unix())
+			}
+			intBlock = append(intBlock, uint16(ts>>16), uint16(ts))
+			continue
+		}
+		v, ok := s.values[reg.item]
+		i, f := modbusIntNoData, math.Float32bits(float32(math.NaN()))
+		if ok {
+			i = modbusInt(v, reg.scale)
+			f = math.Float32bits(float32(v))
+		}
+		intBlock = append(intBlock, uint16(i>>16), uint16(i))
+		floatBlock = append(floatBlock, uint16(f>>16), uint16(f))
+	}
+	return intBlock, floatBlock
+}
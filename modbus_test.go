@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// testModbusRequest は読み出しの要求の PDU を生成します。
+func testModbusRequest(fc byte, addr, count uint16) []byte {
+	pdu := binary.BigEndian.AppendUint16([]byte{fc}, addr)
+	return binary.BigEndian.AppendUint16(pdu, count)
+}
+
+func TestModbusSinkRespond(t *testing.T) {
+	s := &modbusSink{
+		cfg:    &modbusConfig{},
+		values: map[string]float64{"power_watts": 512, "energy_consumed_kwh": 12345.67},
+		time:   time.Unix(0x12345678, 0),
+	}
+	// 取得時刻はレジスタマップの最後の項目
+	timeAddr := uint16(modbusIntBase + 2*(len(modbusRegisters)-1))
+	power := math.Float32bits(512)
+	tests := []struct {
+		name string
+		pdu  []byte
+		want []byte
+	}{
+		{
+			"int power",
+			testModbusRequest(modbusReadHoldingRegisters, modbusIntBase, 2),
+			[]byte{modbusReadHoldingRegisters, 4, 0x00, 0x00, 0x02, 0x00},
+		},
+		{
+			"int energy is scaled",
+			testModbusRequest(modbusReadInputRegisters, modbusIntBase+6, 2),
+			[]byte{modbusReadInputRegisters, 4, 0x00, 0x12, 0xD6, 0x87},
+		},
+		{
+			"int no data",
+			testModbusRequest(modbusReadHoldingRegisters, modbusIntBase+2, 2),
+			[]byte{modbusReadHoldingRegisters, 4, 0x80, 0x00, 0x00, 0x00},
+		},
+		{
+			"time",
+			testModbusRequest(modbusReadHoldingRegisters, timeAddr, 2),
+			[]byte{modbusReadHoldingRegisters, 4, 0x12, 0x34, 0x56, 0x78},
+		},
+		{
+			"float power",
+			testModbusRequest(modbusReadInputRegisters, modbusFloatBase, 2),
+			binary.BigEndian.AppendUint32([]byte{modbusReadInputRegisters, 4}, power),
+		},
+		{
+			"beyond int block",
+			testModbusRequest(modbusReadHoldingRegisters, timeAddr, 3),
+			[]byte{modbusReadHoldingRegisters | 0x80, modbusIllegalDataAddress},
+		},
+		{
+			"gap between blocks",
+			testModbusRequest(modbusReadHoldingRegisters, modbusFloatBase-1, 2),
+			[]byte{modbusReadHoldingRegisters | 0x80, modbusIllegalDataAddress},
+		},
+		{
+			"too many registers",
+			testModbusRequest(modbusReadHoldingRegisters, 0, modbusMaxReadRegisters+1),
+			[]byte{modbusReadHoldingRegisters | 0x80, modbusIllegalDataValue},
+		},
+		{
+			"write is not supported",
+			[]byte{0x06, 0x00, 0x00, 0x00, 0x01},
+			[]byte{0x06 | 0x80, modbusIllegalFunction},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.respond(tt.pdu); !bytes.Equal(got, tt.want) {
+				t.Errorf("respond(% X) = % X, want % X", tt.pdu, got, tt.want)
+			}
+		})
+	}
+
+	// 未取得の浮動小数点数は NaN
+	got := s.respond(testModbusRequest(modbusReadInputRegisters, modbusFloatBase+2, 2))
+	if v := math.Float32frombits(binary.BigEndian.Uint32(got[2:])); !math.IsNaN(float64(v)) {
+		t.Errorf("float register without data = %v, want NaN", v)
+	}
+}
+
+func TestModbusInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     float64
+		scale float64
+		want  uint32
+	}{
+		{"positive", 512, 1, 512},
+		{"negative", -1.5, 10, 0xFFFFFFF1},
+		{"rounded", 0.126, 100, 13},
+		// 7〜8 桁のメーターで 21.4 MWh を超える積算電力量は int32 で表せない
+		{"overflow", 21474836.48, 100, modbusIntNoData},
+		{"max", math.MaxInt32, 1, math.MaxInt32},
+		{"min is reserved", math.MinInt32, 1, modbusIntNoData},
+		{"NaN", math.NaN(), 1, modbusIntNoData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := modbusInt(tt.v, tt.scale); got != tt.want {
+				t.Errorf("modbusInt(%v, %v) = %#x, want %#x", tt.v, tt.scale, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModbusSinkHandle(t *testing.T) {
+	s := &modbusSink{
+		cfg:    &modbusConfig{UnitID: 1},
+		values: map[string]float64{"power_watts": 512},
+		conns:  make(map[net.Conn]struct{}),
+	}
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go s.handle(server)
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	send := func(tid uint16, unit byte) {
+		t.Helper()
+		pdu := testModbusRequest(modbusReadHoldingRegisters, modbusIntBase, 2)
+		b := binary.BigEndian.AppendUint16(nil, tid)
+		b = binary.BigEndian.AppendUint16(b, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(pdu)+1))
+		b = append(b, unit)
+		if _, err := client.Write(append(b, pdu...)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	// 他のユニット宛ての要求には応答せず、次の要求に応答する
+	send(1, 2)
+	send(2, 1)
+	resp := make([]byte, 13)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	want := []byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x07, 0x01,
+		modbusReadHoldingRegisters, 4, 0x00, 0x00, 0x02, 0x00}
+	if !bytes.Equal(resp, want) {
+		t.Errorf("response = % X, want % X", resp, want)
+	}
+}
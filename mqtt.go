@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// MQTT 3.1.1 のパケット種別 (固定ヘッダーの上位4ビット)
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttDisconnect = 14
+)
+
+const (
+	mqttDialTimeout = 10 * time.Second
+	// mqttStatusOnline, mqttStatusOffline は <prefix>/status に retain で送信する接続状態です。
+	// 切断時は Last Will によりブローカーが offline を送信します。
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+)
+
+// mqttConfig は MQTT への出力の設定です。
+type mqttConfig struct {
+	URL                string
+	TopicPrefix        string
+	QoS                int
+	Retain             bool
+	ClientID           string
+	Username           string
+	Password           string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (m *mqttConfig) bind() {
+	m.URL = getEnv("SMARTMETER_MQTT_URL", "")
+	m.TopicPrefix = getEnv("SMARTMETER_MQTT_TOPIC_PREFIX", "smartmeter")
+	m.QoS = getEnvInt("SMARTMETER_MQTT_QOS", 0)
+	m.Retain = getEnvBool("SMARTMETER_MQTT_RETAIN")
+	m.ClientID = getEnv("SMARTMETER_MQTT_CLIENT_ID", "smartmeter_exporter")
+	m.Username = getEnv("SMARTMETER_MQTT_USERNAME", "")
+	m.Password = getEnv("SMARTMETER_MQTT_PASSWORD", "")
+	m.CAFile = getEnv("SMARTMETER_MQTT_CA_FILE", "")
+	m.InsecureSkipVerify = getEnvBool("SMARTMETER_MQTT_INSECURE_SKIP_VERIFY")
+
+	flag.StringVar(&m.URL, "mqtt.url", m.URL,
+		"MQTT broker URL to publish readings to (mqtt://host:1883 or mqtts://host:8883)")
+	flag.StringVar(&m.TopicPrefix, "mqtt.topic-prefix", m.TopicPrefix, "MQTT topic prefix")
+	flag.IntVar(&m.QoS, "mqtt.qos", m.QoS, "MQTT QoS level for published readings (0 or 1)")
+	flag.BoolVar(&m.Retain, "mqtt.retain", m.Retain, "Publish readings as retained messages")
+	flag.StringVar(&m.ClientID, "mqtt.client-id", m.ClientID, "MQTT client identifier")
+	flag.StringVar(&m.Username, "mqtt.username", m.Username, "MQTT username")
+	flag.StringVar(&m.Password, "mqtt.password", m.Password, "MQTT password")
+	flag.StringVar(&m.CAFile, "mqtt.tls.ca-file", m.CAFile,
+		"CA certificate file to verify the MQTT broker")
+	flag.BoolVar(&m.InsecureSkipVerify, "mqtt.tls.insecure-skip-verify", m.InsecureSkipVerify,
+		"Skip verification of the MQTT broker certificate")
+}
+
+func (m *mqttConfig) enabled() bool {
+	return m.URL != ""
+}
+
+// validate は MQTT の設定値を検証します。
+func (m *mqttConfig) validate() error {
+	if !m.enabled() {
+		return nil
+	}
+	if _, _, err := m.address(); err != nil {
+		return err
+	}
+	if m.QoS != 0 && m.QoS != 1 {
+		return fmt.Errorf("unsupported MQTT QoS %d (must be 0 or 1)", m.QoS)
+	}
+	if m.TopicPrefix == "" {
+		return errors.New("MQTT topic prefix must not be empty")
+	}
+	return nil
+}
+
+// address はブローカーの URL から接続先のアドレスと TLS を使うかどうかを返します。
+func (m *mqttConfig) address() (string, bool, error) {
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid MQTT URL %q: %w", m.URL, err)
+	}
+	var useTLS bool
+	port := "1883"
+	switch u.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		useTLS = true
+		port = "8883"
+	default:
+		return "", false, fmt.Errorf("unsupported MQTT URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("MQTT URL %q has no host", m.URL)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// credentials はユーザー名とパスワードを返します。フラグの指定が URL に含まれるものより優先されます。
+func (m *mqttConfig) credentials() (string, string) {
+	username, password := m.Username, m.Password
+	if u, err := url.Parse(m.URL); err == nil && u.User != nil {
+		if username == "" {
+			username = u.User.Username()
+		}
+		if p, ok := u.User.Password(); ok && password == "" {
+			password = p
+		}
+	}
+	return username, password
+}
+
+// mqttSink は取得値を JSON で MQTT ブローカーに送信します。
+// 外部ライブラリに依存しないよう、送信に必要な MQTT 3.1.1 のサブセットのみ実装しています。
+type mqttSink struct {
+	cfg      *mqttConfig
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func newMQTTSink(cfg *mqttConfig) (*mqttSink, error) {
+	addr, useTLS, err := cfg.address()
+	if err != nil {
+		return nil, err
+	}
+	s := &mqttSink{cfg: cfg, addr: addr}
+	s.username, s.password = cfg.credentials()
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		if s.tls, err = newTLSConfig(host, cfg.CAFile, cfg.InsecureSkipVerify); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *mqttSink) topic(name string) string {
+	return s.cfg.TopicPrefix + "/" + name
+}
+
+func (s *mqttSink) publish(ctx context.Context, r *reading) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	topic := s.topic("reading")
+	if s.conn != nil {
+		if err = s.send(ctx, topic, payload, s.cfg.QoS, s.cfg.Retain); err == nil {
+			return nil
+		}
+		// ブローカー側で切断されている可能性があるため、接続し直して1回だけ再送する
+		s.disconnect()
+	}
+	if err = s.connect(ctx); err != nil {
+		return err
+	}
+	if err = s.send(ctx, topic, payload, s.cfg.QoS, s.cfg.Retain); err != nil {
+		s.disconnect()
+	}
+	return err
+}
+
+func (s *mqttSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	// 正常な切断では Last Will が送信されないため、offline を自分で送信する
+	ctx, cancel := context.WithTimeout(context.Background(), mqttDialTimeout)
+	defer cancel()
+	_ = s.send(ctx, s.topic("status"), []byte(mqttStatusOffline), 0, true)
+	_, err := s.conn.Write([]byte{mqttDisconnect << 4, 0})
+	s.disconnect()
+	return err
+}
+
+func (s *mqttSink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// connect はブローカーに接続し、CONNECT を送信して CONNACK を待ちます。
+func (s *mqttSink) connect(ctx context.Context) error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	if s.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tls}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.setDeadline(ctx)
+
+	if _, err = conn.Write(s.connectPacket()); err != nil {
+		s.disconnect()
+		return err
+	}
+	typ, body, err := s.readPacket()
+	if err != nil {
+		s.disconnect()
+		return err
+	}
+	if typ != mqttConnack || len(body) != 2 {
+		s.disconnect()
+		return fmt.Errorf("unexpected MQTT packet type %d", typ)
+	}
+	if body[1] != 0 {
+		s.disconnect()
+		return fmt.Errorf("MQTT connection refused (return code %d)", body[1])
+	}
+	return s.send(ctx, s.topic("status"), []byte(mqttStatusOnline), 0, true)
+}
+
+// connectPacket は CONNECT パケットを生成します。Last Will には <prefix>/status の offline を指定します。
+func (s *mqttSink) connectPacket() []byte {
+	// clean session と Last Will (QoS 0, retain)
+	flags := byte(0x02 | 0x04 | 0x20)
+	if s.username != "" {
+		flags |= 0x80
+		if s.password != "" {
+			flags |= 0x40
+		}
+	}
+	b := appendMQTTString(nil, "MQTT")
+	// プロトコルレベル 4 (3.1.1)、キープアライブ無効
+	b = append(b, 4, flags, 0, 0)
+	b = appendMQTTString(b, s.cfg.ClientID)
+	b = appendMQTTString(b, s.topic("status"))
+	b = appendMQTTString(b, mqttStatusOffline)
+	if s.username != "" {
+		b = appendMQTTString(b, s.username)
+		if s.password != "" {
+			b = appendMQTTString(b, s.password)
+		}
+	}
+	return mqttPacket(mqttConnect<<4, b)
+}
+
+// send は PUBLISH を送信します。QoS 1 の場合は PUBACK を待ちます。
+func (s *mqttSink) send(
+	ctx context.Context, topic string, payload []byte, qos int, retain bool,
+) error {
+	s.setDeadline(ctx)
+	header := byte(mqttPublish<<4 | qos<<1)
+	if retain {
+		header |= 0x01
+	}
+	b := appendMQTTString(nil, topic)
+	if qos > 0 {
+		s.packetID++
+		if s.packetID == 0 {
+			s.packetID = 1
+		}
+		b = binary.BigEndian.AppendUint16(b, s.packetID)
+	}
+	b = append(b, payload...)
+	if _, err := s.conn.Write(mqttPacket(header, b)); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+	typ, body, err := s.readPacket()
+	if err != nil {
+		return err
+	}
+	if typ != mqttPuback || len(body) != 2 || binary.BigEndian.Uint16(body) != s.packetID {
+		return fmt.Errorf("unexpected MQTT packet type %d while waiting for PUBACK", typ)
+	}
+	return nil
+}
+
+func (s *mqttSink) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sinkPublishTimeout)
+	}
+	_ = s.conn.SetDeadline(deadline)
+}
+
+// readPacket はパケットを1つ読み込み、パケット種別と可変ヘッダー以降を返します。
+func (s *mqttSink) readPacket() (byte, []byte, error) {
+	header, err := s.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for {
+		var d byte
+		if d, err = s.r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		n |= int(d&0x7F) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(s.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// mqttPacket は固定ヘッダーを付加したパケットを返します。
+func mqttPacket(header byte, body []byte) []byte {
+	b := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		if n /= 128; n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// appendMQTTString は長さ (2バイト) を前置した UTF-8 文字列を追加します。
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
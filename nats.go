@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/version"
+)
+
+const natsDialTimeout = 10 * time.Second
+
+// natsConfig は NATS への出力の設定です。
+type natsConfig struct {
+	URL                string
+	Subject            string
+	Username           string
+	Password           string
+	Token              string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *natsConfig) bind() {
+	c.URL = getEnv("SMARTMETER_NATS_URL", "")
+	c.Subject = getEnv("SMARTMETER_NATS_SUBJECT", "smartmeter.reading")
+	c.Username = getEnv("SMARTMETER_NATS_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_NATS_PASSWORD", "")
+	c.Token = getEnv("SMARTMETER_NATS_TOKEN", "")
+	c.CAFile = getEnv("SMARTMETER_NATS_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_NATS_INSECURE_SKIP_VERIFY")
+
+	flag.StringVar(&c.URL, "nats.url", c.URL,
+		"NATS server URL to publish readings to (nats://host:4222 or tls://host:4222)")
+	flag.StringVar(&c.Subject, "nats.subject", c.Subject, "NATS subject to publish readings to")
+	flag.StringVar(&c.Username, "nats.username", c.Username, "NATS username")
+	flag.StringVar(&c.Password, "nats.password", c.Password, "NATS password")
+	flag.StringVar(&c.Token, "nats.token", c.Token, "NATS authentication token")
+	flag.StringVar(&c.CAFile, "nats.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the NATS server")
+	flag.BoolVar(&c.InsecureSkipVerify, "nats.tls.insecure-skip-verify", c.InsecureSkipVerify,
+		"Skip verification of the NATS server certificate")
+}
+
+func (c *natsConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は NATS の設定値を検証します。
+func (c *natsConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, _, err := c.address(); err != nil {
+		return err
+	}
+	if c.Subject == "" || strings.ContainsAny(c.Subject, " \t\r\n*>") {
+		return fmt.Errorf("invalid NATS subject %q", c.Subject)
+	}
+	return nil
+}
+
+// address はサーバーの URL から接続先のアドレスと TLS を使うかどうかを返します。
+func (c *natsConfig) address() (string, bool, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid NATS URL %q: %w", c.URL, err)
+	}
+	var useTLS bool
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		useTLS = true
+	default:
+		return "", false, fmt.Errorf("unsupported NATS URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("NATS URL %q has no host", c.URL)
+	}
+	port := "4222"
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// natsConnectOptions は CONNECT で送信する接続のオプションです。
+type natsConnectOptions struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// natsSink は取得値を JSON で NATS のサブジェクトに送信します。
+// 外部ライブラリに依存しないよう、送信に必要な NATS クライアントプロトコルのサブセットのみ実装しています。
+// 送信後に PING を送って PONG を待つことで、サーバーが受け付けたことを確認します。
+type natsSink struct {
+	cfg     *natsConfig
+	addr    string
+	useTLS  bool
+	options natsConnectOptions
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSSink(cfg *natsConfig) (*natsSink, error) {
+	addr, useTLS, err := cfg.address()
+	if err != nil {
+		return nil, err
+	}
+	s := &natsSink{cfg: cfg, addr: addr, useTLS: useTLS}
+	s.options = natsConnectOptions{
+		Name:      programName,
+		Lang:      "go",
+		Version:   version.Version,
+		Protocol:  1,
+		User:      cfg.Username,
+		Pass:      cfg.Password,
+		AuthToken: cfg.Token,
+	}
+	// フラグの指定が URL に含まれるものより優先される
+	if u, _ := url.Parse(cfg.URL); u.User != nil {
+		p, hasPassword := u.User.Password()
+		switch {
+		case s.options.User != "" || s.options.AuthToken != "":
+		case hasPassword:
+			s.options.User, s.options.Pass = u.User.Username(), p
+		default:
+			// nats://token@host の形式
+			s.options.AuthToken = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSink) publish(ctx context.Context, r *reading) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if s.conn != nil {
+		if err = s.send(ctx, payload); err == nil {
+			return nil
+		}
+		// サーバー側で切断されている可能性があるため、接続し直して1回だけ再送する
+		s.disconnect()
+	}
+	if err = s.connect(ctx); err != nil {
+		return err
+	}
+	if err = s.send(ctx, payload); err != nil {
+		s.disconnect()
+	}
+	return err
+}
+
+func (s *natsSink) close() error {
+	s.disconnect()
+	return nil
+}
+
+func (s *natsSink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// connect はサーバーに接続し、INFO を受信して CONNECT を送信します。
+// サーバーが TLS を要求する場合は INFO の受信後に TLS に切り替えます。
+func (s *natsSink) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: natsDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.setDeadline(ctx)
+	if err = s.handshake(ctx); err != nil {
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (s *natsSink) handshake(ctx context.Context) error {
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	infoJSON, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("unexpected NATS message %q", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err = json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+	if s.useTLS || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(s.addr)
+		var tlsConfig *tls.Config
+		if tlsConfig, err = newTLSConfig(host, s.cfg.CAFile, s.cfg.InsecureSkipVerify); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(s.conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		s.conn = tlsConn
+		s.r = bufio.NewReader(tlsConn)
+	}
+	options, err := json.Marshal(s.options)
+	if err != nil {
+		return err
+	}
+	if _, err = s.conn.Write([]byte("CONNECT " + string(options) + "\r\nPING\r\n")); err != nil {
+		return err
+	}
+	return s.waitPong()
+}
+
+// send は PUB を送信し、PONG を待ちます。
+func (s *natsSink) send(ctx context.Context, payload []byte) error {
+	s.setDeadline(ctx)
+	b := []byte("PUB " + s.cfg.Subject + " " + strconv.Itoa(len(payload)) + "\r\n")
+	b = append(b, payload...)
+	b = append(b, "\r\nPING\r\n"...)
+	if _, err := s.conn.Write(b); err != nil {
+		return err
+	}
+	return s.waitPong()
+}
+
+// waitPong は PONG を受信するまで読み込みます。サーバーからの PING には PONG で応答します。
+func (s *natsSink) waitPong() error {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("NATS server error: " + strings.TrimSpace(line[len("-ERR"):]))
+		}
+		// +OK や INFO (クラスタ構成の変更の通知) は無視する
+	}
+}
+
+func (s *natsSink) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s *natsSink) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sinkPublishTimeout)
+	}
+	_ = s.conn.SetDeadline(deadline)
+}
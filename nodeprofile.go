@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// epcSelfNodeInstanceList はノードプロファイルの自ノードインスタンスリストS (EPC 0xD6) です。
+const epcSelfNodeInstanceList = 0xD6
+
+// lvSmartMeterClass は低圧スマート電力量メータのクラス (クラスグループコード、クラスコード) です。
+const lvSmartMeterClass = 0x0288
+
+// スマートメーターのノードに存在する ECHONET オブジェクト (値は常に 1)
+var nodeObjectGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "smartmeter_node_object_info",
+	Help: "ECHONET Lite objects listed in the self-node instance list of the meter node",
+}, []string{"eoj"})
+
+func init() {
+	prometheus.MustRegister(nodeObjectGauge)
+}
+
+// nodeObjects はスマートメーターのノードに存在する ECHONET オブジェクト (EOJ) です (nil は未取得)。
+var nodeObjects []uint32
+
+// decodeInstanceList は自ノードインスタンスリストS の EDT をデコードします。
+// 先頭1バイトがインスタンス総数、以降が3バイトずつの EOJ です。
+func decodeInstanceList(edt []byte) ([]uint32, error) {
+	if len(edt) == 0 {
+		return nil, fmt.Errorf("empty instance list")
+	}
+	n := int(edt[0])
+	if len(edt) != 1+3*n {
+		return nil, fmt.Errorf("unexpected EDT length: %d for %d instances", len(edt), n)
+	}
+	eojs := make([]uint32, 0, n)
+	for i := 1; i < len(edt); i += 3 {
+		eojs = append(eojs, uint32(edt[i])<<16|uint32(edt[i+1])<<8|uint32(edt[i+2]))
+	}
+	return eojs, nil
+}
+
+// eojLabel は EOJ をメトリクスのラベル値 (例: "0x028801") に変換します。
+func eojLabel(eoj uint32) string {
+	return fmt.Sprintf("0x%06X", eoj)
+}
+
+// resolveNodeObjects はノードプロファイルから自ノードインスタンスリストS を取得し、
+// ノードに存在する ECHONET オブジェクトをログと smartmeter_node_object_info に出力します。
+// 低圧スマート電力量メータ以外のオブジェクトが存在する場合の調査に使います。
+func resolveNodeObjects(dev *smartmeter.Device, logger *slog.Logger) error {
+	request := smartmeter.NewFrame(
+		smartmeter.NodeProfile,
+		smartmeter.Get,
+		newProperties([]smartmeter.PropertyCode{epcSelfNodeInstanceList}),
+	)
+	response, err := query(dev, request)
+	if err != nil {
+		return err
+	}
+	for _, p := range response.Properties {
+		if p.EPC != epcSelfNodeInstanceList {
+			continue
+		}
+		eojs, err := decodeInstanceList(p.EDT)
+		if err != nil {
+			return err
+		}
+		nodeObjects = eojs
+
+		nodeObjectGauge.Reset()
+		hasMeter := false
+		labels := make([]string, 0, len(eojs))
+		for _, eoj := range eojs {
+			nodeObjectGauge.WithLabelValues(eojLabel(eoj)).Set(1)
+			labels = append(labels, eojLabel(eoj))
+			if eoj>>8 == lvSmartMeterClass {
+				hasMeter = true
+			}
+		}
+		logger.Info("Node objects discovered", "objects", labels)
+		if !hasMeter {
+			logger.Warn("No low-voltage smart meter object found on the node", "objects", labels)
+		}
+		return nil
+	}
+	return fmt.Errorf("response contained no instance list")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+// postgresConfig は PostgreSQL (TimescaleDB) への記録の設定です。
+type postgresConfig struct {
+	DSN         string
+	Table       string
+	Retention   time.Duration
+	TimescaleDB bool
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *postgresConfig) bind() {
+	c.DSN = getEnv("SMARTMETER_POSTGRES_DSN", "")
+	c.Table = getEnv("SMARTMETER_POSTGRES_TABLE", "readings")
+	c.Retention = getEnvDuration("SMARTMETER_POSTGRES_RETENTION", 0)
+	c.TimescaleDB = getEnvBool("SMARTMETER_POSTGRES_TIMESCALEDB")
+
+	flag.StringVar(&c.DSN, "postgres.dsn", c.DSN,
+		"PostgreSQL connection string to store readings in (requires a build with -tags postgres)")
+	flag.StringVar(&c.Table, "postgres.table", c.Table, "PostgreSQL table name for readings")
+	durationVar(&c.Retention, "postgres.retention", c.Retention,
+		"Delete PostgreSQL rows older than this (0: keep forever)")
+	flag.BoolVar(&c.TimescaleDB, "postgres.timescaledb", c.TimescaleDB,
+		"Create the tables as TimescaleDB hypertables")
+}
+
+func (c *postgresConfig) enabled() bool {
+	return c.DSN != ""
+}
+
+// validate は PostgreSQL への記録の設定値を検証します。
+func (c *postgresConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if !sqlDriverAvailable(postgresDialect.driver) {
+		return errors.New("PostgreSQL support is not built in (rebuild with -tags postgres)")
+	}
+	if c.Retention < 0 {
+		return errors.New("PostgreSQL retention must not be negative")
+	}
+	return validateTableName(c.Table)
+}
+
+func newPostgresSink(cfg *postgresConfig) (*sqlSink, error) {
+	s, err := newSQLSink(postgresDialect, cfg.DSN, cfg.Table, cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TimescaleDB {
+		for _, table := range []string{cfg.Table, cfg.Table + "_fixed_time"} {
+			s.setup = append(s.setup, "SELECT create_hypertable('"+table+"', 'time', "+
+				"if_not_exists => TRUE, migrate_data => TRUE)")
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// meterConfig はスマートメーター (Wi-SUN モジュール) への接続設定です。
+// 設定ファイルの meters では /probe で取得するスマートメーターを名前付きで宣言します。
+type meterConfig struct {
+	Name     string `yaml:"name"`
+	Device   string `yaml:"device"`
+	ID       string `yaml:"id"`
+	Password string `yaml:"password"`
+	Channel  string `yaml:"channel"`
+	IPAddr   string `yaml:"ipaddr"`
+	DSE      bool   `yaml:"dse"`
+}
+
+// openDevice はスマートメーターに接続する Wi-SUN モジュールを開きます。
+func openDevice(m meterConfig, verbosity int, smLogger *log.Logger) (*smartmeter.Device, error) {
+	// smartmeter.Open に渡すオプションを動的に構築
+	smOpts := []smartmeter.Option{
+		smartmeter.ID(m.ID),
+		smartmeter.Password(m.Password),
+		smartmeter.DualStackSK(m.DSE),
+		smartmeter.Verbosity(verbosity),
+		smartmeter.Logger(smLogger),
+		smartmeter.RetryInterval(queryRetryInterval),
+	}
+
+	// Channel指定がある場合のみ追加
+	if m.Channel != "" {
+		smOpts = append(smOpts, smartmeter.Channel(m.Channel))
+	}
+	// IP指定がある場合のみ追加
+	if m.IPAddr != "" {
+		smOpts = append(smOpts, smartmeter.IPAddr(m.IPAddr))
+	}
+	return smartmeter.Open(m.Device, smOpts...)
+}
+
+// checkDevice はシリアルデバイスが存在し、読み書きできるように開けることを確認します。
+// デバイスには何も書き込まないため、Wi-SUN モジュールは操作しません。
+func checkDevice(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Windows の COM ポートはデバイスファイルとして扱われない
+	if runtime.GOOS != "windows" && fi.Mode()&fs.ModeDevice == 0 {
+		return fmt.Errorf("%s is not a device file", path)
+	}
+	// モデムの制御線を待たずに開く
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("%w (the user may need to be in the dialout group)", err)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// probeEPCs は /probe で取得するプロパティです。
+var probeEPCs = []smartmeter.PropertyCode{
+	epcOperationStatus,
+	epcFaultStatus,
+	smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower,
+	smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent,
+	epcCumulativeEnergyNormal,
+	epcCumulativeEnergyReverse,
+}
+
+// probeTarget は /probe で取得するスマートメーターです。
+// Wi-SUN モジュールは同時に1つの要求しか扱えないため、取得は mu で直列化します。
+type probeTarget struct {
+	cfg       meterConfig
+	verbosity int
+	smLogger  *log.Logger
+
+	// client は要求の計数とプロパティの保持先です。定期取得するスマートメーターとは分けます。
+	client *meterClient
+
+	mu      sync.Mutex
+	dev     *smartmeter.Device // 最初の取得時に開く
+	unitKWh float64            // 積算電力量の1カウントあたりの kWh (0 は未取得)
+}
+
+// newProbeTargets は設定ファイルで宣言されたスマートメーターを名前で引けるようにします。
+func newProbeTargets(
+	meters []meterConfig,
+	verbosity int,
+	smLogger *log.Logger,
+) map[string]*probeTarget {
+	targets := make(map[string]*probeTarget, len(meters))
+	for _, m := range meters {
+		targets[m.Name] = &probeTarget{
+			cfg:       m,
+			verbosity: verbosity,
+			smLogger:  smLogger,
+			client:    newProbeClient(),
+		}
+	}
+	return targets
+}
+
+// newProbeClient は /probe で取得するスマートメーターの meterClient を作成します。
+// 要求回数は probe 毎のレジストリに登録し、通知は取得ループに渡さずに読み捨てます。
+func newProbeClient() *meterClient {
+	return &meterClient{
+		queries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smartmeter_queries_total",
+			Help: "Total number of ECHONET Lite queries, not counting retries",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smartmeter_query_retries_total",
+			Help: "Total number of ECHONET Lite query retries after a failed attempt",
+		}),
+		properties: &echonetPropertyCache{edt: map[byte][]byte{}},
+	}
+}
+
+// probeHandler は /probe?meter=<name> の要求毎に指定されたスマートメーターから値を取得し、
+// その結果だけを含むメトリクスを返します (blackbox_exporter と同様のマルチターゲット形式)。
+func probeHandler(
+	targets map[string]*probeTarget,
+	labels map[string]string,
+	logger *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("meter")
+		t, ok := targets[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown meter %q", name), http.StatusBadRequest)
+			return
+		}
+		reg := prometheus.NewRegistry()
+		t.probe(reg, logger.With("meter", name))
+		promhttp.HandlerFor(withConstLabels(reg, labels), promhttp.HandlerOpts{}).ServeHTTP(w, req)
+	}
+}
+
+// probe はスマートメーターから値を取得し、結果を reg に登録します。
+func (t *probeTarget) probe(reg *prometheus.Registry, logger *slog.Logger) {
+	up := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_up",
+		Help: "Whether the probe of the smart meter was successful (1) or not (0)",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_scrape_duration_seconds",
+		Help: "Probe duration in seconds",
+	})
+	reg.MustRegister(up, duration, t.client.queries, t.client.retries)
+
+	start := time.Now()
+	r, err := t.read(logger)
+	duration.Set(time.Since(start).Seconds())
+	if err != nil {
+		logger.Warn("Probe failed", "error", err)
+		return
+	}
+	up.Set(1)
+
+	c := &readingCollector{}
+	c.update(r)
+	reg.MustRegister(c)
+	if r.EnergyConsumedKWh != nil {
+		consumed := newEnergyCounter(
+			"smartmeter_energy_consumed_kwh_total",
+			"Cumulative electric energy consumed (normal direction) in kWh",
+		)
+		consumed.observe(*r.EnergyConsumedKWh, r.Time)
+		reg.MustRegister(consumed)
+	}
+	if r.EnergyExportedKWh != nil {
+		exported := newEnergyCounter(
+			"smartmeter_energy_exported_kwh_total",
+			"Cumulative electric energy exported to the grid (reverse direction) in kWh",
+		)
+		exported.observe(*r.EnergyExportedKWh, r.Time)
+		reg.MustRegister(exported)
+	}
+}
+
+// read はスマートメーターから probeEPCs を取得してデコードします。
+// 必要に応じてデバイスのオープン、IPアドレスの解決、再認証を行います。
+func (t *probeTarget) read(logger *slog.Logger) (*reading, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dev == nil {
+		dev, err := openDevice(t.cfg, t.verbosity, t.smLogger)
+		if err != nil {
+			return nil, fmt.Errorf("open device %s: %w", t.cfg.Device, err)
+		}
+		t.dev = dev
+	}
+	if t.dev.IPAddr == "" {
+		ipAddr, err := t.dev.GetNeibourIP()
+		if err != nil {
+			return nil, fmt.Errorf("scan neighbor IP: %w", err)
+		}
+		t.dev.IPAddr = ipAddr
+	}
+	if t.unitKWh == 0 {
+		if unitKWh, _, err := t.client.readEnergyScale(t.dev, logger); err != nil {
+			logger.Warn("Failed to read cumulative energy unit", "error", err)
+		} else {
+			t.unitKWh = unitKWh
+		}
+	}
+
+	request := smartmeter.NewFrame(
+		smartmeter.LvSmartElectricEnergyMeter,
+		smartmeter.Get,
+		newProperties(probeEPCs),
+	)
+	response, err := t.client.query(t.dev, request)
+	if err != nil {
+		logger.Info("Query failed, attempting re-auth", "error", err)
+		if authErr := t.dev.Authenticate(); authErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("re-auth: %w", authErr))
+		}
+		time.Sleep(postAuthCooldown)
+		if response, err = t.client.query(t.dev, request); err != nil {
+			return nil, err
+		}
+	}
+	t.client.properties.store(response.Properties)
+	return t.decode(response.Properties, logger), nil
+}
+
+// decode はレスポンスのプロパティをデコードします。
+// 積算電力量はスクレイプ毎の取得値を換算するだけで、桁あふれは補正しません。
+func (t *probeTarget) decode(props []*smartmeter.Property, logger *slog.Logger) *reading {
+	r := &reading{Time: time.Now()}
+	for _, p := range props {
+		var err error
+		switch p.EPC {
+		case epcCumulativeEnergyNormal:
+			r.EnergyConsumedKWh, err = t.decodeEnergy(p.EDT)
+		case epcCumulativeEnergyReverse:
+			r.EnergyExportedKWh, err = t.decodeEnergy(p.EDT)
+		default:
+			err = r.decodeProperty(p.EPC, p.EDT, logger)
+		}
+		if err != nil {
+			logger.Warn("Failed to decode property", "epc", epcLabel(p.EPC), "error", err)
+		}
+	}
+	return r
+}
+
+// decodeEnergy は積算電力量計測値を kWh にデコードします。単位が不明な場合は nil を返します。
+func (t *probeTarget) decodeEnergy(edt []byte) (*float64, error) {
+	if len(edt) != 4 {
+		return nil, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	v := binary.BigEndian.Uint32(edt)
+	if !isValidCumulativeEnergy(v) || t.unitKWh == 0 {
+		return nil, nil
+	}
+	return ptr(float64(v) * t.unitKWh), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProbeTargetsUseOwnClient(t *testing.T) {
+	targets := newProbeTargets([]meterConfig{
+		{Name: "a", Device: filepath.Join(t.TempDir(), "missing")},
+		{Name: "b"},
+	}, 0, nil)
+	a, b := targets["a"].client, targets["b"].client
+	// 定期取得するスマートメーターや他の probe の値を上書きしない
+	if a == mainMeter || a.properties == meterProperties || a.queries == queries {
+		t.Error("probe target shares the main meter's client")
+	}
+	if a.properties == b.properties || a.queries == b.queries {
+		t.Error("probe targets share a client")
+	}
+	if a.notify != nil {
+		t.Error("probe target queues notifications to the scrape loop")
+	}
+
+	reg := prometheus.NewRegistry()
+	targets["a"].probe(reg, testLogger)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		got[mf.GetName()] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+	}
+	for name, want := range map[string]float64{
+		"smartmeter_up":                  0,
+		"smartmeter_queries_total":       0,
+		"smartmeter_query_retries_total": 0,
+	} {
+		if v, ok := got[name]; !ok || v != want {
+			t.Errorf("%s = %v (present %v), want %v", name, v, ok, want)
+		}
+	}
+}
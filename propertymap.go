@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// epcGetPropertyMap は Getプロパティマップ (EPC 0x9F) です。
+const epcGetPropertyMap = 0x9F
+
+// プロパティ毎の取得結果の回数
+var propertyReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "smartmeter_property_read_total",
+	Help: "Total number of property reads by EPC and result (success, unanswered, error)",
+}, []string{"epc", "result"})
+
+func init() {
+	prometheus.MustRegister(propertyReads)
+}
+
+// プロパティの取得結果 (smartmeter_property_read_total の result ラベル)
+const (
+	readResultSuccess    = "success"    // 値を取得できた
+	readResultUnanswered = "unanswered" // 応答に値が含まれていない (Get_SNA など)
+	readResultError      = "error"      // 要求全体が失敗した
+)
+
+// supportedEPCs はスマートメーターが Get に対応しているプロパティの集合です (nil は未取得)。
+var supportedEPCs map[smartmeter.PropertyCode]bool
+
+// decodePropertyMap はプロパティマップの EDT をプロパティの集合にデコードします。
+// プロパティ数が16未満の場合は EPC の列挙、16以上の場合は 16バイトのビットマップ形式です。
+// ビットマップ形式では、i バイト目の j ビット目が EPC ((j+8)<<4 | i) に対応します。
+func decodePropertyMap(edt []byte) (map[smartmeter.PropertyCode]bool, error) {
+	if len(edt) == 0 {
+		return nil, fmt.Errorf("empty property map")
+	}
+	n := int(edt[0])
+	epcs := make(map[smartmeter.PropertyCode]bool, n)
+	if n < 16 {
+		if len(edt) != 1+n {
+			return nil, fmt.Errorf("unexpected EDT length: %d for %d properties", len(edt), n)
+		}
+		for _, epc := range edt[1:] {
+			epcs[smartmeter.PropertyCode(epc)] = true
+		}
+		return epcs, nil
+	}
+
+	if len(edt) != 17 {
+		return nil, fmt.Errorf("unexpected EDT length: %d for bitmap property map", len(edt))
+	}
+	for i, b := range edt[1:] {
+		for j := range 8 {
+			if b&(1<<j) != 0 {
+				epcs[smartmeter.PropertyCode((j+8)<<4|i)] = true
+			}
+		}
+	}
+	return epcs, nil
+}
+
+// resolvePropertyMap は Getプロパティマップを取得して supportedEPCs に設定し、
+// スクレイプ対象のうち未対応のプロパティをログに出力します。
+func resolvePropertyMap(dev *smartmeter.Device, logger *slog.Logger) error {
+	response, err := getProperties(dev, epcGetPropertyMap)
+	if err != nil {
+		return err
+	}
+	for _, p := range response.Properties {
+		if p.EPC != epcGetPropertyMap {
+			continue
+		}
+		epcs, err := decodePropertyMap(p.EDT)
+		if err != nil {
+			return err
+		}
+		supportedEPCs = epcs
+		logger.Debug("Property map resolved", "properties", len(epcs))
+		for _, epc := range scrapeEPCs {
+			if !epcs[epc] {
+				logger.Info("Property not supported by the meter, skipping", "epc", epcLabel(epc))
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("response contained no property map")
+}
+
+// filterSupportedEPCs は epcs のうち、スマートメーターが対応しているプロパティを返します。
+// プロパティマップが未取得の場合はすべてを返します。
+func filterSupportedEPCs(epcs []smartmeter.PropertyCode) []smartmeter.PropertyCode {
+	if supportedEPCs == nil {
+		return epcs
+	}
+	return slices.DeleteFunc(slices.Clone(epcs), func(epc smartmeter.PropertyCode) bool {
+		return !supportedEPCs[epc]
+	})
+}
+
+// recordPropertyReads は要求した各プロパティの取得結果を smartmeter_property_read_total に記録します。
+// response が nil の場合は要求全体が失敗したものとして扱います。
+func recordPropertyReads(epcs []smartmeter.PropertyCode, response *smartmeter.Frame) {
+	answered := make(map[smartmeter.PropertyCode]bool)
+	if response != nil {
+		for _, p := range response.Properties {
+			if len(p.EDT) > 0 {
+				answered[p.EPC] = true
+			}
+		}
+	}
+	for _, epc := range epcs {
+		result := readResultSuccess
+		switch {
+		case response == nil:
+			result = readResultError
+		case !answered[epc]:
+			result = readResultUnanswered
+		}
+		propertyReads.WithLabelValues(epcLabel(epc), result).Inc()
+	}
+}
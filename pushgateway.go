@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushgatewayConfig は Pushgateway への送信の設定です。
+type pushgatewayConfig struct {
+	URL                string
+	Job                string
+	GroupingPairs      []string
+	Username           string
+	Password           string
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Grouping map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *pushgatewayConfig) bind() {
+	c.URL = getEnv("SMARTMETER_PUSHGATEWAY_URL", "")
+	c.Job = getEnv("SMARTMETER_PUSHGATEWAY_JOB", "smartmeter")
+	c.Username = getEnv("SMARTMETER_PUSHGATEWAY_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_PUSHGATEWAY_PASSWORD", "")
+	c.CAFile = getEnv("SMARTMETER_PUSHGATEWAY_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_PUSHGATEWAY_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_PUSHGATEWAY_GROUPING", ""); v != "" {
+		c.GroupingPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "pushgateway.url", c.URL,
+		"Pushgateway URL to push readings to (e.g. http://localhost:9091)")
+	flag.StringVar(&c.Job, "pushgateway.job", c.Job, "Job name used in the Pushgateway grouping key")
+	flag.Var(&labelFlag{values: &c.GroupingPairs}, "pushgateway.grouping",
+		"Additional grouping key label key=value such as instance=pi (repeatable)")
+	flag.StringVar(&c.Username, "pushgateway.username", c.Username,
+		"Username for HTTP basic authentication")
+	flag.StringVar(&c.Password, "pushgateway.password", c.Password,
+		"Password for HTTP basic authentication")
+	flag.StringVar(&c.CAFile, "pushgateway.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the Pushgateway")
+	flag.BoolVar(&c.InsecureSkipVerify, "pushgateway.tls.insecure-skip-verify",
+		c.InsecureSkipVerify, "Skip verification of the Pushgateway certificate")
+}
+
+func (c *pushgatewayConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は Pushgateway の設定値を検証します。
+func (c *pushgatewayConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return errors.New("invalid Pushgateway URL: " + c.URL)
+	}
+	if c.Job == "" {
+		return errors.New("job name for the Pushgateway must not be empty")
+	}
+	grouping, err := parseLabels(c.GroupingPairs)
+	if err != nil {
+		return err
+	}
+	c.Grouping = grouping
+	return nil
+}
+
+// pushgatewaySink は取得値を Pushgateway に送信します。
+// 定時積算電力量のみの取得値で他の値を消さないよう、同じ名前のメトリクスのみを置き換える
+// POST (push.Pusher.Add) で送信します。Pushgateway は最新の値のみを保持するため再送はしません。
+type pushgatewaySink struct {
+	pusher    *push.Pusher
+	collector *readingPushCollector
+}
+
+func newPushgatewaySink(cfg *pushgatewayConfig) (*pushgatewaySink, error) {
+	client, err := newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	c := &readingPushCollector{}
+	p := push.New(cfg.URL, cfg.Job).Client(client).Collector(c)
+	// グルーピングキーの順序を安定させる
+	names := make([]string, 0, len(cfg.Grouping))
+	for k := range cfg.Grouping {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		p = p.Grouping(k, cfg.Grouping[k])
+	}
+	if cfg.Username != "" {
+		p = p.BasicAuth(cfg.Username, cfg.Password)
+	}
+	return &pushgatewaySink{pusher: p, collector: c}, p.Error()
+}
+
+func (s *pushgatewaySink) publish(ctx context.Context, r *reading) error {
+	s.collector.reading = r
+	return s.pusher.AddContext(ctx)
+}
+
+func (s *pushgatewaySink) close() error {
+	return nil
+}
+
+// readingPushCollector は直前の取得値を /metrics と同じ名前のメトリクスとして出力します。
+// Pushgateway はタイムスタンプ付きのサンプルを受け付けないため、定時積算電力量の計測日時は
+// smartmeter_fixed_time_energy_timestamp_seconds として出力します。
+type readingPushCollector struct {
+	reading *reading
+}
+
+func (c *readingPushCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *readingPushCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.reading == nil {
+		return
+	}
+	for _, s := range c.reading.samples() {
+		collectSample(ch, s.Name, s, s.Value)
+		if s.Name == "smartmeter_fixed_time_energy_kwh" {
+			ts := float64(s.Time.Unix())
+			collectSample(ch, "smartmeter_fixed_time_energy_timestamp_seconds", s, ts)
+		}
+	}
+}
+
+// collectSample はサンプルのラベルを持つ name のメトリクスを出力します。
+// 名前が _total で終わるものはカウンター、それ以外はゲージとして出力します。
+func collectSample(ch chan<- prometheus.Metric, name string, s readingSample, v float64) {
+	var labelNames, labelValues []string
+	if s.LabelName != "" {
+		labelNames, labelValues = []string{s.LabelName}, []string{s.LabelValue}
+	}
+	vt := prometheus.GaugeValue
+	if strings.HasSuffix(name, "_total") {
+		vt = prometheus.CounterValue
+	}
+	desc := prometheus.NewDesc(name, "Reading pushed by smartmeter_exporter", labelNames, nil)
+	ch <- prometheus.MustNewConstMetric(desc, vt, v, labelValues...)
+}
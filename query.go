@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ECHONET Lite の要求の再試行の設定です。setup で設定から設定します。
+var (
+	// queryAttempts は要求を送信する最大回数 (再試行を含む) です。
+	queryAttempts = 3
+	// queryRetryInterval は再試行までの待ち時間です。ライブラリの RetryInterval にも指定します。
+	queryRetryInterval = 5 * time.Second
+	// queryTimeout は1回の要求 (再試行を含む) にかける最大時間です。0 は無制限です。
+	// 経過した場合は再試行しません。
+	queryTimeout time.Duration
+)
+
+// defaultAttemptTimeout はライブラリが1回の送信で応答を待つ既定の時間です。
+const defaultAttemptTimeout = 10 * time.Second
+
+var (
+	// ECHONET Lite の要求回数 (再試行を含まない)
+	queries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_queries_total",
+		Help: "Total number of ECHONET Lite queries, not counting retries",
+	})
+	// ECHONET Lite の要求の再試行回数
+	queryRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_query_retries_total",
+		Help: "Total number of ECHONET Lite query retries after a failed attempt",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queries)
+	prometheus.MustRegister(queryRetries)
+}
+
+// meterClient はスマートメーター毎の要求の計数と、取得したプロパティの保持先です。
+// /probe で取得するスマートメーターが定期取得するスマートメーターの値を上書きしないよう分けます。
+type meterClient struct {
+	queries    prometheus.Counter
+	retries    prometheus.Counter
+	properties *echonetPropertyCache
+	// notify は要求の処理中に受信した通知を渡す関数です。nil の場合は読み捨てます。
+	notify func(*smartmeter.Frame)
+}
+
+// mainMeter は定期取得するスマートメーターの meterClient です。
+var mainMeter = &meterClient{
+	queries:    queries,
+	retries:    queryRetries,
+	properties: meterProperties,
+	notify:     queueNotification,
+}
+
+// query は定期取得するスマートメーターに ECHONET Lite の要求を送信し、応答を返します。
+func query(dev *smartmeter.Device, request *smartmeter.Frame) (*smartmeter.Frame, error) {
+	return mainMeter.query(dev, request)
+}
+
+// query は ECHONET Lite の要求を送信し、応答を返します。失敗した場合は queryRetryInterval 毎に
+// queryAttempts 回まで (queryTimeout を過ぎない範囲で) 再試行します。
+// 再試行の回数を計上するため、ライブラリの Retry オプションは 1 に抑えます。
+func (c *meterClient) query(
+	dev *smartmeter.Device,
+	request *smartmeter.Frame,
+) (*smartmeter.Frame, error) {
+	c.queries.Inc()
+	start := time.Now()
+	var err error
+	for attempt := range queryAttempts {
+		if attempt > 0 {
+			if queryTimeout > 0 && time.Since(start)+queryRetryInterval >= queryTimeout {
+				break
+			}
+			time.Sleep(queryRetryInterval)
+			c.retries.Inc()
+		}
+		opts := []smartmeter.Option{smartmeter.Retry(1)}
+		if d := attemptTimeout(time.Since(start)); d > 0 {
+			opts = append(opts, smartmeter.Timeout(d))
+		}
+		var response *smartmeter.Frame
+		if response, err = queryEchonetLite(dev, request, c.notify, opts...); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+// attemptTimeout は要求の開始から elapsed 経過した時点の送信で応答を待つ時間を返します。
+// queryTimeout の残りが defaultAttemptTimeout より短い場合は残りの時間です。
+// 0 の場合はライブラリの既定の時間を使います。
+func attemptTimeout(elapsed time.Duration) time.Duration {
+	if queryTimeout <= 0 {
+		return 0
+	}
+	return max(min(queryTimeout-elapsed, defaultAttemptTimeout), time.Millisecond)
+}
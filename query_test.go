@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{"unlimited", 0, 0, 0},
+		{"longer than default", time.Minute, 0, defaultAttemptTimeout},
+		{"remaining", time.Minute, 55 * time.Second, 5 * time.Second},
+		{"shorter than default", 3 * time.Second, 0, 3 * time.Second},
+		{"expired", 3 * time.Second, 4 * time.Second, time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := queryTimeout
+			t.Cleanup(func() { queryTimeout = saved })
+			queryTimeout = tt.timeout
+			if got := attemptTimeout(tt.elapsed); got != tt.want {
+				t.Errorf("attemptTimeout(%s) = %s, want %s", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
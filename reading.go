@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+// reading はスマートメーターから1回のスクレイプで取得した計測値です。
+// 取得できなかった (または無効値だった) 項目は nil になります。
+type reading struct {
+	Time time.Time `json:"time"`
+
+	// 動作状態 (ON のとき true)
+	Operational *bool `json:"operational,omitempty"`
+	// 異常発生状態 (異常ありのとき true)
+	Fault *bool `json:"fault,omitempty"`
+
+	// 瞬時電力 (W)
+	PowerWatts *float64 `json:"power_watts,omitempty"`
+	// R相 瞬時電流 (A)
+	CurrentRAmperes *float64 `json:"current_r_amperes,omitempty"`
+	// T相 瞬時電流 (A)
+	CurrentTAmperes *float64 `json:"current_t_amperes,omitempty"`
+	// 電流を計測している相の数 (0 は不明)
+	Phases int `json:"phases,omitempty"`
+
+	// 積算電力量 正方向 (kWh)
+	EnergyConsumedKWh *float64 `json:"energy_consumed_kwh,omitempty"`
+	// 積算電力量 逆方向 (kWh)
+	EnergyExportedKWh *float64 `json:"energy_exported_kwh,omitempty"`
+
+	// 定時積算電力量 正方向
+	FixedTimeConsumed *fixedTimeReading `json:"fixed_time_consumed,omitempty"`
+	// 定時積算電力量 逆方向
+	FixedTimeExported *fixedTimeReading `json:"fixed_time_exported,omitempty"`
+}
+
+// fixedTimeReading は定時積算電力量とその計測日時です。
+type fixedTimeReading struct {
+	Time time.Time `json:"time"`
+	KWh  float64   `json:"kwh"`
+}
+
+// empty は reading に計測値が1つも含まれていない場合に true を返します。
+func (r *reading) empty() bool {
+	return r.Operational == nil && r.Fault == nil &&
+		r.PowerWatts == nil && r.CurrentRAmperes == nil && r.CurrentTAmperes == nil &&
+		r.EnergyConsumedKWh == nil && r.EnergyExportedKWh == nil &&
+		r.FixedTimeConsumed == nil && r.FixedTimeExported == nil
+}
+
+// readingField は取得値の1項目の名前と値です。
+type readingField struct {
+	Name  string
+	Value float64
+}
+
+// fields は取得できた計測値 (定時積算電力量を除く) を、JSON と同じ名前で返します。
+// 動作状態と異常発生状態は 1/0 に変換します。
+func (r *reading) fields() []readingField {
+	var fs []readingField
+	addBool := func(name string, v *bool) {
+		if v != nil {
+			fs = append(fs, readingField{name, boolToFloat(*v)})
+		}
+	}
+	add := func(name string, v *float64) {
+		if v != nil {
+			fs = append(fs, readingField{name, *v})
+		}
+	}
+	addBool("operational", r.Operational)
+	addBool("fault", r.Fault)
+	add("power_watts", r.PowerWatts)
+	add("current_r_amperes", r.CurrentRAmperes)
+	add("current_t_amperes", r.CurrentTAmperes)
+	if r.Phases > 0 {
+		fs = append(fs, readingField{"phases", float64(r.Phases)})
+	}
+	add("energy_consumed_kwh", r.EnergyConsumedKWh)
+	add("energy_exported_kwh", r.EnergyExportedKWh)
+	return fs
+}
+
+// readingItemNames は取得値の項目の名前です。定時積算電力量以外は JSON と同じ名前で、
+// 定時積算電力量は fixed_time_<direction>_kwh です。
+var readingItemNames = []string{
+	"operational", "fault", "power_watts", "current_r_amperes", "current_t_amperes", "phases",
+	"energy_consumed_kwh", "energy_exported_kwh",
+	"fixed_time_consumed_kwh", "fixed_time_exported_kwh",
+}
+
+// readingItem は取得値の1項目の名前 (readingItemNames のいずれか) と値、その時刻です。
+type readingItem struct {
+	Name  string
+	Value float64
+	Time  time.Time
+}
+
+// items は取得できた項目を返します。時刻は、定時積算電力量は計測日時、それ以外は取得時刻です。
+func (r *reading) items() []readingItem {
+	var items []readingItem
+	for _, f := range r.fields() {
+		items = append(items, readingItem{f.Name, f.Value, r.Time})
+	}
+	for _, ft := range r.fixedTimeFields() {
+		items = append(items, readingItem{"fixed_time_" + ft.Direction + "_kwh", ft.KWh, ft.Time})
+	}
+	return items
+}
+
+// fixedTimeField は定時積算電力量の向き ("consumed" または "exported") と値です。
+type fixedTimeField struct {
+	Direction string
+	*fixedTimeReading
+}
+
+// fixedTimeFields は取得できた定時積算電力量を返します。
+func (r *reading) fixedTimeFields() []fixedTimeField {
+	var fs []fixedTimeField
+	if r.FixedTimeConsumed != nil {
+		fs = append(fs, fixedTimeField{"consumed", r.FixedTimeConsumed})
+	}
+	if r.FixedTimeExported != nil {
+		fs = append(fs, fixedTimeField{"exported", r.FixedTimeExported})
+	}
+	return fs
+}
+
+// readingSample は取得値の1項目を /metrics と同じ名前の時系列のサンプルとして表したものです。
+type readingSample struct {
+	Name string
+	// LabelName は時系列を区別するラベルの名前です (ラベルがない場合は空)。
+	LabelName  string
+	LabelValue string
+	Value      float64
+	Time       time.Time
+}
+
+// samples は取得値を /metrics と同じ名前のサンプルに変換します。
+// 定時積算電力量は計測日時のサンプルになります。
+func (r *reading) samples() []readingSample {
+	var ss []readingSample
+	add := func(name, labelName, labelValue string, v float64) {
+		ss = append(ss, readingSample{name, labelName, labelValue, v, r.Time})
+	}
+	if r.Operational != nil {
+		add("smartmeter_meter_operational", "", "", boolToFloat(*r.Operational))
+	}
+	if r.Fault != nil {
+		add("smartmeter_meter_fault", "", "", boolToFloat(*r.Fault))
+	}
+	if r.PowerWatts != nil {
+		add("smartmeter_power_watts", "", "", *r.PowerWatts)
+	}
+	if r.CurrentRAmperes != nil {
+		add("smartmeter_current_amperes", "phase", "r", *r.CurrentRAmperes)
+	}
+	if r.CurrentTAmperes != nil {
+		add("smartmeter_current_amperes", "phase", "t", *r.CurrentTAmperes)
+	}
+	if r.Phases > 0 {
+		add("smartmeter_phases", "", "", float64(r.Phases))
+	}
+	if r.EnergyConsumedKWh != nil {
+		add("smartmeter_energy_consumed_kwh_total", "", "", *r.EnergyConsumedKWh)
+	}
+	if r.EnergyExportedKWh != nil {
+		add("smartmeter_energy_exported_kwh_total", "", "", *r.EnergyExportedKWh)
+	}
+	for _, ft := range r.fixedTimeFields() {
+		ss = append(ss, readingSample{
+			"smartmeter_fixed_time_energy_kwh", "direction", ft.Direction, ft.KWh, ft.Time,
+		})
+	}
+	return ss
+}
+
+// decodeReading はレスポンスのプロパティ群を reading にデコードします。
+// ECHONET Lite の無効値 (データなし、オーバーフロー等) は読み飛ばし、
+// smartmeter_invalid_values_total に計上します。
+func decodeReading(props []*smartmeter.Property, logger *slog.Logger) *reading {
+	r := &reading{Time: time.Now()}
+	for _, p := range props {
+		if err := r.decodeProperty(p.EPC, p.EDT, logger); err != nil {
+			logger.Warn("Failed to decode property", "epc", epcLabel(p.EPC), "error", err)
+		}
+	}
+	return r
+}
+
+// decodeProperty は1つのプロパティを reading の該当項目にデコードします。
+func (r *reading) decodeProperty(
+	epc smartmeter.PropertyCode,
+	edt []byte,
+	logger *slog.Logger,
+) error {
+	var err error
+	switch epc {
+	case epcOperationStatus:
+		r.Operational, err = decodeStatus(edt, operationStatusOn, operationStatusOff)
+	case epcFaultStatus:
+		r.Fault, err = decodeStatus(edt, faultStatusFault, faultStatusNoFault)
+	case smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower:
+		err = r.decodePower(epc, edt)
+	case smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent:
+		err = r.decodeCurrent(epc, edt)
+	case epcCumulativeEnergyNormal:
+		r.EnergyConsumedKWh, err = decodeCumulativeEnergy(epc, edt, logger)
+	case epcCumulativeEnergyReverse:
+		r.EnergyExportedKWh, err = decodeCumulativeEnergy(epc, edt, logger)
+	case epcFixedTimeEnergyNormal:
+		r.FixedTimeConsumed, err = decodeFixedTimeReading(epc, edt)
+	case epcFixedTimeEnergyReverse:
+		r.FixedTimeExported, err = decodeFixedTimeReading(epc, edt)
+	}
+	return err
+}
+
+// decodeStatus は1バイトの状態プロパティをデコードし、on のとき true、off のとき false を返します。
+func decodeStatus(edt []byte, on, off byte) (*bool, error) {
+	if len(edt) != 1 {
+		return nil, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	switch edt[0] {
+	case on:
+		return ptr(true), nil
+	case off:
+		return ptr(false), nil
+	default:
+		return nil, fmt.Errorf("unknown status: 0x%02X", edt[0])
+	}
+}
+
+// decodePower は瞬時電力計測値 (EPC 0xE7) をデコードします。
+func (r *reading) decodePower(epc smartmeter.PropertyCode, edt []byte) error {
+	if len(edt) != 4 {
+		return fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	// 瞬時電力計測値は符号付き32ビット整数 (逆潮流時は負の値)
+	v := int32(binary.BigEndian.Uint32(edt))
+	if isSentinelInt32(v) {
+		invalidValues.WithLabelValues(epcLabel(epc)).Inc()
+		return nil
+	}
+	r.PowerWatts = ptr(float64(v))
+	return nil
+}
+
+// decodeCurrent は瞬時電流計測値 (EPC 0xE8) をデコードします。
+func (r *reading) decodeCurrent(epc smartmeter.PropertyCode, edt []byte) error {
+	if len(edt) != 4 {
+		return fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	// 瞬時電流計測値は R相、T相 の順に符号付き16ビット整数 (0.1A単位)
+	rv := int16(binary.BigEndian.Uint16(edt[:2]))
+	tv := int16(binary.BigEndian.Uint16(edt[2:]))
+	// 単相2線式のメーターでは T相が常に「データなし」になる
+	r.Phases = 2
+	if tv == currentNoData {
+		r.Phases = 1
+	}
+	if isSentinelInt16(rv) || (r.Phases == 2 && isSentinelInt16(tv)) {
+		invalidValues.WithLabelValues(epcLabel(epc)).Inc()
+	}
+	if !isSentinelInt16(rv) {
+		r.CurrentRAmperes = ptr(float64(rv) / 10.0)
+	}
+	if !isSentinelInt16(tv) {
+		r.CurrentTAmperes = ptr(float64(tv) / 10.0)
+	}
+	return nil
+}
+
+// decodeCumulativeEnergy は積算電力量計測値 (EPC 0xE0/0xE3) を kWh にデコードします。
+// 単位が判明していない場合は nil を返します。
+func decodeCumulativeEnergy(
+	epc smartmeter.PropertyCode,
+	edt []byte,
+	logger *slog.Logger,
+) (*float64, error) {
+	if len(edt) != 4 {
+		return nil, fmt.Errorf("unexpected EDT length: %d", len(edt))
+	}
+	v := binary.BigEndian.Uint32(edt)
+	if !isValidCumulativeEnergy(v) {
+		invalidValues.WithLabelValues(epcLabel(epc)).Inc()
+		return nil, nil
+	}
+	if energyUnitKWh == 0 {
+		return nil, nil // 単位が判明するまでは換算できない
+	}
+	// 有効桁数による桁あふれを補正して単調増加させる
+	kwh := float64(energyCounters[epc].update(v, energyModulus(), logger)) * energyUnitKWh
+	return &kwh, nil
+}
+
+// decodeFixedTimeReading は定時積算電力量計測値 (EPC 0xEA/0xEB) を kWh にデコードします。
+// 単位が判明していない場合は nil を返します。
+func decodeFixedTimeReading(epc smartmeter.PropertyCode, edt []byte) (*fixedTimeReading, error) {
+	v, err := decodeFixedTimeEnergy(edt)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidCumulativeEnergy(v.Value) {
+		invalidValues.WithLabelValues(epcLabel(epc)).Inc()
+		return nil, nil
+	}
+	if energyUnitKWh == 0 {
+		return nil, nil
+	}
+	return &fixedTimeReading{Time: v.Time, KWh: float64(v.Value) * energyUnitKWh}, nil
+}
+
+// lastFault は前回取得した異常発生状態です (nil は未取得)。
+var lastFault *bool
+
+// setMetrics は reading の内容をメトリクスに反映します。
+func setMetrics(r *reading, logger *slog.Logger) {
+	readings.update(r)
+	latest.update(r)
+	history.add(r)
+	stream.publish(readingEvent(r))
+	if r.Fault != nil {
+		if lastFault != nil && *lastFault != *r.Fault {
+			faultTransitions.Inc()
+			if *r.Fault {
+				logger.Warn("Meter reports a fault")
+			} else {
+				logger.Info("Meter fault cleared")
+			}
+		}
+		lastFault = r.Fault
+	}
+	if r.EnergyConsumedKWh != nil {
+		energyConsumedCounter.observe(*r.EnergyConsumedKWh, r.Time)
+	}
+	if r.EnergyExportedKWh != nil {
+		energyExportedCounter.observe(*r.EnergyExportedKWh, r.Time)
+	}
+	setFixedTimeMetrics("consumed", r.FixedTimeConsumed)
+	setFixedTimeMetrics("exported", r.FixedTimeExported)
+}
+
+func setFixedTimeMetrics(direction string, ft *fixedTimeReading) {
+	if ft == nil {
+		return
+	}
+	fixedTimeEnergyGauge.WithLabelValues(direction).Set(ft.KWh)
+	fixedTimeEnergyTimestampGauge.WithLabelValues(direction).Set(float64(ft.Time.Unix()))
+}
+
+// epcLabel は EPC をメトリクスのラベル値 (例: "0xE7") に変換します。
+func epcLabel(epc smartmeter.PropertyCode) string {
+	return fmt.Sprintf("0x%02X", epc)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testLogger は出力を捨てるテスト用のロガーです。
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// setEnergyScale はテストの間だけ積算電力量の単位と有効桁数を設定し、桁あふれ補正の状態を初期化します。
+func setEnergyScale(t *testing.T, unit float64, digits int) {
+	t.Helper()
+	savedUnit, savedDigits := energyUnitKWh, energyDigits
+	energyUnitKWh, energyDigits = unit, digits
+	for _, c := range energyCounters {
+		*c = rolloverCounter{}
+	}
+	t.Cleanup(func() {
+		energyUnitKWh, energyDigits = savedUnit, savedDigits
+		for _, c := range energyCounters {
+			*c = rolloverCounter{}
+		}
+	})
+}
+
+// invalidCount は EPC 毎の無効値の計上数を返します。
+func invalidCount(t *testing.T, epc smartmeter.PropertyCode) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := invalidValues.WithLabelValues(epcLabel(epc)).Write(m); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestDecodeStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		edt     []byte
+		want    *bool
+		wantErr bool
+	}{
+		{"on", []byte{0x30}, ptr(true), false},
+		{"off", []byte{0x31}, ptr(false), false},
+		{"unknown", []byte{0x32}, nil, true},
+		{"empty", nil, nil, true},
+		{"too long", []byte{0x30, 0x30}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeStatus(tt.edt, operationStatusOn, operationStatusOff)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !equalPtr(got, tt.want) {
+				t.Errorf("decodeStatus() = %v, want %v", fmtPtr(got), fmtPtr(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecodePower(t *testing.T) {
+	tests := []struct {
+		name    string
+		edt     []byte
+		want    *float64
+		wantErr bool
+	}{
+		{"positive", []byte{0x00, 0x00, 0x01, 0xF4}, ptr(500.0), false},
+		{"reverse flow", []byte{0xFF, 0xFF, 0xFF, 0x9C}, ptr(-100.0), false},
+		{"zero", []byte{0x00, 0x00, 0x00, 0x00}, ptr(0.0), false},
+		{"overflow", []byte{0x7F, 0xFF, 0xFF, 0xFF}, nil, false},
+		{"no data", []byte{0x7F, 0xFF, 0xFF, 0xFE}, nil, false},
+		{"underflow", []byte{0x80, 0x00, 0x00, 0x00}, nil, false},
+		{"short", []byte{0x00, 0x01}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reading{}
+			err := r.decodePower(smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower, tt.edt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodePower() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !equalPtr(r.PowerWatts, tt.want) {
+				t.Errorf("PowerWatts = %v, want %v", fmtPtr(r.PowerWatts), fmtPtr(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecodeCurrent(t *testing.T) {
+	tests := []struct {
+		name       string
+		edt        []byte
+		wantR      *float64
+		wantT      *float64
+		wantPhases int
+		wantErr    bool
+	}{
+		{"three wire", []byte{0x00, 0x32, 0x00, 0x14}, ptr(5.0), ptr(2.0), 2, false},
+		{"negative", []byte{0xFF, 0xF6, 0x00, 0x0A}, ptr(-1.0), ptr(1.0), 2, false},
+		{"two wire", []byte{0x00, 0x32, 0x7F, 0xFE}, ptr(5.0), nil, 1, false},
+		{"R overflow", []byte{0x7F, 0xFF, 0x00, 0x14}, nil, ptr(2.0), 2, false},
+		{"short", []byte{0x00, 0x32}, nil, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reading{}
+			err := r.decodeCurrent(smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent, tt.edt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCurrent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !equalPtr(r.CurrentRAmperes, tt.wantR) {
+				t.Errorf("CurrentRAmperes = %v, want %v", fmtPtr(r.CurrentRAmperes), fmtPtr(tt.wantR))
+			}
+			if !equalPtr(r.CurrentTAmperes, tt.wantT) {
+				t.Errorf("CurrentTAmperes = %v, want %v", fmtPtr(r.CurrentTAmperes), fmtPtr(tt.wantT))
+			}
+			if r.Phases != tt.wantPhases {
+				t.Errorf("Phases = %d, want %d", r.Phases, tt.wantPhases)
+			}
+		})
+	}
+}
+
+func TestDecodeCumulativeEnergy(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    float64
+		edt     []byte
+		want    *float64
+		wantErr bool
+	}{
+		{"0.1 kWh", 0.1, []byte{0x00, 0x00, 0x04, 0xD2}, ptr(123.4), false},
+		{"1 kWh", 1, []byte{0x00, 0x00, 0x04, 0xD2}, ptr(1234.0), false},
+		{"max", 1, []byte{0x05, 0xF5, 0xE0, 0xFF}, ptr(99999999.0), false},
+		{"no data", 1, []byte{0xFF, 0xFF, 0xFF, 0xFE}, nil, false},
+		{"unit unknown", 0, []byte{0x00, 0x00, 0x04, 0xD2}, nil, false},
+		{"short", 1, []byte{0x04, 0xD2}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnergyScale(t, tt.unit, 8)
+			got, err := decodeCumulativeEnergy(epcCumulativeEnergyNormal, tt.edt, testLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCumulativeEnergy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !equalFloatPtr(got, tt.want) {
+				t.Errorf("decodeCumulativeEnergy() = %v, want %v", fmtPtr(got), fmtPtr(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecodeFixedTimeReading(t *testing.T) {
+	tests := []struct {
+		name    string
+		edt     []byte
+		want    *fixedTimeReading
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			edt:  []byte{0x07, 0xE9, 0x0A, 0x10, 0x0C, 0x1E, 0x00, 0x00, 0x00, 0x00, 0x64},
+			want: &fixedTimeReading{Time: time.Date(2025, 10, 16, 12, 30, 0, 0, meterLocation), KWh: 10},
+		},
+		{
+			name: "no data",
+			edt:  []byte{0x07, 0xE9, 0x0A, 0x10, 0x0C, 0x1E, 0x00, 0xFF, 0xFF, 0xFF, 0xFE},
+		},
+		{
+			name:    "invalid date",
+			edt:     []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x64},
+			wantErr: true,
+		},
+		{
+			name:    "short",
+			edt:     []byte{0x07, 0xE9, 0x0A, 0x10},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnergyScale(t, 0.1, 6)
+			got, err := decodeFixedTimeReading(epcFixedTimeEnergyNormal, tt.edt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeFixedTimeReading() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil:
+				t.Errorf("decodeFixedTimeReading() = %+v, want %+v", got, tt.want)
+			case !got.Time.Equal(tt.want.Time) || !almostEqual(got.KWh, tt.want.KWh):
+				t.Errorf("decodeFixedTimeReading() = %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePropertyCountsInvalidValues(t *testing.T) {
+	const (
+		power   = smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower
+		current = smartmeter.LvSmartElectricEnergyMeterInstantaneousCurrent
+	)
+	tests := []struct {
+		name string
+		epc  smartmeter.PropertyCode
+		edt  []byte
+		want bool
+	}{
+		{"power", power, []byte{0x00, 0x00, 0x01, 0xF4}, false},
+		{"power overflow", power, []byte{0x7F, 0xFF, 0xFF, 0xFF}, true},
+		{"power no data", power, []byte{0x7F, 0xFF, 0xFF, 0xFE}, true},
+		{"power underflow", power, []byte{0x80, 0x00, 0x00, 0x00}, true},
+		// 単相2線式では T相の「データなし」を無効値として数えない
+		{"current single phase", current, []byte{0x00, 0x32, 0x7F, 0xFE}, false},
+		{"current T overflow", current, []byte{0x00, 0x32, 0x7F, 0xFF}, true},
+		{"energy no data", epcCumulativeEnergyNormal, []byte{0xFF, 0xFF, 0xFF, 0xFE}, true},
+		{"energy out of range", epcCumulativeEnergyNormal, []byte{0x05, 0xF5, 0xE1, 0x00}, true},
+		{
+			"fixed time no data", epcFixedTimeEnergyNormal,
+			[]byte{0x07, 0xE9, 0x0A, 0x10, 0x0C, 0x1E, 0x00, 0xFF, 0xFF, 0xFF, 0xFE}, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnergyScale(t, 0.1, 6)
+			before := invalidCount(t, tt.epc)
+			r := &reading{}
+			if err := r.decodeProperty(tt.epc, tt.edt, testLogger); err != nil {
+				t.Fatalf("decodeProperty() error = %v", err)
+			}
+			if got := invalidCount(t, tt.epc) - before; (got > 0) != tt.want {
+				t.Errorf("invalid values counted = %v, want counted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReading(t *testing.T) {
+	setEnergyScale(t, 0.1, 6)
+	props := []*smartmeter.Property{
+		smartmeter.NewProperty(epcOperationStatus, []byte{0x30}),
+		smartmeter.NewProperty(epcFaultStatus, []byte{0x42}),
+		smartmeter.NewProperty(
+			smartmeter.LvSmartElectricEnergyMeterInstantaneousElectricPower,
+			[]byte{0x00, 0x00, 0x01, 0xF4},
+		),
+		smartmeter.NewProperty(epcCumulativeEnergyNormal, []byte{0x00, 0x00, 0x04, 0xD2}),
+		// 不正な EDT は読み飛ばす
+		smartmeter.NewProperty(epcCumulativeEnergyReverse, []byte{0x01}),
+		// 対応していない EPC は無視する
+		smartmeter.NewProperty(0xF0, []byte{0x01}),
+	}
+	r := decodeReading(props, testLogger)
+	if r.Operational == nil || !*r.Operational {
+		t.Errorf("Operational = %v, want true", fmtPtr(r.Operational))
+	}
+	if r.Fault == nil || *r.Fault {
+		t.Errorf("Fault = %v, want false", fmtPtr(r.Fault))
+	}
+	if !equalPtr(r.PowerWatts, ptr(500.0)) {
+		t.Errorf("PowerWatts = %v, want 500", fmtPtr(r.PowerWatts))
+	}
+	if !equalFloatPtr(r.EnergyConsumedKWh, ptr(123.4)) {
+		t.Errorf("EnergyConsumedKWh = %v, want 123.4", fmtPtr(r.EnergyConsumedKWh))
+	}
+	if r.EnergyExportedKWh != nil {
+		t.Errorf("EnergyExportedKWh = %v, want nil", *r.EnergyExportedKWh)
+	}
+	if r.empty() {
+		t.Error("empty() = true, want false")
+	}
+	if !decodeReading(nil, testLogger).empty() {
+		t.Error("empty() = false for no properties, want true")
+	}
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalFloatPtr(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return almostEqual(*a, *b)
+}
+
+// almostEqual は kWh への換算による丸め誤差を無視して比較します。
+func almostEqual(a, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
+
+func fmtPtr[T any](p *T) any {
+	if p == nil {
+		return "<nil>"
+	}
+	return *p
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reloadableFields は設定の再読み込みで反映される、出力先以外の設定 (config のフィールド名) です。
+// シリアルポートや PANA セッションを維持したまま取得ループに反映できるものに限ります。
+var reloadableFields = []string{
+	"Interval", "EPCsStr", "EPCs", "FixedTimeDelay", "Staleness", "Backfill",
+}
+
+// derivedFields は他のフィールドから validate で設定されるフィールドです。変更の検出では元のフィールドを比較します。
+var derivedFields = []string{"Buckets", "Location", "Labels", "Settings"}
+
+var (
+	// 直近の設定の再読み込みが成功したかどうか
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	// 直近に設定の再読み込みに成功した時刻 (Unix Timestamp)。起動時は起動時刻
+	configReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful configuration reload",
+	})
+)
+
+var (
+	// scrapeConfigs は再読み込みした設定を取得ループに渡します。
+	// 取得中に再読み込みが重なった場合は、最後の設定のみを渡します。
+	scrapeConfigs = make(chan *config, 1)
+	// reloadRequests は /-/reload の要求を waitSignals に渡します。結果は要求のチャネルに返します。
+	reloadRequests = make(chan chan error)
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadTimestamp)
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+}
+
+// waitSignals は終了のシグナルを受信するまで待ちます。
+// SIGHUP を受信した場合と /-/reload が要求された場合は設定を再読み込みします。
+func waitSignals(ctx context.Context, cfg *config, logger *slog.Logger) {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-hupChan:
+			cfg, _ = reloadConfig(ctx, cfg, logger)
+		case result := <-reloadRequests:
+			var err error
+			cfg, err = reloadConfig(ctx, cfg, logger)
+			result <- err
+		}
+	}
+}
+
+// reloadConfig は起動時と同じく設定ファイル、環境変数、コマンドラインフラグから設定を読み込み直し、
+// 取得間隔、取得する EPC、出力先などの再起動せずに反映できる設定を適用します。
+// 適用した設定を返します。読み込みに失敗した場合は cur とエラーを返します。
+func reloadConfig(ctx context.Context, cur *config, logger *slog.Logger) (*config, error) {
+	logger.Info("Reloading configuration")
+	next, err := readConfig(logger)
+	if err != nil {
+		logger.Error("Failed to reload configuration", "error", err)
+		configReloadSuccess.Set(0)
+		return cur, err
+	}
+	merged, ignored := mergeReloadable(cur, next)
+	if len(ignored) > 0 {
+		logger.Warn("Some settings require a restart to take effect", "settings", ignored)
+	}
+	if !reflect.DeepEqual(cur.sinkConfigs(), merged.sinkConfigs()) {
+		if err = restartSinks(ctx, cur, merged, logger); err != nil {
+			logger.Error("Failed to reload outputs", "error", err)
+			configReloadSuccess.Set(0)
+			return cur, err
+		}
+	}
+	if !cur.probeOnly() {
+		// 取得中でも待たないよう、取得ループが受け取っていない設定は置き換える
+		select {
+		case <-scrapeConfigs:
+		default:
+		}
+		scrapeConfigs <- merged
+	}
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+	setEffectiveConfig(merged)
+	logger.Info("Configuration reloaded")
+	return merged, nil
+}
+
+// readConfig は設定を読み込み、検証します。
+func readConfig(logger *slog.Logger) (*config, error) {
+	// フラグは起動時と同じ引数を、新しい FlagSet でパースし直す
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	flag.CommandLine = flag.NewFlagSet(commandLine.Name(), flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(logger); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// mergeReloadable は cur のうち再読み込みで反映される設定を next の値に置き換えた設定を返します。
+// 反映されない設定のうち、変更されていたもののフィールド名も返します。
+func mergeReloadable(cur, next *config) (*config, []string) {
+	merged := *cur
+	sinkTypes := make(map[reflect.Type]bool)
+	for _, o := range cur.sinkConfigs() {
+		sinkTypes[reflect.TypeOf(o).Elem()] = true
+	}
+	m := reflect.ValueOf(&merged).Elem()
+	c, n := reflect.ValueOf(cur).Elem(), reflect.ValueOf(next).Elem()
+	var ignored []string
+	for i := 0; i < m.NumField(); i++ {
+		f := m.Type().Field(i)
+		switch {
+		case slices.Contains(reloadableFields, f.Name) || sinkTypes[f.Type]:
+			m.Field(i).Set(n.Field(i))
+		case slices.Contains(derivedFields, f.Name):
+		case !reflect.DeepEqual(c.Field(i).Interface(), n.Field(i).Interface()):
+			ignored = append(ignored, f.Name)
+		}
+	}
+	return &merged, ignored
+}
+
+// restartSinks は出力先を next の設定で開始し直します。
+// 開始できなかった場合は cur の設定で開始し直してエラーを返します。
+func restartSinks(ctx context.Context, cur, next *config, logger *slog.Logger) error {
+	stopSinks()
+	err := startSinks(ctx, next, logger)
+	if err == nil {
+		return nil
+	}
+	if restoreErr := startSinks(ctx, cur, logger); restoreErr != nil {
+		logger.Error("Failed to restart previous outputs", "error", restoreErr)
+	}
+	return err
+}
+
+// reloadHandler は POST (または PUT) で設定を再読み込みする /-/reload のハンドラーです。
+// enabled が false の場合は要求を拒否します。
+func reloadHandler(enabled bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			http.Error(w, "Lifecycle API is not enabled.", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result := make(chan error, 1)
+		select {
+		case reloadRequests <- result:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-result; err != nil {
+			http.Error(w, "failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// healthyHandler はプロセスが動作していることを返す /-/healthy のハンドラーです。
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, "Healthy.\n")
+	})
+}
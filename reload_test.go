@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMergeReloadable(t *testing.T) {
+	cur := &config{
+		DevicePath: "/dev/ttyUSB0",
+		ListenPort: "9102",
+		Interval:   time.Minute,
+		EPCsStr:    "E7",
+		Location:   time.UTC,
+		MQTT:       mqttConfig{URL: "mqtt://old"},
+	}
+	next := &config{
+		DevicePath: "/dev/ttyUSB1",
+		ListenPort: "9102",
+		Interval:   30 * time.Second,
+		EPCsStr:    "E7,E8",
+		Location:   time.Local,
+		MQTT:       mqttConfig{URL: "mqtt://new"},
+	}
+	merged, ignored := mergeReloadable(cur, next)
+
+	// 再読み込みで反映される設定と出力先の設定は next の値になる
+	if merged.Interval != 30*time.Second || merged.EPCsStr != "E7,E8" {
+		t.Errorf("merged interval = %s, EPCs = %q, want next values", merged.Interval, merged.EPCsStr)
+	}
+	if merged.MQTT.URL != "mqtt://new" {
+		t.Errorf("merged MQTT URL = %q, want %q", merged.MQTT.URL, "mqtt://new")
+	}
+	// 再起動が必要な設定と派生した設定は cur の値を保つ
+	if merged.DevicePath != "/dev/ttyUSB0" || merged.Location != time.UTC {
+		t.Errorf("merged device = %q, location = %v, want cur values", merged.DevicePath, merged.Location)
+	}
+	if want := []string{"DevicePath"}; !slices.Equal(ignored, want) {
+		t.Errorf("ignored = %v, want %v", ignored, want)
+	}
+	if cur.Interval != time.Minute || cur.MQTT.URL != "mqtt://old" {
+		t.Error("mergeReloadable modified cur")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteConfig は Prometheus remote_write での送信の設定です。
+type remoteWriteConfig struct {
+	URL                string
+	Username           string
+	Password           string
+	BearerToken        string
+	LabelPairs         []string
+	MaxBuffered        int
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Labels map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *remoteWriteConfig) bind() {
+	c.URL = getEnv("SMARTMETER_REMOTE_WRITE_URL", "")
+	c.Username = getEnv("SMARTMETER_REMOTE_WRITE_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_REMOTE_WRITE_PASSWORD", "")
+	c.BearerToken = getEnv("SMARTMETER_REMOTE_WRITE_BEARER_TOKEN", "")
+	c.MaxBuffered = getEnvInt("SMARTMETER_REMOTE_WRITE_MAX_BUFFERED", 1440)
+	c.CAFile = getEnv("SMARTMETER_REMOTE_WRITE_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_REMOTE_WRITE_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_REMOTE_WRITE_LABELS", ""); v != "" {
+		c.LabelPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "remote-write.url", c.URL,
+		"Prometheus remote_write endpoint to push readings to")
+	flag.StringVar(&c.Username, "remote-write.username", c.Username,
+		"Username for HTTP basic authentication")
+	flag.StringVar(&c.Password, "remote-write.password", c.Password,
+		"Password for HTTP basic authentication")
+	flag.StringVar(&c.BearerToken, "remote-write.bearer-token", c.BearerToken,
+		"Bearer token for authentication")
+	flag.Var(&labelFlag{values: &c.LabelPairs}, "remote-write.label",
+		"Label key=value added to every pushed sample (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "remote-write.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while the endpoint is unreachable")
+	flag.StringVar(&c.CAFile, "remote-write.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the remote_write endpoint")
+	flag.BoolVar(&c.InsecureSkipVerify, "remote-write.tls.insecure-skip-verify",
+		c.InsecureSkipVerify, "Skip verification of the remote_write endpoint certificate")
+}
+
+func (c *remoteWriteConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は remote_write の設定値を検証します。
+func (c *remoteWriteConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return errors.New("invalid remote_write URL: " + c.URL)
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("remote_write max buffered readings must be positive")
+	}
+	labels, err := parseLabels(c.LabelPairs)
+	if err != nil {
+		return err
+	}
+	c.Labels = labels
+	return nil
+}
+
+// remoteWriteSink は取得値を Prometheus remote_write (1.0) で送信します。
+// サンプルには取得時刻 (定時積算電力量は計測日時) のタイムスタンプを付けます。
+// 送信に失敗した取得値は保持しておき、次回の送信時にまとめて再送します。
+type remoteWriteSink struct {
+	cfg    *remoteWriteConfig
+	client *http.Client
+	buffer *retryBuffer
+}
+
+func newRemoteWriteSink(cfg *remoteWriteConfig) (*remoteWriteSink, error) {
+	client, err := newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteWriteSink{
+		cfg:    cfg,
+		client: client,
+		buffer: newRetryBuffer("remote_write", cfg.MaxBuffered),
+	}, nil
+}
+
+func (s *remoteWriteSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		header := authHeader(s.cfg.BearerToken, s.cfg.Username, s.cfg.Password)
+		header.Set("Content-Encoding", "snappy")
+		header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		body := encodeSnappyLiteral(encodeWriteRequest(rs, s.cfg.Labels))
+		return postHTTP(ctx, s.client, s.cfg.URL, "application/x-protobuf", body, header)
+	})
+}
+
+func (s *remoteWriteSink) close() error {
+	return nil
+}
+
+// remoteWriteSeries は WriteRequest の1つの時系列です。
+type remoteWriteSeries struct {
+	labels  [][2]string // 名前でソート済み
+	samples []readingSample
+}
+
+// encodeWriteRequest は取得値を remote_write の WriteRequest (protobuf) にエンコードします。
+// 時系列毎にサンプルを時刻の順にまとめます。
+func encodeWriteRequest(rs []*reading, extra map[string]string) []byte {
+	var series []*remoteWriteSeries
+	index := make(map[string]*remoteWriteSeries)
+	for _, r := range rs {
+		for _, sample := range r.samples() {
+			labels := sortedLabels(sampleLabels(sample, extra))
+			key := labelsKey(labels)
+			ts, ok := index[key]
+			if !ok {
+				ts = &remoteWriteSeries{labels: labels}
+				index[key] = ts
+				series = append(series, ts)
+			}
+			ts.samples = append(ts.samples, sample)
+		}
+	}
+
+	var b []byte
+	for _, ts := range series {
+		sort.SliceStable(ts.samples, func(i, j int) bool {
+			return ts.samples[i].Time.Before(ts.samples[j].Time)
+		})
+		// WriteRequest.timeseries = 1
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeTimeSeries(ts))
+	}
+	return b
+}
+
+func encodeTimeSeries(ts *remoteWriteSeries) []byte {
+	var b []byte
+	for _, l := range ts.labels {
+		// Label.name = 1, Label.value = 2
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l[0])
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l[1])
+		// TimeSeries.labels = 1
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.samples {
+		// Sample.value = 1, Sample.timestamp = 2 (ミリ秒)
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Time.UnixMilli()))
+		// TimeSeries.samples = 2
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// sortedLabels はラベルを名前でソートした組の列に変換します。
+func sortedLabels(labels map[string]string) [][2]string {
+	out := make([][2]string, 0, len(labels))
+	for k, v := range labels {
+		out = append(out, [2]string{k, v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+func labelsKey(labels [][2]string) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l[0])
+		sb.WriteByte(0xff)
+		sb.WriteString(l[1])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+// encodeSnappyLiteral は src を snappy のブロック形式でエンコードします。
+// 依存を増やさないよう圧縮はせず、全体をリテラルとして格納します (送信するデータは小さい)。
+func encodeSnappyLiteral(src []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		// タグ 61<<2: リテラル長 - 1 を続く2バイト (リトルエンディアン) で表す
+		b = append(b, 61<<2, byte(n-1), byte((n-1)>>8))
+		b = append(b, src[:n]...)
+		src = src[n:]
+	}
+	return b
+}
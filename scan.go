@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// skEventScanComplete はアクティブスキャンの完了を表す SKSTACK のイベント番号です。
+const skEventScanComplete = "22"
+
+var (
+	// skScanPattern はアクティブスキャンのコマンド (例: "SKSCAN 2 FFFFFFFF 6 0") です。
+	skScanPattern = regexp.MustCompile(`\bSKSCAN\b`)
+	// skPANDescPattern はアクティブスキャンで見つかった PAN の通知です。
+	skPANDescPattern = regexp.MustCompile(`\bEPANDESC\b`)
+	// skSetRegisterPattern は使用するチャネル (S2) と PAN ID (S3) を設定するコマンドです。
+	skSetRegisterPattern = regexp.MustCompile(`\bSKSREG S([23]) ([0-9A-F]+)\b`)
+	// skPANDescFieldPattern は PAN の通知に続くチャネル、PAN ID、MAC アドレスの行です。
+	skPANDescFieldPattern = regexp.MustCompile(`\b(Channel|Pan ID|Addr):([0-9A-F]+)\b`)
+)
+
+var (
+	// アクティブスキャンの回数
+	wisunScans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_wisun_scans_total",
+		Help: "Total number of completed Wi-SUN active scans",
+	})
+	// 直近のアクティブスキャンの所要時間 (秒)
+	wisunScanDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_wisun_scan_duration_seconds",
+		Help: "Duration of the last Wi-SUN active scan in seconds",
+	})
+	// 直近のアクティブスキャンで見つかった PAN の数
+	wisunScanPANs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_wisun_scan_pans_found",
+		Help: "Number of PANs found by the last Wi-SUN active scan",
+	})
+	// 使用しているチャネルと PAN ID (値は常に 1)
+	wisunPANInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_wisun_pan_info",
+		Help: "Wi-SUN channel and PAN ID in use",
+	}, []string{"channel", "pan_id"})
+)
+
+func init() {
+	prometheus.MustRegister(wisunScans)
+	prometheus.MustRegister(wisunScanDuration)
+	prometheus.MustRegister(wisunScanPANs)
+	prometheus.MustRegister(wisunPANInfo)
+}
+
+// scanState はアクティブスキャンとチャネル設定の検出状態です。
+// ライブラリのログは log.Logger により直列化されて書き込まれるため、排他制御は不要です。
+type scanState struct {
+	started time.Time // スキャン開始時刻 (ゼロ値はスキャン中でない)
+	pans    int       // スキャン中に見つかった PAN の数
+	channel string
+	panID   string
+
+	// found は直近のスキャンで見つかった PAN です。
+	found []panDescriptor
+}
+
+// panDescriptor はアクティブスキャンで見つかった PAN (EPANDESC) です。値は SKSTACK の16進数の表記です。
+type panDescriptor struct {
+	Channel string `json:"channel"`
+	PANID   string `json:"pan_id"`
+	MAC     string `json:"mac"`
+}
+
+// selected は使用するチャネルと PAN ID に設定された PAN を返します。
+// 設定を検出できなかった場合は最後に見つかった PAN を返します。見つかっていない場合は nil です。
+func (s *scanState) selected() *panDescriptor {
+	for i := range s.found {
+		if s.found[i].PANID == s.panID && s.found[i].Channel == s.channel {
+			return &s.found[i]
+		}
+	}
+	if len(s.found) == 0 {
+		return nil
+	}
+	return &s.found[len(s.found)-1]
+}
+
+// observeScan はアクティブスキャンの開始・結果とチャネル・PAN ID の設定を検出します。
+func (m *skstackMonitor) observeScan(line string, now time.Time) {
+	switch {
+	case skScanPattern.MatchString(line):
+		m.scan.started = now
+		m.scan.pans = 0
+		m.scan.found = nil
+	case skPANDescPattern.MatchString(line):
+		m.scan.pans++
+		m.scan.found = append(m.scan.found, panDescriptor{})
+	case len(m.scan.found) > 0:
+		if f := skPANDescFieldPattern.FindStringSubmatch(line); f != nil {
+			pan := &m.scan.found[len(m.scan.found)-1]
+			switch f[1] {
+			case "Channel":
+				pan.Channel = f[2]
+			case "Pan ID":
+				pan.PANID = f[2]
+			default:
+				pan.MAC = f[2]
+			}
+		}
+	}
+	if reg := skSetRegisterPattern.FindStringSubmatch(line); reg != nil {
+		if reg[1] == "2" {
+			m.scan.channel = reg[2]
+		} else {
+			m.scan.panID = reg[2]
+		}
+		if m.scan.channel != "" && m.scan.panID != "" {
+			wisunPANInfo.Reset()
+			wisunPANInfo.WithLabelValues(m.scan.channel, m.scan.panID).Set(1)
+			connStatus.setConnection(m.scan.channel, m.scan.panID, "")
+		}
+	}
+}
+
+// completeScan はアクティブスキャンの完了 (EVENT 22) を記録します。
+func (m *skstackMonitor) completeScan(now time.Time) {
+	wisunScans.Inc()
+	wisunScanPANs.Set(float64(m.scan.pans))
+	if !m.scan.started.IsZero() {
+		wisunScanDuration.Set(now.Sub(m.scan.started).Seconds())
+		m.scan.started = time.Time{}
+	}
+	m.logger.Debug("Active scan completed", "pans_found", m.scan.pans)
+}
+
+// linkLocalAddr は MAC アドレス (16進数16桁) から IPv6 リンクローカルアドレスを求めます (SKLL64 と同じ変換)。
+func linkLocalAddr(mac string) (string, error) {
+	b, err := hex.DecodeString(mac)
+	if err != nil || len(b) != 8 {
+		return "", fmt.Errorf("invalid MAC address %q", mac)
+	}
+	// EUI-64 の U/L ビットを反転してインターフェース ID にする
+	b[0] ^= 0x02
+	return fmt.Sprintf("FE80:0000:0000:0000:%04X:%04X:%04X:%04X",
+		binary.BigEndian.Uint16(b[0:]), binary.BigEndian.Uint16(b[2:]),
+		binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:])), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 取得の種類 (smartmeter_scrape_next_timestamp_seconds の kind ラベル)
+const (
+	scheduleRegular   = "regular"    // 定期取得
+	scheduleFixedTime = "fixed_time" // 定時積算電力量の取得
+)
+
+var (
+	// 次回の取得予定時刻 (Unix Timestamp)
+	nextScrapeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smartmeter_scrape_next_timestamp_seconds",
+		Help: "Unix timestamp of the next scheduled scrape, labeled by kind (regular, fixed_time)",
+	}, []string{"kind"})
+	// 予定時刻から実際に定期取得を開始するまでの遅れ (秒)
+	scheduleDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_scrape_schedule_drift_seconds",
+		Help: "Delay between the scheduled time and the actual start of the last regular scrape",
+	})
+	// 前回の取得が終わっていなかったために行われなかった定期取得の回数
+	scrapesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_scrapes_skipped_total",
+		Help: "Total number of regular scrapes skipped because a previous scrape was still running",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(nextScrapeGauge)
+	prometheus.MustRegister(scheduleDrift)
+	prometheus.MustRegister(scrapesSkipped)
+}
+
+// scheduleTracker は定期取得の ticker の状態を監視します。
+// time.Ticker は受信側が遅れると tick を捨てるため、tick の間隔から取得の取りこぼしを検出します。
+type scheduleTracker struct {
+	interval time.Duration
+	last     time.Time // 直前の tick の時刻
+}
+
+func newScheduleTracker(interval time.Duration, start time.Time) *scheduleTracker {
+	nextScrapeGauge.WithLabelValues(scheduleRegular).Set(float64(start.Add(interval).Unix()))
+	return &scheduleTracker{interval: interval, last: start}
+}
+
+// tick は時刻 t の tick を時刻 now に受信したことを記録します。
+func (s *scheduleTracker) tick(t, now time.Time) {
+	// 間隔を四捨五入して、捨てられた tick の数を求める
+	if missed := int((t.Sub(s.last)+s.interval/2)/s.interval) - 1; missed > 0 {
+		scrapesSkipped.Add(float64(missed))
+	}
+	s.last = t
+	scheduleDrift.Set(now.Sub(t).Seconds())
+	nextScrapeGauge.WithLabelValues(scheduleRegular).Set(float64(t.Add(s.interval).Unix()))
+}
+
+// scheduleFixedTimeRead は次回の定時積算電力量の取得予定時刻を記録し、それまでの時間を返します。
+func scheduleFixedTimeRead(now time.Time, delay time.Duration) time.Duration {
+	next := nextFixedTimeRead(now, delay)
+	nextScrapeGauge.WithLabelValues(scheduleFixedTime).Set(float64(next.Unix()))
+	return next.Sub(now)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 認証の種類 (smartmeter_authentications_total の kind ラベル)
+const (
+	authKindInitial = "initial" // 起動時のデバイスのオープン
+	authKindReauth  = "reauth"  // 取得失敗時の再認証
+)
+
+// sessionStart は現在の PANA セッションを確立した時刻 (Unix ナノ秒、0 は未確立) です。
+// /metrics の要求と取得ループの双方から参照するため atomic で保持します。
+var sessionStart atomic.Int64
+
+// panaLifetime は PANA セッションのライフタイムです。Wi-SUN モジュールの設定 (SKSTACK の
+// レジスタ S16、既定値 7200 秒) に合わせます。
+var panaLifetime = 2 * time.Hour
+
+var (
+	// PANA 認証の回数 (種類別、結果別)
+	authentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_authentications_total",
+		Help: "Total number of PANA authentications, labeled by kind (initial, reauth) and result",
+	}, []string{"kind", "result"})
+	// 現在の PANA セッションの経過時間 (秒)
+	sessionAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "smartmeter_session_age_seconds",
+		Help: "Seconds since the current PANA session was established (0 if none)",
+	}, func() float64 {
+		start := sessionStart.Load()
+		if start == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, start)).Seconds()
+	})
+	// 現在の PANA セッションの残りのライフタイム (秒)
+	sessionRemaining = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "smartmeter_pana_session_remaining_seconds",
+		Help: "Estimated remaining lifetime of the current PANA session in seconds (0 if none)",
+	}, func() float64 {
+		start := sessionStart.Load()
+		if start == 0 {
+			return 0
+		}
+		return max(0, (panaLifetime - time.Since(time.Unix(0, start))).Seconds())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authentications)
+	prometheus.MustRegister(sessionAge)
+	prometheus.MustRegister(sessionRemaining)
+}
+
+// recordAuthentication は認証の結果を記録します。成功した場合はセッションの開始時刻を更新し、
+// 失敗した場合はセッションが失われたものとみなします。
+func recordAuthentication(kind string, err error) {
+	if err != nil {
+		authentications.WithLabelValues(kind, "failure").Inc()
+		sessionStart.Store(0)
+		stream.publish(streamEvent{Type: "auth", Data: apiAuthEvent{
+			Kind: kind, Result: "failure", Error: err.Error(), Time: time.Now(),
+		}})
+		return
+	}
+	authentications.WithLabelValues(kind, "success").Inc()
+	sessionStart.Store(time.Now().UnixNano())
+	stream.publish(streamEvent{Type: "auth", Data: apiAuthEvent{
+		Kind: kind, Result: "success", Time: time.Now(),
+	}})
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sinkQueueSize は出力先ごとに送信待ちにできる取得値の数です。
+	// 送信が詰まった出力先のために取得ループを止めないよう、溢れた取得値は捨てます。
+	sinkQueueSize = 16
+	// sinkPublishTimeout は1回の送信のタイムアウトです。
+	sinkPublishTimeout = 10 * time.Second
+)
+
+// sink は取得値を Prometheus 以外の出力先へ送信します。
+// publish と close は同じ goroutine から順に呼ばれます。
+type sink interface {
+	// publish は1回分の取得値を送信します。
+	publish(ctx context.Context, r *reading) error
+	// close は接続を閉じます。
+	close() error
+}
+
+var (
+	// 出力先ごとの送信成功回数
+	sinkPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_sink_published_total",
+		Help: "Total number of readings sent to an output, labeled by sink",
+	}, []string{"sink"})
+	// 出力先ごとの送信失敗回数
+	sinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_sink_errors_total",
+		Help: "Total number of failed attempts to send a reading to an output, labeled by sink",
+	}, []string{"sink"})
+	// 送信待ちや再送待ちが溢れたため、または出力先に拒否されたために捨てた取得値の数
+	sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_sink_dropped_total",
+		Help: "Total number of readings dropped before reaching an output, labeled by sink",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkPublished)
+	prometheus.MustRegister(sinkErrors)
+	prometheus.MustRegister(sinkDropped)
+}
+
+// sinkRunner は1つの出力先への送信を専用の goroutine で行います。
+type sinkRunner struct {
+	name  string
+	sink  sink
+	queue chan *reading
+}
+
+var (
+	// sinksMu は sinks と stopSinkRunners を保護します。
+	sinksMu sync.Mutex
+	// sinks は有効な出力先です。
+	sinks []*sinkRunner
+	// stopSinkRunners は sinks の goroutine を終了させます。
+	stopSinkRunners context.CancelFunc
+	// sinksDone は全ての出力先の goroutine の終了を待つためのものです。
+	sinksDone sync.WaitGroup
+)
+
+// sinkFactory は出力先の名前と、その出力先を生成する関数です。
+type sinkFactory struct {
+	name    string
+	enabled bool
+	new     func() (sink, error)
+}
+
+// sinkFactories は対応している出力先の一覧です。
+func sinkFactories(cfg *config) []sinkFactory {
+	return []sinkFactory{
+		{"mqtt", cfg.MQTT.enabled(), func() (sink, error) { return newMQTTSink(&cfg.MQTT) }},
+		{"influxdb", cfg.InfluxDB.enabled(), func() (sink, error) {
+			return newInfluxDBSink(&cfg.InfluxDB)
+		}},
+		{"line_protocol", cfg.LineProtocol.enabled(), func() (sink, error) {
+			return newLineProtocolSink(&cfg.LineProtocol)
+		}},
+		{"victoriametrics", cfg.VictoriaMetrics.enabled(), func() (sink, error) {
+			return newVictoriaMetricsSink(&cfg.VictoriaMetrics)
+		}},
+		{"remote_write", cfg.RemoteWrite.enabled(), func() (sink, error) {
+			return newRemoteWriteSink(&cfg.RemoteWrite)
+		}},
+		{"pushgateway", cfg.Pushgateway.enabled(), func() (sink, error) {
+			return newPushgatewaySink(&cfg.Pushgateway)
+		}},
+		{"graphite", cfg.Graphite.enabled(), func() (sink, error) {
+			return newGraphiteSink(&cfg.Graphite)
+		}},
+		{"statsd", cfg.StatsD.enabled(), func() (sink, error) { return newStatsDSink(&cfg.StatsD) }},
+		{"csv", cfg.CSV.enabled(), func() (sink, error) { return newCSVSink(&cfg.CSV, cfg.Location) }},
+		{"jsonl", cfg.JSONL.enabled(), func() (sink, error) { return newJSONLSink(&cfg.JSONL) }},
+		{"sqlite", cfg.SQLite.enabled(), func() (sink, error) { return newSQLiteSink(&cfg.SQLite) }},
+		{"postgres", cfg.Postgres.enabled(), func() (sink, error) {
+			return newPostgresSink(&cfg.Postgres)
+		}},
+		{"cloudwatch", cfg.CloudWatch.enabled(), func() (sink, error) {
+			return newCloudWatchSink(&cfg.CloudWatch)
+		}},
+		{"gcm", cfg.GCM.enabled(), func() (sink, error) { return newGCMSink(&cfg.GCM) }},
+		{"nats", cfg.NATS.enabled(), func() (sink, error) { return newNATSSink(&cfg.NATS) }},
+		{"webhook", cfg.Webhook.enabled(), func() (sink, error) {
+			return newWebhookSink(&cfg.Webhook)
+		}},
+		{"zabbix", cfg.Zabbix.enabled(), func() (sink, error) { return newZabbixSink(&cfg.Zabbix) }},
+		{"modbus", cfg.Modbus.enabled(), func() (sink, error) { return newModbusSink(&cfg.Modbus) }},
+		{"datadog", cfg.Datadog.enabled(), func() (sink, error) {
+			return newDatadogSink(&cfg.Datadog)
+		}},
+	}
+}
+
+// newSinks は設定で有効にした出力先を生成します。
+func newSinks(cfg *config) ([]*sinkRunner, error) {
+	var runners []*sinkRunner
+	for _, f := range sinkFactories(cfg) {
+		if !f.enabled {
+			continue
+		}
+		s, err := f.new()
+		if err != nil {
+			// 生成済みの出力先が待ち受けているポートなどを解放する
+			for _, r := range runners {
+				_ = r.sink.close()
+			}
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		runners = append(runners, &sinkRunner{
+			name:  f.name,
+			sink:  s,
+			queue: make(chan *reading, sinkQueueSize),
+		})
+	}
+	return runners, nil
+}
+
+// startSinks は設定で有効にした出力先への送信を開始します。
+// ctx が終了すると、各出力先の接続を閉じます。
+func startSinks(ctx context.Context, cfg *config, logger *slog.Logger) error {
+	runners, err := newSinks(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	for _, r := range runners {
+		sinksDone.Add(1)
+		go r.run(ctx, logger.With("sink", r.name))
+	}
+	sinksMu.Lock()
+	sinks, stopSinkRunners = runners, cancel
+	sinksMu.Unlock()
+	return nil
+}
+
+// stopSinks は出力先への送信を終了し、各出力先の接続を閉じるのを待ちます。
+// 送信待ちの取得値は捨てます。
+func stopSinks() {
+	sinksMu.Lock()
+	if stopSinkRunners != nil {
+		stopSinkRunners()
+	}
+	sinks, stopSinkRunners = nil, nil
+	sinksMu.Unlock()
+	sinksDone.Wait()
+}
+
+// waitSinks は出力先の goroutine が全て終了するのを待ちます。
+func waitSinks() {
+	sinksDone.Wait()
+}
+
+// publishReading は取得値を全ての出力先の送信待ちに追加します。
+func publishReading(r *reading) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range sinks {
+		select {
+		case s.queue <- r:
+		default:
+			sinkDropped.WithLabelValues(s.name).Inc()
+		}
+	}
+}
+
+// historicalSinks は取得値を計測時刻とともに保存するため、履歴から復元した過去の取得値も送る出力先です。
+// remote_write (Prometheus は古い時刻のサンプルを拒否する)、gcm、datadog (古い時刻の値を受け付けない) や、
+// 時刻を持たない、または最新の値として扱う出力先には送りません。
+var historicalSinks = []string{
+	"influxdb", "line_protocol", "victoriametrics", "graphite", "csv", "jsonl",
+	"sqlite", "postgres", "cloudwatch", "zabbix",
+}
+
+// publishHistoricalReading は履歴から復元した過去の取得値を historicalSinks の送信待ちに追加します。
+// 一度に多くの取得値を送るため、送信待ちが空くまで sinkPublishTimeout だけ待ちます。
+func publishHistoricalReading(r *reading) {
+	sinksMu.Lock()
+	runners := slices.Clone(sinks)
+	sinksMu.Unlock()
+	for _, s := range runners {
+		if !slices.Contains(historicalSinks, s.name) {
+			continue
+		}
+		select {
+		case s.queue <- r:
+		case <-time.After(sinkPublishTimeout):
+			sinkDropped.WithLabelValues(s.name).Inc()
+		}
+	}
+}
+
+func (s *sinkRunner) run(ctx context.Context, logger *slog.Logger) {
+	defer sinksDone.Done()
+	defer func() {
+		if err := s.sink.close(); err != nil {
+			logger.Debug("Failed to close output", "error", err)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-s.queue:
+			pctx, cancel := context.WithTimeout(ctx, sinkPublishTimeout)
+			err := s.sink.publish(pctx, r)
+			cancel()
+			if err != nil {
+				logger.Warn("Failed to send reading", "error", err)
+				sinkErrors.WithLabelValues(s.name).Inc()
+				continue
+			}
+			sinkPublished.WithLabelValues(s.name).Inc()
+		}
+	}
+}
+
+// newTLSConfig は出力先への接続に使う TLS の設定を生成します。
+// caFile を指定した場合は、その CA 証明書でサーバー証明書を検証します。
+func newTLSConfig(serverName, caFile string, insecure bool) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure, //nolint:gosec // 利用者が明示的に指定した場合のみ
+	}
+	if caFile == "" {
+		return c, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	c.RootCAs = pool
+	return c, nil
+}
+
+// newHTTPClient は HTTP で送信する出力先のクライアントを生成します。
+func newHTTPClient(caFile string, insecure bool) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig("", caFile, insecure)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: sinkPublishTimeout}, nil
+}
+
+// postHTTP は body を url に POST し、2xx 以外の応答をエラーとして返します。
+func postHTTP(
+	ctx context.Context, client *http.Client, url, contentType string, body []byte,
+	header http.Header,
+) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	return sendHTTP(client, req)
+}
+
+// sendHTTP は要求を送信し、2xx 以外の応答をエラーとして返します。
+// 要求の内容が受け付けられなかった 4xx の応答は permanentError として返します。
+func sendHTTP(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+		// 要求の内容が受け付けられなかった場合は、再送しても成功しない
+		// (認証情報の更新などで解消するものと、一時的なものを除く)
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden,
+			http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return err
+		}
+		if resp.StatusCode/100 == 4 {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// basicAuth は Basic 認証の Authorization ヘッダーの値を返します。
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// authHeader は Bearer トークンまたは Basic 認証の Authorization ヘッダーを返します。
+// 両方を指定した場合は Bearer トークンを優先します。
+func authHeader(bearerToken, username, password string) http.Header {
+	header := http.Header{}
+	switch {
+	case bearerToken != "":
+		header.Set("Authorization", "Bearer "+bearerToken)
+	case username != "":
+		header.Set("Authorization", basicAuth(username, password))
+	}
+	return header
+}
+
+// permanentError は再送しても成功しない送信エラーです。
+type permanentError struct {
+	error
+}
+
+// retryBuffer は送信に失敗した取得値を次回の送信まで保持し、まとめて再送します。
+// 上限を超えた場合は古いものから捨てます。
+type retryBuffer struct {
+	name     string
+	max      int
+	readings []*reading
+}
+
+func newRetryBuffer(name string, max int) *retryBuffer {
+	return &retryBuffer{name: name, max: max}
+}
+
+// flush は r を追加し、保持している取得値をまとめて send で送信します。
+// 送信に成功した場合と、再送しても成功しないエラーの場合は保持していた取得値を破棄します。
+func (b *retryBuffer) flush(r *reading, send func([]*reading) error) error {
+	b.add(r)
+	if err := send(b.readings); err != nil {
+		if errors.As(err, new(permanentError)) {
+			sinkDropped.WithLabelValues(b.name).Add(float64(len(b.readings)))
+			b.readings = b.readings[:0]
+		}
+		return err
+	}
+	b.readings = b.readings[:0]
+	return nil
+}
+
+// flushEach は r を追加し、保持している取得値を古いものから1つずつ send で送信します。
+// 送信できた取得値から破棄するため、時系列毎に時刻の順に書き込む必要がある出力先に使います。
+func (b *retryBuffer) flushEach(r *reading, send func(*reading) error) error {
+	b.add(r)
+	var rejected error
+	for len(b.readings) > 0 {
+		if err := send(b.readings[0]); err != nil {
+			if !errors.As(err, new(permanentError)) {
+				return err
+			}
+			// 再送しても成功しない取得値は捨てて、次の取得値の送信を続ける
+			sinkDropped.WithLabelValues(b.name).Inc()
+			rejected = err
+		}
+		b.readings = b.readings[1:]
+	}
+	return rejected
+}
+
+// add は r を追加し、上限を超えた場合は古いものから捨てます。
+func (b *retryBuffer) add(r *reading) {
+	b.readings = append(b.readings, r)
+	if over := len(b.readings) - b.max; over > 0 {
+		sinkDropped.WithLabelValues(b.name).Add(float64(over))
+		b.readings = slices.Delete(b.readings, 0, over)
+	}
+}
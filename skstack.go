@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SKSTACK のイベント番号 (EVENT nn)
+const (
+	// PANA による接続過程でエラーが発生した
+	skEventPANAFailure = "24"
+	// PANA による接続が完了した
+	skEventPANASuccess = "25"
+	// PANA セッションの終了に成功した
+	skEventPANAClosed = "27"
+	// PANA セッションの終了要求に対する応答がなくタイムアウトした
+	skEventPANATimeout = "28"
+	// セッションのライフタイムが経過して期限切れになった (モジュールが再認証する)
+	skEventPANAExpiring = "29"
+	// 送信総和時間の制限が発動し、送信が制限された
+	skEventTxRestricted = "32"
+	// 送信総和時間の制限が解除された
+	skEventTxReleased = "33"
+)
+
+var (
+	// skEventPattern は SKSTACK のイベント通知 (例: "EVENT 25 FE80:...") です。
+	skEventPattern = regexp.MustCompile(`\bEVENT ([0-9A-F]{2})\b`)
+	// skCommandPattern は Wi-SUN モジュールに送信する SKSTACK のコマンド (例: "SKSENDTO 1 ...") です。
+	skCommandPattern = regexp.MustCompile(`\bSK[A-Z0-9]+\b`)
+	// skResponsePattern は Wi-SUN モジュールから受信する応答・イベントです。
+	skResponsePattern = regexp.MustCompile(
+		`\b(OK|FAIL ER[0-9]{2}|EVENT [0-9A-F]{2}|ERXUDP|EPANDESC|EVER|EINFO|ESREG|ENEIGHBOR|EADDR)\b`,
+	)
+	// skLQIPattern はアクティブスキャン結果 (EPANDESC) の受信品質 (例: "  LQI:E1") です。
+	skLQIPattern = regexp.MustCompile(`\bLQI:([0-9A-F]{2})\b`)
+)
+
+// 送受信の方向 (direction ラベル)
+const (
+	directionTx = "tx"
+	directionRx = "rx"
+)
+
+var (
+	// シリアルポートで送受信したバイト数 (ライブラリのログから推定)
+	serialBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_serial_bytes_total",
+		Help: "Bytes of SKSTACK lines sent (tx) or received (rx) on the serial port (from library log)",
+	}, []string{"direction"})
+	// Wi-SUN で送受信した UDP フレーム数 (SKSENDTO / ERXUDP)
+	wisunFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smartmeter_wisun_frames_total",
+		Help: "UDP frames sent (SKSENDTO) or received (ERXUDP) over Wi-SUN, from the library log",
+	}, []string{"direction"})
+)
+
+var (
+	// 直近に受信したスキャン結果の受信品質 (LQI)
+	wisunLQI = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_wisun_lqi",
+		Help: "Link quality indicator (LQI) most recently reported by the Wi-SUN module",
+	})
+	// 直近に受信した電波強度 (dBm)
+	wisunRSSI = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_wisun_rssi_dbm",
+		Help: "Received signal strength most recently reported by the Wi-SUN module in dBm",
+	})
+)
+
+var (
+	// 送信総和時間の制限により送信が制限されているか (制限中: 1, 通常: 0)
+	txRestricted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_tx_restricted",
+		Help: "Whether Wi-SUN transmission is restricted by the duty-cycle limit (1) or not (0)",
+	})
+	// 送信総和時間の制限が発動した回数
+	txRestrictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_tx_restriction_episodes_total",
+		Help: "Total number of times Wi-SUN transmission was restricted by the duty-cycle limit",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(txRestricted)
+	prometheus.MustRegister(txRestrictions)
+	prometheus.MustRegister(serialBytes)
+	prometheus.MustRegister(wisunFrames)
+	prometheus.MustRegister(wisunLQI)
+	prometheus.MustRegister(wisunRSSI)
+}
+
+// lqiToRSSI は LQI を RSSI (dBm) に換算します (BP35A1 のコマンドリファレンスの換算式)。
+func lqiToRSSI(lqi int) float64 {
+	return 0.275*float64(lqi) - 104.27
+}
+
+// parseERXUDPRSSI は Dual Stack 版の SKSTACK の ERXUDP から RSSI (dBm) を取り出します。
+// Dual Stack 版の ERXUDP は
+// "ERXUDP <SENDER> <DEST> <RPORT> <LPORT> <SENDERLLA> <RSSI> <SECURED> <SIDE> <DATALEN> <DATA>"
+// の形式で、RSSI は符号付きの16進数です。それ以外の形式では false を返します。
+func parseERXUDPRSSI(line string) (float64, bool) {
+	i := strings.Index(line, "ERXUDP ")
+	if i < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(line[i:])
+	if len(fields) != 11 {
+		return 0, false
+	}
+	bits := 4 * len(fields[6])
+	if bits == 0 || bits > 32 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(fields[6], 16, bits)
+	if err != nil {
+		return 0, false
+	}
+	// 2の補数表現の符号付き整数として解釈する
+	if v >= 1<<(bits-1) {
+		return float64(int64(v) - 1<<bits), true
+	}
+	return float64(v), true
+}
+
+// skstackMonitor は go-smartmeter のログを監視する io.Writer です。
+// ログを out にそのまま書き込みつつ、ログに含まれる SKSTACK のイベントをメトリクスに反映します。
+// ライブラリがシリアル通信の内容をログ出力する詳細度 (-verbosity) の場合のみ検出できます。
+type skstackMonitor struct {
+	out    io.Writer
+	logger *slog.Logger
+	scan   scanState
+
+	txRestricted bool // 送信総和時間の制限中かどうか
+}
+
+func newSKStackMonitor(out io.Writer, logger *slog.Logger) *skstackMonitor {
+	return &skstackMonitor{out: out, logger: logger}
+}
+
+// Write は io.Writer を実装します。
+func (m *skstackMonitor) Write(p []byte) (int, error) {
+	now := time.Now()
+	for _, line := range strings.Split(string(p), "\n") {
+		m.observe(strings.TrimSpace(line), now)
+	}
+	return m.out.Write(p)
+}
+
+// observe はログの1行を解析します。
+func (m *skstackMonitor) observe(line string, now time.Time) {
+	m.countIO(line)
+	m.observeLinkQuality(line)
+	m.observeScan(line, now)
+	connStatus.observe(line, now)
+	if ev := skEventPattern.FindStringSubmatch(line); ev != nil {
+		m.handleEvent(ev[1], now)
+	}
+}
+
+// handleEvent は SKSTACK のイベントを処理します。
+func (m *skstackMonitor) handleEvent(code string, now time.Time) {
+	switch code {
+	case skEventPANASuccess:
+		sessionStart.Store(now.UnixNano())
+	case skEventPANAFailure, skEventPANAClosed, skEventPANATimeout:
+		sessionStart.Store(0)
+	case skEventPANAExpiring:
+		m.logger.Info("PANA session lifetime expired, module is re-authenticating")
+	case skEventScanComplete:
+		m.completeScan(now)
+	case skEventTxRestricted:
+		if !m.txRestricted {
+			txRestrictions.Inc()
+			m.logger.Warn("Wi-SUN transmission restricted by the duty-cycle limit")
+		}
+		m.txRestricted = true
+		txRestricted.Set(1)
+	case skEventTxReleased:
+		if m.txRestricted {
+			m.logger.Info("Wi-SUN transmission restriction released")
+		}
+		m.txRestricted = false
+		txRestricted.Set(0)
+	}
+}
+
+// countIO はログの1行が SKSTACK のコマンドまたは応答であれば、送受信量として計上します。
+// ログの前置きを除くため、コマンドまたは応答の先頭から行末までに改行 (CRLF) を加えた長さを数えます。
+func (m *skstackMonitor) countIO(line string) {
+	if loc := skCommandPattern.FindStringIndex(line); loc != nil {
+		serialBytes.WithLabelValues(directionTx).Add(float64(len(line) - loc[0] + 2))
+		if strings.HasPrefix(line[loc[0]:], "SKSENDTO") {
+			wisunFrames.WithLabelValues(directionTx).Inc()
+		}
+		return
+	}
+	if loc := skResponsePattern.FindStringIndex(line); loc != nil {
+		serialBytes.WithLabelValues(directionRx).Add(float64(len(line) - loc[0] + 2))
+		if strings.HasPrefix(line[loc[0]:], "ERXUDP") {
+			wisunFrames.WithLabelValues(directionRx).Inc()
+		}
+	}
+}
+
+// observeLinkQuality はスキャン結果の LQI と、受信フレームの RSSI を記録します。
+func (m *skstackMonitor) observeLinkQuality(line string) {
+	if lqi := skLQIPattern.FindStringSubmatch(line); lqi != nil {
+		if v, err := strconv.ParseUint(lqi[1], 16, 8); err == nil {
+			wisunLQI.Set(float64(v))
+			wisunRSSI.Set(lqiToRSSI(int(v)))
+		}
+		return
+	}
+	if rssi, ok := parseERXUDPRSSI(line); ok {
+		wisunRSSI.Set(rssi)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+// sqliteConfig は SQLite への記録の設定です。
+type sqliteConfig struct {
+	Path      string
+	Table     string
+	Retention time.Duration
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *sqliteConfig) bind() {
+	c.Path = getEnv("SMARTMETER_SQLITE_PATH", "")
+	c.Table = getEnv("SMARTMETER_SQLITE_TABLE", "readings")
+	c.Retention = getEnvDuration("SMARTMETER_SQLITE_RETENTION", 0)
+
+	flag.StringVar(&c.Path, "sqlite.path", c.Path,
+		"SQLite database file to store readings in (requires a build with -tags sqlite)")
+	flag.StringVar(&c.Table, "sqlite.table", c.Table, "SQLite table name for readings")
+	durationVar(&c.Retention, "sqlite.retention", c.Retention,
+		"Delete SQLite rows older than this (0: keep forever)")
+}
+
+func (c *sqliteConfig) enabled() bool {
+	return c.Path != ""
+}
+
+// validate は SQLite への記録の設定値を検証します。
+func (c *sqliteConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if !sqlDriverAvailable(sqliteDialect.driver) {
+		return errors.New("SQLite support is not built in (rebuild with -tags sqlite)")
+	}
+	if c.Retention < 0 {
+		return errors.New("SQLite retention must not be negative")
+	}
+	return validateTableName(c.Table)
+}
+
+func newSQLiteSink(cfg *sqliteConfig) (*sqlSink, error) {
+	// 他のプロセスが読み込み中でも書き込めるよう、WAL モードにしてロックを待つ
+	dsn := "file:" + cfg.Path + "?_busy_timeout=5000&_journal_mode=WAL"
+	s, err := newSQLSink(sqliteDialect, dsn, cfg.Table, cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite は同時に1つの接続からしか書き込めない
+	s.db.SetMaxOpenConns(1)
+	return s, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlCleanupInterval は保持期間を過ぎた行を削除する間隔です。
+const sqlCleanupInterval = time.Hour
+
+// sqlDialect はデータベース毎の SQL の違いです。
+type sqlDialect struct {
+	driver string
+	// timeType, realType, intType は列の型です。
+	timeType string
+	realType string
+	intType  string
+	// placeholder は i 番目 (1 始まり) のパラメーターのプレースホルダーを返します。
+	placeholder func(i int) string
+}
+
+var (
+	sqliteDialect = sqlDialect{
+		driver:      "sqlite3",
+		timeType:    "TIMESTAMP",
+		realType:    "REAL",
+		intType:     "INTEGER",
+		placeholder: func(int) string { return "?" },
+	}
+	postgresDialect = sqlDialect{
+		driver:      "pgx",
+		timeType:    "TIMESTAMPTZ",
+		realType:    "DOUBLE PRECISION",
+		intType:     "INTEGER",
+		placeholder: func(i int) string { return "$" + strconv.Itoa(i) },
+	}
+)
+
+// sqlDriverAvailable は database/sql のドライバーが組み込まれているかどうかを返します。
+// ドライバーはビルドタグを指定した場合のみ組み込みます。
+func sqlDriverAvailable(driver string) bool {
+	return slices.Contains(sql.Drivers(), driver)
+}
+
+// validateTableName はテーブル名を SQL にそのまま埋め込めることを検証します。
+func validateTableName(table string) error {
+	if !labelNamePattern.MatchString(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	return nil
+}
+
+// sqlSink は取得値をデータベースのテーブルに書き込みます。
+// 計測値は <table> に取得時刻の1行として、定時積算電力量は <table>_fixed_time に
+// 計測日時と向き毎の1行として書き込みます (同じ計測日時の行は書き込みません)。
+// retention が 0 より大きい場合は、保持期間を過ぎた行を定期的に削除します。
+type sqlSink struct {
+	db        *sql.DB
+	dialect   sqlDialect
+	table     string
+	retention time.Duration
+
+	// setup はテーブルの作成後に実行する文です。
+	setup []string
+
+	insertReading   string
+	insertFixedTime string
+	initialized     bool
+	lastCleanup     time.Time
+}
+
+func newSQLSink(dialect sqlDialect, dsn, table string, retention time.Duration) (*sqlSink, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlSink{db: db, dialect: dialect, table: table, retention: retention}
+	s.insertReading = s.insertStatement(table, readingColumns)
+	s.insertFixedTime = s.insertStatement(table+"_fixed_time", fixedTimeColumns) +
+		" ON CONFLICT DO NOTHING"
+	return s, nil
+}
+
+// readingColumns, fixedTimeColumns は書き込む列です。先頭は時刻の列です。
+var (
+	readingColumns = []string{
+		"time", "operational", "fault", "power_watts", "current_r_amperes", "current_t_amperes",
+		"phases", "energy_consumed_kwh", "energy_exported_kwh",
+	}
+	fixedTimeColumns = []string{"time", "direction", "energy_kwh"}
+)
+
+func (s *sqlSink) insertStatement(table string, columns []string) string {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = s.dialect.placeholder(i + 1)
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") +
+		") VALUES (" + strings.Join(placeholders, ", ") + ")"
+}
+
+// createTables はテーブルが存在しない場合に作成します。
+func (s *sqlSink) createTables(ctx context.Context) error {
+	d := s.dialect
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + s.table + " (" +
+			"time " + d.timeType + " NOT NULL, " +
+			"operational " + d.intType + ", " +
+			"fault " + d.intType + ", " +
+			"power_watts " + d.realType + ", " +
+			"current_r_amperes " + d.realType + ", " +
+			"current_t_amperes " + d.realType + ", " +
+			"phases " + d.intType + ", " +
+			"energy_consumed_kwh " + d.realType + ", " +
+			"energy_exported_kwh " + d.realType + ")",
+		"CREATE INDEX IF NOT EXISTS " + s.table + "_time_idx ON " + s.table + " (time)",
+		"CREATE TABLE IF NOT EXISTS " + s.table + "_fixed_time (" +
+			"time " + d.timeType + " NOT NULL, " +
+			"direction TEXT NOT NULL, " +
+			"energy_kwh " + d.realType + " NOT NULL, " +
+			"PRIMARY KEY (time, direction))",
+	}
+	for _, stmt := range append(stmts, s.setup...) {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) publish(ctx context.Context, r *reading) error {
+	// 起動時にデータベースに接続できなくても取得を止めないよう、テーブルは最初の書き込み時に作成する
+	if !s.initialized {
+		if err := s.createTables(ctx); err != nil {
+			return err
+		}
+		s.initialized = true
+		s.lastCleanup = time.Now()
+	}
+	if fields := r.fields(); len(fields) > 0 {
+		_, err := s.db.ExecContext(ctx, s.insertReading,
+			r.Time.UTC(), sqlBool(r.Operational), sqlBool(r.Fault), r.PowerWatts,
+			r.CurrentRAmperes, r.CurrentTAmperes, sqlPhases(r.Phases),
+			r.EnergyConsumedKWh, r.EnergyExportedKWh)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ft := range r.fixedTimeFields() {
+		if _, err := s.db.ExecContext(ctx, s.insertFixedTime,
+			ft.Time.UTC(), ft.Direction, ft.KWh); err != nil {
+			return err
+		}
+	}
+	if s.retention > 0 && time.Since(s.lastCleanup) >= sqlCleanupInterval {
+		if err := s.cleanup(ctx); err != nil {
+			return fmt.Errorf("failed to delete old rows: %w", err)
+		}
+		s.lastCleanup = time.Now()
+	}
+	return nil
+}
+
+// cleanup は保持期間を過ぎた行を削除します。
+func (s *sqlSink) cleanup(ctx context.Context) error {
+	before := time.Now().Add(-s.retention).UTC()
+	for _, table := range []string{s.table, s.table + "_fixed_time"} {
+		stmt := "DELETE FROM " + table + " WHERE time < " + s.dialect.placeholder(1)
+		if _, err := s.db.ExecContext(ctx, stmt, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) close() error {
+	return s.db.Close()
+}
+
+// sqlBool は状態を 1/0 (未取得は NULL) に変換します。
+func sqlBool(b *bool) any {
+	if b == nil {
+		return nil
+	}
+	return int64(boolToFloat(*b))
+}
+
+// sqlPhases は相の数を変換します (不明は NULL)。
+func sqlPhases(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
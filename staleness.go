@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staleCollectors は取得の失敗が続いたときに出力を止めるメトリクスを返します。
+// 古い値を出力し続けると現在の値と区別できない、瞬時値などのメトリクスが対象です。
+func staleCollectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{
+		readings,
+		energyTodayGauge,
+	}
+	seen := map[*prometheus.GaugeVec]bool{}
+	for _, m := range customMetrics {
+		if !seen[m.gauge] {
+			seen[m.gauge] = true
+			collectors = append(collectors, m.gauge)
+		}
+	}
+	return collectors
+}
+
+// stalenessGuard は最後の取得成功から window 以上経過したときにメトリクスの登録を解除し、
+// Prometheus に値が失われた (stale) ことを伝えます。window が 0 の場合は何もしません。
+type stalenessGuard struct {
+	window  time.Duration
+	expired bool
+}
+
+// check は最後の取得成功時刻 lastSuccess から window 以上経過していればメトリクスの登録を解除します。
+func (g *stalenessGuard) check(lastSuccess, now time.Time, logger *slog.Logger) {
+	if g.window <= 0 || g.expired || now.Sub(lastSuccess) < g.window {
+		return
+	}
+	for _, c := range staleCollectors() {
+		prometheus.Unregister(c)
+	}
+	g.expired = true
+	logger.Warn(
+		"No successful scrape within staleness window, expiring metrics",
+		"last_success",
+		lastSuccess,
+		"window",
+		g.window,
+	)
+}
+
+// restore は取得の成功後に、登録を解除したメトリクスを再登録します。
+func (g *stalenessGuard) restore(logger *slog.Logger) {
+	if !g.expired {
+		return
+	}
+	for _, c := range staleCollectors() {
+		if err := prometheus.Register(c); err != nil {
+			logger.Warn("Failed to re-register metric", "error", err)
+		}
+	}
+	g.expired = false
+	logger.Info("Scrape recovered, metrics restored")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hnw/go-smartmeter"
+)
+
+// panState は状態ファイルに保存するスマートメーターの接続情報です。
+// 再起動時にアクティブスキャン (数分かかる) を省略するために使います。
+type panState struct {
+	panDescriptor
+	IPAddr    string    `json:"ipaddr"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// readPANState は状態ファイルを読み込みます。
+func readPANState(path string) (*panState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st panState
+	if err = json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("parse state file %s: %w", path, err)
+	}
+	if st.Channel == "" || st.IPAddr == "" {
+		return nil, fmt.Errorf("state file %s has no channel or IPv6 address", path)
+	}
+	return &st, nil
+}
+
+// writePANState は状態ファイルを書き込みます。書き込み中に終了しても壊れないよう、
+// 同じディレクトリの一時ファイルに書き込んでから置き換えます。
+func writePANState(path string, st *panState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".smartmeter-state-*")
+	if err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(append(b, '\n')); err == nil {
+		err = f.Chmod(0o644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
+
+// openDeviceWithState はスマートメーターに接続します。
+// チャネルと IPv6 アドレスが指定されておらず、状態ファイルに保存されている場合は、保存された値で接続します。
+// 保存された値で接続 (認証) できない場合は、アクティブスキャンからやり直し、見つかった値を状態ファイルに保存します。
+func openDeviceWithState(
+	cfg *config,
+	monitor *skstackMonitor,
+	logger *slog.Logger,
+) (*smartmeter.Device, error) {
+	m := cfg.meter()
+	smLogger := log.New(monitor, "", 0)
+	if cfg.StateFile == "" || m.Channel != "" || m.IPAddr != "" {
+		connStatus.setConnection(m.Channel, "", m.IPAddr)
+		return openDevice(m, cfg.Verbosity, smLogger)
+	}
+
+	st, err := readPANState(cfg.StateFile)
+	switch {
+	case err == nil:
+		cached := m
+		cached.Channel, cached.IPAddr = st.Channel, st.IPAddr
+		dev, openErr := openDevice(cached, cfg.Verbosity, smLogger)
+		if openErr == nil {
+			connStatus.setConnection(st.Channel, st.PANID, st.IPAddr)
+			logger.Info("Connected using the cached PAN",
+				"channel", st.Channel, "ipaddr", st.IPAddr, "state_file", cfg.StateFile)
+			return dev, nil
+		}
+		logger.Warn("Failed to connect using the cached PAN, scanning again", "error", openErr)
+	case !errors.Is(err, fs.ErrNotExist):
+		logger.Warn("Ignoring state file", "error", err)
+	}
+
+	// チャネルはシリアル通信のログから検出するため、スキャンする接続ではライブラリの詳細度を上げる。
+	// -verbosity がそれより低い場合、ライブラリのログは出力しない
+	verbosity := cfg.Verbosity
+	if verbosity < scanVerbosity {
+		verbosity = scanVerbosity
+		monitor.out = io.Discard
+	}
+	dev, err := openDevice(m, verbosity, smLogger)
+	if err != nil {
+		return nil, err
+	}
+	if err = savePANState(cfg.StateFile, dev, &monitor.scan); err != nil {
+		logger.Warn("Failed to save the scanned PAN", "error", err, "state_file", cfg.StateFile)
+	} else {
+		logger.Info("Saved the scanned PAN", "state_file", cfg.StateFile)
+	}
+	return dev, nil
+}
+
+// savePANState はアクティブスキャンで見つかった PAN とスマートメーターの IPv6 アドレスを状態ファイルに保存します。
+func savePANState(path string, dev *smartmeter.Device, scan *scanState) error {
+	pan := scan.selected()
+	if pan == nil || pan.Channel == "" {
+		return errors.New("no PAN detected from the active scan")
+	}
+	if dev.IPAddr == "" {
+		ipAddr, err := dev.GetNeibourIP()
+		if err != nil {
+			return fmt.Errorf("resolve meter IPv6 address: %w", err)
+		}
+		dev.IPAddr = ipAddr
+	}
+	if dev.IPAddr == "" {
+		return errors.New("meter IPv6 address not resolved")
+	}
+	return writePANState(path, &panState{
+		panDescriptor: *pan,
+		IPAddr:        dev.IPAddr,
+		UpdatedAt:     time.Now(),
+	})
+}
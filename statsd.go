@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statsdConfig は StatsD (DogStatsD) への出力の設定です。
+type statsdConfig struct {
+	Address   string
+	Prefix    string
+	NamePairs []string
+	TagPairs  []string
+
+	// validate で設定される
+	Names map[string]string
+	Tags  map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *statsdConfig) bind() {
+	c.Address = getEnv("SMARTMETER_STATSD_ADDRESS", "")
+	c.Prefix = getEnv("SMARTMETER_STATSD_PREFIX", "smartmeter.")
+	if v := getEnv("SMARTMETER_STATSD_METRIC_NAMES", ""); v != "" {
+		c.NamePairs = strings.Split(v, ",")
+	}
+	if v := getEnv("SMARTMETER_STATSD_TAGS", ""); v != "" {
+		c.TagPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.Address, "statsd.address", c.Address,
+		"StatsD/DogStatsD host:port to send readings to as gauges over UDP (e.g. localhost:8125)")
+	flag.StringVar(&c.Prefix, "statsd.prefix", c.Prefix, "Prefix of StatsD metric names")
+	flag.Var(&labelFlag{values: &c.NamePairs}, "statsd.metric-name",
+		"Rename a reading item as item=name such as power_watts=house.power (repeatable)")
+	flag.Var(&labelFlag{values: &c.TagPairs}, "statsd.tag",
+		"DogStatsD tag key=value added to every metric (repeatable)")
+}
+
+func (c *statsdConfig) enabled() bool {
+	return c.Address != ""
+}
+
+// validate は StatsD の設定値を検証します。
+func (c *statsdConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid StatsD address %q: %w", c.Address, err)
+	}
+	c.Names = make(map[string]string, len(readingItemNames))
+	for _, name := range readingItemNames {
+		c.Names[name] = name
+	}
+	for _, p := range c.NamePairs {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || v == "" {
+			return fmt.Errorf("StatsD metric name must be item=name: %q", p)
+		}
+		if !slices.Contains(readingItemNames, k) {
+			return fmt.Errorf("unknown reading item %q for StatsD metric name", k)
+		}
+		if strings.ContainsAny(v, ":|@#\n") {
+			return fmt.Errorf("invalid StatsD metric name %q", v)
+		}
+		c.Names[k] = v
+	}
+	tags, err := parseLabels(c.TagPairs)
+	if err != nil {
+		return err
+	}
+	c.Tags = tags
+	return nil
+}
+
+// statsdSink は取得値を StatsD のゲージとして UDP で送信します。
+// タグを指定した場合は DogStatsD の形式 (|#key:value) で付加します。
+// UDP では受信の確認ができないため、再送はしません。
+type statsdSink struct {
+	cfg  *statsdConfig
+	tags string
+	conn net.Conn
+}
+
+func newStatsDSink(cfg *statsdConfig) (*statsdSink, error) {
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, k+":"+cfg.Tags[k])
+	}
+	s := &statsdSink{cfg: cfg}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+func (s *statsdSink) publish(ctx context.Context, r *reading) error {
+	var b []byte
+	for _, item := range r.items() {
+		b = s.appendGauge(b, item.Name, item.Value)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "udp", s.cfg.Address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	// 複数のメトリクスを改行で区切って1つのデータグラムで送信する
+	if _, err := s.conn.Write(b[:len(b)-1]); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// appendGauge はゲージの行を追加します。StatsD では符号付きの値が増減として扱われるため、
+// 負の値は 0 に設定してから減算します。
+func (s *statsdSink) appendGauge(b []byte, field string, v float64) []byte {
+	name := s.cfg.Prefix + s.cfg.Names[field]
+	if v < 0 {
+		b = s.appendLine(b, name, "0")
+	}
+	return s.appendLine(b, name, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (s *statsdSink) appendLine(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, "|g"...)
+	b = append(b, s.tags...)
+	return append(b, '\n')
+}
+
+func (s *statsdSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusHistorySize は /debug/status に表示する直近のイベントとエラーの数です。
+const statusHistorySize = 10
+
+var (
+	// skVersionPattern は SKVER に対する応答 (例: "EVER 1.2.10") です。
+	skVersionPattern = regexp.MustCompile(`\bEVER ([0-9A-Za-z.]+)`)
+	// skAppVersionPattern は SKAPPVER に対する応答 (例: "EAPPVER rev26e") です。
+	skAppVersionPattern = regexp.MustCompile(`\bEAPPVER (\S+)`)
+	// skEventAddrPattern はイベント通知の送信元の IPv6 アドレスです。
+	skEventAddrPattern = regexp.MustCompile(`\bEVENT [0-9A-F]{2} ([0-9A-F]{4}(?::[0-9A-F]{4}){7})\b`)
+)
+
+// skEventDescriptions は /debug/status に表示する SKSTACK のイベントの説明です。
+var skEventDescriptions = map[string]string{
+	"1F":                "ED scan completed",
+	"20":                "beacon received",
+	skEventScanComplete: "active scan completed",
+	skEventPANAFailure:  "PANA authentication failed",
+	skEventPANASuccess:  "PANA authentication succeeded",
+	"26":                "session close requested by the meter",
+	skEventPANAClosed:   "PANA session closed",
+	skEventPANATimeout:  "PANA session close timed out",
+	skEventPANAExpiring: "PANA session lifetime expired",
+	skEventTxRestricted: "transmission restricted by the duty-cycle limit",
+	skEventTxReleased:   "transmission restriction released",
+}
+
+// statusEvent は /debug/status に表示する SKSTACK のイベントです。
+type statusEvent struct {
+	Time time.Time
+	Code string
+}
+
+// statusError は /debug/status に表示するエラーです。Type は smartmeter_scrape_errors_total の type です。
+type statusError struct {
+	Time  time.Time
+	Type  string
+	Error string
+}
+
+// connectionStatus は /debug/status に表示する Wi-SUN モジュールとスマートメーターとの接続の状態です。
+// ライブラリのログ (取得ループ) と HTTP の要求の双方から参照するため、mu で保護します。
+type connectionStatus struct {
+	mu sync.Mutex
+	// firmware と appVersion は SKSTACK とアプリケーションのバージョンです。ライブラリのログから検出します。
+	firmware   string
+	appVersion string
+	channel    string
+	panID      string
+	meterAddr  string
+	// events と errors は古い順の直近のイベントとエラーです。
+	events []statusEvent
+	errors []statusError
+}
+
+// connStatus は /debug/status に表示する接続の状態です。
+var connStatus = &connectionStatus{}
+
+// setConnection はチャネル、PAN ID、スマートメーターの IPv6 アドレスを記録します。空の値は記録しません。
+func (s *connectionStatus) setConnection(channel, panID, meterAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if channel != "" {
+		s.channel = channel
+	}
+	if panID != "" {
+		s.panID = panID
+	}
+	if meterAddr != "" {
+		s.meterAddr = meterAddr
+	}
+}
+
+// observe はライブラリのログの1行から、バージョンとイベントを記録します。
+func (s *connectionStatus) observe(line string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v := skVersionPattern.FindStringSubmatch(line); v != nil {
+		s.firmware = v[1]
+	}
+	if v := skAppVersionPattern.FindStringSubmatch(line); v != nil {
+		s.appVersion = v[1]
+	}
+	ev := skEventPattern.FindStringSubmatch(line)
+	// UDP の送信完了 (EVENT 21) は要求の度に発生し、他のイベントが埋もれるため記録しない
+	if ev == nil || ev[1] == "21" {
+		return
+	}
+	if ev[1] == skEventPANASuccess {
+		// PANA 認証の完了は認証相手 (スマートメーター) のアドレスとともに通知される
+		if addr := skEventAddrPattern.FindStringSubmatch(line); addr != nil {
+			s.meterAddr = addr[1]
+		}
+	}
+	s.events = appendStatusHistory(s.events, statusEvent{Time: now, Code: ev[1]})
+}
+
+// addError はエラーを記録します。
+func (s *connectionStatus) addError(errType string, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = appendStatusHistory(s.errors, statusError{Time: now, Type: errType, Error: err.Error()})
+}
+
+// appendStatusHistory は v を追加し、statusHistorySize を超えた古い要素を削除します。
+func appendStatusHistory[T any](s []T, v T) []T {
+	s = append(s, v)
+	if len(s) > statusHistorySize {
+		s = slices.Delete(s, 0, len(s)-statusHistorySize)
+	}
+	return s
+}
+
+// orUnknown は空の値を "unknown" にします。
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// writeStatus は接続の状態を人が読める形式で書き出します。
+func (s *connectionStatus) writeStatus(w io.Writer, cfg *config, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(w, "Wi-SUN adapter")
+	fmt.Fprintf(w, "  device:         %s\n", cfg.DevicePath)
+	fmt.Fprintf(w, "  dual stack:     %t\n", cfg.UseDSE)
+	fmt.Fprintf(w, "  SKSTACK:        %s\n", orUnknown(s.firmware))
+	fmt.Fprintf(w, "  application:    %s\n", orUnknown(s.appVersion))
+
+	fmt.Fprintln(w, "\nConnection")
+	fmt.Fprintf(w, "  channel:        %s\n", orUnknown(s.channel))
+	fmt.Fprintf(w, "  PAN ID:         %s\n", orUnknown(s.panID))
+	fmt.Fprintf(w, "  meter IPv6:     %s\n", orUnknown(s.meterAddr))
+	if start := sessionStart.Load(); start != 0 {
+		t := time.Unix(0, start)
+		fmt.Fprintf(w, "  session:        established %s (age %s, remaining about %s)\n",
+			t.Format(time.RFC3339), now.Sub(t).Round(time.Second),
+			max(0, panaLifetime-now.Sub(t)).Round(time.Second))
+	} else {
+		fmt.Fprintln(w, "  session:        none")
+	}
+	if last := scrapeSuccess.Load(); last != 0 {
+		t := time.Unix(0, last)
+		fmt.Fprintf(w, "  last scrape:    %s (%s ago)\n",
+			t.Format(time.RFC3339), now.Sub(t).Round(time.Second))
+	} else {
+		fmt.Fprintln(w, "  last scrape:    none")
+	}
+
+	fmt.Fprintln(w, "\nRecent SKSTACK events (newest first)")
+	switch {
+	case len(s.events) == 0 && cfg.Verbosity < scanVerbosity:
+		// イベントはライブラリがシリアル通信の内容をログ出力する場合のみ検出できる
+		fmt.Fprintf(w, "  none (events are only visible with -verbosity %d)\n", scanVerbosity)
+	case len(s.events) == 0:
+		fmt.Fprintln(w, "  none")
+	}
+	for _, ev := range slices.Backward(s.events) {
+		fmt.Fprintf(w, "  %s  EVENT %s  %s\n",
+			ev.Time.Format(time.RFC3339), ev.Code, skEventDescriptions[ev.Code])
+	}
+
+	fmt.Fprintln(w, "\nRecent errors (newest first)")
+	if len(s.errors) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, e := range slices.Backward(s.errors) {
+		fmt.Fprintf(w, "  %s  %-10s  %s\n",
+			e.Time.Format(time.RFC3339), e.Type, strings.ReplaceAll(e.Error, "\n", " "))
+	}
+}
+
+// statusHandler は Wi-SUN モジュールとスマートメーターとの接続の状態を返す /debug/status のハンドラーです。
+// 不具合の報告に貼り付けられるよう、テキストで返します。
+func statusHandler(cfg *config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		connStatus.writeStatus(w, cfg, time.Now())
+	})
+}
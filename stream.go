@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// streamQueueSize は購読者ごとに送信待ちにできるイベントの数です。
+	// 受信の遅いクライアントのために取得ループを止めないよう、溢れたイベントは捨てます。
+	streamQueueSize = 16
+	// streamKeepAlive は /api/v1/stream と /api/v1/ws でイベントがない間にコメントや ping を送る間隔です。
+	// プロキシなどがアイドル状態の接続を切断するのを防ぎます。
+	streamKeepAlive = 30 * time.Second
+)
+
+// streamEvent は /api/v1/stream と /api/v1/ws で送るイベントです。Type はイベントの種類、Data は JSON で送る内容です。
+type streamEvent struct {
+	Type string
+	Data any
+}
+
+// eventStream は取得値、認証とエラーのイベントを /api/v1/stream と /api/v1/ws の購読者に配信します。
+type eventStream struct {
+	mu          sync.Mutex
+	subscribers map[chan streamEvent]struct{}
+	closed      bool
+}
+
+// stream は /api/v1/stream と /api/v1/ws で配信するイベントの購読者です。
+var stream = &eventStream{subscribers: make(map[chan streamEvent]struct{})}
+
+// subscribe はイベントを受け取るチャネルを返します。チャネルは unsubscribe または close で閉じます。
+func (s *eventStream) subscribe() chan streamEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan streamEvent, streamQueueSize)
+	if s.closed {
+		close(ch)
+		return ch
+	}
+	s.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe は購読をやめ、チャネルを閉じます。
+func (s *eventStream) unsubscribe(ch chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish はイベントを全ての購読者の送信待ちに追加します。
+func (s *eventStream) publish(ev streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close は全ての購読者のチャネルを閉じ、以降の購読を受け付けないようにします。
+// HTTP サーバーの終了時に呼び、接続したままの /api/v1/stream と /api/v1/ws の要求を終わらせます。
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		close(ch)
+	}
+	clear(s.subscribers)
+	s.closed = true
+}
+
+// readingEvent は取得値を /api/v1/reading と同じ形式で表したイベントです。
+func readingEvent(r *reading) streamEvent {
+	values := make(map[string]apiSample)
+	for _, item := range r.items() {
+		values[item.Name] = apiSample{Value: item.Value, Time: item.Time}
+	}
+	return streamEvent{Type: "reading", Data: values}
+}
+
+// apiAuthEvent は PANA 認証の結果を表す auth イベントの内容です。
+type apiAuthEvent struct {
+	Kind   string    `json:"kind"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// apiErrorEvent は取得などのエラーを表す error イベントの内容です。Type は smartmeter_scrape_errors_total の type です。
+type apiErrorEvent struct {
+	Type  string    `json:"type"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// writeServerSentEvent は Server-Sent Events の形式でイベントを書き出します。
+func writeServerSentEvent(w io.Writer, ev streamEvent) error {
+	b, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+	return err
+}
+
+// streamHandler は取得値などのイベントを Server-Sent Events で送る /api/v1/stream のハンドラーです。
+// 接続時に直近の取得値を送り、以降は取得する度に reading イベントを、認証とエラーの度に
+// auth と error イベントを送ります。
+func streamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"only GET requests allowed"})
+			return
+		}
+		rc := http.NewResponseController(w)
+		ch := stream.subscribe()
+		defer stream.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// nginx がレスポンスをバッファリングしないようにする
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if values := latest.snapshot(); len(values) > 0 {
+			_ = writeServerSentEvent(w, streamEvent{Type: "reading", Data: values})
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				err = writeServerSentEvent(w, ev)
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// systemdSecretFlags は systemd のユニットファイルに書き込まないフラグです。
+var systemdSecretFlags = []string{"id", "password"}
+
+// systemdEnvironmentFile は B ルート ID とパスワードを置く環境変数ファイルです。
+const systemdEnvironmentFile = "/etc/default/smartmeter-exporter"
+
+// systemdStateDirectory は状態ファイルを置く StateDirectory= です (/var/lib の下に作成されます)。
+// DynamicUser=yes では UID が起動毎に変わるため、systemd が所有者を合わせるこのディレクトリに置きます。
+const systemdStateDirectory = "smartmeter-exporter"
+
+// runSystemd は現在のフラグと環境変数で起動する systemd のユニットファイルを標準出力に書き出します。
+// B ルート ID とパスワードはユニットファイルに含めず、EnvironmentFile から読み込みます。
+func runSystemd() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(exitUsage)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to find the executable:", err)
+		os.Exit(exitError)
+	}
+	writeSystemdUnit(os.Stdout, cfg, exe)
+}
+
+// writeSystemdUnit は systemd のユニットファイルを書き出します。
+// コマンドラインで指定されたフラグは ExecStart に、接頭辞 (既定は SMARTMETER_) で始まる環境変数は Environment に含めます。
+func writeSystemdUnit(w io.Writer, cfg *config, exe string) {
+	args := []string{systemdExecArg(exe)}
+	flag.Visit(func(f *flag.Flag) {
+		// 状態ファイルは StateDirectory= の下に置き直す
+		if slices.Contains(systemdSecretFlags, f.Name) || f.Name == "state.file" {
+			return
+		}
+		// 繰り返し指定するフラグは値毎に指定する
+		values := []string{f.Value.String()}
+		if lf, ok := f.Value.(*labelFlag); ok {
+			values = *lf.values
+		}
+		for _, v := range values {
+			args = append(args, systemdExecArg("-"+f.Name+"="+v))
+		}
+	})
+	if cfg.StateFile != "" {
+		// ${STATE_DIRECTORY} は systemd が ExecStart で展開する
+		base := strings.ReplaceAll(filepath.Base(cfg.StateFile), "$", "$$")
+		args = append(args, systemdQuote("-state.file=${STATE_DIRECTORY}/"+base))
+	}
+	// B ルート ID とパスワードは書き込まない
+	secrets := []string{envName("SMARTMETER_ID"), envName("SMARTMETER_PASSWORD")}
+	env := systemdEnvironment(append(slices.Clone(secrets), envName("SMARTMETER_STATE_FILE")))
+	writable := systemdWritablePaths(cfg)
+
+	device := systemdEscapePath(cfg.DevicePath) + ".device"
+	fmt.Fprintf(w, `[Unit]
+Description=Smart meter exporter (Wi-SUN B-route)
+Documentation=https://github.com/hnw/smartmeter-exporter
+Wants=network-online.target
+After=network-online.target %[1]s
+BindsTo=%[1]s
+
+[Service]
+Type=simple
+# Put %[3]s and %[4]s in this file (mode 0600).
+EnvironmentFile=-%[2]s
+`, device, systemdEnvironmentFile, secrets[0], secrets[1])
+	for _, kv := range env {
+		fmt.Fprintf(w, "Environment=%s\n", systemdQuote(kv))
+	}
+	fmt.Fprintf(w, `ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=30s
+
+DynamicUser=yes
+SupplementaryGroups=dialout
+DevicePolicy=closed
+DeviceAllow=%s rw
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+ProtectClock=yes
+ProtectHostname=yes
+ProtectKernelLogs=yes
+ProtectKernelModules=yes
+ProtectKernelTunables=yes
+ProtectControlGroups=yes
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+StateDirectory=%s
+`, strings.Join(args, " "), cfg.DevicePath, systemdStateDirectory)
+	for _, path := range writable {
+		fmt.Fprintf(w, "ReadWritePaths=%s\n", systemdQuote(path))
+	}
+	fmt.Fprint(w, `
+[Install]
+WantedBy=multi-user.target
+`)
+}
+
+// systemdEnvironment は Environment= に書き込む環境変数を返します。
+// 接頭辞で始まる環境変数のうち、skipped 以外のものです。
+func systemdEnvironment(skipped []string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if (strings.HasPrefix(name, envPrefix) || name == defaultEnvPrefix+"ENV_PREFIX") &&
+			!slices.Contains(skipped, name) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// systemdWritablePaths はファイルの出力先のディレクトリを返します。
+// ProtectSystem=strict でも書き込めるよう、ReadWritePaths= に書き込みます。
+func systemdWritablePaths(cfg *config) []string {
+	var writable []string
+	for _, dir := range []string{
+		fileDir(cfg.SQLite.Path), cfg.CSV.Dir, fileDir(cfg.JSONL.Output), fileDir(cfg.LogFile),
+	} {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil && !slices.Contains(writable, abs) {
+			writable = append(writable, abs)
+		}
+	}
+	return writable
+}
+
+// fileDir は出力先のファイルのディレクトリを返します。ファイルでない場合 (空または標準出力) は空文字列です。
+func fileDir(path string) string {
+	if path == "" || path == "-" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// systemdEscapePath はパスを systemd のユニット名に変換します (systemd-escape --path と同じ変換)。
+func systemdEscapePath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == ':', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// systemdExecArg は ExecStart の引数として書けるよう、systemdQuote に加えて環境変数の展開 ($) をエスケープします。
+func systemdExecArg(s string) string {
+	return systemdQuote(strings.ReplaceAll(s, "$", "$$"))
+}
+
+// systemdQuote はユニットファイルの値として書けるよう、空白などを含む場合に引用符で囲みます。
+// 指定子 (%) はエスケープします。
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteSystemdUnitStateDirectory(t *testing.T) {
+	t.Setenv("SMARTMETER_STATE_FILE", "/var/lib/smartmeter/pan.json")
+	t.Setenv("SMARTMETER_INTERVAL", "30s")
+	cfg := &config{
+		DevicePath: "/dev/ttyUSB0",
+		StateFile:  "/var/lib/smartmeter/pan.json",
+		CSV:        csvConfig{Dir: "/srv/csv"},
+	}
+	var b strings.Builder
+	writeSystemdUnit(&b, cfg, "/usr/local/bin/smartmeter-exporter")
+	unit := b.String()
+
+	// DynamicUser=yes でも再起動後に書き込めるよう、状態ファイルは StateDirectory= に置く
+	for _, want := range []string{
+		"\nStateDirectory=smartmeter-exporter\n",
+		" -state.file=${STATE_DIRECTORY}/pan.json",
+		"\nEnvironment=SMARTMETER_INTERVAL=30s\n",
+		"\nReadWritePaths=/srv/csv\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit does not contain %q:\n%s", want, unit)
+		}
+	}
+	for _, unwanted := range []string{"SMARTMETER_STATE_FILE", "ReadWritePaths=/var/lib/smartmeter"} {
+		if strings.Contains(unit, unwanted) {
+			t.Errorf("unit contains %q:\n%s", unwanted, unit)
+		}
+	}
+}
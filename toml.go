@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML は設定ファイルに必要な範囲の TOML をパースします。
+// テーブル ([a.b])、テーブルの配列 ([[a]])、ドット区切りのキー、文字列 (基本文字列とリテラル文字列)、
+// 整数、浮動小数点数、真偽値、配列、インラインテーブルに対応します。複数行の文字列と日時には対応しません。
+func parseTOML(s string) (map[string]interface{}, error) {
+	p := &tomlParser{s: s, line: 1}
+	root := make(map[string]interface{})
+	if err := p.parse(root); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return root, nil
+}
+
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) parse(root map[string]interface{}) error {
+	table := root
+	for {
+		p.skipBlank(true)
+		if p.pos >= len(p.s) {
+			return nil
+		}
+		var err error
+		if p.s[p.pos] == '[' {
+			table, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(table)
+		}
+		if err != nil {
+			return err
+		}
+		if err = p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseHeader は [table] または [[array]] の行をパースし、以降のキーを格納するテーブルを返します。
+func (p *tomlParser) parseHeader(root map[string]interface{}) (map[string]interface{}, error) {
+	array := strings.HasPrefix(p.s[p.pos:], "[[")
+	closing := "]"
+	p.pos++
+	if array {
+		closing = "]]"
+		p.pos++
+	}
+	p.skipBlank(false)
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank(false)
+	if !strings.HasPrefix(p.s[p.pos:], closing) {
+		return nil, errors.New("unterminated table header")
+	}
+	p.pos += len(closing)
+
+	parent, err := tomlDescend(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	table := make(map[string]interface{})
+	switch v := parent[last].(type) {
+	case nil:
+		if array {
+			parent[last] = []interface{}{table}
+		} else {
+			parent[last] = table
+		}
+	case []interface{}:
+		if !array {
+			return nil, fmt.Errorf("key %q is already defined as an array", last)
+		}
+		parent[last] = append(v, table)
+	case map[string]interface{}:
+		if array {
+			return nil, fmt.Errorf("key %q is already defined as a table", last)
+		}
+		table = v
+	default:
+		return nil, fmt.Errorf("key %q is already defined", last)
+	}
+	return table, nil
+}
+
+// tomlDescend は keys をたどったテーブルを返します。存在しないテーブルは作成し、
+// テーブルの配列は最後の要素をたどります。
+func tomlDescend(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case nil:
+			t := make(map[string]interface{})
+			table[k] = t
+			table = t
+		case map[string]interface{}:
+			table = v
+		case []interface{}:
+			t, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("key %q is not a table", k)
+			}
+			table = t
+		default:
+			return nil, fmt.Errorf("key %q is not a table", k)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) parseKeyValue(table map[string]interface{}) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipBlank(false)
+	if !p.consume('=') {
+		return errors.New("expected '=' after key")
+	}
+	p.skipBlank(false)
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	parent, err := tomlDescend(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent[last]; ok {
+		return fmt.Errorf("duplicate key %q", last)
+	}
+	parent[last] = v
+	return nil
+}
+
+// parseKey は "a.b" や "a.\"b.c\"" のようなドット区切りのキーをパースします。
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		var key string
+		var err error
+		switch {
+		case p.pos >= len(p.s):
+			return nil, errors.New("expected key")
+		case p.s[p.pos] == '"':
+			key, err = p.parseBasicString()
+		case p.s[p.pos] == '\'':
+			key, err = p.parseLiteralString()
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && isTOMLBareKeyChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, fmt.Errorf("unexpected character %q in key", p.s[p.pos])
+			}
+			key = p.s[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		p.skipBlank(false)
+		if !p.consume('.') {
+			return keys, nil
+		}
+		p.skipBlank(false)
+	}
+}
+
+func isTOMLBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	if p.pos >= len(p.s) {
+		return nil, errors.New("expected value")
+	}
+	switch p.s[p.pos] {
+	case '"':
+		if strings.HasPrefix(p.s[p.pos:], `"""`) {
+			return nil, errors.New("multi-line strings are not supported")
+		}
+		return p.parseBasicString()
+	case '\'':
+		if strings.HasPrefix(p.s[p.pos:], "'''") {
+			return nil, errors.New("multi-line strings are not supported")
+		}
+		return p.parseLiteralString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	if i, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unsupported value %q", tok)
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		case c == '\n':
+			return "", errors.New("unterminated string")
+		case c == '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", errors.New("unterminated string")
+}
+
+// parseEscape は基本文字列のエスケープシーケンスを b に書き出します。
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.s) {
+		return errors.New("unterminated string")
+	}
+	c := p.s[p.pos+1]
+	p.pos += 2
+	if r, ok := map[byte]byte{'b': '\b', 't': '\t', 'n': '\n', 'f': '\f', 'r': '\r',
+		'"': '"', '\\': '\\'}[c]; ok {
+		b.WriteByte(r)
+		return nil
+	}
+	n := map[byte]int{'u': 4, 'U': 8}[c]
+	if n == 0 || p.pos+n > len(p.s) {
+		return fmt.Errorf("invalid escape sequence \\%c", c)
+	}
+	code, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(code)) {
+		return fmt.Errorf("invalid escape sequence \\%c%s", c, p.s[p.pos:p.pos+n])
+	}
+	b.WriteRune(rune(code))
+	p.pos += n
+	return nil
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	end := strings.IndexAny(p.s[p.pos:], "'\n")
+	if end < 0 || p.s[p.pos+end] != '\'' {
+		return "", errors.New("unterminated string")
+	}
+	s := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// parseArray は配列をパースします。要素の間には改行とコメントを含められます。
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	values := []interface{}{}
+	for {
+		p.skipBlank(true)
+		if p.consume(']') {
+			return values, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipBlank(true)
+		if !p.consume(',') {
+			p.skipBlank(true)
+			if !p.consume(']') {
+				return nil, errors.New("expected ',' or ']' in array")
+			}
+			return values, nil
+		}
+	}
+}
+
+// parseInlineTable は { key = value, ... } の形式のテーブルをパースします。
+func (p *tomlParser) parseInlineTable() (map[string]interface{}, error) {
+	p.pos++
+	table := make(map[string]interface{})
+	p.skipBlank(false)
+	if p.consume('}') {
+		return table, nil
+	}
+	for {
+		p.skipBlank(false)
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		if p.consume('}') {
+			return table, nil
+		}
+		if !p.consume(',') {
+			return nil, errors.New("expected ',' or '}' in inline table")
+		}
+	}
+}
+
+// skipBlank は空白とコメントを読み飛ばします。newlines が true の場合は改行も読み飛ばします。
+func (p *tomlParser) skipBlank(newlines bool) {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.line++
+			p.pos++
+		case '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine は行末 (空白とコメントを除く) であることを確認します。
+func (p *tomlParser) endOfLine() error {
+	p.skipBlank(false)
+	if p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		return fmt.Errorf("unexpected character %q after value", p.s[p.pos])
+	}
+	return nil
+}
+
+func (p *tomlParser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	type table = map[string]interface{}
+	tests := []struct {
+		name string
+		in   string
+		want table
+	}{
+		{"empty", "# comment only\n\n", table{}},
+		{
+			"scalars",
+			"s = \"a\\tb\\u00e9\"  # comment\nl = 'C:\\path'\ni = 1_000\nh = 0xE7\nf = -0.5\nb = true\n",
+			table{"s": "a\tbé", "l": `C:\path`, "i": int64(1000), "h": int64(0xE7), "f": -0.5, "b": true},
+		},
+		{
+			"tables",
+			"top = 1\n[device]\nport = \"/dev/ttyUSB0\"\n[sink.mqtt]\nqos = 1\n",
+			table{
+				"top":    int64(1),
+				"device": table{"port": "/dev/ttyUSB0"},
+				"sink":   table{"mqtt": table{"qos": int64(1)}},
+			},
+		},
+		{
+			"dotted and quoted keys",
+			"a.b = 1\na.\"c.d\" = 2\n'e f' = 3\n",
+			table{"a": table{"b": int64(1), "c.d": int64(2)}, "e f": int64(3)},
+		},
+		{
+			"array of tables",
+			"[[meters]]\nname = \"a\"\n[[meters]]\nname = \"b\"\n[meters.labels]\nroom = \"x\"\n",
+			table{"meters": []interface{}{
+				table{"name": "a"},
+				table{"name": "b", "labels": table{"room": "x"}},
+			}},
+		},
+		{
+			"multi-line array",
+			"epcs = [\n  \"E7\", # power\n  \"E8\",\n]\nempty = []\n",
+			table{"epcs": []interface{}{"E7", "E8"}, "empty": []interface{}{}},
+		},
+		{
+			"inline table",
+			"labels = { room = \"living\", floor = 1 }\nnone = {}\n",
+			table{"labels": table{"room": "living", "floor": int64(1)}, "none": table{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.in)
+			if err != nil {
+				t.Fatalf("parseTOML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"missing equals", "a 1\n", "line 1: expected '='"},
+		{"duplicate key", "a = 1\n\na = 2\n", "line 3: duplicate key"},
+		{"trailing garbage", "a = 1 2\n", "line 1: unexpected character"},
+		{"unterminated string", "a = \"abc\nb = 1\n", "line 1: unterminated string"},
+		{"invalid escape", `a = "\q"`, "invalid escape sequence"},
+		{"multi-line string", `a = """x"""`, "not supported"},
+		{"date", "a = 2025-10-16\n", "unsupported value"},
+		{"unterminated header", "[a\n", "unterminated table header"},
+		{"table redefined as array", "[a]\n[[a]]\n", "line 2: key \"a\" is already defined as a table"},
+		{"value redefined as table", "a = 1\n[a]\n", "already defined"},
+		{"key under value", "a = 1\na.b = 2\n", "not a table"},
+		{"unterminated array", "a = [1, 2\n", "expected ',' or ']'"},
+		{"unterminated inline table", "a = { b = 1\n", "expected ',' or '}'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML(tt.in)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseTOML() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeExemplars が true の場合、取得毎にトレース ID を生成し、ログと
+// smartmeter_scrape_duration_seconds の exemplar に付加します。
+var scrapeExemplars bool
+
+// newTraceID は W3C Trace Context 形式 (16バイト、32桁の16進数) のトレース ID を生成します。
+func newTraceID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// startScrapeTrace は1回の取得のトレースを開始します。
+// scrapeExemplars が true の場合はトレース ID をログに付加した logger と exemplar を返します。
+func startScrapeTrace(logger *slog.Logger) (*slog.Logger, prometheus.Labels) {
+	if !scrapeExemplars {
+		return logger, nil
+	}
+	id := newTraceID()
+	return logger.With("trace_id", id), prometheus.Labels{"trace_id": id}
+}
+
+// observeScrapeDuration は取得時間を記録します。exemplar があれば付加します。
+func observeScrapeDuration(seconds float64, exemplar prometheus.Labels) {
+	if eo, ok := scrapeDuration.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(seconds, exemplar)
+		return
+	}
+	scrapeDuration.Observe(seconds)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/common/version"
+)
+
+// programName はバージョン情報とビルド情報のメトリクス (smartmeter_exporter_build_info) に使う名前です。
+const programName = "smartmeter_exporter"
+
+func init() {
+	// ビルド時に -ldflags で指定されなかった場合は、go install 時のモジュールのバージョンを使う
+	if version.Version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			version.Version = info.Main.Version
+		}
+	}
+	prometheus.MustRegister(versioncollector.NewCollector(programName))
+}
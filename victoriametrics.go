@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// victoriaMetricsConfig は VictoriaMetrics へのプッシュの設定です。
+type victoriaMetricsConfig struct {
+	URL                string
+	Username           string
+	Password           string
+	BearerToken        string
+	LabelPairs         []string
+	MaxBuffered        int
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Labels map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *victoriaMetricsConfig) bind() {
+	c.URL = getEnv("SMARTMETER_VICTORIAMETRICS_URL", "")
+	c.Username = getEnv("SMARTMETER_VICTORIAMETRICS_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_VICTORIAMETRICS_PASSWORD", "")
+	c.BearerToken = getEnv("SMARTMETER_VICTORIAMETRICS_BEARER_TOKEN", "")
+	c.MaxBuffered = getEnvInt("SMARTMETER_VICTORIAMETRICS_MAX_BUFFERED", 1440)
+	c.CAFile = getEnv("SMARTMETER_VICTORIAMETRICS_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_VICTORIAMETRICS_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_VICTORIAMETRICS_LABELS", ""); v != "" {
+		c.LabelPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "victoriametrics.url", c.URL,
+		"VictoriaMetrics JSON import URL to push readings to "+
+			"(e.g. http://localhost:8428/api/v1/import)")
+	flag.StringVar(&c.Username, "victoriametrics.username", c.Username,
+		"Username for HTTP basic authentication")
+	flag.StringVar(&c.Password, "victoriametrics.password", c.Password,
+		"Password for HTTP basic authentication")
+	flag.StringVar(&c.BearerToken, "victoriametrics.bearer-token", c.BearerToken,
+		"Bearer token for authentication")
+	flag.Var(&labelFlag{values: &c.LabelPairs}, "victoriametrics.label",
+		"Label key=value added to every pushed sample (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "victoriametrics.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while VictoriaMetrics is unreachable")
+	flag.StringVar(&c.CAFile, "victoriametrics.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the VictoriaMetrics server")
+	flag.BoolVar(&c.InsecureSkipVerify, "victoriametrics.tls.insecure-skip-verify",
+		c.InsecureSkipVerify, "Skip verification of the VictoriaMetrics server certificate")
+}
+
+func (c *victoriaMetricsConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は VictoriaMetrics の設定値を検証します。
+func (c *victoriaMetricsConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return errors.New("invalid VictoriaMetrics URL: " + c.URL)
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("VictoriaMetrics max buffered readings must be positive")
+	}
+	labels, err := parseLabels(c.LabelPairs)
+	if err != nil {
+		return err
+	}
+	c.Labels = labels
+	return nil
+}
+
+// victoriaMetricsSink は取得値を VictoriaMetrics の JSON line 形式のインポート API に送信します。
+// 送信に失敗した取得値は保持しておき、次回の送信時にまとめて再送します。
+type victoriaMetricsSink struct {
+	cfg    *victoriaMetricsConfig
+	client *http.Client
+	buffer *retryBuffer
+}
+
+func newVictoriaMetricsSink(cfg *victoriaMetricsConfig) (*victoriaMetricsSink, error) {
+	client, err := newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return &victoriaMetricsSink{
+		cfg:    cfg,
+		client: client,
+		buffer: newRetryBuffer("victoriametrics", cfg.MaxBuffered),
+	}, nil
+}
+
+// vmImportLine は JSON line 形式のインポート API の1行です。
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+func (s *victoriaMetricsSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var body []byte
+		for _, rd := range rs {
+			for _, sample := range rd.samples() {
+				line, err := json.Marshal(vmImportLine{
+					Metric:     sampleLabels(sample, s.cfg.Labels),
+					Values:     []float64{sample.Value},
+					Timestamps: []int64{sample.Time.UnixMilli()},
+				})
+				if err != nil {
+					return err
+				}
+				body = append(append(body, line...), '\n')
+			}
+		}
+		header := authHeader(s.cfg.BearerToken, s.cfg.Username, s.cfg.Password)
+		return postHTTP(ctx, s.client, s.cfg.URL, "application/json", body, header)
+	})
+}
+
+func (s *victoriaMetricsSink) close() error {
+	return nil
+}
+
+// sampleLabels はサンプルの __name__ を含むラベルに、追加のラベルを加えて返します。
+// サンプルが同じ名前のラベルを持つ場合は、サンプルのラベルを優先します。
+func sampleLabels(s readingSample, extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(extra)+2)
+	for k, v := range extra {
+		labels[k] = v
+	}
+	labels["__name__"] = s.Name
+	if s.LabelName != "" {
+		labels[s.LabelName] = s.LabelValue
+	}
+	return labels
+}
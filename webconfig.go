@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// webConfig は -web.config.file の内容です。Prometheus の exporter-toolkit と同じ形式です。
+// 対応していない設定が無視されないよう、未知のキーはエラーにします。
+type webConfig struct {
+	TLSServerConfig *webTLSConfig `yaml:"tls_server_config"`
+	// BasicAuthUsers は Basic 認証のユーザー名と bcrypt でハッシュ化したパスワードです。
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// webTLSConfig は HTTPS で待ち受ける場合の TLS の設定です。
+type webTLSConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientAuthType string   `yaml:"client_auth_type"`
+	ClientCAFile   string   `yaml:"client_ca_file"`
+	MinVersion     string   `yaml:"min_version"`
+	MaxVersion     string   `yaml:"max_version"`
+	CipherSuites   []string `yaml:"cipher_suites"`
+}
+
+// tlsVersions は min_version と max_version に指定できる TLS のバージョンです。
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// clientAuthTypes は client_auth_type に指定できるクライアント証明書の要求方法です。
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// readWebConfig は -web.config.file を読み込みます。
+// ファイルのパスは、設定ファイルのディレクトリからの相対パスとして扱います。
+func readWebConfig(path string) (*webConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wc webConfig
+	if err = yaml.UnmarshalStrict(b, &wc); err != nil {
+		return nil, fmt.Errorf("parse web config file %s: %w", path, err)
+	}
+	if t := wc.TLSServerConfig; t != nil {
+		dir := filepath.Dir(path)
+		for _, p := range []*string{&t.CertFile, &t.KeyFile, &t.ClientCAFile} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+	}
+	return &wc, nil
+}
+
+// tlsConfig は TLS の設定から tls.Config を作成します。証明書と鍵を読み込みます。
+func (t *webTLSConfig) tlsConfig() (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("tls_server_config requires cert_file and key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// WebSocket (/api/v1/ws) は HTTP/2 の接続では使えないため、HTTP/1.1 で通信する
+		NextProtos: []string{"http/1.1"},
+	}
+	cfg.MinVersion, err = parseTLSVersion("min_version", t.MinVersion, tls.VersionTLS12)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxVersion, err = parseTLSVersion("max_version", t.MaxVersion, tls.VersionTLS13)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MinVersion > cfg.MaxVersion {
+		return nil, fmt.Errorf("min_version %s is newer than max_version %s", t.MinVersion, t.MaxVersion)
+	}
+	if err = t.setClientAuth(cfg); err != nil {
+		return nil, err
+	}
+	for _, name := range t.CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	return cfg, nil
+}
+
+// parseTLSVersion は min_version または max_version の値をパースします。空の場合は def を返します。
+func parseTLSVersion(name, value string, def uint16) (uint16, error) {
+	if value == "" {
+		return def, nil
+	}
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("unknown %s %q (want TLS10, TLS11, TLS12 or TLS13)", name, value)
+	}
+	return version, nil
+}
+
+// setClientAuth は client_auth_type と client_ca_file からクライアント証明書の検証方法を設定します。
+func (t *webTLSConfig) setClientAuth(cfg *tls.Config) error {
+	auth, ok := clientAuthTypes[t.ClientAuthType]
+	if !ok {
+		return fmt.Errorf("unknown client_auth_type %q", t.ClientAuthType)
+	}
+	cfg.ClientAuth = auth
+	if t.ClientCAFile == "" {
+		if auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert {
+			return fmt.Errorf("client_auth_type %s requires client_ca_file", t.ClientAuthType)
+		}
+		return nil
+	}
+	pem, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("read client CA file: %w", err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client CA file %s", t.ClientCAFile)
+	}
+	return nil
+}
+
+// cipherSuiteID は暗号スイートの名前 (例: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) の ID を返します。
+// 安全でない暗号スイートは指定できません。
+func cipherSuiteID(name string) (uint16, error) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown or insecure cipher suite %q", name)
+}
+
+// webTLSConfig は -web.config.file に TLS の設定がある場合に、HTTPS で待ち受けるための tls.Config を返します。
+// 証明書を更新しても再起動せずに反映されるよう、設定ファイルと証明書は TLS の接続毎に読み込み直します。
+// TLS の設定がない場合は nil を返します。
+func (c *config) webTLSConfig() (*tls.Config, error) {
+	if c.WebConfigFile == "" {
+		return nil, nil
+	}
+	wc, err := readWebConfig(c.WebConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if wc.TLSServerConfig == nil {
+		return nil, nil
+	}
+	// 起動時に設定の誤りを検出する
+	if _, err = wc.TLSServerConfig.tlsConfig(); err != nil {
+		return nil, err
+	}
+	path := c.WebConfigFile
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			wc, err := readWebConfig(path)
+			if err != nil {
+				return nil, err
+			}
+			if wc.TLSServerConfig == nil {
+				return nil, errors.New("tls_server_config was removed from the web config file")
+			}
+			return wc.TLSServerConfig.tlsConfig()
+		},
+	}, nil
+}
+
+// webBasicAuth は -web.config.file に basic_auth_users がある場合に、Basic 認証を返します。
+// ユーザーの変更は再起動後に反映します。basic_auth_users がない場合は nil を返します。
+func (c *config) webBasicAuth() (*basicAuthenticator, error) {
+	if c.WebConfigFile == "" {
+		return nil, nil
+	}
+	wc, err := readWebConfig(c.WebConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(wc.BasicAuthUsers) == 0 {
+		return nil, nil
+	}
+	return newBasicAuthenticator(wc.BasicAuthUsers)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert は自己署名証明書と鍵を dir に cert.pem と key.pem として書き出します。
+func writeTestCert(t *testing.T, dir string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		if err = os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeWebConfig は -web.config.file の内容を dir/web.yml に書き出し、そのパスを返します。
+func writeWebConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "web.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeWebConfig(t, dir,
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: /abs/key.pem\n")
+	wc, err := readWebConfig(path)
+	if err != nil {
+		t.Fatalf("readWebConfig() error = %v", err)
+	}
+	// 相対パスは設定ファイルのディレクトリから
+	if got := wc.TLSServerConfig.CertFile; got != filepath.Join(dir, "cert.pem") {
+		t.Errorf("CertFile = %q", got)
+	}
+	if got := wc.TLSServerConfig.KeyFile; got != "/abs/key.pem" {
+		t.Errorf("KeyFile = %q", got)
+	}
+
+	writeWebConfig(t, dir, "tls_server_config:\n  cert_file: cert.pem\n  unknown: x\n")
+	if _, err = readWebConfig(path); err == nil {
+		t.Error("readWebConfig() with unknown key error = nil, want error")
+	}
+}
+
+func TestWebTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	tests := []struct {
+		name    string
+		extra   string
+		want    uint16
+		wantErr bool
+	}{
+		{"defaults", "", tls.VersionTLS12, false},
+		{"min version", "  min_version: TLS13\n", tls.VersionTLS13, false},
+		{"unknown version", "  min_version: SSL3\n", 0, true},
+		{"min newer than max", "  min_version: TLS13\n  max_version: TLS12\n", 0, true},
+		{"client auth without CA", "  client_auth_type: RequireAndVerifyClientCert\n", 0, true},
+		{"unknown client auth", "  client_auth_type: Sometimes\n", 0, true},
+		{"insecure cipher suite", "  cipher_suites: [TLS_RSA_WITH_RC4_128_SHA]\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeWebConfig(t, dir,
+				"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n"+tt.extra)
+			wc, err := readWebConfig(path)
+			if err != nil {
+				t.Fatalf("readWebConfig() error = %v", err)
+			}
+			cfg, err := wc.TLSServerConfig.tlsConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tlsConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.MinVersion != tt.want {
+				t.Errorf("MinVersion = %x, want %x", cfg.MinVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigWebTLSConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	path := writeWebConfig(t, dir, "tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n")
+	c := &config{WebConfigFile: path}
+	cfg, err := c.webTLSConfig()
+	if err != nil || cfg == nil {
+		t.Fatalf("webTLSConfig() = %v, %v", cfg, err)
+	}
+
+	// 設定ファイルの変更は次の接続から反映される
+	writeWebConfig(t, dir,
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  min_version: TLS13\n")
+	got, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient() error = %v", err)
+	}
+	if got.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion after reload = %x, want TLS 1.3", got.MinVersion)
+	}
+	writeWebConfig(t, dir, "{}\n")
+	if _, err = cfg.GetConfigForClient(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("GetConfigForClient() after removing TLS error = nil, want error")
+	}
+
+	// TLS の設定がない場合は HTTP で待ち受ける
+	if cfg, err = c.webTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("webTLSConfig() without TLS = %v, %v, want nil, nil", cfg, err)
+	}
+}
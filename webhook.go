@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookRetryInterval は webhook の最初の再送までの間隔です。再送毎に2倍にします。
+const webhookRetryInterval = time.Second
+
+// webhookConfig は webhook への送信の設定です。
+type webhookConfig struct {
+	URL                string
+	ContentType        string
+	HeaderPairs        []string
+	Username           string
+	Password           string
+	BearerToken        string
+	Template           string
+	TemplateFile       string
+	Retries            int
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// validate で設定される
+	Header  http.Header
+	payload *template.Template
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *webhookConfig) bind() {
+	c.URL = getEnv("SMARTMETER_WEBHOOK_URL", "")
+	c.ContentType = getEnv("SMARTMETER_WEBHOOK_CONTENT_TYPE", "application/json")
+	c.Username = getEnv("SMARTMETER_WEBHOOK_USERNAME", "")
+	c.Password = getEnv("SMARTMETER_WEBHOOK_PASSWORD", "")
+	c.BearerToken = getEnv("SMARTMETER_WEBHOOK_BEARER_TOKEN", "")
+	c.Template = getEnv("SMARTMETER_WEBHOOK_TEMPLATE", "")
+	c.TemplateFile = getEnv("SMARTMETER_WEBHOOK_TEMPLATE_FILE", "")
+	c.Retries = getEnvInt("SMARTMETER_WEBHOOK_RETRIES", 3)
+	c.CAFile = getEnv("SMARTMETER_WEBHOOK_CA_FILE", "")
+	c.InsecureSkipVerify = getEnvBool("SMARTMETER_WEBHOOK_INSECURE_SKIP_VERIFY")
+	if v := getEnv("SMARTMETER_WEBHOOK_HEADERS", ""); v != "" {
+		c.HeaderPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.URL, "webhook.url", c.URL, "URL to POST each reading to")
+	flag.StringVar(&c.ContentType, "webhook.content-type", c.ContentType,
+		"Content-Type of the webhook request")
+	flag.Var(&labelFlag{values: &c.HeaderPairs}, "webhook.header",
+		"HTTP header \"Name: value\" added to the webhook request (repeatable)")
+	flag.StringVar(&c.Username, "webhook.username", c.Username,
+		"Username for HTTP basic authentication")
+	flag.StringVar(&c.Password, "webhook.password", c.Password,
+		"Password for HTTP basic authentication")
+	flag.StringVar(&c.BearerToken, "webhook.bearer-token", c.BearerToken,
+		"Bearer token for authentication")
+	flag.StringVar(&c.Template, "webhook.template", c.Template,
+		"Go template of the request body (default: the reading as JSON)")
+	flag.StringVar(&c.TemplateFile, "webhook.template-file", c.TemplateFile,
+		"File containing the Go template of the request body")
+	flag.IntVar(&c.Retries, "webhook.retries", c.Retries,
+		"Number of retries with exponential backoff when the webhook request fails")
+	flag.StringVar(&c.CAFile, "webhook.tls.ca-file", c.CAFile,
+		"CA certificate file to verify the webhook server")
+	flag.BoolVar(&c.InsecureSkipVerify, "webhook.tls.insecure-skip-verify", c.InsecureSkipVerify,
+		"Skip verification of the webhook server certificate")
+}
+
+func (c *webhookConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate は webhook の設定値を検証し、テンプレートを解析します。
+func (c *webhookConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return errors.New("invalid webhook URL: " + c.URL)
+	}
+	if c.Retries < 0 {
+		return errors.New("webhook retries must not be negative")
+	}
+	header := authHeader(c.BearerToken, c.Username, c.Password)
+	for _, p := range c.HeaderPairs {
+		k, v, ok := strings.Cut(p, ":")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return fmt.Errorf("webhook header must be \"Name: value\": %q", p)
+		}
+		header.Add(k, strings.TrimSpace(v))
+	}
+	c.Header = header
+
+	text := c.Template
+	if c.TemplateFile != "" {
+		if text != "" {
+			return errors.New("webhook template and template file are mutually exclusive")
+		}
+		b, err := os.ReadFile(c.TemplateFile)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	if text != "" {
+		t, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid webhook template: %w", err)
+		}
+		c.payload = t
+	}
+	return nil
+}
+
+// webhookTemplateFuncs は webhook のテンプレートで使える関数です。
+var webhookTemplateFuncs = template.FuncMap{
+	// json は値を JSON に変換します (未取得の項目は null)
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// unix は時刻を Unix 時間 (秒) に変換します
+	"unix": func(t time.Time) int64 { return t.Unix() },
+}
+
+// webhookSink は取得値を1つずつ HTTP の POST で送信します。
+// 本文は取得値の JSON (MQTT と同じ形式) で、テンプレートを指定した場合は取得値 (reading) を
+// データとして展開した結果です。送信に失敗した場合は間隔を2倍にしながら再送します。
+type webhookSink struct {
+	cfg    *webhookConfig
+	client *http.Client
+}
+
+func newWebhookSink(cfg *webhookConfig) (*webhookSink, error) {
+	client, err := newHTTPClient(cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookSink{cfg: cfg, client: client}, nil
+}
+
+func (s *webhookSink) publish(ctx context.Context, r *reading) error {
+	body, err := s.body(r)
+	if err != nil {
+		return err
+	}
+	interval := webhookRetryInterval
+	for i := 0; ; i++ {
+		err = postHTTP(ctx, s.client, s.cfg.URL, s.cfg.ContentType, body, s.cfg.Header)
+		if err == nil || i >= s.cfg.Retries || errors.As(err, new(permanentError)) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// body は要求の本文を生成します。
+func (s *webhookSink) body(r *reading) ([]byte, error) {
+	if s.cfg.payload == nil {
+		return json.Marshal(r)
+	}
+	var b bytes.Buffer
+	if err := s.cfg.payload.Execute(&b, r); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *webhookSink) close() error {
+	return nil
+}
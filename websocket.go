@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID は Sec-WebSocket-Accept の計算に使う RFC 6455 の固定値です。
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	// webSocketWriteTimeout は1回のフレームの送信のタイムアウトです。
+	webSocketWriteTimeout = 10 * time.Second
+	// webSocketMaxFrameSize はクライアントから受け付けるフレームの最大長です。
+	// クライアントからのメッセージは使わないため、小さくします。
+	webSocketMaxFrameSize = 4096
+)
+
+// WebSocket のフレームの opcode です。
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+)
+
+// WebSocket の close フレームのステータスコードです。
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// errWebSocketFrameTooBig はクライアントのフレームが webSocketMaxFrameSize を超えた場合のエラーです。
+var errWebSocketFrameTooBig = errors.New("websocket frame too big")
+
+// webSocketMessage は /api/v1/ws で送る JSON のメッセージです。
+type webSocketMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// webSocketConn はハイジャックした HTTP の接続上の WebSocket (RFC 6455) のサーバー側です。
+// 送信は複数の goroutine から行うため、mu で保護します。
+type webSocketConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+// writeFrame は1つのフレームを送信します。サーバーからのフレームはマスクしません。
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// writeClose はステータスコードを含む close フレームを送信します。
+func (c *webSocketConn) writeClose(code uint16) error {
+	return c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// readFrame はクライアントから1つのフレームを受信し、マスクを解除したペイロードを返します。
+// 分割されたメッセージは結合せず、フレーム毎に返します。
+func (c *webSocketConn) readFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket frame from client is not masked")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > webSocketMaxFrameSize {
+		return 0, nil, errWebSocketFrameTooBig
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop はクライアントからのフレームを受信し、ping に応答します。
+// close フレームを受信するか、接続が切れると終了します。
+func (c *webSocketConn) readLoop() {
+	for {
+		// ping を送る間隔の2倍の間、pong などを受信しない場合は接続が切れたとみなす
+		_ = c.conn.SetReadDeadline(time.Now().Add(2 * streamKeepAlive))
+		opcode, payload, err := c.readFrame()
+		switch {
+		case errors.Is(err, errWebSocketFrameTooBig):
+			_ = c.writeClose(wsCloseTooBig)
+			return
+		case err != nil:
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				_ = c.writeClose(wsCloseProtocolError)
+			}
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			_ = c.writeClose(wsCloseNormal)
+			return
+		case wsOpPing:
+			_ = c.writeFrame(wsOpPong, payload)
+		}
+		// クライアントからのメッセージと pong は読み捨てる
+	}
+}
+
+// writeMessage はイベントを JSON のテキストメッセージとして送信します。
+func (c *webSocketConn) writeMessage(ev streamEvent) error {
+	b, err := json.Marshal(webSocketMessage{Type: ev.Type, Data: ev.Data})
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, b)
+}
+
+// headerHasToken は要求のヘッダーのカンマ区切りの値に token (大文字と小文字を区別しない) が含まれるかを返します。
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin は Origin ヘッダーがないか、要求先のホストと同じ場合に true を返します。
+// 他のサイトのページからブラウザーの認証情報を使って接続されるのを防ぎます。
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// webSocketAccept は Sec-WebSocket-Key に対する Sec-WebSocket-Accept の値を返します。
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// upgradeWebSocket は WebSocket のハンドシェイクを行い、接続を返します。
+// 要求が WebSocket のハンドシェイクとして不正な場合は、エラーを応答して nil を返します。
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) *webSocketConn {
+	if !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeJSON(w, http.StatusUpgradeRequired, apiError{"websocket upgrade required"})
+		return nil
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeJSON(w, http.StatusBadRequest, apiError{"unsupported websocket version"})
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid Sec-WebSocket-Key"})
+		return nil
+	}
+	if !sameOrigin(r) {
+		writeJSON(w, http.StatusForbidden, apiError{"cross-origin websocket requests are not allowed"})
+		return nil
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		return nil
+	}
+	_ = conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		webSocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil
+	}
+	return &webSocketConn{conn: conn, rw: rw}
+}
+
+// webSocketHandler は取得値などのイベントを WebSocket で送る /api/v1/ws のハンドラーです。
+// /api/v1/stream と同じイベントを {"type": ..., "data": ...} の JSON のテキストメッセージとして送ります。
+func webSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"only GET requests allowed"})
+			return
+		}
+		ws := upgradeWebSocket(w, r)
+		if ws == nil {
+			return
+		}
+		defer ws.conn.Close()
+
+		ch := stream.subscribe()
+		defer stream.unsubscribe(ch)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ws.readLoop()
+		}()
+		if values := latest.snapshot(); len(values) > 0 {
+			if err := ws.writeMessage(streamEvent{Type: "reading", Data: values}); err != nil {
+				return
+			}
+		}
+
+		ping := time.NewTicker(streamKeepAlive)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case <-done:
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					// サーバーの終了
+					_ = ws.writeClose(wsCloseGoingAway)
+					return
+				}
+				err = ws.writeMessage(ev)
+			case <-ping.C:
+				err = ws.writeFrame(wsOpPing, nil)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// RFC 6455 1.3 の例
+	if got := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("webSocketAccept() = %q", got)
+	}
+}
+
+func TestWebSocketHandlerRejects(t *testing.T) {
+	srv := httptest.NewServer(webSocketHandler())
+	defer srv.Close()
+	handshake := map[string]string{
+		"Connection":            "Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"no upgrade", map[string]string{"Connection": "", "Upgrade": ""}, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusBadRequest},
+		{"invalid key", map[string]string{"Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"cross origin", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range handshake {
+				req.Header.Set(k, v)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandlerHandshake(t *testing.T) {
+	srv := httptest.NewServer(webSocketHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 同じオリジンのページからの接続は受け付ける
+	_, err = conn.Write([]byte("GET /api/v1/ws HTTP/1.1\r\nHost: " + host + "\r\n" +
+		"Origin: http://" + host + "\r\n" +
+		"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	// マスクした close フレームを送ると close フレームが返る
+	if _, err = conn.Write([]byte{0x80 | wsOpClose, 0x80, 1, 2, 3, 4}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for {
+		var opcode byte
+		if opcode, err = readServerFrame(r); err != nil {
+			t.Fatalf("no close frame: %v", err)
+		}
+		// 直近の取得値のメッセージなどは読み飛ばす
+		if opcode == wsOpClose {
+			break
+		}
+	}
+}
+
+// readServerFrame はサーバーからの (マスクされていない) フレームを1つ読み、opcode を返します。
+func readServerFrame(r io.Reader) (byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+		return 0, err
+	}
+	return header[0] & 0x0f, nil
+}
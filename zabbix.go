@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// zabbixHeader は Zabbix のプロトコルのヘッダー ("ZBXD" とフラグ) です。
+var zabbixHeader = []byte("ZBXD\x01")
+
+// zabbixFailedPattern は応答の info から受け付けられなかった項目の数を取り出します。
+var zabbixFailedPattern = regexp.MustCompile(`failed:\s*(\d+)`)
+
+// zabbixConfig は Zabbix サーバー (trapper) への送信の設定です。
+type zabbixConfig struct {
+	Address     string
+	Host        string
+	KeyPrefix   string
+	KeyPairs    []string
+	MaxBuffered int
+
+	// validate で設定される
+	Keys map[string]string
+}
+
+// bind は環境変数から初期値を読み込み、コマンドラインフラグを登録します。
+func (c *zabbixConfig) bind() {
+	c.Address = getEnv("SMARTMETER_ZABBIX_ADDRESS", "")
+	c.Host = getEnv("SMARTMETER_ZABBIX_HOST", "smartmeter")
+	c.KeyPrefix = getEnv("SMARTMETER_ZABBIX_KEY_PREFIX", "smartmeter.")
+	c.MaxBuffered = getEnvInt("SMARTMETER_ZABBIX_MAX_BUFFERED", 60)
+	if v := getEnv("SMARTMETER_ZABBIX_KEYS", ""); v != "" {
+		c.KeyPairs = strings.Split(v, ",")
+	}
+
+	flag.StringVar(&c.Address, "zabbix.address", c.Address,
+		"Zabbix server host:port to send readings to as trapper items (e.g. zabbix:10051)")
+	flag.StringVar(&c.Host, "zabbix.host", c.Host, "Host name of the meter in Zabbix")
+	flag.StringVar(&c.KeyPrefix, "zabbix.key-prefix", c.KeyPrefix, "Prefix of Zabbix item keys")
+	flag.Var(&labelFlag{values: &c.KeyPairs}, "zabbix.key",
+		"Rename the Zabbix item key of a reading item as item=key such as power_watts=power (repeatable)")
+	flag.IntVar(&c.MaxBuffered, "zabbix.max-buffered", c.MaxBuffered,
+		"Maximum number of readings kept for retry while the Zabbix server is unreachable")
+}
+
+func (c *zabbixConfig) enabled() bool {
+	return c.Address != ""
+}
+
+// validate は Zabbix の設定値を検証します。
+func (c *zabbixConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid Zabbix address %q: %w", c.Address, err)
+	}
+	if c.Host == "" {
+		return errors.New("zabbix host name must not be empty")
+	}
+	if c.MaxBuffered < 1 {
+		return errors.New("zabbix max buffered readings must be positive")
+	}
+	c.Keys = make(map[string]string, len(readingItemNames))
+	for _, name := range readingItemNames {
+		c.Keys[name] = name
+	}
+	for _, p := range c.KeyPairs {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || v == "" {
+			return fmt.Errorf("zabbix item key must be item=key: %q", p)
+		}
+		if !slices.Contains(readingItemNames, k) {
+			return fmt.Errorf("unknown reading item %q for Zabbix item key", k)
+		}
+		c.Keys[k] = v
+	}
+	for name, key := range c.Keys {
+		c.Keys[name] = c.KeyPrefix + key
+	}
+	return nil
+}
+
+// zabbixSink は取得値を Zabbix sender のプロトコルで Zabbix サーバー (またはプロキシ) に送信します。
+// Zabbix 側にはタイプが「Zabbix トラッパー」のアイテムを作成しておく必要があります。
+// 送信に失敗した取得値は保持しておき、次回の送信時にまとめて再送します。
+type zabbixSink struct {
+	cfg    *zabbixConfig
+	buffer *retryBuffer
+}
+
+func newZabbixSink(cfg *zabbixConfig) (*zabbixSink, error) {
+	return &zabbixSink{cfg: cfg, buffer: newRetryBuffer("zabbix", cfg.MaxBuffered)}, nil
+}
+
+// zabbixItem は sender data の要求の1項目です。
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+func (s *zabbixSink) publish(ctx context.Context, r *reading) error {
+	return s.buffer.flush(r, func(rs []*reading) error {
+		var items []zabbixItem
+		for _, rd := range rs {
+			for _, item := range rd.items() {
+				items = append(items, zabbixItem{
+					Host:  s.cfg.Host,
+					Key:   s.cfg.Keys[item.Name],
+					Value: strconv.FormatFloat(item.Value, 'f', -1, 64),
+					Clock: item.Time.Unix(),
+					NS:    item.Time.Nanosecond(),
+				})
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return s.send(ctx, items)
+	})
+}
+
+// send は項目を送信し、応答を確認します。
+// Zabbix サーバーは応答を返すと接続を閉じるため、送信毎に接続します。
+func (s *zabbixSink) send(ctx context.Context, items []zabbixItem) error {
+	body, err := json.Marshal(map[string]any{"request": "sender data", "data": items})
+	if err != nil {
+		return err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.cfg.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	packet := binary.LittleEndian.AppendUint64(slices.Clone(zabbixHeader), uint64(len(body)))
+	if _, err = conn.Write(append(packet, body...)); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], zabbixHeader[:4]) {
+		return errors.New("unexpected response from Zabbix server")
+	}
+	n := binary.LittleEndian.Uint64(header[len(zabbixHeader):])
+	if n > 1<<16 {
+		return fmt.Errorf("too large response from Zabbix server (%d bytes)", n)
+	}
+	resp := make([]byte, n)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	var result struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return fmt.Errorf("invalid response from Zabbix server: %w", err)
+	}
+	if result.Response != "success" {
+		return fmt.Errorf("zabbix server returned %q: %s", result.Response, result.Info)
+	}
+	// アイテムが存在しない (またはトラッパーでない) 項目は再送しても受け付けられない
+	if m := zabbixFailedPattern.FindStringSubmatch(result.Info); m != nil && m[1] != "0" {
+		return permanentError{fmt.Errorf("zabbix server rejected some items: %s", result.Info)}
+	}
+	return nil
+}
+
+func (s *zabbixSink) close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestZabbixConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      zabbixConfig
+		wantKeys map[string]string
+		wantErr  bool
+	}{
+		{"disabled", zabbixConfig{}, nil, false},
+		{
+			"renamed key",
+			zabbixConfig{
+				Address:     "zabbix:10051",
+				Host:        "meter",
+				KeyPrefix:   "sm.",
+				KeyPairs:    []string{"power_watts=power"},
+				MaxBuffered: 1,
+			},
+			map[string]string{"power_watts": "sm.power"},
+			false,
+		},
+		{"no port", zabbixConfig{Address: "zabbix", Host: "meter", MaxBuffered: 1}, nil, true},
+		{"empty host", zabbixConfig{Address: "zabbix:10051", MaxBuffered: 1}, nil, true},
+		{"no buffer", zabbixConfig{Address: "zabbix:10051", Host: "meter"}, nil, true},
+		{
+			"unknown item",
+			zabbixConfig{
+				Address:     "zabbix:10051",
+				Host:        "meter",
+				KeyPairs:    []string{"unknown=x"},
+				MaxBuffered: 1,
+			},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for name, want := range tt.wantKeys {
+				if got := tt.cfg.Keys[name]; got != want {
+					t.Errorf("Keys[%q] = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// fakeZabbixServer は1つの接続を受け付け、受信した sender data の項目を返し、response を応答するサーバーです。
+func fakeZabbixServer(t *testing.T, response string) (string, <-chan []zabbixItem) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	received := make(chan []zabbixItem, 1)
+	go func() {
+		defer close(received)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		header := make([]byte, len(zabbixHeader)+8)
+		if _, err = io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint64(header[len(zabbixHeader):]))
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return
+		}
+		var req struct {
+			Request string       `json:"request"`
+			Data    []zabbixItem `json:"data"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.Request != "sender data" {
+			return
+		}
+		received <- req.Data
+		packet := binary.LittleEndian.AppendUint64(slices.Clone(zabbixHeader), uint64(len(response)))
+		_, _ = conn.Write(append(packet, response...))
+	}()
+	return l.Addr().String(), received
+}
+
+func TestZabbixSinkSend(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      string
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{
+			"processed",
+			`{"response":"success","info":"processed: 1; failed: 0; total: 1; seconds spent: 0.000055"}`,
+			false,
+			false,
+		},
+		{
+			"partially failed",
+			`{"response":"success","info":"processed: 1; failed: 2; total: 3; seconds spent: 0.000055"}`,
+			true,
+			true,
+		},
+		{"failed", `{"response":"failed","info":"error"}`, true, false},
+		{"invalid", `not json`, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeZabbixServer(t, tt.response)
+			s, err := newZabbixSink(&zabbixConfig{Address: addr, Host: "meter", MaxBuffered: 1})
+			if err != nil {
+				t.Fatalf("newZabbixSink() error = %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			item := zabbixItem{Host: "meter", Key: "smartmeter.power_watts", Value: "512", Clock: 1}
+			err = s.send(ctx, []zabbixItem{item})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := errors.As(err, new(permanentError)); got != tt.wantPermanent {
+				t.Errorf("send() permanent = %v, want %v", got, tt.wantPermanent)
+			}
+			if got := <-received; len(got) != 1 || got[0] != item {
+				t.Errorf("server received %+v, want %+v", got, item)
+			}
+		})
+	}
+}